@@ -19,6 +19,7 @@ import (
 type devmodOwnerModule struct {
 	serviceinfo.Devmod
 	Modules []string
+	Schema  *serviceinfo.DevmodSchema
 }
 
 func (d *devmodOwnerModule) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
@@ -41,13 +42,24 @@ func (d *devmodOwnerModule) HandleInfo(ctx context.Context, messageName string,
 	for i := range dm.NumField() {
 		tag := dm.Type().Field(i).Tag.Get("devmod")
 		fieldMessageName, _, _ := strings.Cut(tag, ",")
-		if fieldMessageName != messageName {
+		if fieldMessageName == "" || fieldMessageName != messageName {
 			continue
 		}
 		return cbor.NewDecoder(messageBody).Decode(dm.Field(i).Addr().Interface())
 	}
 
-	return fmt.Errorf("unknown devmod message name: %s", messageName)
+	raw, ok, err := d.Schema.DecodeExtension(messageName, messageBody)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("unknown devmod message name: %s", messageName)
+	}
+	if d.Extensions == nil {
+		d.Extensions = make(map[string][]byte)
+	}
+	d.Extensions[messageName] = raw
+	return nil
 }
 
 func (d *devmodOwnerModule) parseModules(messageBody io.Reader) error {
@@ -82,10 +94,13 @@ func (d *devmodOwnerModule) ProduceInfo(_ context.Context, _ *serviceinfo.Produc
 		return false, false, nil
 	}
 
-	// Validate required fields were sent
+	// Validate required fields were sent and apply the owner's schema
 	if err := d.Validate(); err != nil {
 		return false, false, err
 	}
+	if err := d.Schema.Check(&d.Devmod); err != nil {
+		return false, false, err
+	}
 
 	return false, true, nil
 }
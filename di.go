@@ -72,6 +72,7 @@ type DIConfig struct {
 // [Java server]: https://github.com/fido-device-onboard/pri-fidoiot
 func DI(ctx context.Context, transport Transport, info any, c DIConfig) (*DeviceCredential, error) {
 	ctx = contextWithErrMsg(ctx)
+	ctx = protocol.ContextWithLogAttrs(ctx, "protocol", protocol.DIProtocol.String())
 
 	ovh, err := appStart(ctx, transport, info)
 	if err != nil {
@@ -24,7 +24,6 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -178,19 +177,22 @@ func client(ctx context.Context) error {
 	if !ok {
 		return fmt.Errorf("invalid key exchange cipher suite: %s", cipherSuite)
 	}
+
+	// Detect devmod, using placeholders for undetected required values
+	devmod := serviceinfo.DetectDevmod()
+	if devmod.Version == "" {
+		devmod.Version = "unknown"
+	}
+	if devmod.Device == "" {
+		devmod.Device = "go-validation"
+	}
+
 	newDC := transferOwnership(ctx, dc.RvInfo, fdo.TO2Config{
-		Cred:       *dc,
-		HmacSha256: hmacSha256,
-		HmacSha384: hmacSha384,
-		Key:        privateKey,
-		Devmod: serviceinfo.Devmod{
-			Os:      runtime.GOOS,
-			Arch:    runtime.GOARCH,
-			Version: "Debian Bookworm",
-			Device:  "go-validation",
-			FileSep: ";",
-			Bin:     runtime.GOARCH,
-		},
+		Cred:                 *dc,
+		HmacSha256:           hmacSha256,
+		HmacSha384:           hmacSha384,
+		Key:                  privateKey,
+		Devmod:               devmod,
 		KeyExchange:          kex.Suite(kexSuite),
 		CipherSuite:          kexCipherSuiteID,
 		AllowCredentialReuse: true,
@@ -404,7 +406,7 @@ func transferOwnership2(ctx context.Context, transport fdo.Transport, to1d *cose
 		"fido_alliance": &fsim.Interop{},
 	}
 	if dlDir != "" {
-		fsims["fdo.download"] = &fsim.Download{
+		download := &fsim.Download{
 			CreateTemp: func() (*os.File, error) {
 				return os.CreateTemp(dlDir, ".fdo.download_*")
 			},
@@ -415,7 +417,10 @@ func transferOwnership2(ctx context.Context, transport fdo.Transport, to1d *cose
 				}
 				return filepath.Join(dlDir, filepath.Clean(name))
 			},
+			PartialDir: filepath.Join(dlDir, ".fdo.download_partial"),
 		}
+		fsims["fdo.download"] = download
+		download.AdvertiseResume(&conf.Devmod)
 	}
 	if echoCmds {
 		fsims["fdo.command"] = &fsim.Command{
@@ -39,6 +39,7 @@ import (
 	"github.com/fido-device-onboard/go-fdo/custom"
 	"github.com/fido-device-onboard/go-fdo/fsim"
 	transport "github.com/fido-device-onboard/go-fdo/http"
+	"github.com/fido-device-onboard/go-fdo/metrics"
 	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 	"github.com/fido-device-onboard/go-fdo/sqlite"
@@ -73,6 +74,8 @@ var (
 	uploadDir            string
 	uploadReqs           stringList
 	wgets                stringList
+	interopToken         string
+	workflowPath         string
 	initOnly             bool
 )
 
@@ -113,6 +116,8 @@ func init() {
 	serverFlags.StringVar(&uploadDir, "upload-dir", "uploads", "The directory `path` to put file uploads")
 	serverFlags.Var(&uploadReqs, "upload", "Use fdo.upload FSIM for each `file` (flag may be used multiple times)")
 	serverFlags.Var(&wgets, "wget", "Use fdo.wget FSIM for each `url` (flag may be used multiple times)")
+	serverFlags.StringVar(&interopToken, "interop-token", "", "Use fido_alliance FSIM to send interop dashboard access `token`")
+	serverFlags.StringVar(&workflowPath, "workflow", "", "Run the JSON workflow at `path` instead of the FSIMs given by other flags")
 	serverFlags.BoolVar(&initOnly, "initOnly", false, "Initialize initialization (db/key/voucher creation)")
 }
 
@@ -316,7 +321,8 @@ func generateKeys(state *sqlite.DB) error { //nolint:gocyclo
 
 func serveHTTP(ctx context.Context, rvInfo [][]protocol.RvInstruction, state *sqlite.DB) error {
 	// Create FDO responder
-	handler, err := newHandler(ctx, rvInfo, state)
+	var m metrics.Prometheus
+	handler, err := newHandler(ctx, rvInfo, state, &m)
 	if err != nil {
 		return err
 	}
@@ -324,6 +330,10 @@ func serveHTTP(ctx context.Context, rvInfo [][]protocol.RvInstruction, state *sq
 	// Handle messages
 	mux := http.NewServeMux()
 	mux.Handle("POST /fdo/{fdoVer}/msg/{msg}", handler)
+	mux.Handle("GET "+transport.HealthPath, handler)
+	mux.Handle("GET "+transport.ReadyPath, handler)
+	mux.Handle("GET "+transport.CapabilitiesPath, handler)
+	mux.Handle("GET /metrics", &m)
 	srv := &http.Server{
 		Handler:           mux,
 		ReadHeaderTimeout: 3 * time.Second,
@@ -643,7 +653,7 @@ func mustMarshal(v any) []byte {
 }
 
 //nolint:gocyclo
-func newHandler(ctx context.Context, rvInfo [][]protocol.RvInstruction, state *sqlite.DB) (*transport.Handler, error) {
+func newHandler(ctx context.Context, rvInfo [][]protocol.RvInstruction, state *sqlite.DB, m metrics.Metrics) (*transport.Handler, error) {
 	aio := fdo.AllInOne{
 		DIAndOwner:         state,
 		RendezvousAndOwner: withOwnerAddrs{state, rvInfo},
@@ -657,6 +667,18 @@ func newHandler(ctx context.Context, rvInfo [][]protocol.RvInstruction, state *s
 		autoTO0 = aio.RegisterOwnerAddr
 	}
 
+	// Run the FSIMs given by flags, unless a workflow is given
+	plan := func(_ context.Context, device *serviceinfo.DeviceInfo) iter.Seq2[string, serviceinfo.OwnerModule] {
+		return ownerModules(device.Modules)
+	}
+	if workflowPath != "" {
+		workflow, err := loadWorkflow(workflowPath)
+		if err != nil {
+			return nil, err
+		}
+		plan = workflow.Plan
+	}
+
 	// Use Manufacturer key as device certificate authority
 	deviceCAKey, deviceCAChain, err := state.ManufacturerKey(ctx, protocol.Secp384r1KeyType, 0)
 	if err != nil {
@@ -664,7 +686,11 @@ func newHandler(ctx context.Context, rvInfo [][]protocol.RvInstruction, state *s
 	}
 
 	return &transport.Handler{
-		Tokens: state,
+		Tokens:    state,
+		Health:    true,
+		Readiness: state,
+		Discovery: true,
+		Metrics:   m,
 		DIResponder: &fdo.DIServer[custom.DeviceMfgInfo]{
 			Session:               state,
 			Vouchers:              state,
@@ -687,18 +713,28 @@ func newHandler(ctx context.Context, rvInfo [][]protocol.RvInstruction, state *s
 			BeforeVoucherPersist: autoExtend,
 			AfterVoucherPersist:  autoTO0,
 			RvInfo:               func(context.Context, *fdo.Voucher) ([][]protocol.RvInstruction, error) { return rvInfo, nil },
+			Metrics:              m,
 		},
 		TO0Responder: &fdo.TO0Server{
 			Session: state,
 			RVBlobs: state,
+			Metrics: m,
 		},
 		TO1Responder: &fdo.TO1Server{
 			Session: state,
 			RVBlobs: state,
+			Metrics: m,
 		},
 		TO2Responder: &fdo.TO2Server{
-			Session:         state,
-			Modules:         moduleStateMachines{DB: state, states: make(map[string]*moduleStateMachineState)},
+			Session: state,
+			// Module state is stored in the database after each message, so
+			// that any instance sharing it may continue the session
+			Modules: &serviceinfo.PlanStateMachine{
+				Session:   state.TokenFromContext,
+				Device:    fdo.TO2DeviceInfo(state, state),
+				Plan:      plan,
+				Persister: state,
+			},
 			Vouchers:        state,
 			OwnerKeys:       state,
 			DelegateKeys:    state,
@@ -706,6 +742,10 @@ func newHandler(ctx context.Context, rvInfo [][]protocol.RvInstruction, state *s
 			OnboardDelegate: onboardDelegate,
 			RvDelegate:      rvDelegate,
 			ReuseCredential: func(context.Context, fdo.Voucher) (bool, error) { return reuseCred, nil },
+			DevmodSchema: &serviceinfo.DevmodSchema{
+				Extensions: []serviceinfo.DevmodExtension{fsim.DownloadResumeExtension},
+			},
+			Metrics: m,
 		},
 	}, nil
 }
@@ -768,71 +808,46 @@ func encodePublicKey(keyType protocol.KeyType, keyEncoding protocol.KeyEncoding,
 	}
 }
 
-type moduleStateMachines struct {
-	DB *sqlite.DB
-	// current module state machine state for all sessions (indexed by token)
-	states map[string]*moduleStateMachineState
-}
-
-type moduleStateMachineState struct {
-	Name string
-	Impl serviceinfo.OwnerModule
-	Next func() (string, serviceinfo.OwnerModule, bool)
-	Stop func()
-}
-
-func (s moduleStateMachines) Module(ctx context.Context) (string, serviceinfo.OwnerModule, error) {
-	token, ok := s.DB.TokenFromContext(ctx)
-	if !ok {
-		return "", nil, fmt.Errorf("invalid context: no token")
-	}
-	module, ok := s.states[token]
-	if !ok {
-		return "", nil, fmt.Errorf("NextModule not called")
+func loadWorkflow(path string) (*fsim.Workflow, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("error opening workflow: %w", err)
 	}
-	return module.Name, module.Impl, nil
-}
-
-func (s moduleStateMachines) NextModule(ctx context.Context) (bool, error) {
-	token, ok := s.DB.TokenFromContext(ctx)
-	if !ok {
-		return false, fmt.Errorf("invalid context: no token")
+	defer func() { _ = f.Close() }()
+	workflow, err := fsim.ParseWorkflow(f)
+	if err != nil {
+		return nil, err
 	}
-	module, ok := s.states[token]
-	if !ok {
-		// Create a new module state machine
-		_, modules, _, err := s.DB.Devmod(ctx)
-		if err != nil {
-			return false, fmt.Errorf("error getting devmod: %w", err)
-		}
-		next, stop := iter.Pull2(ownerModules(modules))
-		module = &moduleStateMachineState{
-			Next: next,
-			Stop: stop,
+	workflow.Record = func(ctx context.Context, guid protocol.GUID, result fsim.WorkflowResult) {
+		switch {
+		case result.Skipped:
+			slog.Debug("workflow step skipped", "guid", guid, "step", result.Step)
+		case result.Err != nil:
+			slog.Warn("workflow step failed", "guid", guid, "step", result.Step, "exit", result.ExitCode, "error", result.Err)
+		default:
+			slog.Info("workflow step completed", "guid", guid, "step", result.Step, "exit", result.ExitCode, "files", result.Files)
 		}
-		s.states[token] = module
-	}
-
-	var valid bool
-	module.Name, module.Impl, valid = module.Next()
-	return valid, nil
-}
-
-func (s moduleStateMachines) CleanupModules(ctx context.Context) {
-	token, ok := s.DB.TokenFromContext(ctx)
-	if !ok {
-		return
-	}
-	module, ok := s.states[token]
-	if !ok {
-		return
 	}
-	module.Stop()
-	delete(s.states, token)
+	return workflow, nil
 }
 
 func ownerModules(modules []string) iter.Seq2[string, serviceinfo.OwnerModule] { //nolint:gocyclo
 	return func(yield func(string, serviceinfo.OwnerModule) bool) {
+		if interopToken != "" && slices.Contains(modules, "fido_alliance") {
+			if !yield("fido_alliance", &fsim.InteropConformance{
+				Token: interopToken,
+				Result: func(ctx context.Context, guid protocol.GUID, err error) {
+					if err != nil {
+						slog.Error("interop conformance failed", "guid", guid, "error", err)
+						return
+					}
+					slog.Info("interop conformance passed", "guid", guid)
+				},
+			}) {
+				return
+			}
+		}
+
 		if slices.Contains(modules, "fdo.download") {
 			for _, name := range downloads {
 				f, err := os.Open(filepath.Clean(name))
@@ -845,6 +860,7 @@ func ownerModules(modules []string) iter.Seq2[string, serviceinfo.OwnerModule] {
 					Name:         name,
 					Contents:     f,
 					MustDownload: true,
+					Resume:       true,
 				}) {
 					return
 				}
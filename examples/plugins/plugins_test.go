@@ -19,6 +19,7 @@ import (
 	"github.com/fido-device-onboard/go-fdo/fdotest"
 	"github.com/fido-device-onboard/go-fdo/fsim"
 	"github.com/fido-device-onboard/go-fdo/plugin"
+	"github.com/fido-device-onboard/go-fdo/plugin/plugintest"
 	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
@@ -166,3 +167,28 @@ func TestDevmodPlugin(t *testing.T) {
 		t.Errorf("devmod did not match expected\nwant %+v\ngot  %+v", expected, got)
 	}
 }
+
+func TestDevmodPluginConformance(t *testing.T) {
+	devmod := []plugintest.KV{
+		{Name: "os", Value: "linux"},
+		{Name: "arch", Value: "amd64"},
+		{Name: "version", Value: "TestOS"},
+		{Name: "device", Value: "UnitMcUnitFace"},
+		{Name: "sn", Value: []byte{0x00, 0x01}},
+		{Name: "sep", Value: ";"},
+		{Name: "bin", Value: "amd64"},
+	}
+
+	plugintest.Run(t, func() plugin.Module {
+		cmd := exec.Command("./devmod.bash", "linux", "amd64", "TestOS", "UnitMcUnitFace", "0001", "", ";", "", "", "", "", "amd64", "")
+		cmd.Stderr = fdotest.TestingLog(t)
+		return plugin.NewCommandPluginModule(cmd)
+	}, plugintest.Suite{
+		Name:    "devmod",
+		Version: "0.0.1",
+		Rounds: []plugintest.Round{
+			{Expect: devmod},
+			{Send: []plugintest.KV{{Name: "active", Value: true}}, Err: true},
+		},
+	})
+}
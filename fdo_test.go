@@ -6,17 +6,23 @@ package fdo_test
 import (
 	"context"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
 	"iter"
 	"runtime"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/fido-device-onboard/go-fdo"
 	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/custom"
 	"github.com/fido-device-onboard/go-fdo/fdotest"
+	"github.com/fido-device-onboard/go-fdo/kex"
 	"github.com/fido-device-onboard/go-fdo/plugin"
 	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
@@ -202,6 +208,102 @@ func TestClientWithCustomDevmod(t *testing.T) {
 	})
 }
 
+func TestClientWithDevmodSchema(t *testing.T) {
+	// Device modules are only used in one TO2 run of the suite, so the schema
+	// must accept the default devmod of the others
+	schema := &serviceinfo.DevmodSchema{
+		Extensions: []serviceinfo.DevmodExtension{
+			{Name: "x-sku", Type: serviceinfo.DevmodString},
+		},
+		Policies: []serviceinfo.DevmodPolicy{
+			func(devmod *serviceinfo.Devmod) error {
+				var sku string
+				if ok, err := devmod.Extension("x-sku", &sku); err != nil {
+					return err
+				} else if ok && sku == "blocked" {
+					return errors.New("sku is blocked")
+				}
+				return nil
+			},
+		},
+	}
+	customDevmod := func(sku any) *fdotest.MockDeviceModule {
+		return &fdotest.MockDeviceModule{
+			YieldFunc: func(ctx context.Context, respond func(message string) io.Writer, yield func()) error {
+				for _, kv := range []struct {
+					name string
+					val  any
+				}{
+					{"os", runtime.GOOS},
+					{"arch", runtime.GOARCH},
+					{"version", "Debian Bookworm"},
+					{"device", "go-validation"},
+					{"sep", ";"},
+					{"bin", runtime.GOARCH},
+					{"x-sku", sku},
+				} {
+					if err := cbor.NewEncoder(respond(kv.name)).Encode(kv.val); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}
+	}
+
+	t.Run("Extension", func(t *testing.T) {
+		var got []string
+		fdotest.RunClientTestSuite(t, fdotest.Config{
+			DeviceModules: map[string]serviceinfo.DeviceModule{
+				"devmod":       customDevmod("SKU-1"),
+				mockModuleName: &fdotest.MockDeviceModule{},
+			},
+			OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+				return func(yield func(string, serviceinfo.OwnerModule) bool) {
+					yield(mockModuleName, &fdotest.MockOwnerModule{
+						ProduceInfoFunc: func(ctx context.Context, _ *serviceinfo.Producer) (bool, bool, error) {
+							devmod, _ := serviceinfo.DevmodFromContext(ctx)
+							var sku string
+							if ok, err := devmod.Extension("x-sku", &sku); err != nil {
+								return false, false, err
+							} else if ok {
+								got = append(got, sku)
+							}
+							return false, true, nil
+						},
+					})
+				}
+			},
+			DevmodSchema: schema,
+		})
+		if len(got) == 0 || slices.ContainsFunc(got, func(sku string) bool { return sku != "SKU-1" }) {
+			t.Fatalf("expected owner module to read devmod extension, got %q", got)
+		}
+	})
+
+	for name, tc := range map[string]struct {
+		sku    any
+		errMsg string
+	}{
+		"Wrong type": {sku: 1, errMsg: "devmod:x-sku must be tstr"},
+		"Policy":     {sku: "blocked", errMsg: "sku is blocked"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fdotest.RunClientTestSuite(t, fdotest.Config{
+				DeviceModules: map[string]serviceinfo.DeviceModule{
+					"devmod": customDevmod(tc.sku),
+				},
+				DevmodSchema: schema,
+				CustomExpect: func(t *testing.T, err error) {
+					if err == nil || !strings.Contains(err.Error(), "devmod rejected") || !strings.Contains(err.Error(), tc.errMsg) {
+						t.Fatalf("expected devmod to be rejected with %q, got: %v", tc.errMsg, err)
+					}
+				},
+			})
+		})
+	}
+}
+
 func TestClientWithPluginModule(t *testing.T) {
 	devicePlugin := new(fdotest.MockPlugin)
 	devicePlugin.Routines = fdotest.ModuleNameOnlyRoutines(mockModuleName)
@@ -284,6 +386,169 @@ func TestClientWithPluginModule(t *testing.T) {
 	}
 }
 
+func TestClientWithEvents(t *testing.T) {
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	onEvent := func(_ context.Context, event fdo.TO2Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch event := event.(type) {
+		case fdo.DeviceProvedEvent:
+			if event.GUID == (protocol.GUID{}) {
+				t.Error("device proved event missing GUID")
+			}
+			counts["proved"]++
+		case fdo.ServiceInfoStartedEvent:
+			if event.Devmod.Os == "" {
+				t.Error("service info started event missing devmod")
+			}
+			counts["started"]++
+		case fdo.ServiceInfoCompletedEvent:
+			counts["completed"]++
+		case fdo.VoucherReplacedEvent:
+			if event.OldGUID == event.NewGUID {
+				t.Error("voucher replaced event should have a new GUID")
+			}
+			if event.Duration <= 0 {
+				t.Error("voucher replaced event should have a duration")
+			}
+			counts["replaced"]++
+		case fdo.DeviceErrorEvent:
+			counts["error"]++
+		}
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		NewTransport: func(t *testing.T, tokens protocol.TokenService, di, to0, to1, to2 protocol.Responder) fdo.Transport {
+			to2.(*fdo.TO2Server).OnEvent = onEvent
+			return &fdotest.Transport{
+				T:            t,
+				Tokens:       tokens,
+				DIResponder:  di.(*fdo.DIServer[custom.DeviceMfgInfo]),
+				TO0Responder: to0.(*fdo.TO0Server),
+				TO1Responder: to1.(*fdo.TO1Server),
+				TO2Responder: to2.(*fdo.TO2Server),
+			}
+		},
+	})
+
+	for _, name := range []string{"proved", "started", "completed", "replaced"} {
+		if counts[name] == 0 {
+			t.Errorf("expected at least one %s event", name)
+		}
+	}
+	if counts["replaced"] > counts["proved"] {
+		t.Errorf("expected no more voucher replaced events than device proved events, got %d > %d", counts["replaced"], counts["proved"])
+	}
+}
+
+func TestClientWithAbandonedServiceInfo(t *testing.T) {
+	var mu sync.Mutex
+	var sessions int
+	var received []string
+	var abandon atomic.Bool
+
+	// Each message is larger than the MTU, so part of it is held by the owner
+	// service when the session is abandoned
+	message := func(session int) string {
+		return strings.Repeat(fmt.Sprintf("session %d;", session), 300)
+	}
+
+	deviceModule := &fdotest.MockDeviceModule{
+		ReceiveFunc: func(ctx context.Context, messageName string, messageBody io.Reader, respond func(message string) io.Writer, yield func()) error {
+			var body string
+			if err := cbor.NewDecoder(messageBody).Decode(&body); err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, body)
+			return nil
+		},
+	}
+	newOwnerModule := func() serviceinfo.OwnerModule {
+		return &fdotest.MockOwnerModule{
+			ProduceInfoFunc: func(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+				mu.Lock()
+				sessions++
+				session := sessions
+				mu.Unlock()
+
+				// Abandon every other session after producing service info
+				// which does not fit in the MTU
+				abandon.Store(session%2 == 1)
+
+				if err := producer.WriteChunk("active", []byte{0xf5}); err != nil {
+					return false, false, err
+				}
+				if err := cbor.NewEncoder(producer.Message("data")).Encode(message(session)); err != nil {
+					return false, false, err
+				}
+				return false, true, nil
+			},
+		}
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		NewTransport: func(t *testing.T, tokens protocol.TokenService, di, to0, to1, to2 protocol.Responder) fdo.Transport {
+			// Hold pending service info in memory
+			server := to2.(*fdo.TO2Server)
+			server.Session = struct{ fdo.TO2SessionState }{server.Session}
+			return &abandoningTransport{
+				Transport: &fdotest.Transport{
+					T:            t,
+					Tokens:       tokens,
+					DIResponder:  di.(*fdo.DIServer[custom.DeviceMfgInfo]),
+					TO0Responder: to0.(*fdo.TO0Server),
+					TO1Responder: to1.(*fdo.TO1Server),
+					TO2Responder: server,
+				},
+				abandon: &abandon,
+			}
+		},
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			mockModuleName: deviceModule,
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield(mockModuleName, newOwnerModule())
+			}
+		},
+		RetryModules: true,
+	})
+
+	// Only service info of the sessions which were not abandoned is received
+	var expected []string
+	for session := 2; session <= sessions; session += 2 {
+		expected = append(expected, message(session))
+	}
+	if len(expected) == 0 || !slices.Equal(expected, received) {
+		t.Errorf("expected service info from %d retried sessions, got %d messages", len(expected), len(received))
+	}
+}
+
+// abandoningTransport stops sending messages, as if the device lost its
+// connection, when abandon is set at the next TO2.DeviceServiceInfo. Sending
+// resumes when the next TO2 session starts.
+type abandoningTransport struct {
+	fdo.Transport
+	abandon   *atomic.Bool
+	abandoned bool
+}
+
+func (t *abandoningTransport) Send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (uint8, io.ReadCloser, error) {
+	switch {
+	case msgType == protocol.TO2HelloDeviceMsgType:
+		t.abandoned = false
+	case msgType == protocol.TO2DeviceServiceInfoMsgType && t.abandon.Swap(false):
+		t.abandoned = true
+	}
+	if t.abandoned {
+		return 0, nil, errors.New("connection lost")
+	}
+	return t.Transport.Send(ctx, msgType, msg, sess)
+}
+
 func TestServerState(t *testing.T) {
 	fdotest.RunServerStateSuite(t, nil)
 }
@@ -16,7 +16,6 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -24,7 +23,6 @@ import (
 	"log/slog"
 	"math/big"
 	"runtime"
-	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -96,6 +94,48 @@ type Config struct {
 	// If CustomExpect is non-nil, then it is used to validate the result of
 	// TO2 with modules enabled
 	CustomExpect func(*testing.T, error)
+
+	// If RetryModules is true and TO2 with modules enabled fails, then it is
+	// run again with the same credential, as a device would after its session
+	// was abandoned.
+	RetryModules bool
+
+	// If DevmodSchema is non-nil, then it is used by the owner service to
+	// accept devmod extensions and reject devices.
+	DevmodSchema *serviceinfo.DevmodSchema
+
+	// If DeviceDevmod is non-nil, then it is called to modify the devmod sent
+	// by the device when DeviceModules are used, i.e. to add extensions.
+	DeviceDevmod func(*serviceinfo.Devmod)
+
+	// If OwnerInstances is greater than one, then TO2 messages are handled in
+	// turn by that many owner services, as if horizontally scaled without
+	// session affinity. State must implement serviceinfo.ModulePersister and
+	// serviceinfo.ModuleRestorer.
+	OwnerInstances int
+}
+
+// roundRobin passes each message to the next of several responders.
+type roundRobin struct {
+	mu         sync.Mutex
+	responders []*fdo.TO2Server
+	next       int
+}
+
+func (r *roundRobin) responder() *fdo.TO2Server {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	responder := r.responders[r.next]
+	r.next = (r.next + 1) % len(r.responders)
+	return responder
+}
+
+func (r *roundRobin) Respond(ctx context.Context, msgType uint8, msg io.Reader) (uint8, any) {
+	return r.responder().Respond(ctx, msgType, msg)
+}
+
+func (r *roundRobin) HandleError(ctx context.Context, errMsg protocol.ErrorMessage) {
+	r.responder().HandleError(ctx, errMsg)
 }
 
 var internalStateOnce sync.Once
@@ -215,35 +255,54 @@ func RunClientTestSuite(t *testing.T, conf Config) {
 		Session: conf.State,
 		RVBlobs: conf.State,
 	}
-	to2Responder := &fdo.TO2Server{
-		Session: conf.State,
-		Modules: &to2ModuleStateMachine{
-			Session:  conf.State,
-			Vouchers: conf.State,
-			OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
-				mods := startModules(ctx, replacementGUID, info, chain, devmod, supportedMods)
-
-				// Filter out modules not in supportedMods
-				return func(yield func(string, serviceinfo.OwnerModule) bool) {
-					for modName, mod := range mods {
-						if slices.Contains(supportedMods, modName) {
-							if !yield(modName, mod) {
-								return
-							}
-						}
-					}
-				}
+	// Tokens may change as session state is updated, so identify TO2 sessions
+	// by device GUID and the nonce generated for the session instead
+	sessionKey := func(ctx context.Context) (string, bool) {
+		guid, err := conf.State.GUID(ctx)
+		if err != nil {
+			return "", false
+		}
+		nonce, err := conf.State.ProveDeviceNonce(ctx)
+		if err != nil {
+			return "", false
+		}
+		return guid.String() + ":" + hex.EncodeToString(nonce[:]), true
+	}
+	newTO2Responder := func(persister serviceinfo.ModulePersister) *fdo.TO2Server {
+		return &fdo.TO2Server{
+			Session: conf.State,
+			Modules: &serviceinfo.PlanStateMachine{
+				Session: sessionKey,
+				Device:  fdo.TO2DeviceInfo(conf.State, conf.State),
+				Plan: func(ctx context.Context, device *serviceinfo.DeviceInfo) iter.Seq2[string, serviceinfo.OwnerModule] {
+					return startModules(ctx, device.ReplacementGUID, device.Info, device.CertChain, device.Devmod, device.Modules)
+				},
+				Persister: persister,
 			},
-		},
-		Vouchers:             conf.State,
-		OwnerKeys:            conf.State,
-		DelegateKeys:         conf.State,
-		VouchersForExtension: conf.State,
-		RvInfo: func(context.Context, fdo.Voucher) ([][]protocol.RvInstruction, error) {
-			return [][]protocol.RvInstruction{}, nil
-		},
-		ReuseCredential: func(context.Context, fdo.Voucher) (bool, error) { return conf.Reuse, nil },
-		VerifyVoucher:   func(context.Context, fdo.Voucher) error { return nil },
+			Vouchers:             conf.State,
+			OwnerKeys:            conf.State,
+			DelegateKeys:         conf.State,
+			VouchersForExtension: conf.State,
+			RvInfo: func(context.Context, fdo.Voucher) ([][]protocol.RvInstruction, error) {
+				return [][]protocol.RvInstruction{}, nil
+			},
+			ReuseCredential: func(context.Context, fdo.Voucher) (bool, error) { return conf.Reuse, nil },
+			VerifyVoucher:   func(context.Context, fdo.Voucher) error { return nil },
+			DevmodSchema:    conf.DevmodSchema,
+		}
+	}
+	to2Responder := newTO2Responder(nil)
+	var to2 protocol.Responder = to2Responder
+	if conf.OwnerInstances > 1 {
+		persister, ok := conf.State.(serviceinfo.ModulePersister)
+		if _, canRestore := conf.State.(serviceinfo.ModuleRestorer); !ok || !canRestore {
+			t.Fatal("state must implement serviceinfo.ModulePersister and serviceinfo.ModuleRestorer to use multiple owner instances")
+		}
+		instances := &roundRobin{}
+		for range conf.OwnerInstances {
+			instances.responders = append(instances.responders, newTO2Responder(persister))
+		}
+		to2Responder, to2 = instances.responders[0], instances
 	}
 
 	var transport fdo.Transport = &Transport{
@@ -251,11 +310,11 @@ func RunClientTestSuite(t *testing.T, conf Config) {
 		DIResponder:  diResponder,
 		TO0Responder: to0Responder,
 		TO1Responder: to1Responder,
-		TO2Responder: to2Responder,
+		TO2Responder: to2,
 		T:            t,
 	}
 	if conf.NewTransport != nil {
-		transport = conf.NewTransport(t, conf.State, diResponder, to0Responder, to1Responder, to2Responder)
+		transport = conf.NewTransport(t, conf.State, diResponder, to0Responder, to1Responder, to2)
 	}
 
 	to0 := &fdo.TO0Client{
@@ -532,7 +591,7 @@ func RunClientTestSuite(t *testing.T, conf Config) {
 
 				ctx, cancel := context.WithTimeout(context.Background(), timeout)
 				defer cancel()
-				cred, err = runTO2(ctx, transport, nil, fdo.TO2Config{
+				to2Config := fdo.TO2Config{
 					Cred:       *cred,
 					HmacSha256: hmacSha256,
 					HmacSha384: hmacSha384,
@@ -550,7 +609,15 @@ func RunClientTestSuite(t *testing.T, conf Config) {
 					KeyExchange:          table.keyExchange,
 					CipherSuite:          table.cipherSuite,
 					AllowCredentialReuse: conf.Reuse,
-				}, conf.Version)
+				}
+				if conf.DeviceDevmod != nil {
+					conf.DeviceDevmod(&to2Config.Devmod)
+				}
+				cred, err = runTO2(ctx, transport, nil, to2Config, conf.Version)
+				if err != nil && conf.RetryModules {
+					t.Logf("retrying TO2 after error: %v", err)
+					cred, err = runTO2(ctx, transport, nil, to2Config, conf.Version)
+				}
 				if conf.CustomExpect != nil {
 					conf.CustomExpect(t, err)
 					if err != nil {
@@ -564,95 +631,3 @@ func RunClientTestSuite(t *testing.T, conf Config) {
 		})
 	}
 }
-
-// Store a single module state at a time, initializing it with OwnerModules and
-// relying on CleanupModules to be called to clear the state before the next
-// usage.
-type to2ModuleStateMachine struct {
-	Session  fdo.TO2SessionState
-	Vouchers interface {
-		fdo.VoucherPersistentState
-		fdo.OwnerVoucherPersistentState
-	}
-	OwnerModules func(ctx context.Context, guid protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, modules []string) iter.Seq2[string, serviceinfo.OwnerModule]
-
-	module *moduleStateMachineState
-}
-
-type moduleStateMachineState struct {
-	Name string
-	Impl serviceinfo.OwnerModule
-	Next func() (string, serviceinfo.OwnerModule, bool)
-	Stop func()
-}
-
-func (s *to2ModuleStateMachine) Module(ctx context.Context) (string, serviceinfo.OwnerModule, error) {
-	if s.module == nil {
-		return "", nil, fmt.Errorf("NextModule never called")
-	}
-	if s.module.Impl == nil {
-		return "", nil, fmt.Errorf("NextModule already returned false")
-	}
-	return s.module.Name, s.module.Impl, nil
-}
-
-func (s *to2ModuleStateMachine) NextModule(ctx context.Context) (bool, error) {
-	if s.module != nil {
-		var valid bool
-		s.module.Name, s.module.Impl, valid = s.module.Next()
-		return valid, nil
-	}
-
-	guid, err := s.Session.GUID(ctx)
-	if err != nil {
-		return false, fmt.Errorf("error retrieving associated device GUID of TO2 session: %w", err)
-	}
-
-	ov, err := s.Vouchers.Voucher(ctx, guid)
-	if err != nil {
-		return false, fmt.Errorf("error retrieving voucher for device %x: %w", guid, err)
-	}
-	info := ov.Header.Val.DeviceInfo
-
-	replacementGUID, err := s.Session.ReplacementGUID(ctx)
-	if errors.Is(err, fdo.ErrNotFound) {
-		// replacement GUID is not found when using the Credential Reuse Protocol
-		replacementGUID = guid
-	} else if err != nil {
-		return false, fmt.Errorf("error retrieving replacement GUID for device: %w", err)
-	}
-
-	devmod, modules, devmodComplete, err := s.Session.Devmod(ctx)
-	if err == nil && !devmodComplete {
-		return false, fmt.Errorf("devmod did not complete")
-	}
-	if err != nil {
-		return false, fmt.Errorf("error retrieving devmod info for device %x: %w", guid, err)
-	}
-
-	var deviceCertChain []*x509.Certificate
-	if ov.CertChain != nil {
-		deviceCertChain = make([]*x509.Certificate, len(*ov.CertChain))
-		for i, cert := range *ov.CertChain {
-			deviceCertChain[i] = (*x509.Certificate)(cert)
-		}
-	}
-
-	// Start iterator
-	nextModule, stopIter := iter.Pull2(s.OwnerModules(ctx, replacementGUID, info, deviceCertChain, devmod, modules))
-	name, impl, valid := nextModule()
-	s.module = &moduleStateMachineState{
-		Name: name,
-		Impl: impl,
-		Next: nextModule,
-		Stop: stopIter,
-	}
-	return valid, nil
-}
-
-func (s *to2ModuleStateMachine) CleanupModules(ctx context.Context) {
-	if s.module != nil {
-		s.module.Stop()
-		s.module = nil
-	}
-}
@@ -61,6 +61,9 @@ type to2State struct {
 	Devmod         *serviceinfo.Devmod
 	Modules        []string
 	DevmodComplete bool
+	ModuleName     string
+	ModuleState    []byte
+	PendingInfo    []byte
 }
 
 type keyExchange struct {
@@ -132,6 +135,9 @@ var _ fdo.DISessionState = (*Service)(nil)
 var _ fdo.TO0SessionState = (*Service)(nil)
 var _ fdo.TO1SessionState = (*Service)(nil)
 var _ fdo.TO2SessionState = (*Service)(nil)
+var _ fdo.TO2ServiceInfoState = (*Service)(nil)
+var _ serviceinfo.ModulePersister = (*Service)(nil)
+var _ serviceinfo.ModuleRestorer = (*Service)(nil)
 
 // NewService initializes a stateless token service with a random HMAC secret
 // and self-signed CAs for the common key types.
@@ -532,6 +538,64 @@ func (s Service) Devmod(ctx context.Context) (devmod serviceinfo.Devmod, modules
 	return
 }
 
+// PersistModule stores the state of the current service info module, which
+// must implement encoding.BinaryMarshaler.
+func (s Service) PersistModule(ctx context.Context, name string, module serviceinfo.OwnerModule) error {
+	marshaler, ok := module.(encoding.BinaryMarshaler)
+	if !ok {
+		return fmt.Errorf("service info module %q does not implement encoding.BinaryMarshaler", name)
+	}
+	moduleState, err := marshaler.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error marshaling service info module %q state: %w", name, err)
+	}
+	return update(ctx, s, func(state *to2State) error {
+		state.ModuleName = name
+		state.ModuleState = moduleState
+		return nil
+	})
+}
+
+// RestoreModule decodes the state stored by PersistModule into module, which
+// must implement encoding.BinaryUnmarshaler.
+func (s Service) RestoreModule(ctx context.Context, module serviceinfo.OwnerModule) (name string, ok bool, err error) {
+	moduleState, err := fetch(ctx, s, func(state to2State) ([]byte, error) {
+		name = state.ModuleName
+		return state.ModuleState, nil
+	})
+	if err != nil || name == "" {
+		return "", false, err
+	}
+	unmarshaler, ok := module.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return "", false, fmt.Errorf("%T does not implement encoding.BinaryUnmarshaler", module)
+	}
+	if err := unmarshaler.UnmarshalBinary(moduleState); err != nil {
+		return "", false, fmt.Errorf("error unmarshaling service info module %q state: %w", name, err)
+	}
+	return name, true, nil
+}
+
+// SetPendingServiceInfo stores owner service info to send in following
+// messages.
+func (s Service) SetPendingServiceInfo(ctx context.Context, info []byte) error {
+	return update(ctx, s, func(state *to2State) error {
+		state.PendingInfo = info
+		return nil
+	})
+}
+
+// PendingServiceInfo returns the owner service info to send in following
+// messages.
+func (s Service) PendingServiceInfo(ctx context.Context) ([]byte, error) {
+	return fetch(ctx, s, func(state to2State) ([]byte, error) {
+		if len(state.PendingInfo) == 0 {
+			return nil, fdo.ErrNotFound
+		}
+		return state.PendingInfo, nil
+	})
+}
+
 // ExtendVoucher adds a new signed voucher entry to the list and returns the
 // new extended vouchers. Vouchers should be treated as immutable structures.
 func (s Service) ExtendVoucher(ov *fdo.Voucher, nextOwner crypto.PublicKey) (*fdo.Voucher, error) {
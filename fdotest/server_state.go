@@ -545,6 +545,80 @@ func RunServerStateSuite(t *testing.T, state AllServerState) { //nolint:gocyclo
 				t.Fatal("devmod complete state did not match expected")
 			}
 		})
+
+		t.Run("ServiceInfo", func(t *testing.T) {
+			persister, canPersist := state.(serviceinfo.ModulePersister)
+			restorer, canRestore := state.(serviceinfo.ModuleRestorer)
+			pendingState, canHoldPending := state.(fdo.TO2ServiceInfoState)
+			if !canPersist || !canRestore || !canHoldPending {
+				t.Skip("state does not implement service info module persistence")
+			}
+
+			token, err := state.NewToken(t.Context(), protocol.TO2Protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := state.TokenContext(t.Context(), token)
+			defer func() { _ = state.InvalidateToken(ctx) }()
+
+			restore := func(t *testing.T, expectName string, expectState []byte) {
+				t.Helper()
+				var module persistedModule
+				name, ok, err := restorer.RestoreModule(ctx, &module)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok || name != expectName || !bytes.Equal(module.State, expectState) {
+					t.Fatalf("expected module %q with state %q, got %q (%t) with state %q", expectName, expectState, name, ok, module.State)
+				}
+			}
+			pending := func(t *testing.T, expect []byte) {
+				t.Helper()
+				info, err := pendingState.PendingServiceInfo(ctx)
+				if expect == nil {
+					if !errors.Is(err, fdo.ErrNotFound) {
+						t.Fatalf("expected ErrNotFound, got %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(info, expect) {
+					t.Fatalf("expected pending service info %x, got %x", expect, info)
+				}
+			}
+
+			// Check for not found
+			if _, ok, err := restorer.RestoreModule(ctx, new(persistedModule)); err != nil || ok {
+				t.Fatalf("expected no module, got %t, %v", ok, err)
+			}
+			pending(t, nil)
+
+			// Storing pending service info does not overwrite the module state
+			if err := persister.PersistModule(ctx, "fdotest.mock", &persistedModule{State: []byte("first")}); err != nil {
+				t.Fatal(err)
+			}
+			if err := pendingState.SetPendingServiceInfo(ctx, []byte{0x01, 0x02}); err != nil {
+				t.Fatal(err)
+			}
+			restore(t, "fdotest.mock", []byte("first"))
+			pending(t, []byte{0x01, 0x02})
+
+			// Storing the module state does not overwrite pending service info
+			if err := persister.PersistModule(ctx, "fdotest.other", &persistedModule{State: []byte("second")}); err != nil {
+				t.Fatal(err)
+			}
+			restore(t, "fdotest.other", []byte("second"))
+			pending(t, []byte{0x01, 0x02})
+
+			// Clear pending service info
+			if err := pendingState.SetPendingServiceInfo(ctx, nil); err != nil {
+				t.Fatal(err)
+			}
+			pending(t, nil)
+			restore(t, "fdotest.other", []byte("second"))
+		})
 	})
 
 	t.Run("RendezvousBlobPersistentState", func(t *testing.T) {
@@ -706,6 +780,20 @@ func RunServerStateSuite(t *testing.T, state AllServerState) { //nolint:gocyclo
 	})
 }
 
+// persistedModule is an owner module with opaque state for testing module
+// persistence.
+type persistedModule struct {
+	MockOwnerModule
+	State []byte
+}
+
+func (m *persistedModule) MarshalBinary() ([]byte, error) { return m.State, nil }
+
+func (m *persistedModule) UnmarshalBinary(data []byte) error {
+	m.State = slices.Clone(data)
+	return nil
+}
+
 func mustMarshal(t *testing.T, v any) []byte {
 	data, err := cbor.Marshal(v)
 	if err != nil {
@@ -28,7 +28,7 @@ type Transport struct {
 	DIResponder  *fdo.DIServer[custom.DeviceMfgInfo]
 	TO0Responder *fdo.TO0Server
 	TO1Responder *fdo.TO1Server
-	TO2Responder *fdo.TO2Server
+	TO2Responder protocol.Responder
 
 	// internal state
 
@@ -49,6 +49,11 @@ func (t *Transport) Send(ctx context.Context, msgType uint8, msg any, sess kex.S
 		return 0, nil, err
 	}
 
+	if msgType == protocol.ErrorMsgType {
+		t.T.Logf("Request %d: %v", msgType, tryDebugNotation(msg))
+		return 0, nil, t.handleError(ctx, &msgBody)
+	}
+
 	if msgType < t.prevMsg || protocol.Of(t.prevMsg) != protocol.Of(msgType) {
 		t.token = ""
 	}
@@ -106,6 +111,36 @@ func (t *Transport) Send(ctx context.Context, msgType uint8, msg any, sess kex.S
 	return respType, io.NopCloser(&respBody), nil
 }
 
+// handleError passes an error message to the responder of the protocol in
+// progress, as the HTTP handler does, and invalidates the session token.
+func (t *Transport) handleError(ctx context.Context, msgBody io.Reader) error {
+	var errMsg protocol.ErrorMessage
+	if err := cbor.NewDecoder(msgBody).Decode(&errMsg); err != nil {
+		return err
+	}
+	var responder protocol.Responder
+	switch protocol.Of(errMsg.PrevMsgType) {
+	case protocol.DIProtocol:
+		responder = t.DIResponder
+	case protocol.TO0Protocol:
+		responder = t.TO0Responder
+	case protocol.TO1Protocol:
+		responder = t.TO1Responder
+	case protocol.TO2Protocol:
+		responder = t.TO2Responder
+	}
+	if responder == nil || t.token == "" {
+		return nil
+	}
+	ctx = t.Tokens.TokenContext(ctx, t.token)
+	responder.HandleError(ctx, errMsg)
+	if err := t.Tokens.InvalidateToken(ctx); err != nil {
+		t.T.Logf("error invalidating token: %v", err)
+	}
+	t.token = ""
+	return nil
+}
+
 func tryDebugNotation(v any) any {
 	b, err := cbor.Marshal(v)
 	if err != nil {
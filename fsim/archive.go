@@ -0,0 +1,242 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// ArchiveFormat is the format used to transfer multiple files with the
+// fdo.upload and fdo.download modules.
+type ArchiveFormat string
+
+// Archive formats
+const (
+	ArchiveTar     ArchiveFormat = "tar"
+	ArchiveTarGzip ArchiveFormat = "tar+gzip"
+)
+
+func (f ArchiveFormat) validate() error {
+	switch f {
+	case ArchiveTar, ArchiveTarGzip:
+		return nil
+	default:
+		return fmt.Errorf("unsupported archive format %q", f)
+	}
+}
+
+// ArchiveLimits restricts the contents of unpacked archives.
+type ArchiveLimits struct {
+	// MaxSize is the maximum total size of unpacked files. If zero, then
+	// 1 GiB is used.
+	MaxSize int64
+
+	// MaxFiles is the maximum number of files and directories. If zero, then
+	// 10000 is used.
+	MaxFiles int
+}
+
+func (l ArchiveLimits) maxSize() int64 {
+	if l.MaxSize > 0 {
+		return l.MaxSize
+	}
+	return 1 << 30
+}
+
+func (l ArchiveLimits) maxFiles() int {
+	if l.MaxFiles > 0 {
+		return l.MaxFiles
+	}
+	return 10000
+}
+
+// WriteArchive writes all files in fsys matching the glob pattern, including
+// the contents of matching directories, to w. Entries other than regular
+// files and directories, such as symlinks, are skipped.
+func WriteArchive(w io.Writer, fsys fs.FS, pattern string, format ArchiveFormat) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+	matches, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no files match %q", pattern)
+	}
+
+	var gz *gzip.Writer
+	if format == ArchiveTarGzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	written := make(map[string]bool)
+	for _, match := range matches {
+		if err := fs.WalkDir(fsys, match, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if written[name] || (!d.IsDir() && !d.Type().IsRegular()) {
+				return nil
+			}
+			written[name] = true
+			return writeArchiveEntry(tw, fsys, name, d)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+func writeArchiveEntry(tw *tar.Writer, fsys fs.FS, name string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if d.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if d.IsDir() {
+		return nil
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// unpackArchive extracts regular files and directories from an archive into
+// dir. Entries which would be placed outside of dir are rejected and other
+// entry types, such as symlinks, are skipped.
+func unpackArchive(r io.Reader, dir string, format ArchiveFormat, limits ArchiveLimits) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+	if format == ArchiveTarGzip {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("error reading gzip header: %w", err)
+		}
+		defer func() { _ = gz.Close() }()
+		r = gz
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = root.Close() }()
+
+	tr := tar.NewReader(r)
+	remaining, files := limits.maxSize(), 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading archive: %w", err)
+		}
+
+		name := filepath.FromSlash(path.Clean(hdr.Name))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("archive entry %q is outside of the destination", hdr.Name)
+		}
+		if files++; files > limits.maxFiles() {
+			return fmt.Errorf("archive contains more than %d entries", limits.maxFiles())
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(name, 0o755); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if hdr.Size > remaining {
+				return fmt.Errorf("archive contents exceed %d bytes", limits.maxSize())
+			}
+			remaining -= hdr.Size
+			if err := unpackFile(root, name, hdr.FileInfo().Mode().Perm(), tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func unpackFile(root *os.Root, name string, perm fs.FileMode, r io.Reader) error {
+	if parent := filepath.Dir(name); parent != "." {
+		if err := root.MkdirAll(parent, 0o755); err != nil {
+			return err
+		}
+	}
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm&0o755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing %q: %w", name, err)
+	}
+	return f.Close()
+}
+
+// mergeDir moves the contents of src into dst, replacing existing files, and
+// then removes src.
+func mergeDir(src, dst string) error {
+	if _, err := os.Stat(dst); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		return os.Rename(src, dst)
+	}
+	if err := filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		return os.Rename(name, target)
+	}); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
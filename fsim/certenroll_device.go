@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// CertEnroll implements the fdo.certenroll device module and should be
+// registered to the "fdo.certenroll" module. It generates a key, requests a
+// certificate from the owner, and installs the issued certificate chain when
+// TO2 completes (see [serviceinfo.TransactionalModule]).
+//
+// The messages are:
+//
+//	fdo.certenroll:active      bool      (owner -> device)
+//	fdo.certenroll:enroll      tstr      (owner -> device, requested common name)
+//	fdo.certenroll:csr         bstr      (device -> owner, DER CSR)
+//	fdo.certenroll:cert-chain  [+ bstr]  (owner -> device, DER certs, leaf first)
+//	fdo.certenroll:done        bool      (device -> owner)
+type CertEnroll struct {
+	// NewKey optionally overrides how the private key is generated, i.e. to
+	// use tpm.GenerateECKey. By default, an ECDSA P-256 software key is
+	// generated.
+	NewKey func() (crypto.Signer, error)
+
+	// Template optionally sets the subject and SANs of the CSR. If the
+	// template has no common name, then the name requested by the owner is
+	// used.
+	Template *x509.CertificateRequest
+
+	// CertPath and KeyPath are the files to which the issued certificate
+	// chain and private key are written in PEM format. KeyPath is ignored if
+	// the key cannot be exported, as is the case for TPM keys.
+	CertPath string
+	KeyPath  string
+
+	// Install optionally overrides how the issued certificate chain and key
+	// are stored.
+	Install func(ctx context.Context, chain []*x509.Certificate, key crypto.Signer) error
+
+	// Internal state
+	transaction
+	key crypto.Signer
+}
+
+var _ serviceinfo.TransactionalModule = (*CertEnroll)(nil)
+
+// Transition implements serviceinfo.DeviceModule.
+func (c *CertEnroll) Transition(active bool) error { c.reset(); return nil }
+
+// Receive implements serviceinfo.DeviceModule.
+func (c *CertEnroll) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	if err := c.receive(ctx, messageName, messageBody, respond); err != nil {
+		c.reset()
+		return err
+	}
+	return nil
+}
+
+func (c *CertEnroll) receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer) error {
+	switch messageName {
+	case "enroll":
+		var commonName string
+		if err := cbor.NewDecoder(messageBody).Decode(&commonName); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		csr, err := c.request(commonName)
+		if err != nil {
+			return err
+		}
+		return cbor.NewEncoder(respond("csr")).Encode(csr)
+
+	case "cert-chain":
+		var chain []*cbor.X509Certificate
+		if err := cbor.NewDecoder(messageBody).Decode(&chain); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if err := c.install(chain); err != nil {
+			return err
+		}
+		return cbor.NewEncoder(respond("done")).Encode(true)
+
+	default:
+		return fmt.Errorf("unknown message %s", messageName)
+	}
+}
+
+// Yield implements serviceinfo.DeviceModule.
+func (c *CertEnroll) Yield(ctx context.Context, respond func(message string) io.Writer, yield func()) error {
+	return nil
+}
+
+func (c *CertEnroll) request(commonName string) (*cbor.X509CertificateRequest, error) {
+	var err error
+	if c.NewKey != nil {
+		c.key, err = c.NewKey()
+	} else {
+		c.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %w", err)
+	}
+
+	var template x509.CertificateRequest
+	if c.Template != nil {
+		template = *c.Template
+	}
+	if template.Subject.CommonName == "" {
+		template.Subject.CommonName = commonName
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, c.key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating CSR: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CSR: %w", err)
+	}
+	return (*cbor.X509CertificateRequest)(csr), nil
+}
+
+// install checks the issued certificate chain and stages storing it.
+func (c *CertEnroll) install(certs []*cbor.X509Certificate) error {
+	if c.key == nil {
+		return errors.New("certificate chain received before enroll")
+	}
+	if len(certs) == 0 {
+		return errors.New("empty certificate chain")
+	}
+	chain := make([]*x509.Certificate, len(certs))
+	for i, cert := range certs {
+		chain[i] = (*x509.Certificate)(cert)
+	}
+
+	// Check that the certificate was issued for the generated key
+	pub, ok := c.key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(chain[0].PublicKey) {
+		return errors.New("issued certificate does not match the requested key")
+	}
+
+	if c.Install == nil && c.CertPath == "" {
+		return errors.New("no certificate path configured")
+	}
+	key := c.key
+	c.stage(func(ctx context.Context) error {
+		if c.Install != nil {
+			return c.Install(ctx, chain, key)
+		}
+		return c.writePEM(chain, key)
+	}, nil)
+	return nil
+}
+
+func (c *CertEnroll) writePEM(chain []*x509.Certificate, key crypto.Signer) error {
+	var certPEM bytes.Buffer
+	for _, cert := range chain {
+		_ = pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	if err := writeFileAtomic(c.CertPath, certPEM.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if c.KeyPath == "" {
+		return nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		// Not a software key
+		return nil
+	}
+	return writeFileAtomic(c.KeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+func (c *CertEnroll) reset() {
+	c.key = nil
+}
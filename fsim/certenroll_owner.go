@@ -0,0 +1,289 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// CertificateAuthority issues certificates for device CSRs.
+type CertificateAuthority interface {
+	// Sign issues a certificate for a CSR which has already been checked
+	// against the device's policy. The returned chain begins with the issued
+	// certificate.
+	Sign(ctx context.Context, csr *x509.CertificateRequest) ([]*x509.Certificate, error)
+}
+
+// CertPolicy restricts the subject and SANs a device may request.
+type CertPolicy struct {
+	// CommonName is the required subject common name. It is also sent to the
+	// device as the requested name. The subject must not contain any other
+	// attributes.
+	CommonName string
+
+	// DNSNames, IPAddresses, URIs, and EmailAddresses are the SANs which the
+	// device may request. A CSR may contain any subset of them.
+	DNSNames       []string
+	IPAddresses    []net.IP
+	URIs           []string
+	EmailAddresses []string
+}
+
+var oidCommonName = asn1.ObjectIdentifier{2, 5, 4, 3}
+
+// Check returns an error if the CSR requests a subject or SAN not allowed by
+// the policy.
+func (p *CertPolicy) Check(csr *x509.CertificateRequest) error {
+	if csr.Subject.CommonName != p.CommonName {
+		return fmt.Errorf("common name %q not allowed", csr.Subject.CommonName)
+	}
+	for _, attr := range csr.Subject.Names {
+		if !attr.Type.Equal(oidCommonName) {
+			return fmt.Errorf("subject attribute %s not allowed", attr.Type)
+		}
+		if attr.Value != p.CommonName {
+			return fmt.Errorf("common name %v not allowed", attr.Value)
+		}
+	}
+	for _, name := range csr.DNSNames {
+		if !slices.Contains(p.DNSNames, name) {
+			return fmt.Errorf("DNS name %q not allowed", name)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if !slices.ContainsFunc(p.IPAddresses, ip.Equal) {
+			return fmt.Errorf("IP address %s not allowed", ip)
+		}
+	}
+	for _, uri := range csr.URIs {
+		if !slices.Contains(p.URIs, uri.String()) {
+			return fmt.Errorf("URI %q not allowed", uri)
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		if !slices.Contains(p.EmailAddresses, email) {
+			return fmt.Errorf("email address %q not allowed", email)
+		}
+	}
+	return nil
+}
+
+// EnrollCertificate implements the fdo.certenroll owner module. See
+// [CertEnroll] for the message definitions.
+type EnrollCertificate struct {
+	// CA signs device CSRs. It is required.
+	CA CertificateAuthority
+
+	// Policy optionally chooses the subject and SANs allowed for a device,
+	// based on its GUID (before any replacement) and devmod. If Policy is nil,
+	// then the common name must be the device GUID and no SANs are allowed.
+	// If Policy returns a nil policy, then no certificate is issued.
+	Policy func(ctx context.Context, guid protocol.GUID, devmod *serviceinfo.Devmod) (*CertPolicy, error)
+
+	// Internal state
+	policy *CertPolicy
+	queue  []*serviceinfo.KV
+	done   bool
+}
+
+var _ serviceinfo.OwnerModule = (*EnrollCertificate)(nil)
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (e *EnrollCertificate) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	switch messageName {
+	case "active":
+		var deviceActive bool
+		if err := cbor.NewDecoder(messageBody).Decode(&deviceActive); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if !deviceActive {
+			return fmt.Errorf("device service info module is not active")
+		}
+		return nil
+
+	case "csr":
+		var csr cbor.X509CertificateRequest
+		if err := cbor.NewDecoder(messageBody).Decode(&csr); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		return e.sign(ctx, (*x509.CertificateRequest)(&csr))
+
+	case "done":
+		var ok bool
+		if err := cbor.NewDecoder(messageBody).Decode(&ok); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		e.done = true
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported message %q", messageName)
+	}
+}
+
+func (e *EnrollCertificate) sign(ctx context.Context, csr *x509.CertificateRequest) error {
+	if e.policy == nil {
+		return errors.New("CSR received before enroll")
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("invalid CSR signature: %w", err)
+	}
+	if err := e.policy.Check(csr); err != nil {
+		return fmt.Errorf("CSR rejected by policy: %w", err)
+	}
+	if e.CA == nil {
+		return errors.New("no certificate authority")
+	}
+	chain, err := e.CA.Sign(ctx, csr)
+	if err != nil {
+		return fmt.Errorf("error signing CSR: %w", err)
+	}
+	if len(chain) == 0 {
+		return errors.New("certificate authority returned an empty chain")
+	}
+	certs := make([]*cbor.X509Certificate, len(chain))
+	for i, cert := range chain {
+		certs[i] = (*cbor.X509Certificate)(cert)
+	}
+	body, err := cbor.Marshal(certs)
+	if err != nil {
+		return fmt.Errorf("error marshaling certificate chain: %w", err)
+	}
+	e.queue = append(e.queue, &serviceinfo.KV{Key: "cert-chain", Val: body})
+	return nil
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (e *EnrollCertificate) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	if e.done {
+		return false, true, nil
+	}
+
+	if e.policy == nil {
+		guid, _ := serviceinfo.GUIDFromContext(ctx)
+		policy := &CertPolicy{CommonName: guid.String()}
+		if e.Policy != nil {
+			devmod, _ := serviceinfo.DevmodFromContext(ctx)
+			var err error
+			if policy, err = e.Policy(ctx, guid, devmod); err != nil {
+				return false, false, fmt.Errorf("error getting certificate policy: %w", err)
+			}
+			if policy == nil {
+				return false, true, nil
+			}
+		}
+		commonName, err := cbor.Marshal(policy.CommonName)
+		if err != nil {
+			return false, false, fmt.Errorf("error marshaling common name: %w", err)
+		}
+		e.policy = policy
+		e.queue = []*serviceinfo.KV{
+			{Key: "active", Val: []byte{0xf5}},
+			{Key: "enroll", Val: commonName},
+		}
+	}
+
+	blockPeer, err := writeQueue(producer, &e.queue)
+	return blockPeer, false, err
+}
+
+// LocalCA implements CertificateAuthority by signing certificates with a key
+// held by the owner service.
+type LocalCA struct {
+	// Key and Chain are the CA private key and certificate chain, beginning
+	// with the CA certificate.
+	Key   crypto.Signer
+	Chain []*x509.Certificate
+
+	// Validity is how long issued certificates are valid. If zero, then one
+	// year is used.
+	Validity time.Duration
+
+	// ExtKeyUsage is the extended key usage of issued certificates. If nil,
+	// then both server and client authentication are allowed.
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
+var _ CertificateAuthority = (*LocalCA)(nil)
+
+// Sign implements CertificateAuthority. Only the common name of the CSR
+// subject is included in the certificate.
+func (ca *LocalCA) Sign(ctx context.Context, csr *x509.CertificateRequest) ([]*x509.Certificate, error) {
+	if ca.Key == nil || len(ca.Chain) == 0 {
+		return nil, errors.New("CA key and certificate are required")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("error generating serial number: %w", err)
+	}
+	validity := ca.Validity
+	if validity == 0 {
+		validity = 365 * 24 * time.Hour
+	}
+	extKeyUsage := ca.ExtKeyUsage
+	if extKeyUsage == nil {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Issuer:         ca.Chain[0].Subject,
+		Subject:        pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+		EmailAddresses: csr.EmailAddresses,
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(validity),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    extKeyUsage,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Chain[0], csr.PublicKey, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error signing certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing issued certificate: %w", err)
+	}
+	return append([]*x509.Certificate{cert}, ca.Chain...), nil
+}
+
+type enrollState struct {
+	Policy *CertPolicy
+	Queue  []*serviceinfo.KV
+	Done   bool
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The policy chosen for
+// the device is included, so that Policy is not called again.
+func (e *EnrollCertificate) MarshalBinary() ([]byte, error) {
+	return cbor.Marshal(enrollState{Policy: e.policy, Queue: e.queue, Done: e.done})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (e *EnrollCertificate) UnmarshalBinary(data []byte) error {
+	var state enrollState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	e.policy, e.queue, e.done = state.Policy, state.Queue, state.Done
+	return nil
+}
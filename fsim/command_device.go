@@ -4,19 +4,20 @@
 package fsim
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log/slog"
+	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
 
@@ -24,6 +25,15 @@ const defaultCommandTimeout = time.Hour
 
 // Command implements https://github.com/fido-alliance/fdo-sim/blob/main/fsim-repository/fdo.command.md
 // and should be registered to the "fdo.command" module.
+//
+// As an extension, the owner may send the following messages before execute:
+//
+//	fdo.command:env    bstr([* tstr]) ("KEY=VALUE", added to the environment)
+//	fdo.command:dir    tstr           (working directory)
+//	fdo.command:stdin  bstr           (may be sent multiple times)
+//
+// Output is streamed to the owner while the command runs, one or more lines
+// at a time.
 type Command struct {
 	// Timeout determines the maximum amount of time to allow running the
 	// command. Exceeding this time will result in the module sending an error.
@@ -34,18 +44,27 @@ type Command struct {
 	// them.
 	Transform func(name string, arg []string) (newName string, newArg []string)
 
+	// Policy, if set, is applied after Transform and before the command is
+	// started. It may reject the command by returning an error or modify it,
+	// i.e. to run as a different user. See [CommandPolicy].
+	Policy func(cmd *exec.Cmd) error
+
 	// Message data
 	arg0    string
 	args    cbor.Bstr[[]string]
+	env     cbor.Bstr[[]string]
+	dir     string
+	stdin   bytes.Buffer
 	mayFail bool
 	stdout  bool
 	stderr  bool
 
 	// Internal state
-	cmd  *exec.Cmd
-	out  *bufio.Reader
-	err  *bufio.Reader
-	errc chan error
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	out    *safeBuffer
+	err    *safeBuffer
+	errc   chan error
 }
 
 var _ serviceinfo.DeviceModule = (*Command)(nil)
@@ -76,6 +95,36 @@ func (c *Command) receive(ctx context.Context, messageName string, messageBody i
 	case "args":
 		return cbor.NewDecoder(messageBody).Decode(&c.args)
 
+	case "env":
+		if err := cbor.NewDecoder(messageBody).Decode(&c.env); err != nil {
+			return err
+		}
+		for _, kv := range c.env.Val {
+			if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+				return fmt.Errorf("invalid environment variable %q", kv)
+			}
+		}
+		return nil
+
+	case "dir":
+		return cbor.NewDecoder(messageBody).Decode(&c.dir)
+
+	case "stdin":
+		// Consecutive stdin messages are concatenated
+		dec := cbor.NewDecoder(messageBody)
+		for {
+			var chunk []byte
+			if err := dec.Decode(&chunk); errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if c.cmd != nil {
+				return fmt.Errorf("received stdin after execute")
+			}
+			_, _ = c.stdin.Write(chunk)
+		}
+
 	case "may_fail":
 		return cbor.NewDecoder(messageBody).Decode(&c.mayFail)
 
@@ -127,29 +176,44 @@ func (c *Command) execute(ctx context.Context) error {
 		timeout = defaultCommandTimeout
 	}
 
-	// Start command
-	ctx, _ = context.WithTimeout(ctx, timeout)     //nolint:govet // This context is only used for the command
-	c.cmd = exec.CommandContext(ctx, name, arg...) //nolint:gosec // This is dangerous by intentional design as the owner service is meant to be privileged
+	// Prepare command
+	cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+	cmd := exec.CommandContext(cmdCtx, name, arg...) //nolint:gosec // This is dangerous by intentional design as the owner service is meant to be privileged
+	cmd.Dir = c.dir
+	if len(c.env.Val) > 0 {
+		cmd.Env = append(os.Environ(), c.env.Val...)
+	}
+	if c.stdin.Len() > 0 {
+		cmd.Stdin = &c.stdin
+	}
+	if c.Policy != nil {
+		if err := c.Policy(cmd); err != nil {
+			cancel()
+			return fmt.Errorf("command %v rejected by policy: %w", cmd.Args, err)
+		}
+	}
 	if c.stdout {
-		var buf safeBuffer
-		c.cmd.Stdout = &buf
-		c.out = bufio.NewReader(&buf)
+		c.out = new(safeBuffer)
+		cmd.Stdout = c.out
 	}
 	if c.stderr {
-		var buf safeBuffer
-		c.cmd.Stderr = &buf
-		c.err = bufio.NewReader(&buf)
+		c.err = new(safeBuffer)
+		cmd.Stderr = c.err
 	}
-	if debugEnabled() {
-		slog.Debug("fdo.command", "args", c.cmd.Args)
+
+	// Start command
+	if debugEnabled(ctx) {
+		protocol.LoggerFromContext(ctx).Debug("fdo.command", "args", cmd.Args, "dir", cmd.Dir)
 	}
-	if err := c.cmd.Start(); err != nil {
-		return fmt.Errorf("error starting command %v: %w", c.cmd.Args, err)
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("error starting command %v: %w", cmd.Args, err)
 	}
+	c.cmd, c.cancel = cmd, cancel
 	c.errc = make(chan error, 1)
 	go func() {
 		defer close(c.errc)
-		if err := c.cmd.Wait(); err != nil {
+		if err := cmd.Wait(); err != nil {
 			c.errc <- err
 		}
 	}()
@@ -172,7 +236,9 @@ func (c *Command) Yield(ctx context.Context, respond func(message string) io.Wri
 		defer c.reset()
 		exited = true
 
-		if err != nil {
+		// A non-zero exit status is handled below, so that it may be
+		// reported to the owner
+		if exitErr := (*exec.ExitError)(nil); err != nil && !errors.As(err, &exitErr) {
 			return fmt.Errorf("command failed to execute: %w", err)
 		}
 	default:
@@ -180,12 +246,12 @@ func (c *Command) Yield(ctx context.Context, respond func(message string) io.Wri
 
 	// Send any data on the stdout/stderr pipes
 	if c.stdout {
-		if err := cborEncodeBuffer(respond("stdout"), c.out); err != nil {
+		if err := cborEncodeBuffer(respond("stdout"), c.out, exited); err != nil {
 			return fmt.Errorf("stdout: %w", err)
 		}
 	}
 	if c.stderr {
-		if err := cborEncodeBuffer(respond("stderr"), c.err); err != nil {
+		if err := cborEncodeBuffer(respond("stderr"), c.err, exited); err != nil {
 			return fmt.Errorf("stderr: %w", err)
 		}
 	}
@@ -204,24 +270,17 @@ func (c *Command) Yield(ctx context.Context, respond func(message string) io.Wri
 	return cbor.NewEncoder(respond("exitcode")).Encode(code)
 }
 
-// Encode stdin/stdout buffer, ensuring that partial lines are not written. EOF
-// is ignored, because it only indicates that the in-memory buffer is empty,
-// not that the process has exited.
-func cborEncodeBuffer(w io.Writer, br *bufio.Reader) error {
-	enc := cbor.NewEncoder(w)
-
-	b, err := br.ReadBytes('\n')
-	for err == nil {
-		line := append(b, '\n')
-		if err := enc.Encode(line); err != nil {
-			return fmt.Errorf("error sending buffer: %w", err)
-		}
-		b, err = br.ReadBytes('\n')
-	}
-	if errors.Is(err, io.EOF) {
+// Encode stdout/stderr buffer, ensuring that partial lines are not written
+// unless the process has exited or the line is too long to hold back.
+func cborEncodeBuffer(w io.Writer, buf *safeBuffer, exited bool) error {
+	b := buf.next(exited)
+	if len(b) == 0 {
 		return nil
 	}
-	return err
+	if err := cbor.NewEncoder(w).Encode(b); err != nil {
+		return fmt.Errorf("error sending buffer: %w", err)
+	}
+	return nil
 }
 
 func (c *Command) reset() {
@@ -231,9 +290,13 @@ func (c *Command) reset() {
 		}
 		_ = c.cmd.Process.Kill()
 	}
+	if c.cancel != nil {
+		c.cancel()
+	}
 	*c = Command{
 		Timeout:   c.Timeout,
 		Transform: c.Transform,
+		Policy:    c.Policy,
 	}
 }
 
@@ -242,7 +305,7 @@ type safeBuffer struct {
 	buf bytes.Buffer
 }
 
-var _ io.ReadWriter = (*safeBuffer)(nil)
+var _ io.Writer = (*safeBuffer)(nil)
 
 func (s *safeBuffer) Write(p []byte) (n int, err error) {
 	s.mu.Lock()
@@ -250,8 +313,18 @@ func (s *safeBuffer) Write(p []byte) (n int, err error) {
 	return s.buf.Write(p)
 }
 
-func (s *safeBuffer) Read(p []byte) (n int, err error) {
+// maxHeldOutput is the longest partial line which is held back from sending
+// until it is completed.
+const maxHeldOutput = 4096
+
+// next returns all complete lines, or all data if flush is set or the partial
+// line is too long.
+func (s *safeBuffer) next(flush bool) []byte {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.buf.Read(p)
+	n := bytes.LastIndexByte(s.buf.Bytes(), '\n') + 1
+	if flush || s.buf.Len()-n > maxHeldOutput {
+		n = s.buf.Len()
+	}
+	return bytes.Clone(s.buf.Next(n))
 }
@@ -0,0 +1,15 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build !unix
+
+package fsim
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func runAsUser(*exec.Cmd, string) error {
+	return errors.New("running commands as another user is not supported on this platform")
+}
@@ -5,6 +5,7 @@ package fsim
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 
@@ -23,6 +24,17 @@ type RunCommand struct {
 	// Command arguments
 	Args []string
 
+	// Env optionally sets additional environment variables in "KEY=VALUE"
+	// form. Dir optionally sets the working directory. Stdin optionally
+	// provides the command's standard input, which is sent in full before
+	// the command is executed.
+	//
+	// These are extensions (see [Command]) and devices which do not support
+	// them will fail on the unknown message.
+	Env   []string
+	Dir   string
+	Stdin io.Reader
+
 	// If false, Device will terminate TO2 on error (FDO message 255);
 	// otherwise device will send exitcode and continue to process ServiceInfo.
 	// This permits the Owner side to either take recovery action or fail the
@@ -30,11 +42,11 @@ type RunCommand struct {
 	MayFail bool
 
 	// If set, stdout will be requested from the device and written to this
-	// writer
+	// writer as the command runs
 	Stdout io.Writer
 
 	// If set, stderr will be requested from the device and written to this
-	// writer
+	// writer as the command runs
 	Stderr io.Writer
 
 	// If set, the exit code will be sent on this channel. It should be
@@ -46,7 +58,9 @@ type RunCommand struct {
 
 	// Internal state
 	sentCommand bool
-	argBody     []byte
+	queue       []*serviceinfo.KV
+	sentStdin   bool
+	stdinRead   int64
 	sentExecute bool
 	done        bool
 }
@@ -150,74 +164,107 @@ func (c *RunCommand) produceInfo(producer *serviceinfo.Producer) (blockPeer, mod
 	}
 
 	if !c.sentCommand {
-		cmdBody, err := cbor.Marshal(c.Command)
-		if err != nil {
+		if err := c.enqueue(); err != nil {
 			return false, false, err
 		}
+		c.sentCommand = true
+	}
 
-		if err := producer.WriteChunk("active", []byte{0xf5}); err != nil {
-			return false, false, err
-		}
-		if err := producer.WriteChunk("command", cmdBody); err != nil {
-			return false, false, err
-		}
+	// Command and args may be long and require chunking
+	if blockPeer, err := writeQueue(producer, &c.queue); err != nil || blockPeer {
+		return blockPeer, false, err
+	}
+	if len(c.queue) > 0 {
+		return false, false, nil
+	}
 
-		c.argBody, err = cbor.Marshal(*cbor.NewBstr(c.Args))
-		if err != nil {
+	if !c.sentStdin {
+		if err := c.sendStdin(producer); err != nil {
 			return false, false, err
 		}
-
-		c.sentCommand = true
+		if !c.sentStdin {
+			return false, false, nil
+		}
 	}
 
-	moreInfo, err := c.sendArgsAndExecute(producer)
-	return moreInfo, false, err
+	if producer.Available("execute") < 2 {
+		return false, false, nil
+	}
+	if err := producer.WriteChunk("execute", []byte{0xf6}); err != nil {
+		return false, false, err
+	}
+	c.sentExecute = true
+	return false, false, nil
 }
 
-func (c *RunCommand) sendArgsAndExecute(producer *serviceinfo.Producer) (moreInfo bool, _ error) {
+func (c *RunCommand) enqueue() error {
 	trueBody := []byte{0xf5}
-	nullBody := []byte{0xf6}
 
-	// Args may be long and require chunking
-	remaining := producer.Available("args")
-	if remaining < 1 {
-		return true, nil
+	cmdBody, err := cbor.Marshal(c.Command)
+	if err != nil {
+		return err
 	}
-	n := min(remaining, len(c.argBody))
-
-	if n > 0 {
-		var messageBody []byte
-		messageBody, c.argBody = c.argBody[:n], c.argBody[n:]
-		if err := producer.WriteChunk("args", messageBody); err != nil {
-			return false, err
+	argBody, err := cbor.Marshal(*cbor.NewBstr(c.Args))
+	if err != nil {
+		return err
+	}
+	c.queue = []*serviceinfo.KV{
+		{Key: "active", Val: trueBody},
+		{Key: "command", Val: cmdBody},
+		{Key: "args", Val: argBody},
+	}
+	if len(c.Env) > 0 {
+		envBody, err := cbor.Marshal(*cbor.NewBstr(c.Env))
+		if err != nil {
+			return err
 		}
+		c.queue = append(c.queue, &serviceinfo.KV{Key: "env", Val: envBody})
 	}
-
-	// Send remaining messages
-	if producer.Available("") < 100 { // ensure enough space after sending args
-		return true, nil
+	if c.Dir != "" {
+		dirBody, err := cbor.Marshal(c.Dir)
+		if err != nil {
+			return err
+		}
+		c.queue = append(c.queue, &serviceinfo.KV{Key: "dir", Val: dirBody})
 	}
 	if c.MayFail {
-		if err := producer.WriteChunk("may_fail", trueBody); err != nil {
-			return false, err
-		}
+		c.queue = append(c.queue, &serviceinfo.KV{Key: "may_fail", Val: trueBody})
 	}
 	if c.Stdout != nil {
-		if err := producer.WriteChunk("return_stdout", trueBody); err != nil {
-			return false, err
-		}
+		c.queue = append(c.queue, &serviceinfo.KV{Key: "return_stdout", Val: trueBody})
 	}
 	if c.Stderr != nil {
-		if err := producer.WriteChunk("return_stderr", trueBody); err != nil {
-			return false, err
-		}
+		c.queue = append(c.queue, &serviceinfo.KV{Key: "return_stderr", Val: trueBody})
 	}
-	if err := producer.WriteChunk("execute", nullBody); err != nil {
-		return false, err
-	}
-	c.sentExecute = true
+	return nil
+}
 
-	return false, nil
+// sendStdin sends as much of stdin as fits in the current service info.
+func (c *RunCommand) sendStdin(producer *serviceinfo.Producer) error {
+	if c.Stdin == nil {
+		c.sentStdin = true
+		return nil
+	}
+	available := producer.Available("stdin") - 6 // 3 for each byte array (double-encoded)
+	if available < 1 {
+		return nil
+	}
+	chunk := make([]byte, min(available, 1014))
+	n, err := io.ReadFull(c.Stdin, chunk)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		c.sentStdin = true
+	} else if err != nil {
+		return fmt.Errorf("error reading stdin: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	c.stdinRead += int64(n)
+	body, err := cbor.Marshal(chunk[:n])
+	if err != nil {
+		return err
+	}
+	return producer.WriteChunk("stdin", body)
 }
 
 func (c *RunCommand) cleanup() {
@@ -225,3 +272,46 @@ func (c *RunCommand) cleanup() {
 		close(c.ExitChan)
 	}
 }
+
+type commandState struct {
+	SentCommand bool
+	Queue       []*serviceinfo.KV
+	SentStdin   bool
+	StdinRead   int64
+	SentExecute bool
+	Done        bool
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. To restore a module which
+// had partially sent Stdin, Stdin must implement io.Seeker.
+func (c *RunCommand) MarshalBinary() ([]byte, error) {
+	return cbor.Marshal(commandState{
+		SentCommand: c.sentCommand,
+		Queue:       c.queue,
+		SentStdin:   c.sentStdin,
+		StdinRead:   c.stdinRead,
+		SentExecute: c.sentExecute,
+		Done:        c.done,
+	})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (c *RunCommand) UnmarshalBinary(data []byte) error {
+	var state commandState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if !state.SentStdin && state.StdinRead > 0 {
+		seeker, ok := c.Stdin.(io.Seeker)
+		if !ok {
+			return errors.New("stdin was partially sent and cannot be resumed")
+		}
+		if _, err := seeker.Seek(state.StdinRead, io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking stdin: %w", err)
+		}
+	}
+	c.sentCommand, c.queue = state.SentCommand, state.Queue
+	c.sentStdin, c.stdinRead = state.SentStdin, state.StdinRead
+	c.sentExecute, c.done = state.SentExecute, state.Done
+	return nil
+}
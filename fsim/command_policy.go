@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// CommandPolicy restricts the commands run by the fdo.command device module.
+// Its Apply method may be used as [Command.Policy].
+type CommandPolicy struct {
+	// Executables, if not empty, is the list of executables which may be
+	// run. Commands are resolved using the PATH before being compared, so
+	// entries should be absolute paths. Commands given as relative paths are
+	// always rejected.
+	//
+	// Because environment variables set by the owner are added to the
+	// device's environment, they could otherwise cause an allowed executable
+	// to load other code. So when Executables is set, commands for which the
+	// owner set a dynamic loader variable (LD_* or DYLD_*, i.e. LD_PRELOAD)
+	// are always rejected.
+	Executables []string
+
+	// DenyEnv and DenyDir reject commands for which the owner set
+	// environment variables or a working directory, respectively.
+	DenyEnv bool
+	DenyDir bool
+
+	// User, if set, is the name or ID of the user to run commands as. The
+	// device must be running with privileges to change users. This is only
+	// supported on Unix systems.
+	User string
+}
+
+// Apply checks the command against the policy and configures it to run as
+// User, if set.
+func (p CommandPolicy) Apply(cmd *exec.Cmd) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	if len(p.Executables) > 0 {
+		// Relative paths are resolved against cmd.Dir, which the owner may
+		// set, so only commands found in the PATH or given as absolute paths
+		// can be matched against the allowlist
+		if !filepath.IsAbs(cmd.Path) {
+			return fmt.Errorf("executable %q is not an absolute path", cmd.Path)
+		}
+		if !slices.Contains(p.Executables, filepath.Clean(cmd.Path)) {
+			return fmt.Errorf("executable %q is not allowed", cmd.Path)
+		}
+		if name, ok := loaderEnv(cmd.Env); ok {
+			return fmt.Errorf("environment variable %s is not allowed", name)
+		}
+	}
+	if p.DenyEnv && cmd.Env != nil {
+		return fmt.Errorf("environment variables are not allowed")
+	}
+	if p.DenyDir && cmd.Dir != "" {
+		return fmt.Errorf("working directory is not allowed")
+	}
+	if p.User != "" {
+		return runAsUser(cmd, p.User)
+	}
+	return nil
+}
+
+// loaderEnv returns the name of the first variable which affects the dynamic
+// loader and was not inherited from the device's environment.
+func loaderEnv(env []string) (string, bool) {
+	environ := os.Environ()
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, "LD_") && !strings.HasPrefix(name, "DYLD_") {
+			continue
+		}
+		if !slices.Contains(environ, kv) {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -6,20 +6,56 @@ package fsim
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"log/slog"
+	"io/fs"
 	"os"
+	"path/filepath"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
 
+// DownloadResumeExtension is the devmod extension which a device sends to
+// advertise support for the fdo.download resume extension. Owner services
+// must declare it in their [serviceinfo.DevmodSchema] to accept these devices.
+var DownloadResumeExtension = serviceinfo.DevmodExtension{
+	Name: "x-fdo.download.resume",
+	Type: serviceinfo.DevmodBool,
+}
+
 // Download implements https://github.com/fido-alliance/fdo-sim/blob/main/fsim-repository/fdo.download.md
 // and should be registered to the "fdo.download" module.
+//
+// As an extension, the owner may send a resume message after sha-384, to
+// which the device responds with the number of bytes already downloaded in a
+// previous session. The owner then sends data starting from that offset.
+//
+//	fdo.download:resume  bool (owner -> device)
+//	fdo.download:offset  uint (device -> owner)
+//
+// Owners only send resume to devices which advertise support by sending
+// [DownloadResumeExtension] in devmod, so a device with PartialDir set should
+// add it with [Download.AdvertiseResume]. Owner services which do not declare
+// the extension reject devices which send it.
+//
+// The owner may also send an archive message before data, in which case the
+// downloaded file is an archive which is unpacked into the directory given
+// by name.
+//
+//	fdo.download:archive  tstr ("tar" or "tar+gzip")
+//
+// Owners which do not send these messages are unaffected.
+//
+// Downloaded files are kept in a temporary location until TO2 completes and
+// are only moved into place when the download is committed (see
+// [serviceinfo.TransactionalModule]).
 type Download struct {
 	// CreateTemp optionally overrides the behavior of how the FSIM creates a
 	// temporary file to download to.
@@ -29,6 +65,16 @@ type Download struct {
 	// the file after downloading to a temporary location.
 	NameToPath func(name string) string
 
+	// PartialDir optionally enables resuming downloads. Partial downloads
+	// are kept in this directory, keyed by name and SHA-384 checksum, so that
+	// a download interrupted by a failed TO2 session can continue in the
+	// next. Downloads without a checksum are never resumed.
+	PartialDir string
+
+	// ArchiveLimits restricts the contents of downloaded archives. Files are
+	// never unpacked outside of the destination directory.
+	ArchiveLimits ArchiveLimits
+
 	// ErrorLog is optional and any causes of a -1 response will have a
 	// corresponding message written.
 	ErrorLog io.Writer
@@ -36,17 +82,32 @@ type Download struct {
 	// TODO: Configurable timeout?
 
 	// Message data
-	name   string
-	length int
-	sha384 []byte // optional
+	name    string
+	length  int
+	sha384  []byte        // optional
+	archive ArchiveFormat // optional
 
 	// Internal state
+	transaction
 	temp    *os.File
+	partial bool
 	hash    hash.Hash
 	written int
 }
 
-var _ serviceinfo.DeviceModule = (*Download)(nil)
+var _ serviceinfo.TransactionalModule = (*Download)(nil)
+
+// AdvertiseResume adds [DownloadResumeExtension] to devmod if resuming
+// downloads is enabled by PartialDir.
+func (d *Download) AdvertiseResume(devmod *serviceinfo.Devmod) {
+	if d.PartialDir == "" {
+		return
+	}
+	if devmod.Extensions == nil {
+		devmod.Extensions = make(map[string][]byte)
+	}
+	devmod.Extensions[DownloadResumeExtension.Name] = []byte{0xf5} // true
+}
 
 // Transition implements serviceinfo.DeviceModule.
 func (d *Download) Transition(active bool) error {
@@ -56,14 +117,14 @@ func (d *Download) Transition(active bool) error {
 
 // Receive implements serviceinfo.DeviceModule.
 func (d *Download) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
-	if err := d.receive(messageName, messageBody, respond); err != nil {
+	if err := d.receive(ctx, messageName, messageBody, respond); err != nil {
 		d.reset()
 		return err
 	}
 	return nil
 }
 
-func (d *Download) receive(messageName string, messageBody io.Reader, respond func(string) io.Writer) error {
+func (d *Download) receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer) error {
 	switch messageName {
 	case "length":
 		return cbor.NewDecoder(messageBody).Decode(&d.length)
@@ -74,6 +135,31 @@ func (d *Download) receive(messageName string, messageBody io.Reader, respond fu
 	case "name":
 		return cbor.NewDecoder(messageBody).Decode(&d.name)
 
+	case "archive":
+		if err := cbor.NewDecoder(messageBody).Decode(&d.archive); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		return d.archive.validate()
+
+	case "resume":
+		var resume bool
+		if err := cbor.NewDecoder(messageBody).Decode(&resume); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if resume {
+			if err := d.openPartial(ctx); err != nil {
+				return err
+			}
+		}
+		if err := cbor.NewEncoder(respond("offset")).Encode(d.written); err != nil {
+			return err
+		}
+		if d.temp != nil && d.written >= d.length {
+			// No data will be sent, because it was all received previously
+			return d.finalize(respond)
+		}
+		return nil
+
 	case "data":
 		if err := d.createTemp(); err != nil {
 			return err
@@ -102,8 +188,8 @@ func (d *Download) receive(messageName string, messageBody io.Reader, respond fu
 				return cbor.NewEncoder(respond("done")).Encode(-1)
 			}
 			d.written += n
-			if debugEnabled() {
-				slog.Default().WithGroup("fdo.download").Debug("progress", "written", d.written, "length", d.length)
+			if debugEnabled(ctx) {
+				protocol.LoggerFromContext(ctx).WithGroup("fdo.download").Debug("progress", "written", d.written, "length", d.length)
 			}
 		}
 
@@ -118,7 +204,13 @@ func (d *Download) createTemp() error {
 	}
 
 	var err error
-	if d.CreateTemp != nil {
+	if path, ok := d.partialPath(); ok {
+		if err := os.MkdirAll(d.PartialDir, 0o700); err != nil {
+			return fmt.Errorf("error creating partial download directory: %w", err)
+		}
+		d.temp, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+		d.partial = true
+	} else if d.CreateTemp != nil {
 		d.temp, err = d.CreateTemp()
 	} else {
 		d.temp, err = os.CreateTemp("", "fdo.download_*")
@@ -129,6 +221,54 @@ func (d *Download) createTemp() error {
 	return nil
 }
 
+// partialPath returns the file used to persist the download, if resuming is
+// enabled and the name and checksum are known.
+func (d *Download) partialPath() (string, bool) {
+	if d.PartialDir == "" || d.name == "" || len(d.sha384) == 0 {
+		return "", false
+	}
+	key := sha256.Sum256(append([]byte(d.name+"\x00"), d.sha384...))
+	return filepath.Join(d.PartialDir, "fdo.download_"+hex.EncodeToString(key[:16])+".part"), true
+}
+
+// openPartial continues a download persisted in a previous session. If there
+// is no partial download, then nothing is done.
+func (d *Download) openPartial(ctx context.Context) error {
+	if d.temp != nil {
+		return fmt.Errorf("resume received after data")
+	}
+	path, ok := d.partialPath()
+	if !ok {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error opening partial download: %w", err)
+	}
+
+	// Rehash the downloaded bytes, discarding any beyond the expected length
+	n, err := io.Copy(d.hash, io.LimitReader(f, int64(d.length)))
+	if err == nil {
+		err = f.Truncate(n)
+	}
+	if err == nil {
+		_, err = f.Seek(n, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		d.hash.Reset()
+		return fmt.Errorf("error reading partial download: %w", err)
+	}
+
+	d.temp, d.partial, d.written = f, true, int(n)
+	if debugEnabled(ctx) {
+		protocol.LoggerFromContext(ctx).WithGroup("fdo.download").Debug("resuming", "written", d.written, "length", d.length)
+	}
+	return nil
+}
+
 func (d *Download) finalize(respond func(string) io.Writer) error {
 	defer d.reset()
 
@@ -137,9 +277,11 @@ func (d *Download) finalize(respond func(string) io.Writer) error {
 		if d.ErrorLog != nil {
 			_, _ = fmt.Fprintf(d.ErrorLog, "[file=%s] %d bytes written, expected a length of %d\n", d.name, d.written, d.length)
 		}
+		d.discard()
 		return cbor.NewEncoder(respond("done")).Encode(-1)
 	}
 	if hashed := d.hash.Sum(nil); len(d.sha384) > 0 && !bytes.Equal(hashed, d.sha384) {
+		d.discard()
 		if d.ErrorLog != nil {
 			_, _ = fmt.Fprintf(d.ErrorLog, "[file=%s] checksum failed verification\nexp: %x\ngot: %x\n", d.name, d.sha384, hashed)
 		}
@@ -157,27 +299,96 @@ func (d *Download) finalize(respond func(string) io.Writer) error {
 		}
 		return fmt.Errorf("name not sent before data transfer completed")
 	}
-	if err := os.Rename(d.temp.Name(), resolveName(d.name)); err != nil {
+	if d.archive != "" {
+		return d.unpack(resolveName(d.name), respond)
+	}
+
+	// Stage the rename of the temp file to the final file name. Partial
+	// downloads are kept on abort, so that they may be resumed.
+	if err := d.temp.Close(); err != nil {
 		if d.ErrorLog != nil {
-			_, _ = fmt.Fprintf(d.ErrorLog, "[file=%s] error renaming file: %v\n", d.name, err)
+			_, _ = fmt.Fprintf(d.ErrorLog, "[file=%s] error closing file: %v\n", d.name, err)
 		}
 		return cbor.NewEncoder(respond("done")).Encode(-1)
 	}
+	temp, dest, partial := d.temp.Name(), resolveName(d.name), d.partial
+	d.temp = nil
+	d.stage(func(context.Context) error {
+		return os.Rename(temp, dest)
+	}, func(context.Context) error {
+		if partial {
+			return nil
+		}
+		return os.Remove(temp)
+	})
 
 	// Send done message
 	return cbor.NewEncoder(respond("done")).Encode(d.written)
 }
 
+func (d *Download) unpack(dir string, respond func(string) io.Writer) error {
+	// The archive is removed whether or not it is unpacked successfully
+	d.discard()
+
+	if _, err := d.temp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading downloaded archive: %w", err)
+	}
+
+	// Unpack to a staging directory next to the destination, so that it can
+	// be moved into place on commit
+	staging, err := d.unpackStaging(dir)
+	if err != nil {
+		if d.ErrorLog != nil {
+			_, _ = fmt.Fprintf(d.ErrorLog, "[file=%s] error unpacking archive: %v\n", d.name, err)
+		}
+		return cbor.NewEncoder(respond("done")).Encode(-1)
+	}
+	d.stage(func(context.Context) error {
+		return mergeDir(staging, dir)
+	}, func(context.Context) error {
+		return os.RemoveAll(staging)
+	})
+	return cbor.NewEncoder(respond("done")).Encode(d.written)
+}
+
+func (d *Download) unpackStaging(dir string) (string, error) {
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp(parent, ".fdo.download_*")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(staging, 0o755); err != nil {
+		_ = os.RemoveAll(staging)
+		return "", err
+	}
+	if err := unpackArchive(d.temp, staging, d.archive, d.ArchiveLimits); err != nil {
+		_ = os.RemoveAll(staging)
+		return "", err
+	}
+	return staging, nil
+}
+
+// discard removes the downloaded file, even if it is a partial download
+// which would otherwise be kept for resuming.
+func (d *Download) discard() {
+	d.partial = false
+}
+
 func (d *Download) reset() {
 	if d.temp != nil {
 		_ = d.temp.Close()
-		_ = os.Remove(d.temp.Name())
+		if !d.partial {
+			_ = os.Remove(d.temp.Name())
+		}
 	}
 	if d.hash == nil {
 		d.hash = sha512.New384()
 	}
 	d.hash.Reset()
-	d.name, d.length, d.sha384, d.temp, d.written = "", 0, nil, nil, 0
+	d.name, d.length, d.sha384, d.archive, d.temp, d.partial, d.written = "", 0, nil, "", nil, false, 0
 }
 
 // Yield implements serviceinfo.DeviceModule.
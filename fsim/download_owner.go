@@ -25,11 +25,27 @@ type DownloadContents[T io.ReadSeeker] struct {
 	// Defaults to 1014, by spec
 	ChunkSize int
 
+	// Resume sends the resume extension message (see [Download]), so that a
+	// device which persisted a partial download in a previous session only
+	// receives the remaining contents. The message is only sent to devices
+	// which send [DownloadResumeExtension] in devmod, so it is safe to set for
+	// devices which do not support the extension.
+	Resume bool
+
+	// Archive optionally indicates that Contents is an archive, such as one
+	// created by [WriteArchive], which the device unpacks into the directory
+	// given by Name. Devices which do not support this extension (see
+	// [Download]) will fail on the unknown message.
+	Archive ArchiveFormat
+
 	// internal state
-	started bool
-	chunk   []byte
-	index   int64
-	done    bool
+	started  bool
+	resuming bool
+	resumed  bool
+	length   int64
+	chunk    []byte
+	index    int64
+	done     bool
 }
 
 var _ serviceinfo.OwnerModule = (*DownloadContents[io.ReadSeekCloser])(nil)
@@ -47,6 +63,17 @@ func (d *DownloadContents[T]) HandleInfo(ctx context.Context, messageName string
 		}
 		return nil
 
+	case "offset":
+		var offset int64
+		if err := cbor.NewDecoder(messageBody).Decode(&offset); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if offset < 0 || offset > d.length {
+			return fmt.Errorf("device resumed at offset %d, expected at most %d", offset, d.length)
+		}
+		d.index, d.resumed = offset, true
+		return nil
+
 	case "done":
 		defer func() {
 			if closer, ok := any(d.Contents).(io.Closer); ok {
@@ -80,6 +107,10 @@ func (d *DownloadContents[T]) ProduceInfo(ctx context.Context, producer *service
 	}
 
 	if d.started {
+		if d.resuming && !d.resumed {
+			// Wait for the device to respond with the offset to resume at
+			return false, false, nil
+		}
 		return d.sendData(producer)
 	}
 
@@ -95,8 +126,21 @@ func (d *DownloadContents[T]) ProduceInfo(ctx context.Context, producer *service
 		"name":    d.Name,
 		"length":  length,
 		"sha-384": sha384.Sum(nil)[:],
+		"resume":  true,
+		"archive": d.Archive,
 	}
-	for _, messageName := range []string{"active", "name", "length", "sha-384"} {
+	messageNames := []string{"active", "name", "length", "sha-384"}
+	if d.Archive != "" {
+		if err := d.Archive.validate(); err != nil {
+			return false, false, err
+		}
+		messageNames = append(messageNames, "archive")
+	}
+	if d.Resume && deviceSupportsResume(ctx) {
+		messageNames = append(messageNames, "resume")
+		d.resuming = true
+	}
+	for _, messageName := range messageNames {
 		messageBody, err := cbor.Marshal(messageVal[messageName])
 		if err != nil {
 			return false, false, err
@@ -114,15 +158,33 @@ func (d *DownloadContents[T]) ProduceInfo(ctx context.Context, producer *service
 	}
 
 	// Prepare for data to be sent on the next ProduceInfo
-	maxChunkSize := 1014
+	d.chunk = make([]byte, d.maxChunkSize())
+	d.length = length
+	d.started = true
+	return false, false, nil
+}
+
+// deviceSupportsResume reports whether the device advertised the resume
+// extension in devmod.
+func deviceSupportsResume(ctx context.Context) bool {
+	devmod, ok := serviceinfo.DevmodFromContext(ctx)
+	if !ok {
+		return false
+	}
+	var resume bool
+	if ok, err := devmod.Extension(DownloadResumeExtension.Name, &resume); err != nil || !ok {
+		return false
+	}
+	return resume
+}
+
+func (d *DownloadContents[T]) maxChunkSize() int {
 	if d.ChunkSize > 0 {
-		maxChunkSize = d.ChunkSize
+		return d.ChunkSize
 	} else if d.ChunkSize < 0 {
-		maxChunkSize = (1 << 16) - 1
+		return (1 << 16) - 1
 	}
-	d.chunk = make([]byte, maxChunkSize)
-	d.started = true
-	return false, false, nil
+	return 1014
 }
 
 func (d *DownloadContents[T]) sendData(producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
@@ -158,3 +220,39 @@ func (d *DownloadContents[T]) sendData(producer *serviceinfo.Producer) (blockPee
 	// Write the message
 	return false, false, producer.WriteChunk(messageName, messageBody)
 }
+
+type downloadState struct {
+	Started  bool
+	Resumed  bool
+	Length   int64
+	Index    int64
+	Done     bool
+	Resuming bool `cbor:",omitempty"`
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. Contents is read again
+// from the current index after the module is restored.
+func (d *DownloadContents[T]) MarshalBinary() ([]byte, error) {
+	return cbor.Marshal(downloadState{
+		Started:  d.started,
+		Resumed:  d.resumed,
+		Length:   d.length,
+		Index:    d.index,
+		Done:     d.done,
+		Resuming: d.resuming,
+	})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (d *DownloadContents[T]) UnmarshalBinary(data []byte) error {
+	var state downloadState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	d.started, d.resumed, d.length, d.index, d.done = state.Started, state.Resumed, state.Length, state.Index, state.Done
+	d.resuming = state.Resuming
+	if d.started {
+		d.chunk = make([]byte, d.maxChunkSize())
+	}
+	return nil
+}
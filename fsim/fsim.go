@@ -4,13 +4,62 @@
 // Package fsim implements common FSIM modules defined in
 // https://github.com/fido-alliance/fdo-sim/tree/main/fsim-repository as well
 // as plugin modules as defined in plugin/README.md.
+//
+// Owner modules implement [encoding.BinaryMarshaler] and
+// [encoding.BinaryUnmarshaler] for their internal state only, so that an owner
+// service may persist and restore them (see serviceinfo.ModuleRestorer).
+// State is restored into a module which was created with the same exported
+// fields.
 package fsim
 
 import (
 	"context"
 	"log/slog"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
 
-func debugEnabled() bool {
-	return slog.Default().Enabled(context.Background(), slog.LevelDebug)
+func debugEnabled(ctx context.Context) bool {
+	return protocol.LoggerFromContext(ctx).Enabled(ctx, slog.LevelDebug)
+}
+
+// writeQueue writes queued messages until the producer is full. Messages
+// larger than the space available are split across multiple service info,
+// in which case blockPeer is true so that the device concatenates them.
+func writeQueue(producer *serviceinfo.Producer, queue *[]*serviceinfo.KV) (blockPeer bool, _ error) {
+	for len(*queue) > 0 {
+		next := (*queue)[0]
+		n := bstrFits(producer.Available(next.Key))
+		if n < 1 {
+			return false, nil
+		}
+		if len(next.Val) <= n {
+			if err := producer.WriteChunk(next.Key, next.Val); err != nil {
+				return false, err
+			}
+			*queue = (*queue)[1:]
+			continue
+		}
+		// Split the message body and continue in the next round
+		if err := producer.WriteChunk(next.Key, next.Val[:n]); err != nil {
+			return false, err
+		}
+		next.Val = next.Val[n:]
+		return true, nil
+	}
+	return false, nil
+}
+
+// bstrFits returns the length of the largest message body which fits in the
+// bytes available, including its CBOR byte string header.
+func bstrFits(available int) int {
+	switch {
+	case available <= 24:
+		return available - 1
+	case available <= 257:
+		return available - 2
+	default:
+		return available - 3
+	}
 }
@@ -4,24 +4,40 @@
 package fsim_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha512"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"iter"
 	"log"
 	"math"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"testing/fstest"
 	"time"
@@ -156,6 +172,394 @@ func TestClientWithDataModules(t *testing.T) {
 	}
 }
 
+func TestClientWithResumedDownload(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("Hello World!\n"), 1024)
+	sum := sha512.Sum384(data)
+	half := int64(len(data) / 2)
+
+	download := &fsim.Download{
+		NameToPath: func(name string) string { return filepath.Join(dir, name) },
+		PartialDir: filepath.Join(dir, "partial"),
+		ErrorLog:   fdotest.TestingLog(t),
+	}
+
+	// Simulate a session which failed part way through the download
+	if err := download.Transition(true); err != nil {
+		t.Fatal(err)
+	}
+	respond := func(string) io.Writer { return io.Discard }
+	for _, msg := range []struct {
+		name string
+		val  any
+	}{
+		{"name", "resumed.test"},
+		{"length", len(data)},
+		{"sha-384", sum[:]},
+		{"data", data[:half]},
+	} {
+		body, err := cbor.Marshal(msg.val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := download.Receive(context.TODO(), msg.name, bytes.NewReader(body), respond, func() {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := download.Transition(false); err != nil {
+		t.Fatal(err)
+	}
+
+	var seeks []int64
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.download": download,
+		},
+		DeviceDevmod: download.AdvertiseResume,
+		DevmodSchema: &serviceinfo.DevmodSchema{
+			Extensions: []serviceinfo.DevmodExtension{fsim.DownloadResumeExtension},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.download", &fsim.DownloadContents[*seekRecorder]{
+					Name:         "resumed.test",
+					Contents:     &seekRecorder{Reader: bytes.NewReader(data), seeks: &seeks},
+					MustDownload: true,
+					Resume:       true,
+				})
+			}
+		},
+	})
+
+	if len(seeks) == 0 || seeks[0] != half {
+		t.Errorf("expected first data chunk to be read at offset %d, got seeks %v", half, seeks)
+	}
+	contents, err := os.ReadFile(filepath.Join(dir, "resumed.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, data) {
+		t.Fatal("download contents did not match expected")
+	}
+	if partials, _ := os.ReadDir(filepath.Join(dir, "partial")); len(partials) > 0 {
+		t.Errorf("expected partial downloads to be removed, found %d", len(partials))
+	}
+}
+
+func TestClientWithResumeUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("Hello World!\n"), 1024)
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.download": noResumeDownload{&fsim.Download{
+				NameToPath: func(name string) string { return filepath.Join(dir, name) },
+				ErrorLog:   fdotest.TestingLog(t),
+			}},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.download", &fsim.DownloadContents[*bytes.Reader]{
+					Name:         "download.test",
+					Contents:     bytes.NewReader(data),
+					MustDownload: true,
+					Resume:       true,
+				})
+			}
+		},
+	})
+
+	contents, err := os.ReadFile(filepath.Join(dir, "download.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, data) {
+		t.Fatal("download contents did not match expected")
+	}
+}
+
+// noResumeDownload behaves like a device which does not implement the resume
+// extension and fails on the unknown message.
+type noResumeDownload struct{ *fsim.Download }
+
+func (d noResumeDownload) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	if messageName == "resume" {
+		return fmt.Errorf("unknown message %s", messageName)
+	}
+	return d.Download.Receive(ctx, messageName, messageBody, respond, yield)
+}
+
+type seekRecorder struct {
+	*bytes.Reader
+	seeks *[]int64
+}
+
+func (r *seekRecorder) Seek(offset int64, whence int) (int64, error) {
+	*r.seeks = append(*r.seeks, offset)
+	return r.Reader.Seek(offset, whence)
+}
+
+func TestClientWithArchiveModules(t *testing.T) {
+	dir := t.TempDir()
+	fsys := fstest.MapFS{
+		"var/log/messages":      &fstest.MapFile{Data: []byte("boot\n"), Mode: 0644},
+		"var/log/app/app.log":   &fstest.MapFile{Data: bytes.Repeat([]byte("Hello World!\n"), 1024), Mode: 0600},
+		"var/log/app/old.log":   &fstest.MapFile{Data: []byte("old\n"), Mode: 0644},
+		"var/log/ignored.trace": &fstest.MapFile{Data: []byte("trace\n"), Mode: 0644},
+	}
+
+	var archive bytes.Buffer
+	if err := fsim.WriteArchive(&archive, fsys, "var/log/app", fsim.ArchiveTar); err != nil {
+		t.Fatal(err)
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.download": &fsim.Download{
+				NameToPath: func(name string) string { return filepath.Join(dir, "downloads", name) },
+				ErrorLog:   fdotest.TestingLog(t),
+			},
+			"fdo.upload": &fsim.Upload{FS: fsys},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				if !yield("fdo.download", &fsim.DownloadContents[*bytes.Reader]{
+					Name:         "unpacked",
+					Contents:     bytes.NewReader(archive.Bytes()),
+					MustDownload: true,
+					Archive:      fsim.ArchiveTar,
+				}) {
+					return
+				}
+				yield("fdo.upload", &fsim.UploadRequest{
+					Dir:     filepath.Join(dir, "uploads"),
+					Name:    "var/log/*[^e]",
+					Archive: fsim.ArchiveTarGzip,
+				})
+			}
+		},
+	})
+
+	for path, expect := range map[string]*fstest.MapFile{
+		"downloads/unpacked/var/log/app/app.log": fsys["var/log/app/app.log"],
+		"downloads/unpacked/var/log/app/old.log": fsys["var/log/app/old.log"],
+		"uploads/var/log/messages":               fsys["var/log/messages"],
+		"uploads/var/log/app/app.log":            fsys["var/log/app/app.log"],
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(got, expect.Data) {
+			t.Errorf("%s: contents did not match expected", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "uploads/var/log/ignored.trace")); err == nil {
+		t.Error("expected file not matching glob to not be uploaded")
+	}
+}
+
+func TestDownloadArchiveTraversal(t *testing.T) {
+	dir := t.TempDir()
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, name := range []string{"ok.txt", "../escaped.txt"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 2, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha512.Sum384(archive.Bytes())
+
+	download := &fsim.Download{
+		NameToPath: func(name string) string { return filepath.Join(dir, name) },
+	}
+	if err := download.Transition(true); err != nil {
+		t.Fatal(err)
+	}
+	var done bytes.Buffer
+	respond := func(string) io.Writer { return &done }
+	for _, msg := range []struct {
+		name string
+		val  any
+	}{
+		{"name", "unpacked"},
+		{"length", archive.Len()},
+		{"sha-384", sum[:]},
+		{"archive", "tar"},
+		{"data", archive.Bytes()},
+	} {
+		body, err := cbor.Marshal(msg.val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := download.Receive(context.TODO(), msg.name, bytes.NewReader(body), respond, func() {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var result int
+	if err := cbor.Unmarshal(done.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result != -1 {
+		t.Errorf("expected download to fail, got %d", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); err == nil {
+		t.Error("archive entry was unpacked outside of the destination")
+	}
+}
+
+func TestDownloadTransaction(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("staged until TO2 completes")
+	sum := sha512.Sum384(data)
+
+	download := &fsim.Download{
+		CreateTemp: func() (*os.File, error) { return os.CreateTemp(dir, ".tmp_*") },
+		NameToPath: func(name string) string { return filepath.Join(dir, name) },
+	}
+	receive := func() {
+		if err := download.Transition(true); err != nil {
+			t.Fatal(err)
+		}
+		respond := func(string) io.Writer { return io.Discard }
+		for _, msg := range []struct {
+			name string
+			val  any
+		}{
+			{"name", "file.txt"},
+			{"length", len(data)},
+			{"sha-384", sum[:]},
+			{"data", data},
+		} {
+			body, err := cbor.Marshal(msg.val)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := download.Receive(context.TODO(), msg.name, bytes.NewReader(body), respond, func() {}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "file.txt")); err == nil {
+			t.Fatal("expected file not to be written before commit")
+		}
+	}
+
+	// Aborting removes the downloaded file
+	receive()
+	if err := download.Abort(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatalf("expected no files after abort, got %d", len(entries))
+	}
+
+	// Committing moves it into place
+	receive()
+	if err := download.Commit(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected %q, got %q", data, got)
+	}
+}
+
+func TestClientWithArtifactServer(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("Hello World!\n"), 1024)
+	artifacts := &fsim.ArtifactServer{
+		FS:  fstest.MapFS{"images/firmware.bin": &fstest.MapFile{Data: data, Mode: 0644}},
+		Key: bytes.Repeat([]byte{0x42}, 32),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/artifacts/", artifacts)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	artifacts.BaseURL, _ = url.Parse(srv.URL + "/artifacts/")
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.wget": &fsim.Wget{
+				NameToPath: func(name string) string { return filepath.Join(dir, name) },
+				Timeout:    10 * time.Second,
+			},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.wget", &fsim.WgetArtifact{Server: artifacts, Artifact: "images/firmware.bin"})
+			}
+		},
+	})
+
+	contents, err := os.ReadFile(filepath.Join(dir, "firmware.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, data) {
+		t.Fatal("wget contents did not match expected")
+	}
+}
+
+func TestArtifactServerURLs(t *testing.T) {
+	artifacts := &fsim.ArtifactServer{
+		FS:      fstest.MapFS{"a.bin": &fstest.MapFile{Data: []byte("a")}, "b.bin": &fstest.MapFile{Data: []byte("b")}},
+		Key:     bytes.Repeat([]byte{0x42}, 32),
+		BaseURL: &url.URL{Scheme: "http", Host: "owner.example", Path: "/artifacts"},
+	}
+	get := func(u *url.URL) int {
+		rec := httptest.NewRecorder()
+		artifacts.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u.String(), nil))
+		return rec.Code
+	}
+	guid := protocol.GUID{1, 2, 3}
+
+	valid, err := artifacts.URL(guid, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(valid); code != http.StatusOK {
+		t.Errorf("valid URL: expected status 200, got %d", code)
+	}
+
+	otherFile := *valid
+	otherFile.Path = "/artifacts/b.bin"
+	if code := get(&otherFile); code != http.StatusForbidden {
+		t.Errorf("other artifact: expected status 403, got %d", code)
+	}
+
+	otherGUID := *valid
+	query := otherGUID.Query()
+	query.Set("guid", hex.EncodeToString(make([]byte, 16)))
+	otherGUID.RawQuery = query.Encode()
+	if code := get(&otherGUID); code != http.StatusForbidden {
+		t.Errorf("other GUID: expected status 403, got %d", code)
+	}
+
+	artifacts.TTL = time.Nanosecond
+	expiring, err := artifacts.URL(guid, "a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if code := get(expiring); code != http.StatusForbidden {
+		t.Errorf("expired URL: expected status 403, got %d", code)
+	}
+}
+
 func TestClientWithMockDownloadOwner(t *testing.T) {
 	var (
 		firstTime = true
@@ -310,6 +714,538 @@ func TestClientWithCommandModule(t *testing.T) {
 	}
 }
 
+func TestClientWithCommandExtensions(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	dir := t.TempDir()
+	stdin := bytes.Repeat([]byte("input\n"), 1000)
+
+	var stdout, stderr bytes.Buffer
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.command": &fsim.Command{
+				Timeout: 10 * time.Second,
+				Policy:  fsim.CommandPolicy{Executables: []string{sh}}.Apply,
+			},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				stdout.Reset()
+				stderr.Reset()
+				yield("fdo.command", &fsim.RunCommand{
+					Command: "sh",
+					Args:    []string{"-c", `echo "$GREETING"; pwd; wc -l; printf partial >&2`},
+					Env:     []string{"GREETING=hello"},
+					Dir:     dir,
+					Stdin:   bytes.NewReader(stdin),
+					Stdout:  &stdout,
+					Stderr:  &stderr,
+				})
+			}
+		},
+	})
+
+	fields := strings.Fields(stdout.String())
+	if len(fields) != 3 || fields[0] != "hello" || fields[2] != "1000" {
+		t.Fatalf("unexpected stdout %q", stdout.String())
+	}
+	if got, err := filepath.EvalSymlinks(fields[1]); err != nil || got != mustEvalSymlinks(t, dir) {
+		t.Errorf("expected working directory %q, got %q", dir, fields[1])
+	}
+	if stderr.String() != "partial" {
+		t.Errorf("expected partial line on stderr, got %q", stderr.String())
+	}
+}
+
+func TestCommandPolicy(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	policy := fsim.CommandPolicy{Executables: []string{sh}, DenyDir: true}
+
+	if err := policy.Apply(exec.Command("sh", "-c", "true")); err != nil {
+		t.Errorf("expected sh to be allowed: %v", err)
+	}
+	if err := policy.Apply(exec.Command("go", "version")); err == nil {
+		t.Error("expected executable not in allowlist to be rejected")
+	}
+	cmd := exec.Command("sh", "-c", "true")
+	cmd.Dir = t.TempDir()
+	if err := policy.Apply(cmd); err == nil {
+		t.Error("expected working directory to be rejected")
+	}
+
+	// A relative path is resolved against the owner-set working directory
+	// when run, so it must not match the allowlist
+	dirPolicy := fsim.CommandPolicy{Executables: []string{sh}}
+	for _, name := range []string{"./sh", strings.TrimPrefix(sh, "/")} {
+		cmd := exec.Command(name, "-c", "true")
+		cmd.Dir = "/"
+		if err := dirPolicy.Apply(cmd); err == nil {
+			t.Errorf("expected relative path %q with working directory to be rejected", name)
+		}
+	}
+
+	// Env is set as by the fdo.command device module
+	for _, env := range []string{"LD_PRELOAD=/tmp/evil.so", "LD_LIBRARY_PATH=/tmp", "DYLD_INSERT_LIBRARIES=/tmp/evil.dylib"} {
+		cmd := exec.Command("sh", "-c", "true")
+		cmd.Env = append(os.Environ(), env)
+		if err := policy.Apply(cmd); err == nil {
+			t.Errorf("expected %s to be rejected", env)
+		}
+	}
+	cmd = exec.Command("sh", "-c", "true")
+	cmd.Env = append(os.Environ(), "GREETING=hello")
+	if err := policy.Apply(cmd); err != nil {
+		t.Errorf("expected other environment variables to be allowed: %v", err)
+	}
+}
+
+func mustEvalSymlinks(t *testing.T, path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolved
+}
+
+func TestClientWithInteropModule(t *testing.T) {
+	var results []error
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fido_alliance": &fsim.Interop{},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fido_alliance", &fsim.InteropConformance{
+					Token: "test-token",
+					Result: func(ctx context.Context, guid protocol.GUID, err error) {
+						if guid == (protocol.GUID{}) {
+							t.Error("expected device GUID in result")
+						}
+						results = append(results, err)
+					},
+				})
+			}
+		},
+	})
+
+	if len(results) == 0 {
+		t.Fatal("expected interop results to be reported")
+	}
+	for _, err := range results {
+		if err != nil {
+			t.Errorf("expected interop success, got %v", err)
+		}
+	}
+}
+
+type failingInterop struct{ fsim.Interop }
+
+func (d *failingInterop) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	if messageName == "dev_conformance" {
+		return errors.New("conformance token rejected")
+	}
+	return d.Interop.Receive(ctx, messageName, messageBody, respond, yield)
+}
+
+func TestClientWithFailedInteropModule(t *testing.T) {
+	var results []error
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fido_alliance": &failingInterop{},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fido_alliance", &fsim.InteropConformance{
+					Token: "test-token",
+					Result: func(ctx context.Context, guid protocol.GUID, err error) {
+						if guid == (protocol.GUID{}) {
+							t.Error("expected device GUID in result")
+						}
+						results = append(results, err)
+					},
+				})
+			}
+		},
+		CustomExpect: func(t *testing.T, err error) {
+			if err == nil {
+				t.Error("expected TO2 to fail when the device rejects the token")
+			}
+		},
+	})
+
+	if len(results) == 0 {
+		t.Fatal("expected interop failures to be reported")
+	}
+	for _, err := range results {
+		if err == nil {
+			t.Error("expected interop failure, got success")
+		}
+	}
+}
+
+func TestClientWithSysConfigModule(t *testing.T) {
+	root := t.TempDir()
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.sysconfig": &fsim.SysConfig{Root: root},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.sysconfig", &fsim.SetSysConfig{
+					Hostname:  "device-01.example.com",
+					Timezone:  "America/Los_Angeles",
+					NTPServer: "pool.ntp.org",
+					Locale:    "en_US.UTF-8",
+				})
+			}
+		},
+	})
+
+	for name, expect := range map[string]string{
+		"etc/hostname": "device-01.example.com\n",
+		"etc/timezone": "America/Los_Angeles\n",
+		"etc/systemd/timesyncd.conf.d/fdo-sysconfig.conf": "[Time]\nNTP=pool.ntp.org\n",
+		"etc/locale.conf": "LANG=en_US.UTF-8\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expect {
+			t.Errorf("expected %s to contain %q, got %q", name, expect, got)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(root, "etc", "localtime")); err != nil {
+		t.Fatal(err)
+	} else if target != "/usr/share/zoneinfo/America/Los_Angeles" {
+		t.Errorf("expected localtime to link to zoneinfo, got %q", target)
+	}
+}
+
+func TestClientWithSSHKeyModule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".ssh", "authorized_keys")
+	existing, operator, selected := testSSHKey(t, "existing"), testSSHKey(t, "operator"), testSSHKey(t, "selected")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("# managed by test\n"+existing+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.sshkey": &fsim.SSHKey{Path: path},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.sshkey", &fsim.AuthorizeSSHKeys{
+					Keys: []string{existing, operator},
+					Select: func(ctx context.Context, guid protocol.GUID, devmod *serviceinfo.Devmod) ([]string, error) {
+						if guid == (protocol.GUID{}) || devmod == nil {
+							return nil, fmt.Errorf("missing GUID or devmod")
+						}
+						return []string{selected}, nil
+					},
+				})
+			}
+		},
+	})
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "# managed by test\n" + existing + "\n" + operator + "\n" + selected + "\n"; string(got) != expect {
+		t.Errorf("expected authorized_keys\n%s\ngot\n%s", expect, got)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("expected authorized_keys mode 0600, got %s", info.Mode())
+	}
+}
+
+func TestClientWithWifiModule(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	// Make the certificate larger than the MTU to test chunking
+	for i := range 100 {
+		template.DNSNames = append(template.DNSNames, fmt.Sprintf("device-%03d.example.com", i))
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.wifi": &fsim.Wifi{Configurer: fsim.NMKeyfileWriter{Dir: dir}},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.wifi", &fsim.ProvisionWifi{
+					Networks: []fsim.WifiNetwork{
+						{
+							SSID:     "Home Network",
+							Security: fsim.WifiWPA2PSK,
+							PSK:      "correct horse battery staple",
+						},
+						{
+							SSID:     "corp",
+							Security: fsim.WifiWPA2Enterprise,
+							Hidden:   true,
+							EAP: &fsim.WifiEAP{
+								Method:     "tls",
+								Identity:   "device@example.com",
+								CACert:     cert,
+								ClientCert: cert,
+								ClientKey:  keyDER,
+							},
+						},
+					},
+				})
+			}
+		},
+	})
+
+	profiles, err := filepath.Glob(filepath.Join(dir, "*.nmconnection"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("expected 2 profiles, got %v", profiles)
+	}
+	var all string
+	for _, profile := range profiles {
+		info, err := os.Stat(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected %s to have mode 0600, got %s", profile, info.Mode())
+		}
+		contents, err := os.ReadFile(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all += string(contents)
+	}
+	for _, expect := range []string{
+		"ssid=Home Network\n",
+		"key-mgmt=wpa-psk\npsk=correct horse battery staple\n",
+		"ssid=corp\nhidden=true\n",
+		"key-mgmt=wpa-eap\n",
+		"eap=tls\nidentity=device@example.com\n",
+		"private-key-password-flags=4\n",
+	} {
+		if !strings.Contains(all, expect) {
+			t.Errorf("expected profiles to contain %q", expect)
+		}
+	}
+	if t.Failed() {
+		t.Log(all)
+	}
+
+	keyFiles, err := filepath.Glob(filepath.Join(dir, "*-client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyFiles) != 1 {
+		t.Fatalf("expected 1 private key file, got %v", keyFiles)
+	}
+	keyPEM, err := os.ReadFile(keyFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(keyPEM); block == nil || !bytes.Equal(block.Bytes, keyDER) {
+		t.Error("expected private key file to contain the client key")
+	}
+}
+
+func TestClientWithCertEnrollModule(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "device.crt"), filepath.Join(dir, "device.key")
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Device CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.certenroll": &fsim.CertEnroll{
+				Template: &x509.CertificateRequest{DNSNames: []string{"device.example.com"}},
+				CertPath: certPath,
+				KeyPath:  keyPath,
+			},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.certenroll", &fsim.EnrollCertificate{
+					CA: &fsim.LocalCA{Key: caKey, Chain: []*x509.Certificate{caCert}},
+					Policy: func(ctx context.Context, guid protocol.GUID, devmod *serviceinfo.Devmod) (*fsim.CertPolicy, error) {
+						return &fsim.CertPolicy{
+							CommonName: guid.String(),
+							DNSNames:   []string{"device.example.com"},
+						}, nil
+					},
+				})
+			}
+		},
+	})
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("expected certificate file to contain a PEM certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(rest); block == nil || !bytes.Equal(block.Bytes, caDER) {
+		t.Error("expected certificate file to contain the CA certificate")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "device.example.com", Roots: roots}); err != nil {
+		t.Errorf("error verifying issued certificate: %v", err)
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		t.Fatal("expected key file to contain a PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.(*ecdsa.PrivateKey).PublicKey.Equal(leaf.PublicKey) {
+		t.Error("expected private key to match the issued certificate")
+	}
+}
+
+func TestCertPolicy(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &fsim.CertPolicy{
+		CommonName:  "device",
+		DNSNames:    []string{"device.example.com"},
+		IPAddresses: []net.IP{net.IPv4(192, 0, 2, 1)},
+	}
+	for _, test := range []struct {
+		name    string
+		csr     *x509.CertificateRequest
+		allowed bool
+	}{
+		{"Subset", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device"}}, true},
+		{"All SANs", &x509.CertificateRequest{
+			Subject:     pkix.Name{CommonName: "device"},
+			DNSNames:    []string{"device.example.com"},
+			IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+		}, true},
+		{"Common Name", &x509.CertificateRequest{Subject: pkix.Name{CommonName: "other"}}, false},
+		{"DNS Name", &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: "device"},
+			DNSNames: []string{"other.example.com"},
+		}, false},
+		{"IP Address", &x509.CertificateRequest{
+			Subject:     pkix.Name{CommonName: "device"},
+			IPAddresses: []net.IP{net.ParseIP("192.0.2.2")},
+		}, false},
+		{"Organizational Unit", &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "device", OrganizationalUnit: []string{"admins"}},
+		}, false},
+		{"Extra Names", &x509.CertificateRequest{
+			Subject: pkix.Name{
+				CommonName: "device",
+				ExtraNames: []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{2, 5, 4, 5}, Value: "1234"}},
+			},
+		}, false},
+		{"Second Common Name", &x509.CertificateRequest{
+			Subject: pkix.Name{
+				CommonName: "device",
+				ExtraNames: []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{2, 5, 4, 3}, Value: "other"}},
+			},
+		}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			der, err := x509.CreateCertificateRequest(rand.Reader, test.csr, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := policy.Check(csr); (err == nil) != test.allowed {
+				t.Errorf("expected allowed=%t, got error %v", test.allowed, err)
+			}
+		})
+	}
+}
+
+// testSSHKey returns a random ed25519 public key in authorized_keys format.
+func testSSHKey(t *testing.T, comment string) string {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const typ = "ssh-ed25519"
+	var blob []byte
+	blob = binary.BigEndian.AppendUint32(blob, uint32(len(typ)))
+	blob = append(blob, typ...)
+	blob = binary.BigEndian.AppendUint32(blob, uint32(len(pub)))
+	blob = append(blob, pub...)
+	return typ + " " + base64.StdEncoding.EncodeToString(blob) + " " + comment
+}
+
 func tryDebugNotation(b []byte) string {
 	d, err := cdn.FromCBOR(b)
 	if err != nil {
@@ -317,3 +1253,177 @@ func tryDebugNotation(b []byte) string {
 	}
 	return d
 }
+
+func TestClientWithWorkflow(t *testing.T) {
+	t.Run("single owner", func(t *testing.T) { testClientWithWorkflow(t, 1) })
+
+	// Module state is restored from the token on each request
+	t.Run("multiple owners", func(t *testing.T) { testClientWithWorkflow(t, 2) })
+}
+
+func testClientWithWorkflow(t *testing.T, ownerInstances int) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "agent"), []byte("agent binary"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "device"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "conf"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "conf", "agent.conf"), []byte("debug = false\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	workflow, err := fsim.ParseWorkflow(strings.NewReader(fmt.Sprintf(`{
+		"steps": [
+			{
+				"name": "agent",
+				"when": {"devmod": {"arch": %q}},
+				"download": {"file": %q, "name": "agent"}
+			},
+			{
+				"name": "config",
+				"download": {"file": %q, "name": "conf", "archive": "tar"}
+			},
+			{
+				"name": "other-arch",
+				"when": {"devmod": {"arch": "not-*"}},
+				"command": {"command": "false"}
+			},
+			{
+				"name": "unsupported",
+				"wget": {"url": "http://example.com/file", "name": "file"}
+			},
+			{
+				"name": "install",
+				"command": {"command": "sh", "args": ["-c", "echo installed"], "capture_output": true}
+			},
+			{
+				"name": "optional",
+				"may_fail": true,
+				"command": {"command": "sh", "args": ["-c", "exit 3"]}
+			},
+			{
+				"name": "log",
+				"upload": {"name": "agent.log", "dir": %q}
+			}
+		]
+	}`, runtime.GOARCH, filepath.Join(dir, "agent"), filepath.Join(dir, "conf", "*.conf"), filepath.Join(dir, "uploads"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	results := make(map[protocol.GUID]map[string]fsim.WorkflowResult)
+	workflow.Record = func(_ context.Context, guid protocol.GUID, result fsim.WorkflowResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if results[guid] == nil {
+			results[guid] = make(map[string]fsim.WorkflowResult)
+		}
+		results[guid][result.Step] = result
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.download": &fsim.Download{
+				NameToPath: func(name string) string { return filepath.Join(dir, "device", name) },
+			},
+			"fdo.command": &fsim.Command{Timeout: 10 * time.Second},
+			"fdo.upload": &fsim.Upload{FS: fstest.MapFS{
+				"agent.log": &fstest.MapFile{Data: []byte("installed\n")},
+			}},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			guid, _ := serviceinfo.GUIDFromContext(ctx)
+			return workflow.Plan(ctx, &serviceinfo.DeviceInfo{
+				GUID:            guid,
+				ReplacementGUID: replacementGUID,
+				Info:            info,
+				CertChain:       chain,
+				Devmod:          devmod,
+				Modules:         supportedMods,
+			})
+		},
+		OwnerInstances: ownerInstances,
+	})
+
+	if len(results) == 0 {
+		t.Fatal("expected workflow results")
+	}
+	for guid, steps := range results {
+		if len(steps) != 7 {
+			t.Errorf("%s: expected results for 7 steps, got %d", guid, len(steps))
+			continue
+		}
+		if archives, _ := filepath.Glob(filepath.Join(os.TempDir(), "fdo-workflow-"+guid.String()+"-*")); len(archives) > 0 {
+			t.Errorf("%s: expected temporary archives to be removed, got %v", guid, archives)
+		}
+		if steps["install"].Skipped {
+			// Device modules are not enabled in all TO2 runs
+			for name, result := range steps {
+				if !result.Skipped {
+					t.Errorf("%s: expected step %q to be skipped", guid, name)
+				}
+			}
+			continue
+		}
+		for _, name := range []string{"other-arch", "unsupported"} {
+			if !steps[name].Skipped {
+				t.Errorf("%s: expected step %q to be skipped", guid, name)
+			}
+		}
+		if agent := steps["agent"]; agent.Skipped || agent.Err != nil {
+			t.Errorf("%s: unexpected download result %+v", guid, agent)
+		}
+		if config := steps["config"]; config.Skipped || config.Err != nil {
+			t.Errorf("%s: unexpected archive download result %+v", guid, config)
+		}
+		if install := steps["install"]; install.Err != nil || install.ExitCode != 0 || string(install.Stdout) != "installed\n" {
+			t.Errorf("%s: unexpected install result %+v", guid, install)
+		}
+		if optional := steps["optional"]; optional.Err == nil || optional.ExitCode != 3 {
+			t.Errorf("%s: expected optional step to fail with exit code 3, got %+v", guid, optional)
+		}
+		log := steps["log"]
+		if log.Err != nil || len(log.Files) != 1 {
+			t.Errorf("%s: unexpected upload result %+v", guid, log)
+			continue
+		}
+		if got, err := os.ReadFile(log.Files[0]); err != nil {
+			t.Error(err)
+		} else if string(got) != "installed\n" {
+			t.Errorf("%s: expected uploaded log, got %q", guid, got)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "device", "agent")); err != nil {
+		t.Error(err)
+	} else if string(got) != "agent binary" {
+		t.Errorf("expected downloaded agent, got %q", got)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "device", "conf", "agent.conf")); err != nil {
+		t.Error(err)
+	} else if string(got) != "debug = false\n" {
+		t.Errorf("expected downloaded config, got %q", got)
+	}
+}
+
+func TestParseWorkflow(t *testing.T) {
+	for _, tc := range []struct {
+		name, json string
+	}{
+		{"no module", `{"steps": [{"name": "a"}]}`},
+		{"two modules", `{"steps": [{"name": "a", "command": {"command": "true"}, "wget": {"url": "http://x", "name": "x"}}]}`},
+		{"duplicate", `{"steps": [{"name": "a", "command": {"command": "true"}}, {"name": "a", "command": {"command": "true"}}]}`},
+		{"unknown devmod", `{"steps": [{"name": "a", "when": {"devmod": {"cpu": "x"}}, "command": {"command": "true"}}]}`},
+		{"unknown field", `{"steps": [{"name": "a", "shell": "true"}]}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := fsim.ParseWorkflow(strings.NewReader(tc.json)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
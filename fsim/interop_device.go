@@ -7,9 +7,9 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log/slog"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
 
@@ -28,10 +28,10 @@ func (d *Interop) Receive(ctx context.Context, messageName string, messageBody i
 	switch messageName {
 	case "dev_conformance":
 		var token string
-		if err := cbor.NewDecoder(messageBody).Decode(token); err != nil {
+		if err := cbor.NewDecoder(messageBody).Decode(&token); err != nil {
 			return err
 		}
-		slog.Info("FIDO Alliance interop dashboard", "access token", token)
+		protocol.LoggerFromContext(ctx).Info("FIDO Alliance interop dashboard", "access token", token)
 		return nil
 
 	default:
@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// InteropConformance implements the owner side of the FIDO Alliance interop
+// module and should be registered to the "fido_alliance" module. It sends the
+// interop dashboard access token to the device, so that the owner service may
+// be tested against other implementations of the device. See [Interop] for
+// the device side.
+type InteropConformance struct {
+	// Token is the access token issued by the FIDO Alliance interop
+	// dashboard.
+	Token string
+
+	// Result, if set, is called once the exchange completes with the GUID of
+	// the device (before any replacement) and a nil error if the device
+	// accepted the token. If the device fails TO2 after the token was sent,
+	// Result is called with the device's error message.
+	Result func(ctx context.Context, guid protocol.GUID, err error)
+
+	// Internal state
+	sent bool
+	done bool
+}
+
+var _ serviceinfo.AbortableOwnerModule = (*InteropConformance)(nil)
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (i *InteropConformance) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	switch messageName {
+	case "active":
+		var deviceActive bool
+		if err := cbor.NewDecoder(messageBody).Decode(&deviceActive); err != nil {
+			return i.report(ctx, fmt.Errorf("error decoding message %s: %w", messageName, err))
+		}
+		if !deviceActive {
+			return i.report(ctx, fmt.Errorf("device service info module is not active"))
+		}
+		i.done = true
+		return i.report(ctx, nil)
+
+	default:
+		return i.report(ctx, fmt.Errorf("unsupported message %q", messageName))
+	}
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (i *InteropConformance) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	if i.done {
+		return false, true, nil
+	}
+	if i.sent {
+		return false, false, nil
+	}
+
+	if i.Token == "" {
+		return false, false, i.report(ctx, errors.New("interop dashboard access token is required"))
+	}
+	tokenBody, err := cbor.Marshal(i.Token)
+	if err != nil {
+		return false, false, err
+	}
+	if err := producer.WriteChunk("active", []byte{0xf5}); err != nil {
+		return false, false, err
+	}
+	if err := producer.WriteChunk("dev_conformance", tokenBody); err != nil {
+		return false, false, err
+	}
+	i.sent = true
+	return false, false, nil
+}
+
+// Abort implements serviceinfo.AbortableOwnerModule.
+func (i *InteropConformance) Abort(ctx context.Context, err error) {
+	if !i.sent || i.done {
+		return
+	}
+	i.done = true
+	_ = i.report(ctx, fmt.Errorf("device failed conformance: %w", err))
+}
+
+// report calls the result callback, if set, and returns err.
+func (i *InteropConformance) report(ctx context.Context, err error) error {
+	if i.Result != nil {
+		guid, _ := serviceinfo.GUIDFromContext(ctx)
+		i.Result(ctx, guid, err)
+	}
+	return err
+}
+
+type interopState struct {
+	Sent bool
+	Done bool
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (i *InteropConformance) MarshalBinary() ([]byte, error) {
+	return cbor.Marshal(interopState{Sent: i.sent, Done: i.done})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (i *InteropConformance) UnmarshalBinary(data []byte) error {
+	var state interopState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	i.sent, i.done = state.Sent, state.Done
+	return nil
+}
@@ -0,0 +1,251 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// SSHKey implements the fdo.sshkey device module and should be registered to
+// the "fdo.sshkey" module. It installs SSH public keys in an authorized_keys
+// file for a single user.
+//
+// The owner sends:
+//
+//	fdo.sshkey:active   bool
+//	fdo.sshkey:replace  bool     (optional, default false)
+//	fdo.sshkey:keys     [+ tstr] (authorized_keys lines)
+//
+// When keys is received, the device validates the keys and responds with:
+//
+//	fdo.sshkey:done     uint     (number of keys added)
+//
+// The authorized_keys file is written when TO2 completes (see
+// [serviceinfo.TransactionalModule]).
+//
+// Keys which are already present, compared by type and key data, are not
+// added again. If replace is true, then all keys not in the received list are
+// removed.
+type SSHKey struct {
+	// User is the name of the user to authorize keys for. If Path is empty,
+	// the keys are written to .ssh/authorized_keys in the user's home
+	// directory. If the process is running as root, the file is owned by the
+	// user.
+	User string
+
+	// Path optionally overrides the location of the authorized_keys file.
+	Path string
+
+	// Internal state
+	transaction
+	replace bool
+	pending []string // staged lines, read instead of the file
+}
+
+var _ serviceinfo.TransactionalModule = (*SSHKey)(nil)
+
+// Transition implements serviceinfo.DeviceModule.
+func (s *SSHKey) Transition(active bool) error { s.replace = false; return nil }
+
+// Receive implements serviceinfo.DeviceModule.
+func (s *SSHKey) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	switch messageName {
+	case "replace":
+		return cbor.NewDecoder(messageBody).Decode(&s.replace)
+
+	case "keys":
+		var keys []string
+		if err := cbor.NewDecoder(messageBody).Decode(&keys); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		added, err := s.install(keys)
+		if err != nil {
+			return fmt.Errorf("error installing SSH keys: %w", err)
+		}
+		return cbor.NewEncoder(respond("done")).Encode(added)
+
+	default:
+		return fmt.Errorf("unknown message %s", messageName)
+	}
+}
+
+// Yield implements serviceinfo.DeviceModule.
+func (s *SSHKey) Yield(ctx context.Context, respond func(message string) io.Writer, yield func()) error {
+	return nil
+}
+
+// install validates the keys and stages writing the authorized_keys file.
+func (s *SSHKey) install(keys []string) (added int, _ error) {
+	// Validate all keys before modifying any files
+	newKeys := make([]authorizedKey, 0, len(keys))
+	for _, line := range keys {
+		key, ok := parseAuthorizedKey(line)
+		if !ok {
+			return 0, fmt.Errorf("invalid authorized key %q", line)
+		}
+		newKeys = append(newKeys, key)
+	}
+
+	path, uid, gid, err := s.lookup()
+	if err != nil {
+		return 0, err
+	}
+
+	// Read existing keys, keeping comments and unparsable lines unless
+	// replacing
+	var lines []string
+	seen := make(map[string]bool)
+	if !s.replace {
+		existing, err := os.ReadFile(filepath.Clean(path))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+		if s.pending != nil {
+			existing = []byte(strings.Join(s.pending, "\n"))
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(existing))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if key, ok := parseAuthorizedKey(line); ok {
+				if seen[key.id] {
+					continue
+				}
+				seen[key.id] = true
+			}
+			lines = append(lines, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, fmt.Errorf("error reading %s: %w", path, err)
+		}
+	}
+	for _, key := range newKeys {
+		if seen[key.id] {
+			continue
+		}
+		seen[key.id] = true
+		lines = append(lines, key.line)
+		added++
+	}
+
+	// Only the last staged file needs to be written
+	s.pending = lines
+	s.stage(func(context.Context) error {
+		if !slices.Equal(s.pending, lines) {
+			return nil
+		}
+		s.pending = nil
+		return writeAuthorizedKeys(path, lines, uid, gid)
+	}, func(context.Context) error {
+		s.pending = nil
+		return nil
+	})
+	return added, nil
+}
+
+// writeAuthorizedKeys writes the file with the permissions required by sshd.
+func writeAuthorizedKeys(path string, lines []string, uid, gid int) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("error creating %s: %w", dir, err)
+	}
+	if err := writeFileAtomic(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		return err
+	}
+	if uid >= 0 && os.Geteuid() == 0 {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return fmt.Errorf("error setting owner of %s: %w", dir, err)
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return fmt.Errorf("error setting owner of %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// lookup returns the authorized_keys path and, if User is set, the owner to
+// set on it. The uid is -1 if no owner should be set.
+func (s *SSHKey) lookup() (path string, uid, gid int, _ error) {
+	if s.User == "" {
+		if s.Path == "" {
+			return "", -1, -1, errors.New("user or path must be configured")
+		}
+		return s.Path, -1, -1, nil
+	}
+
+	u, err := user.Lookup(s.User)
+	if err != nil {
+		return "", -1, -1, fmt.Errorf("error looking up user %q: %w", s.User, err)
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		// Not a POSIX system
+		uid, gid = -1, -1
+	} else if gid, err = strconv.Atoi(u.Gid); err != nil {
+		uid, gid = -1, -1
+	}
+
+	path = s.Path
+	if path == "" {
+		path = filepath.Join(u.HomeDir, ".ssh", "authorized_keys")
+	}
+	return path, uid, gid, nil
+}
+
+type authorizedKey struct {
+	// id is the key type and data, used for de-duplication
+	id   string
+	line string
+}
+
+// parseAuthorizedKey parses a line in authorized_keys format: optional
+// options, key type, base64-encoded key data, and optional comment.
+func parseAuthorizedKey(line string) (authorizedKey, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.ContainsAny(line, "\r\n\x00") {
+		return authorizedKey{}, false
+	}
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		typ, data := fields[i], fields[i+1]
+		if !isSSHKeyType(typ) {
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return authorizedKey{}, false
+		}
+		// The key data begins with the length-prefixed key type
+		if len(blob) < 4 {
+			return authorizedKey{}, false
+		}
+		n := binary.BigEndian.Uint32(blob)
+		if uint64(len(blob)) < 4+uint64(n) || string(blob[4:4+n]) != typ {
+			return authorizedKey{}, false
+		}
+		return authorizedKey{id: typ + " " + data, line: line}, true
+	}
+	return authorizedKey{}, false
+}
+
+func isSSHKeyType(s string) bool {
+	return strings.HasPrefix(s, "ssh-") ||
+		strings.HasPrefix(s, "ecdsa-sha2-") ||
+		strings.HasPrefix(s, "sk-")
+}
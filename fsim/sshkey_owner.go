@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// AuthorizeSSHKeys implements the fdo.sshkey owner module. See [SSHKey] for
+// the message definitions.
+type AuthorizeSSHKeys struct {
+	// Keys are lines in authorized_keys format to install on every device.
+	Keys []string
+
+	// Select optionally chooses additional keys to install on a device, based
+	// on its GUID (before any replacement) and devmod.
+	Select func(ctx context.Context, guid protocol.GUID, devmod *serviceinfo.Devmod) ([]string, error)
+
+	// Replace removes all keys from the device's authorized_keys file which
+	// are not sent.
+	Replace bool
+
+	// Internal state
+	keysBody    []byte
+	started     bool
+	sentAllKeys bool
+	done        bool
+}
+
+var _ serviceinfo.OwnerModule = (*AuthorizeSSHKeys)(nil)
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (a *AuthorizeSSHKeys) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	switch messageName {
+	case "active":
+		var deviceActive bool
+		if err := cbor.NewDecoder(messageBody).Decode(&deviceActive); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if !deviceActive {
+			return fmt.Errorf("device service info module is not active")
+		}
+		return nil
+
+	case "done":
+		var added uint
+		if err := cbor.NewDecoder(messageBody).Decode(&added); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		a.done = true
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported message %q", messageName)
+	}
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (a *AuthorizeSSHKeys) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	if a.done {
+		return false, true, nil
+	}
+	if a.sentAllKeys {
+		return false, false, nil
+	}
+
+	if !a.started {
+		keys := a.Keys
+		if a.Select != nil {
+			guid, _ := serviceinfo.GUIDFromContext(ctx)
+			devmod, _ := serviceinfo.DevmodFromContext(ctx)
+			selected, err := a.Select(ctx, guid, devmod)
+			if err != nil {
+				return false, false, fmt.Errorf("error selecting SSH keys: %w", err)
+			}
+			keys = append(keys[:len(keys):len(keys)], selected...)
+		}
+		if len(keys) == 0 && !a.Replace {
+			return false, true, nil
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+
+		var err error
+		a.keysBody, err = cbor.Marshal(keys)
+		if err != nil {
+			return false, false, err
+		}
+
+		if err := producer.WriteChunk("active", []byte{0xf5}); err != nil {
+			return false, false, err
+		}
+		if a.Replace {
+			if err := producer.WriteChunk("replace", []byte{0xf5}); err != nil {
+				return false, false, err
+			}
+		}
+		a.started = true
+	}
+
+	// Keys may be long and require chunking
+	available := bstrFits(producer.Available("keys"))
+	if available < 1 {
+		return true, false, nil
+	}
+	n := min(available, len(a.keysBody))
+	var messageBody []byte
+	messageBody, a.keysBody = a.keysBody[:n], a.keysBody[n:]
+	if err := producer.WriteChunk("keys", messageBody); err != nil {
+		return false, false, err
+	}
+	a.sentAllKeys = len(a.keysBody) == 0
+	return !a.sentAllKeys, false, nil
+}
+
+type sshKeysState struct {
+	KeysBody    []byte
+	Started     bool
+	SentAllKeys bool
+	Done        bool
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. Keys selected for the
+// device which have not yet been sent are included.
+func (a *AuthorizeSSHKeys) MarshalBinary() ([]byte, error) {
+	return cbor.Marshal(sshKeysState{
+		KeysBody:    a.keysBody,
+		Started:     a.started,
+		SentAllKeys: a.sentAllKeys,
+		Done:        a.done,
+	})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (a *AuthorizeSSHKeys) UnmarshalBinary(data []byte) error {
+	var state sshKeysState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	a.keysBody, a.started, a.sentAllKeys, a.done = state.KeysBody, state.Started, state.SentAllKeys, state.Done
+	return nil
+}
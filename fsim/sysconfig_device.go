@@ -0,0 +1,218 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// SysConfig implements https://github.com/fido-alliance/fdo-sim/blob/main/fsim-repository/fdo.sysconfig.md
+// and should be registered to the "fdo.sysconfig" module.
+//
+// Each setting is validated as soon as it is received and applied when TO2
+// completes (see [serviceinfo.TransactionalModule]). By default, settings are
+// applied by writing the conventional Linux configuration files under Root.
+// Any setting may be applied differently, i.e. via D-Bus, by setting the
+// corresponding function.
+type SysConfig struct {
+	// Root is the directory under which the default appliers write files. If
+	// empty, then "/" is used.
+	Root string
+
+	// SetHostname optionally overrides how the hostname is applied. By
+	// default, the hostname is written to /etc/hostname.
+	SetHostname func(ctx context.Context, hostname string) error
+
+	// SetTimezone optionally overrides how the timezone is applied. By
+	// default, the IANA timezone name is written to /etc/timezone and
+	// /etc/localtime is linked to the zoneinfo file.
+	SetTimezone func(ctx context.Context, timezone string) error
+
+	// SetNTPServer optionally overrides how the NTP server is applied. By
+	// default, a systemd-timesyncd drop-in configuration is written to
+	// /etc/systemd/timesyncd.conf.d/fdo-sysconfig.conf.
+	SetNTPServer func(ctx context.Context, server string) error
+
+	// SetLocale optionally overrides how the locale is applied. By default,
+	// LANG is set in /etc/locale.conf.
+	SetLocale func(ctx context.Context, locale string) error
+
+	// Internal state
+	transaction
+}
+
+var _ serviceinfo.TransactionalModule = (*SysConfig)(nil)
+
+// Transition implements serviceinfo.DeviceModule.
+func (s *SysConfig) Transition(active bool) error { return nil }
+
+// Receive implements serviceinfo.DeviceModule.
+func (s *SysConfig) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	var value string
+	if err := cbor.NewDecoder(messageBody).Decode(&value); err != nil {
+		return fmt.Errorf("error decoding message %s: %w", messageName, err)
+	}
+	if err := validateSysConfigValue(value); err != nil {
+		return fmt.Errorf("invalid %s: %w", messageName, err)
+	}
+	apply, err := s.applier(messageName, value)
+	if err != nil {
+		return err
+	}
+	s.stage(func(ctx context.Context) error {
+		if err := apply(ctx); err != nil {
+			return fmt.Errorf("error applying %s: %w", messageName, err)
+		}
+		return nil
+	}, nil)
+	return nil
+}
+
+// applier validates a setting and returns the func which applies it.
+func (s *SysConfig) applier(messageName, value string) (func(context.Context) error, error) {
+	switch messageName {
+	case "hostname":
+		if !validHostname(value) {
+			return nil, fmt.Errorf("invalid hostname %q", value)
+		}
+		if s.SetHostname != nil {
+			return func(ctx context.Context) error { return s.SetHostname(ctx, value) }, nil
+		}
+		return func(context.Context) error {
+			return writeFileAtomic(s.path("etc", "hostname"), []byte(value+"\n"), 0o644)
+		}, nil
+
+	case "timezone":
+		if !filepath.IsLocal(value) || strings.Contains(value, `\`) {
+			return nil, fmt.Errorf("invalid timezone %q", value)
+		}
+		if s.SetTimezone != nil {
+			return func(ctx context.Context) error { return s.SetTimezone(ctx, value) }, nil
+		}
+		return func(context.Context) error { return s.setTimezone(value) }, nil
+
+	case "ntp-server":
+		if s.SetNTPServer != nil {
+			return func(ctx context.Context) error { return s.SetNTPServer(ctx, value) }, nil
+		}
+		return func(context.Context) error {
+			return writeFileAtomic(s.path("etc", "systemd", "timesyncd.conf.d", "fdo-sysconfig.conf"),
+				[]byte("[Time]\nNTP="+value+"\n"), 0o644)
+		}, nil
+
+	case "locale":
+		if s.SetLocale != nil {
+			return func(ctx context.Context) error { return s.SetLocale(ctx, value) }, nil
+		}
+		return func(context.Context) error {
+			return writeFileAtomic(s.path("etc", "locale.conf"), []byte("LANG="+value+"\n"), 0o644)
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown message %s", messageName)
+	}
+}
+
+// Yield implements serviceinfo.DeviceModule.
+func (s *SysConfig) Yield(ctx context.Context, respond func(message string) io.Writer, yield func()) error {
+	return nil
+}
+
+func (s *SysConfig) path(elem ...string) string {
+	root := s.Root
+	if root == "" {
+		root = "/"
+	}
+	return filepath.Join(append([]string{root}, elem...)...)
+}
+
+func (s *SysConfig) setTimezone(timezone string) error {
+	if err := writeFileAtomic(s.path("etc", "timezone"), []byte(timezone+"\n"), 0o644); err != nil {
+		return err
+	}
+
+	// The link target is absolute on the device, regardless of Root
+	localtime := s.path("etc", "localtime")
+	if err := os.Remove(localtime); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing %s: %w", localtime, err)
+	}
+	if err := os.Symlink(path.Join("/usr/share/zoneinfo", timezone), localtime); err != nil {
+		return fmt.Errorf("error linking %s: %w", localtime, err)
+	}
+	return nil
+}
+
+// validateSysConfigValue rejects values which could inject additional lines
+// or settings into configuration files.
+func validateSysConfigValue(value string) error {
+	if value == "" {
+		return errors.New("empty value")
+	}
+	if strings.ContainsFunc(value, func(r rune) bool { return unicode.IsControl(r) || unicode.IsSpace(r) }) {
+		return fmt.Errorf("%q contains whitespace or control characters", value)
+	}
+	return nil
+}
+
+// validHostname checks a hostname against RFC 1123.
+func validHostname(hostname string) bool {
+	if len(hostname) > 253 {
+		return false
+	}
+	for label := range strings.SplitSeq(hostname, ".") {
+		if len(label) < 1 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes a file by renaming a fully written temporary file
+// in the same directory, creating parent directories as needed.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+	temp, err := os.CreateTemp(dir, "."+filepath.Base(name)+"_*")
+	if err != nil {
+		return fmt.Errorf("error creating temp file for %s: %w", name, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(temp.Name())
+		}
+	}()
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	if err := temp.Chmod(perm); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("error setting permissions of %s: %w", name, err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	if err := os.Rename(temp.Name(), name); err != nil {
+		return fmt.Errorf("error renaming temp file to %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// Implement owner service info module for
+// https://github.com/fido-alliance/fdo-sim/blob/main/fsim-repository/fdo.sysconfig.md
+
+// SetSysConfig implements the fdo.sysconfig owner module. Empty settings are
+// not sent to the device.
+type SetSysConfig struct {
+	// Hostname of the device
+	Hostname string
+
+	// Timezone as an IANA timezone name, i.e. "America/Los_Angeles"
+	Timezone string
+
+	// NTPServer is the hostname or IP of the NTP server to use
+	NTPServer string
+
+	// Locale, i.e. "en_US.UTF-8"
+	Locale string
+
+	// Internal state
+	pending []*serviceinfo.KV
+	started bool
+	active  bool
+}
+
+var _ serviceinfo.OwnerModule = (*SetSysConfig)(nil)
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (s *SetSysConfig) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	switch messageName {
+	case "active":
+		var deviceActive bool
+		if err := cbor.NewDecoder(messageBody).Decode(&deviceActive); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if !deviceActive {
+			return fmt.Errorf("device service info module is not active")
+		}
+		s.active = true
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported message %q", messageName)
+	}
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (s *SetSysConfig) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	// Any device response after the last settings were sent indicates that
+	// they were all applied
+	if s.active && s.started && len(s.pending) == 0 {
+		return false, true, nil
+	}
+
+	if !s.started {
+		s.pending = []*serviceinfo.KV{{Key: "active", Val: []byte{0xf5}}}
+		for _, setting := range []struct{ name, value string }{
+			{"hostname", s.Hostname},
+			{"timezone", s.Timezone},
+			{"ntp-server", s.NTPServer},
+			{"locale", s.Locale},
+		} {
+			if setting.value == "" {
+				continue
+			}
+			messageBody, err := cbor.Marshal(setting.value)
+			if err != nil {
+				return false, false, err
+			}
+			s.pending = append(s.pending, &serviceinfo.KV{Key: setting.name, Val: messageBody})
+		}
+		s.started = true
+	}
+
+	// Send as many settings as fit
+	for len(s.pending) > 0 {
+		next := s.pending[0]
+		if len(next.Val) > bstrFits(producer.Available(next.Key)) {
+			if len(producer.ServiceInfo()) == 0 {
+				return false, false, fmt.Errorf("not enough buffer space to send %s", next.Key)
+			}
+			return false, false, nil
+		}
+		if err := producer.WriteChunk(next.Key, next.Val); err != nil {
+			return false, false, err
+		}
+		s.pending = s.pending[1:]
+	}
+
+	return false, false, nil
+}
+
+type sysConfigState struct {
+	Pending []*serviceinfo.KV
+	Started bool
+	Active  bool
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (s *SetSysConfig) MarshalBinary() ([]byte, error) {
+	return cbor.Marshal(sysConfigState{Pending: s.pending, Started: s.started, Active: s.active})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (s *SetSysConfig) UnmarshalBinary(data []byte) error {
+	var state sysConfigState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	s.pending, s.started, s.active = state.Pending, state.Started, state.Active
+	return nil
+}
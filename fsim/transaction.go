@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+// transaction holds changes staged by a device module until TO2 completes.
+// Embedding it in a device module implements the Commit and Abort methods of
+// serviceinfo.TransactionalModule.
+type transaction struct {
+	staged []stagedChange
+}
+
+type stagedChange struct {
+	commit func(context.Context) error
+	abort  func(context.Context) error
+}
+
+// stage adds a change to apply on commit. The optional abort func cleans up
+// any resources held by the change if it is never applied.
+func (t *transaction) stage(commit, abort func(context.Context) error) {
+	t.staged = append(t.staged, stagedChange{commit: commit, abort: abort})
+}
+
+// Commit applies staged changes in the order they were staged.
+func (t *transaction) Commit(ctx context.Context) error {
+	staged := t.staged
+	t.staged = nil
+
+	var errs []error
+	for _, change := range staged {
+		if err := change.commit(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Abort discards staged changes in the reverse order they were staged.
+func (t *transaction) Abort(ctx context.Context) error {
+	staged := t.staged
+	t.staged = nil
+
+	var errs []error
+	for _, change := range slices.Backward(staged) {
+		if change.abort == nil {
+			continue
+		}
+		if err := change.abort(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
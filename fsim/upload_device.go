@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
@@ -16,11 +17,22 @@ import (
 
 // Upload implements https://github.com/fido-alliance/fdo-sim/blob/main/fsim-repository/fdo.upload.md
 // and should be registered to the "fdo.upload" module.
+//
+// As an extension, the owner may send an archive message before name, in
+// which case name is a glob pattern and all matching files, including the
+// contents of matching directories, are uploaded as a single archive.
+//
+//	fdo.upload:archive  tstr ("tar" or "tar+gzip")
 type Upload struct {
 	FS fs.FS
 
+	// CreateTemp optionally overrides the behavior of how the FSIM creates a
+	// temporary file to build archives in.
+	CreateTemp func() (*os.File, error)
+
 	// Internal state
 	needSha bool
+	archive ArchiveFormat
 }
 
 var _ serviceinfo.DeviceModule = (*Upload)(nil)
@@ -52,6 +64,12 @@ func (u *Upload) receive(messageName string, messageBody io.Reader, respond func
 	case "need-sha":
 		return cbor.NewDecoder(messageBody).Decode(&u.needSha)
 
+	case "archive":
+		if err := cbor.NewDecoder(messageBody).Decode(&u.archive); err != nil {
+			return err
+		}
+		return u.archive.validate()
+
 	default:
 		u.reset()
 		return fmt.Errorf("unknown message %s", messageName)
@@ -61,6 +79,10 @@ func (u *Upload) receive(messageName string, messageBody io.Reader, respond func
 func (u *Upload) upload(name string, respond func(string) io.Writer, yield func()) error {
 	defer u.reset()
 
+	if u.archive != "" {
+		return u.uploadArchive(name, respond, yield)
+	}
+
 	f, err := u.FS.Open(name)
 	if err != nil {
 		return err
@@ -71,14 +93,47 @@ func (u *Upload) upload(name string, respond func(string) io.Writer, yield func(
 	if err != nil {
 		return err
 	}
-	if err := cbor.NewEncoder(respond("length")).Encode(stat.Size()); err != nil {
+	return u.send(f, stat.Size(), respond, yield)
+}
+
+func (u *Upload) uploadArchive(pattern string, respond func(string) io.Writer, yield func()) error {
+	var temp *os.File
+	var err error
+	if u.CreateTemp != nil {
+		temp, err = u.CreateTemp()
+	} else {
+		temp, err = os.CreateTemp("", "fdo.upload_*")
+	}
+	if err != nil {
+		return fmt.Errorf("error creating temp file for archive: %w", err)
+	}
+	defer func() {
+		_ = temp.Close()
+		_ = os.Remove(temp.Name())
+	}()
+
+	if err := WriteArchive(temp, u.FS, pattern, u.archive); err != nil {
+		return fmt.Errorf("error creating archive: %w", err)
+	}
+	size, err := temp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return u.send(temp, size, respond, yield)
+}
+
+func (u *Upload) send(f io.Reader, size int64, respond func(string) io.Writer, yield func()) error {
+	if err := cbor.NewEncoder(respond("length")).Encode(size); err != nil {
 		return err
 	}
 	yield()
 
 	chunk := make([]byte, 1014)
 	hash := sha512.New384()
-	for i := stat.Size(); i > 0; {
+	for i := size; i > 0; {
 		n, err := f.Read(chunk[:min(1014, i)])
 		if err != nil {
 			return err
@@ -101,7 +156,7 @@ func (u *Upload) upload(name string, respond func(string) io.Writer, yield func(
 	return cbor.NewEncoder(respond("sha-384")).Encode(hash.Sum(nil))
 }
 
-func (u *Upload) reset() { u.needSha = false }
+func (u *Upload) reset() { u.needSha, u.archive = false, "" }
 
 // Yield implements DeviceModule.
 func (u *Upload) Yield(ctx context.Context, respond func(message string) io.Writer, yield func()) error {
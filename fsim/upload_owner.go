@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha512"
+	"encoding"
 	"errors"
 	"fmt"
 	"hash"
@@ -33,6 +34,17 @@ type UploadRequest struct {
 	// Optional name to use on local filesystem
 	Rename string
 
+	// Archive optionally requests all files matching Name, which is then a
+	// glob pattern, including the contents of matching directories. The
+	// device sends them as a single archive, which is unpacked into Dir, or
+	// into Rename within Dir if it is set. Devices which do not support this
+	// extension (see [Upload]) will fail on the unknown message.
+	Archive ArchiveFormat
+
+	// Limits restricts the contents of archives. Files are never unpacked
+	// outside of the destination directory.
+	Limits ArchiveLimits
+
 	// CreateTemp optionally overrides the behavior of how the module creates a
 	// temporary file to download to.
 	CreateTemp func() (*os.File, error)
@@ -139,6 +151,18 @@ func (u *UploadRequest) request(producer *serviceinfo.Producer) (blockPeer, modu
 	if err := producer.WriteChunk("need-sha", trueBody); err != nil {
 		return false, false, err
 	}
+	if u.Archive != "" {
+		if err := u.Archive.validate(); err != nil {
+			return false, false, err
+		}
+		archiveBody, err := cbor.Marshal(u.Archive)
+		if err != nil {
+			return false, false, err
+		}
+		if err := producer.WriteChunk("archive", archiveBody); err != nil {
+			return false, false, err
+		}
+	}
 	if err := producer.WriteChunk("name", nameBody); err != nil {
 		return false, false, err
 	}
@@ -154,6 +178,9 @@ func (u *UploadRequest) finalize() (blockPeer, moduleDone bool, _ error) {
 	if !bytes.Equal(u.sha384, u.hash.Sum(nil)[:]) {
 		return false, false, fmt.Errorf("uploaded file %q: SHA-384 did not match", u.Name)
 	}
+	if u.Archive != "" {
+		return u.unpack()
+	}
 	if err := u.temp.Close(); err != nil {
 		return false, false, fmt.Errorf("error closing temp file for upload %q: %w", u.Name, err)
 	}
@@ -167,3 +194,83 @@ func (u *UploadRequest) finalize() (blockPeer, moduleDone bool, _ error) {
 	}
 	return false, true, nil
 }
+
+func (u *UploadRequest) unpack() (blockPeer, moduleDone bool, _ error) {
+	defer func() {
+		_ = u.temp.Close()
+		_ = os.Remove(u.temp.Name())
+	}()
+	if _, err := u.temp.Seek(0, io.SeekStart); err != nil {
+		return false, false, fmt.Errorf("error reading uploaded archive %q: %w", u.Name, err)
+	}
+	dir := u.Dir
+	if u.Rename != "" {
+		if !filepath.IsLocal(u.Rename) {
+			return false, false, fmt.Errorf("invalid destination %q for uploaded archive", u.Rename)
+		}
+		dir = filepath.Join(u.Dir, u.Rename)
+	}
+	if err := unpackArchive(u.temp, dir, u.Archive, u.Limits); err != nil {
+		return false, false, fmt.Errorf("error unpacking uploaded archive %q: %w", u.Name, err)
+	}
+	return false, true, nil
+}
+
+type uploadState struct {
+	Requested bool
+	Length    int64
+	Written   int64
+	SHA384    []byte
+	Temp      string
+	Hash      []byte
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. Data received before the
+// module is restored remains in its temporary file, which is reopened by
+// name, so owner service instances must share the directory it is created in.
+func (u *UploadRequest) MarshalBinary() ([]byte, error) {
+	state := uploadState{
+		Requested: u.requested,
+		Length:    u.length,
+		Written:   u.written,
+		SHA384:    u.sha384,
+	}
+	if u.temp != nil {
+		state.Temp = u.temp.Name()
+		hashState, err := u.hash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling hash state: %w", err)
+		}
+		state.Hash = hashState
+	}
+	return cbor.Marshal(state)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (u *UploadRequest) UnmarshalBinary(data []byte) error {
+	var state uploadState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	u.requested, u.length, u.written, u.sha384 = state.Requested, state.Length, state.Written, state.SHA384
+	if state.Temp == "" {
+		return nil
+	}
+
+	// Continue writing to the temp file
+	temp, err := os.OpenFile(filepath.Clean(state.Temp), os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("error reopening temp file for upload of %q: %w", u.Name, err)
+	}
+	if _, err := temp.Seek(state.Written, io.SeekStart); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("error seeking temp file for upload of %q: %w", u.Name, err)
+	}
+	hash := sha512.New384()
+	if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state.Hash); err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("error unmarshaling hash state: %w", err)
+	}
+	u.once.Do(func() { u.temp, u.hash = temp, hash })
+	return nil
+}
@@ -21,6 +21,10 @@ const defaultWgetTimeout = time.Hour
 
 // Wget implements https://github.com/fido-alliance/fdo-sim/blob/main/fsim-repository/fdo.wget.md
 // and should be registered to the "fdo.wget" module.
+//
+// Downloaded files are kept in a temporary location until TO2 completes and
+// are only moved into place when the download is committed (see
+// [serviceinfo.TransactionalModule]).
 type Wget struct {
 	// CreateTemp optionally overrides the behavior of how the FSIM creates a
 	// temporary file to download to.
@@ -44,16 +48,18 @@ type Wget struct {
 	sha384 []byte // optional
 
 	// Internal state
+	transaction
 	resultCh <-chan wgetResult
 	cancel   context.CancelFunc
 }
 
 type wgetResult struct {
-	len int64
-	err error
+	temp string
+	len  int64
+	err  error
 }
 
-var _ serviceinfo.DeviceModule = (*Wget)(nil)
+var _ serviceinfo.TransactionalModule = (*Wget)(nil)
 
 // Transition implements serviceinfo.DeviceModule.
 func (d *Wget) Transition(active bool) error {
@@ -94,8 +100,8 @@ func (d *Wget) receive(ctx context.Context, messageName string, messageBody io.R
 		ctx, d.cancel = context.WithTimeout(ctx, timeout)
 
 		go func() {
-			n, err := d.download(ctx, url)
-			resultCh <- wgetResult{len: n, err: err}
+			temp, n, err := d.download(ctx, url)
+			resultCh <- wgetResult{temp: temp, len: n, err: err}
 		}()
 
 		return nil
@@ -105,7 +111,9 @@ func (d *Wget) receive(ctx context.Context, messageName string, messageBody io.R
 	}
 }
 
-func (d *Wget) download(ctx context.Context, url string) (_ int64, err error) {
+// download fetches the file to a temporary location and returns its path. The
+// temporary file is removed if an error occurs.
+func (d *Wget) download(ctx context.Context, url string) (_ string, _ int64, err error) {
 	// Create a temp file
 	var temp *os.File
 	if d.CreateTemp != nil {
@@ -114,10 +122,14 @@ func (d *Wget) download(ctx context.Context, url string) (_ int64, err error) {
 		temp, err = os.CreateTemp("", "fdo.wget_*")
 	}
 	if err != nil {
-		return 0, fmt.Errorf("error creating temp file for download: %w", err)
+		return "", 0, fmt.Errorf("error creating temp file for download: %w", err)
 	}
-	defer func() { _ = os.Remove(temp.Name()) }()
-	defer func() { _ = temp.Close() }()
+	defer func() {
+		_ = temp.Close()
+		if err != nil {
+			_ = os.Remove(temp.Name())
+		}
+	}()
 
 	// Make HTTP GET request
 	client := d.Client
@@ -126,21 +138,21 @@ func (d *Wget) download(ctx context.Context, url string) (_ int64, err error) {
 	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return 0, fmt.Errorf("error creating request: %w", err)
+		return "", 0, fmt.Errorf("error creating request: %w", err)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("error making request: %w", err)
+		return "", 0, fmt.Errorf("error making request: %w", err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("expected status 200, got %d", resp.StatusCode)
+		return "", 0, fmt.Errorf("expected status 200, got %d", resp.StatusCode)
 	}
 
 	// TODO: Spawn goroutine to log progress at regular intervals
 	//
-	// if debugEnabled() {
-	// 	slog.Default().WithGroup("fdo.wget").Debug("progress", "written", written, "length", resp.ContentLength)
+	// if debugEnabled(ctx) {
+	// 	protocol.LoggerFromContext(ctx).WithGroup("fdo.wget").Debug("progress", "written", written, "length", resp.ContentLength)
 	// }
 
 	// Write to temp file and hash
@@ -148,27 +160,19 @@ func (d *Wget) download(ctx context.Context, url string) (_ int64, err error) {
 	w := io.MultiWriter(temp, hash)
 	n, err := io.Copy(w, resp.Body)
 	if err != nil {
-		return 0, fmt.Errorf("error saving response: %w", err)
+		return "", 0, fmt.Errorf("error saving response: %w", err)
 	}
 
 	// Validate file checksum
 	if hashed := hash.Sum(nil); len(d.sha384) > 0 && !bytes.Equal(hashed, d.sha384) {
-		return 0, fmt.Errorf("checksum of %q failed verification: expected: %x, got: %x", d.name, d.sha384, hashed)
+		return "", 0, fmt.Errorf("checksum of %q failed verification: expected: %x, got: %x", d.name, d.sha384, hashed)
 	}
 
-	// Rename temp file to final file name
-	resolveName := d.NameToPath
-	if resolveName == nil {
-		resolveName = func(name string) string { return name }
-	}
 	if d.name == "" {
-		return 0, fmt.Errorf("name not sent before file download completed")
-	}
-	if err := os.Rename(temp.Name(), resolveName(d.name)); err != nil {
-		return 0, fmt.Errorf("error renaming file to %q: %w", d.name, err)
+		return "", 0, fmt.Errorf("name not sent before file download completed")
 	}
 
-	return n, nil
+	return temp.Name(), n, nil
 }
 
 // Yield implements serviceinfo.DeviceModule.
@@ -181,6 +185,21 @@ func (d *Wget) Yield(ctx context.Context, respond func(message string) io.Writer
 			return cbor.NewEncoder(respond("error")).Encode(result.err.Error())
 		}
 
+		// Stage the rename of the temp file to the final file name
+		resolveName := d.NameToPath
+		if resolveName == nil {
+			resolveName = func(name string) string { return name }
+		}
+		temp, name := result.temp, resolveName(d.name)
+		d.stage(func(context.Context) error {
+			if err := os.Rename(temp, name); err != nil {
+				return fmt.Errorf("error renaming file to %q: %w", name, err)
+			}
+			return nil
+		}, func(context.Context) error {
+			return os.Remove(temp)
+		})
+
 		return cbor.NewEncoder(respond("done")).Encode(result.len)
 
 	default:
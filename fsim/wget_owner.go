@@ -116,3 +116,23 @@ func (w *WgetCommand) ProduceInfo(ctx context.Context, producer *serviceinfo.Pro
 	w.sent = true
 	return false, false, nil
 }
+
+type wgetState struct {
+	Sent bool
+	Done bool
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (w *WgetCommand) MarshalBinary() ([]byte, error) {
+	return cbor.Marshal(wgetState{Sent: w.sent, Done: w.done})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (w *WgetCommand) UnmarshalBinary(data []byte) error {
+	var state wgetState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	w.sent, w.done = state.Sent, state.Done
+	return nil
+}
@@ -0,0 +1,260 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+const defaultArtifactTTL = 15 * time.Minute
+
+// ArtifactServer serves files to devices downloading them with the fdo.wget
+// module. Each URL is signed with HMAC-SHA256, bound to the GUID of the
+// device it was issued to, and expires after a short time.
+//
+// ArtifactServer implements [http.Handler] and must be served at BaseURL.
+type ArtifactServer struct {
+	// FS contains the artifacts to serve. Use [os.DirFS] to serve a
+	// directory.
+	FS fs.FS
+
+	// Key is the HMAC key used to sign URLs. It must be at least 32 bytes.
+	Key []byte
+
+	// BaseURL is the externally reachable URL of the handler. Artifact paths
+	// are appended to its path.
+	BaseURL *url.URL
+
+	// TTL is how long signed URLs are valid. If zero, then 15 minutes is
+	// used.
+	TTL time.Duration
+
+	// Internal state
+	mu   sync.Mutex
+	sums map[string]artifactSum
+}
+
+type artifactSum struct {
+	modTime time.Time
+	size    int64
+	sha384  []byte
+}
+
+var _ http.Handler = (*ArtifactServer)(nil)
+
+// URL returns a URL for the artifact signed for the device GUID.
+func (s *ArtifactServer) URL(guid protocol.GUID, name string) (*url.URL, error) {
+	if len(s.Key) < 32 {
+		return nil, errors.New("artifact server key must be at least 32 bytes")
+	}
+	if s.BaseURL == nil {
+		return nil, errors.New("artifact server base URL is required")
+	}
+	if !fs.ValidPath(name) {
+		return nil, fmt.Errorf("invalid artifact name %q", name)
+	}
+
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = defaultArtifactTTL
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	u := s.BaseURL.JoinPath(name)
+	u.RawQuery = url.Values{
+		"guid": {hex.EncodeToString(guid[:])},
+		"exp":  {expires},
+		"sig":  {s.sign(guid[:], expires, name)},
+	}.Encode()
+	return u, nil
+}
+
+func (s *ArtifactServer) sign(guid []byte, expires, name string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	_, _ = mac.Write(guid)
+	_, _ = io.WriteString(mac, "\x00"+expires+"\x00"+name)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the artifact name if the request URL is validly signed and
+// has not expired.
+func (s *ArtifactServer) verify(u *url.URL) (string, error) {
+	name := strings.TrimPrefix(u.Path, strings.TrimSuffix(s.BaseURL.Path, "/")+"/")
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("invalid artifact name %q", name)
+	}
+
+	query := u.Query()
+	guid, err := hex.DecodeString(query.Get("guid"))
+	if err != nil || len(guid) != len(protocol.GUID{}) {
+		return "", errors.New("invalid guid")
+	}
+	expires := query.Get("exp")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", errors.New("invalid expiration")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get("sig"))
+	if err != nil {
+		return "", errors.New("invalid signature encoding")
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(s.sign(guid, expires, name))
+	if !hmac.Equal(sig, expected) {
+		return "", errors.New("invalid signature")
+	}
+	if time.Now().Unix() > exp {
+		return "", errors.New("URL expired")
+	}
+	return name, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *ArtifactServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.Key) < 32 || s.BaseURL == nil {
+		http.Error(w, "artifact server is not configured", http.StatusInternalServerError)
+		return
+	}
+	name, err := s.verify(r.URL)
+	if err != nil {
+		protocol.LoggerFromContext(r.Context()).Debug("artifact request rejected", "path", r.URL.Path, "error", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	f, err := s.FS.Open(name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "artifact is not seekable", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), content)
+}
+
+// checksum returns the length and SHA-384 of an artifact. Checksums are
+// cached until the file's size or modification time changes.
+func (s *ArtifactServer) checksum(name string) (int64, []byte, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, nil, fmt.Errorf("artifact %q is not a regular file", name)
+	}
+
+	s.mu.Lock()
+	sum, ok := s.sums[name]
+	s.mu.Unlock()
+	if ok && sum.size == info.Size() && sum.modTime.Equal(info.ModTime()) {
+		return sum.size, sum.sha384, nil
+	}
+
+	hash := sha512.New384()
+	if _, err := io.Copy(hash, f); err != nil {
+		return 0, nil, err
+	}
+	sum = artifactSum{modTime: info.ModTime(), size: info.Size(), sha384: hash.Sum(nil)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sums == nil {
+		s.sums = make(map[string]artifactSum)
+	}
+	s.sums[name] = sum
+	return sum.size, sum.sha384, nil
+}
+
+// WgetArtifact implements the fdo.wget owner module for an artifact served by
+// an [ArtifactServer]. When the module starts, a URL is signed for the device
+// GUID and the length and SHA-384 of the artifact are sent so that the device
+// verifies the download.
+type WgetArtifact struct {
+	Server *ArtifactServer
+
+	// Artifact is the path of the file in the server's FS.
+	Artifact string
+
+	// Name to download file as. If empty, then the base name of Artifact is
+	// used.
+	Name string
+
+	// Internal state
+	cmd *WgetCommand
+}
+
+var _ serviceinfo.OwnerModule = (*WgetArtifact)(nil)
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (w *WgetArtifact) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	if w.cmd == nil {
+		return fmt.Errorf("unexpected message %q before module started", messageName)
+	}
+	return w.cmd.HandleInfo(ctx, messageName, messageBody)
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (w *WgetArtifact) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	if w.cmd == nil {
+		guid, ok := serviceinfo.GUIDFromContext(ctx)
+		if !ok {
+			return false, false, errors.New("device GUID not available to sign artifact URL")
+		}
+		u, err := w.Server.URL(guid, w.Artifact)
+		if err != nil {
+			return false, false, err
+		}
+		length, sum, err := w.Server.checksum(w.Artifact)
+		if err != nil {
+			return false, false, fmt.Errorf("error hashing artifact %q: %w", w.Artifact, err)
+		}
+		name := w.Name
+		if name == "" {
+			name = path.Base(w.Artifact)
+		}
+		w.cmd = &WgetCommand{
+			Name:     name,
+			URL:      u,
+			Length:   length,
+			Checksum: sum,
+		}
+	}
+	return w.cmd.ProduceInfo(ctx, producer)
+}
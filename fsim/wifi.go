@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// WifiSecurity is the security type of a WiFi network.
+type WifiSecurity string
+
+// WiFi security types
+const (
+	WifiOpen           WifiSecurity = "open"
+	WifiWPA2PSK        WifiSecurity = "wpa2-psk"
+	WifiWPA3SAE        WifiSecurity = "wpa3-sae"
+	WifiWPA2Enterprise WifiSecurity = "wpa2-eap"
+)
+
+// WifiNetwork is a WiFi network profile provisioned by the fdo.wifi module.
+type WifiNetwork struct {
+	SSID     string
+	Security WifiSecurity
+	Hidden   bool
+
+	// PSK is the passphrase (8-63 characters) or hex-encoded key (64
+	// characters) for WPA2-PSK and WPA3-SAE networks.
+	PSK string
+
+	// EAP is the 802.1X configuration for WPA2-Enterprise networks.
+	EAP *WifiEAP
+}
+
+// WifiEAP is the 802.1X configuration of a WiFi network.
+type WifiEAP struct {
+	// Method is one of "tls", "peap", or "ttls".
+	Method string
+
+	Identity string
+
+	// Password is used for the inner authentication of PEAP and TTLS.
+	Password string
+
+	// CACert is the DER-encoded certificate of the CA which issued the
+	// authentication server's certificate.
+	CACert []byte
+
+	// ClientCert and ClientKey are the DER-encoded certificate and PKCS #8
+	// private key used for EAP-TLS.
+	ClientCert []byte
+	ClientKey  []byte
+}
+
+// WifiConfigurer applies WiFi network profiles on the device.
+type WifiConfigurer interface {
+	ConfigureWifi(ctx context.Context, network WifiNetwork) error
+}
+
+func (n WifiNetwork) validate() error {
+	if n.SSID == "" || len(n.SSID) > 32 {
+		return fmt.Errorf("SSID must be 1-32 bytes")
+	}
+	if strings.ContainsFunc(n.SSID, unicode.IsControl) {
+		return fmt.Errorf("SSID contains control characters")
+	}
+
+	switch n.Security {
+	case WifiOpen:
+		return nil
+
+	case WifiWPA2PSK, WifiWPA3SAE:
+		if !validPSK(n.PSK) {
+			return fmt.Errorf("PSK must be 8-63 printable ASCII characters or 64 hex digits")
+		}
+		return nil
+
+	case WifiWPA2Enterprise:
+		if n.EAP == nil {
+			return fmt.Errorf("802.1X configuration is required for %s", n.Security)
+		}
+		return n.EAP.validate()
+
+	default:
+		return fmt.Errorf("unsupported security type %q", n.Security)
+	}
+}
+
+func (e *WifiEAP) validate() error {
+	if strings.ContainsFunc(e.Identity+e.Password, unicode.IsControl) {
+		return errors.New("802.1X identity or password contains control characters")
+	}
+	switch e.Method {
+	case "tls":
+		if len(e.ClientCert) == 0 || len(e.ClientKey) == 0 {
+			return errors.New("EAP-TLS requires a client certificate and key")
+		}
+	case "peap", "ttls":
+		if e.Identity == "" || e.Password == "" {
+			return fmt.Errorf("EAP-%s requires an identity and password", strings.ToUpper(e.Method))
+		}
+	default:
+		return fmt.Errorf("unsupported EAP method %q", e.Method)
+	}
+	return nil
+}
+
+func validPSK(psk string) bool {
+	if len(psk) == 64 {
+		return !strings.ContainsFunc(psk, func(r rune) bool {
+			return (r < '0' || r > '9') && (r < 'a' || r > 'f') && (r < 'A' || r > 'F')
+		})
+	}
+	if len(psk) < 8 || len(psk) > 63 {
+		return false
+	}
+	return !strings.ContainsFunc(psk, func(r rune) bool { return r < 0x20 || r > 0x7e })
+}
@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// Wifi implements the fdo.wifi device module and should be registered to the
+// "fdo.wifi" module.
+//
+// The owner sends one or more network profiles, each beginning with ssid and
+// ending with apply:
+//
+//	fdo.wifi:active       bool
+//	fdo.wifi:ssid         tstr
+//	fdo.wifi:security     tstr ("open", "wpa2-psk", "wpa3-sae", "wpa2-eap")
+//	fdo.wifi:hidden       bool (optional)
+//	fdo.wifi:psk          tstr (WPA2-PSK and WPA3-SAE)
+//	fdo.wifi:eap-method   tstr ("tls", "peap", "ttls")
+//	fdo.wifi:identity     tstr (optional)
+//	fdo.wifi:password     tstr (PEAP and TTLS)
+//	fdo.wifi:ca-cert      bstr (optional, DER)
+//	fdo.wifi:client-cert  bstr (TLS, DER)
+//	fdo.wifi:client-key   bstr (TLS, PKCS #8 DER)
+//	fdo.wifi:apply        null
+//
+// After each network is configured, the device responds with:
+//
+//	fdo.wifi:done         uint (number of networks configured)
+//
+// Networks are validated as they are received and passed to the Configurer
+// when TO2 completes (see [serviceinfo.TransactionalModule]).
+type Wifi struct {
+	// Configurer applies each received network profile. It is required.
+	Configurer WifiConfigurer
+
+	// Internal state
+	transaction
+	network *WifiNetwork
+	applied uint
+}
+
+var _ serviceinfo.TransactionalModule = (*Wifi)(nil)
+
+// Transition implements serviceinfo.DeviceModule.
+func (w *Wifi) Transition(active bool) error { w.reset(); return nil }
+
+// Receive implements serviceinfo.DeviceModule.
+func (w *Wifi) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	if err := w.receive(ctx, messageName, messageBody, respond); err != nil {
+		w.reset()
+		return err
+	}
+	return nil
+}
+
+func (w *Wifi) receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer) error { //nolint:gocyclo // Message dispatch is best understood as a large switch stmt
+	if messageName == "ssid" {
+		w.network = new(WifiNetwork)
+		return cbor.NewDecoder(messageBody).Decode(&w.network.SSID)
+	}
+	if w.network == nil {
+		return fmt.Errorf("message %s received before ssid", messageName)
+	}
+
+	eap := func() *WifiEAP {
+		if w.network.EAP == nil {
+			w.network.EAP = new(WifiEAP)
+		}
+		return w.network.EAP
+	}
+
+	switch messageName {
+	case "security":
+		return cbor.NewDecoder(messageBody).Decode(&w.network.Security)
+
+	case "hidden":
+		return cbor.NewDecoder(messageBody).Decode(&w.network.Hidden)
+
+	case "psk":
+		return cbor.NewDecoder(messageBody).Decode(&w.network.PSK)
+
+	case "eap-method":
+		return cbor.NewDecoder(messageBody).Decode(&eap().Method)
+
+	case "identity":
+		return cbor.NewDecoder(messageBody).Decode(&eap().Identity)
+
+	case "password":
+		return cbor.NewDecoder(messageBody).Decode(&eap().Password)
+
+	case "ca-cert":
+		return cbor.NewDecoder(messageBody).Decode(&eap().CACert)
+
+	case "client-cert":
+		return cbor.NewDecoder(messageBody).Decode(&eap().ClientCert)
+
+	case "client-key":
+		return cbor.NewDecoder(messageBody).Decode(&eap().ClientKey)
+
+	case "apply":
+		var null struct{}
+		if err := cbor.NewDecoder(messageBody).Decode(&null); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if w.Configurer == nil {
+			return errors.New("no WiFi configurer")
+		}
+		network := *w.network
+		w.network = nil
+		if err := network.validate(); err != nil {
+			return fmt.Errorf("invalid network %q: %w", network.SSID, err)
+		}
+		configurer := w.Configurer
+		w.stage(func(ctx context.Context) error {
+			if err := configurer.ConfigureWifi(ctx, network); err != nil {
+				return fmt.Errorf("error configuring network %q: %w", network.SSID, err)
+			}
+			return nil
+		}, nil)
+		w.applied++
+		return cbor.NewEncoder(respond("done")).Encode(w.applied)
+
+	default:
+		return fmt.Errorf("unknown message %s", messageName)
+	}
+}
+
+// Yield implements serviceinfo.DeviceModule.
+func (w *Wifi) Yield(ctx context.Context, respond func(message string) io.Writer, yield func()) error {
+	return nil
+}
+
+func (w *Wifi) reset() {
+	w.network = nil
+	w.applied = 0
+}
@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// NMKeyfileWriter implements WifiConfigurer by writing NetworkManager keyfile
+// connection profiles. Certificates and keys for 802.1X are written as PEM
+// files alongside the profile.
+//
+// NetworkManager must be reloaded (i.e. `nmcli connection reload`) for new
+// profiles to take effect. This may be done by wrapping the writer.
+type NMKeyfileWriter struct {
+	// Dir is the directory to write profiles to. If empty, then
+	// /etc/NetworkManager/system-connections is used.
+	Dir string
+}
+
+var _ WifiConfigurer = NMKeyfileWriter{}
+
+// ConfigureWifi implements WifiConfigurer.
+func (nm NMKeyfileWriter) ConfigureWifi(ctx context.Context, network WifiNetwork) error {
+	if err := network.validate(); err != nil {
+		return err
+	}
+
+	dir := nm.Dir
+	if dir == "" {
+		dir = "/etc/NetworkManager/system-connections"
+	}
+	name := nmProfileName(network.SSID)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[connection]\nid=%s\nuuid=%s\ntype=wifi\nautoconnect=true\n\n",
+		nmEscape(network.SSID), nmUUID(network.SSID))
+	fmt.Fprintf(&b, "[wifi]\nmode=infrastructure\nssid=%s\n", nmEscape(network.SSID))
+	if network.Hidden {
+		b.WriteString("hidden=true\n")
+	}
+	b.WriteString("\n")
+
+	switch network.Security {
+	case WifiWPA2PSK:
+		fmt.Fprintf(&b, "[wifi-security]\nkey-mgmt=wpa-psk\npsk=%s\n\n", nmEscape(network.PSK))
+
+	case WifiWPA3SAE:
+		fmt.Fprintf(&b, "[wifi-security]\nkey-mgmt=sae\npsk=%s\n\n", nmEscape(network.PSK))
+
+	case WifiWPA2Enterprise:
+		b.WriteString("[wifi-security]\nkey-mgmt=wpa-eap\n\n")
+		if err := nm.write8021X(&b, dir, name, network.EAP); err != nil {
+			return err
+		}
+	}
+
+	b.WriteString("[ipv4]\nmethod=auto\n\n[ipv6]\nmethod=auto\n")
+
+	// NetworkManager ignores profiles readable by other users
+	return writeFileAtomic(filepath.Join(dir, name+".nmconnection"), []byte(b.String()), 0o600)
+}
+
+func (nm NMKeyfileWriter) write8021X(b *strings.Builder, dir, name string, eap *WifiEAP) error {
+	fmt.Fprintf(b, "[802-1x]\neap=%s\n", eap.Method)
+	if eap.Identity != "" {
+		fmt.Fprintf(b, "identity=%s\n", nmEscape(eap.Identity))
+	}
+	if eap.Password != "" {
+		fmt.Fprintf(b, "password=%s\nphase2-auth=mschapv2\n", nmEscape(eap.Password))
+	}
+
+	for _, file := range []struct {
+		key, suffix, pemType string
+		der                  []byte
+	}{
+		{"ca-cert", "ca.pem", "CERTIFICATE", eap.CACert},
+		{"client-cert", "client.pem", "CERTIFICATE", eap.ClientCert},
+		{"private-key", "client-key.pem", "PRIVATE KEY", eap.ClientKey},
+	} {
+		if len(file.der) == 0 {
+			continue
+		}
+		path := filepath.Join(dir, name+"-"+file.suffix)
+		data := pem.EncodeToMemory(&pem.Block{Type: file.pemType, Bytes: file.der})
+		if err := writeFileAtomic(path, data, 0o600); err != nil {
+			return err
+		}
+		fmt.Fprintf(b, "%s=%s\n", file.key, nmEscape(path))
+	}
+	if len(eap.ClientKey) > 0 {
+		// The key is not encrypted, so no password is required
+		b.WriteString("private-key-password-flags=4\n")
+	}
+	b.WriteString("\n")
+	return nil
+}
+
+// nmProfileName returns a file name for the profile which is safe for any
+// SSID and unique among SSIDs.
+func nmProfileName(ssid string) string {
+	safe := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, ssid)
+	sum := sha256.Sum256([]byte(ssid))
+	return "fdo-" + safe + "-" + hex.EncodeToString(sum[:4])
+}
+
+// nmUUID returns a stable name-based UUID for the SSID, so that provisioning
+// the same network again replaces its profile.
+func nmUUID(ssid string) string {
+	sum := sha256.Sum256([]byte("fdo.wifi:" + ssid))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(sum[:16])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+var nmEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// nmEscape escapes a value as a GKeyFile string.
+func nmEscape(s string) string {
+	s = nmEscaper.Replace(s)
+	if strings.HasPrefix(s, " ") {
+		// Leading whitespace is otherwise trimmed
+		s = `\s` + s[1:]
+	}
+	return s
+}
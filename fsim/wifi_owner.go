@@ -0,0 +1,182 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// ProvisionWifi implements the fdo.wifi owner module. See [Wifi] for the
+// message definitions.
+type ProvisionWifi struct {
+	Networks []WifiNetwork
+
+	// Internal state
+	queue   []*serviceinfo.KV
+	started bool
+	applied int
+}
+
+var _ serviceinfo.OwnerModule = (*ProvisionWifi)(nil)
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (p *ProvisionWifi) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	switch messageName {
+	case "active":
+		var deviceActive bool
+		if err := cbor.NewDecoder(messageBody).Decode(&deviceActive); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if !deviceActive {
+			return fmt.Errorf("device service info module is not active")
+		}
+		return nil
+
+	case "done":
+		// Consecutive done messages are concatenated
+		dec := cbor.NewDecoder(messageBody)
+		for {
+			var applied int
+			if err := dec.Decode(&applied); errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("error decoding message %s: %w", messageName, err)
+			}
+			p.applied = applied
+		}
+
+	default:
+		return fmt.Errorf("unsupported message %q", messageName)
+	}
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (p *ProvisionWifi) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	if p.started && p.applied >= len(p.Networks) {
+		return false, true, nil
+	}
+
+	if !p.started {
+		if len(p.Networks) == 0 {
+			return false, true, nil
+		}
+		if err := p.enqueueAll(); err != nil {
+			return false, false, err
+		}
+		p.started = true
+	}
+
+	blockPeer, err := writeQueue(producer, &p.queue)
+	return blockPeer, false, err
+}
+
+func (p *ProvisionWifi) enqueueAll() error {
+	p.queue = []*serviceinfo.KV{{Key: "active", Val: []byte{0xf5}}}
+	for _, network := range p.Networks {
+		if err := network.validate(); err != nil {
+			return fmt.Errorf("invalid network %q: %w", network.SSID, err)
+		}
+		if err := p.enqueue(network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *ProvisionWifi) enqueue(network WifiNetwork) error {
+	type message struct {
+		name  string
+		value any
+	}
+	messages := []message{
+		{"ssid", network.SSID},
+		{"security", string(network.Security)},
+	}
+	if network.Hidden {
+		messages = append(messages, message{"hidden", true})
+	}
+	if network.PSK != "" {
+		messages = append(messages, message{"psk", network.PSK})
+	}
+	if eap := network.EAP; eap != nil {
+		messages = append(messages, message{"eap-method", eap.Method})
+		for _, msg := range []message{
+			{"identity", eap.Identity},
+			{"password", eap.Password},
+		} {
+			if msg.value != "" {
+				messages = append(messages, msg)
+			}
+		}
+		for _, msg := range []message{
+			{"ca-cert", eap.CACert},
+			{"client-cert", eap.ClientCert},
+			{"client-key", eap.ClientKey},
+		} {
+			if len(msg.value.([]byte)) > 0 {
+				messages = append(messages, msg)
+			}
+		}
+	}
+
+	for _, msg := range messages {
+		body, err := cbor.Marshal(msg.value)
+		if err != nil {
+			return fmt.Errorf("error marshaling %s: %w", msg.name, err)
+		}
+		p.queue = append(p.queue, &serviceinfo.KV{Key: msg.name, Val: body})
+	}
+	p.queue = append(p.queue, &serviceinfo.KV{Key: "apply", Val: []byte{0xf6}})
+	return nil
+}
+
+type wifiState struct {
+	Started bool
+	Applied int
+
+	// Messages not yet sent and the length of the first, which may have
+	// been partially sent
+	Queued  int
+	HeadLen int
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. Networks are not
+// included, so that credentials are not persisted with the module state.
+// Instead, unsent messages are recreated from Networks when the module is
+// restored.
+func (p *ProvisionWifi) MarshalBinary() ([]byte, error) {
+	state := wifiState{Started: p.started, Applied: p.applied, Queued: len(p.queue)}
+	if len(p.queue) > 0 {
+		state.HeadLen = len(p.queue[0].Val)
+	}
+	return cbor.Marshal(state)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (p *ProvisionWifi) UnmarshalBinary(data []byte) error {
+	var state wifiState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	p.started, p.applied, p.queue = state.Started, state.Applied, nil
+	if !p.started || state.Queued == 0 {
+		return nil
+	}
+	if err := p.enqueueAll(); err != nil {
+		return err
+	}
+	if state.Queued > len(p.queue) || state.HeadLen > len(p.queue[len(p.queue)-state.Queued].Val) {
+		return errors.New("networks do not match restored state")
+	}
+	p.queue = p.queue[len(p.queue)-state.Queued:]
+	head := p.queue[0]
+	head.Val = head.Val[len(head.Val)-state.HeadLen:]
+	return nil
+}
@@ -0,0 +1,715 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// maxCapturedOutput is the maximum number of bytes of stdout and stderr which
+// are captured for each workflow command step.
+const maxCapturedOutput = 64 << 10
+
+// Workflow is a declarative list of owner service info steps, usually parsed
+// from JSON with [ParseWorkflow]. Each step runs one fsim owner module:
+//
+//	{
+//	  "steps": [
+//	    {
+//	      "name": "agent",
+//	      "when": {"devmod": {"arch": "arm64"}},
+//	      "download": {"file": "dist/agent-arm64", "name": "/opt/agent"}
+//	    },
+//	    {
+//	      "name": "install",
+//	      "command": {"command": "sh", "args": ["-c", "/opt/agent install"]}
+//	    },
+//	    {
+//	      "name": "log",
+//	      "may_fail": true,
+//	      "upload": {"name": "/var/log/agent.log", "dir": "uploads"}
+//	    }
+//	  ]
+//	}
+//
+// Use [Workflow.Plan] as the Plan of a [serviceinfo.PlanStateMachine] to run
+// the workflow for each onboarding device.
+type Workflow struct {
+	Steps []WorkflowStep `json:"steps"`
+
+	// Record, if non-nil, is called with the result of each step for each
+	// device, including steps which were skipped.
+	Record func(ctx context.Context, guid protocol.GUID, result WorkflowResult) `json:"-"`
+}
+
+// WorkflowStep runs exactly one owner module, set by one of Download, Upload,
+// Command, Wget, or SysConfig.
+type WorkflowStep struct {
+	// Name identifies the step in results. It must be unique.
+	Name string `json:"name"`
+
+	// When optionally restricts which devices run the step.
+	When *WorkflowCondition `json:"when,omitempty"`
+
+	// MayFail allows onboarding to continue if the step fails. The error is
+	// recorded in the step's result.
+	MayFail bool `json:"may_fail,omitempty"`
+
+	Download  *WorkflowDownload  `json:"download,omitempty"`
+	Upload    *WorkflowUpload    `json:"upload,omitempty"`
+	Command   *WorkflowCommand   `json:"command,omitempty"`
+	Wget      *WorkflowWget      `json:"wget,omitempty"`
+	SysConfig *WorkflowSysConfig `json:"sysconfig,omitempty"`
+}
+
+// WorkflowCondition matches devices by devmod values and supported modules.
+type WorkflowCondition struct {
+	// Devmod maps devmod message names, i.e. "arch", to glob patterns (see
+	// [path.Match]) which the device's value must match.
+	Devmod map[string]string `json:"devmod,omitempty"`
+
+	// Modules are service info modules which the device must support, in
+	// addition to the module of the step itself.
+	Modules []string `json:"modules,omitempty"`
+}
+
+// WorkflowDownload sends a local file, or an archive of files, to the device
+// with fdo.download.
+type WorkflowDownload struct {
+	// File is the local path of the file to send.
+	File string `json:"file"`
+
+	// Name is the name of the file, or directory for archives, on the device.
+	Name string `json:"name"`
+
+	// Archive optionally sends all files matching the glob pattern File as an
+	// archive of this format.
+	Archive ArchiveFormat `json:"archive,omitempty"`
+
+	// Resume enables the resume extension (see [DownloadContents]).
+	Resume bool `json:"resume,omitempty"`
+}
+
+// WorkflowUpload requests a file from the device with fdo.upload.
+type WorkflowUpload struct {
+	// Name is the file, or glob pattern for archives, on the device.
+	Name string `json:"name"`
+
+	// Dir is the local directory under which uploads are stored. Each device
+	// uploads to a subdirectory named by its GUID.
+	Dir string `json:"dir"`
+
+	// Rename optionally sets the local file name.
+	Rename string `json:"rename,omitempty"`
+
+	// Archive optionally requests all files matching Name as an archive.
+	Archive ArchiveFormat `json:"archive,omitempty"`
+}
+
+// WorkflowCommand runs a command on the device with fdo.command.
+type WorkflowCommand struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+
+	// CaptureOutput records up to 64 KiB each of stdout and stderr in the
+	// step's result.
+	CaptureOutput bool `json:"capture_output,omitempty"`
+}
+
+// WorkflowWget has the device download a file with fdo.wget.
+type WorkflowWget struct {
+	URL    string `json:"url"`
+	Name   string `json:"name"`
+	Length int64  `json:"length,omitempty"`
+	SHA384 string `json:"sha384,omitempty"` // hex-encoded
+}
+
+// WorkflowSysConfig applies system settings with fdo.sysconfig.
+type WorkflowSysConfig struct {
+	Hostname  string `json:"hostname,omitempty"`
+	Timezone  string `json:"timezone,omitempty"`
+	NTPServer string `json:"ntp_server,omitempty"`
+	Locale    string `json:"locale,omitempty"`
+}
+
+// WorkflowResult is the outcome of a workflow step for a device.
+type WorkflowResult struct {
+	Step   string
+	Module string
+
+	// Skipped is true if the device did not match the step's condition or
+	// did not support its module.
+	Skipped bool
+
+	// Err is the reason the step failed. Steps which fail without MayFail
+	// also fail TO2.
+	Err error
+
+	// ExitCode, Stdout, and Stderr are set for command steps. Output is only
+	// captured if requested.
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+
+	// Files are the local paths of uploaded files, or directories for
+	// archives.
+	Files []string
+}
+
+// ParseWorkflow decodes and validates a JSON workflow.
+func ParseWorkflow(r io.Reader) (*Workflow, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var w Workflow
+	if err := dec.Decode(&w); err != nil {
+		return nil, fmt.Errorf("error decoding workflow: %w", err)
+	}
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// Validate checks that each step is named uniquely and runs exactly one
+// module.
+func (w *Workflow) Validate() error {
+	names := make(map[string]bool)
+	for i, step := range w.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("workflow step %d: name is required", i)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("workflow step %q: duplicate name", step.Name)
+		}
+		names[step.Name] = true
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("workflow step %q: %w", step.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *WorkflowStep) validate() error {
+	var n int
+	for _, set := range []bool{s.Download != nil, s.Upload != nil, s.Command != nil, s.Wget != nil, s.SysConfig != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of download, upload, command, wget, or sysconfig is required")
+	}
+	if s.When != nil {
+		for name, pattern := range s.When.Devmod {
+			if _, ok := new(serviceinfo.Devmod).Field(name); !ok {
+				return fmt.Errorf("unknown devmod field %q", name)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern for devmod field %q: %w", name, err)
+			}
+		}
+	}
+
+	switch {
+	case s.Download != nil:
+		if s.Download.File == "" || s.Download.Name == "" {
+			return errors.New("download file and name are required")
+		}
+		if s.Download.Archive != "" {
+			return s.Download.Archive.validate()
+		}
+	case s.Upload != nil:
+		if s.Upload.Name == "" || s.Upload.Dir == "" {
+			return errors.New("upload name and dir are required")
+		}
+		if s.Upload.Archive != "" {
+			return s.Upload.Archive.validate()
+		}
+	case s.Command != nil:
+		if s.Command.Command == "" {
+			return errors.New("command is required")
+		}
+	case s.Wget != nil:
+		if s.Wget.Name == "" {
+			return errors.New("wget name is required")
+		}
+		if _, err := url.Parse(s.Wget.URL); err != nil || s.Wget.URL == "" {
+			return fmt.Errorf("invalid wget URL %q", s.Wget.URL)
+		}
+		if _, err := hex.DecodeString(s.Wget.SHA384); err != nil {
+			return fmt.Errorf("invalid wget sha384: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *WorkflowStep) module() string {
+	switch {
+	case s.Download != nil:
+		return "fdo.download"
+	case s.Upload != nil:
+		return "fdo.upload"
+	case s.Command != nil:
+		return "fdo.command"
+	case s.Wget != nil:
+		return "fdo.wget"
+	default:
+		return "fdo.sysconfig"
+	}
+}
+
+// matches reports whether the device meets the step's condition.
+func (s *WorkflowStep) matches(device *serviceinfo.DeviceInfo) bool {
+	if !slices.Contains(device.Modules, s.module()) {
+		return false
+	}
+	if s.When == nil {
+		return true
+	}
+	for _, module := range s.When.Modules {
+		if !slices.Contains(device.Modules, module) {
+			return false
+		}
+	}
+	for name, pattern := range s.When.Devmod {
+		value, _ := device.Devmod.Field(name)
+		if ok, _ := path.Match(pattern, value); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Plan implements [serviceinfo.Plan], yielding the module of each step which
+// applies to the device.
+func (w *Workflow) Plan(ctx context.Context, device *serviceinfo.DeviceInfo) iter.Seq2[string, serviceinfo.OwnerModule] {
+	return func(yield func(string, serviceinfo.OwnerModule) bool) {
+		// Skipped steps are recorded when the following module starts, so
+		// that they are not recorded again if the plan is run again to
+		// restore a module
+		var skipped []WorkflowResult
+		for _, step := range w.Steps {
+			result := WorkflowResult{Step: step.Name, Module: step.module()}
+			if !step.matches(device) {
+				result.Skipped = true
+				skipped = append(skipped, result)
+				continue
+			}
+			module := &workflowModule{
+				step:    step,
+				device:  device,
+				result:  result,
+				skipped: skipped,
+				record:  func(ctx context.Context, result WorkflowResult) { w.record(ctx, device.GUID, result) },
+			}
+			skipped = nil
+			if !yield(step.module(), module) {
+				return
+			}
+		}
+		for _, result := range skipped {
+			w.record(ctx, device.GUID, result)
+		}
+	}
+}
+
+func (w *Workflow) record(ctx context.Context, guid protocol.GUID, result WorkflowResult) {
+	if w.Record != nil {
+		w.Record(ctx, guid, result)
+	}
+}
+
+// workflowModule wraps the owner module of a step to record its result and,
+// if the step may fail, to complete the module instead of failing TO2.
+type workflowModule struct {
+	serviceinfo.OwnerModule // built when the module starts
+
+	step    WorkflowStep
+	device  *serviceinfo.DeviceInfo
+	result  WorkflowResult
+	skipped []WorkflowResult // results of preceding skipped steps
+	record  func(context.Context, WorkflowResult)
+	started bool
+	err     error // error building the module or returned by it
+	done    bool
+
+	exitCode       chan int
+	exited         bool // exit code has been received
+	exitStatus     int
+	stdout, stderr *limitedBuffer
+	files          []string
+	archive        string // temporary file of a download archive
+}
+
+// start records the results of preceding skipped steps and builds the module
+// of the step.
+func (m *workflowModule) start(ctx context.Context) {
+	if m.started {
+		return
+	}
+	m.started = true
+	for _, result := range m.skipped {
+		m.record(ctx, result)
+	}
+	m.OwnerModule, m.err = m.build(m.device)
+}
+
+func (m *workflowModule) build(device *serviceinfo.DeviceInfo) (serviceinfo.OwnerModule, error) {
+	switch step := m.step; {
+	case step.Download != nil:
+		return m.buildDownload(step.Download, device.GUID)
+
+	case step.Upload != nil:
+		dir := filepath.Join(step.Upload.Dir, device.GUID.String())
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, err
+		}
+		dest := step.Upload.Rename
+		if dest == "" && step.Upload.Archive == "" {
+			dest = filepath.Base(step.Upload.Name)
+		}
+		m.files = []string{filepath.Join(dir, dest)}
+		return &UploadRequest{
+			Dir:     dir,
+			Name:    step.Upload.Name,
+			Rename:  step.Upload.Rename,
+			Archive: step.Upload.Archive,
+		}, nil
+
+	case step.Command != nil:
+		m.exitCode = make(chan int, 1)
+		cmd := &RunCommand{
+			Command:  step.Command.Command,
+			Args:     step.Command.Args,
+			Env:      step.Command.Env,
+			Dir:      step.Command.Dir,
+			MayFail:  step.MayFail,
+			ExitChan: m.exitCode,
+		}
+		if step.Command.CaptureOutput {
+			m.stdout, m.stderr = new(limitedBuffer), new(limitedBuffer)
+			cmd.Stdout, cmd.Stderr = m.stdout, m.stderr
+		}
+		return cmd, nil
+
+	case step.Wget != nil:
+		u, err := url.Parse(step.Wget.URL)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := hex.DecodeString(step.Wget.SHA384)
+		if err != nil {
+			return nil, err
+		}
+		return &WgetCommand{
+			Name:     step.Wget.Name,
+			URL:      u,
+			Length:   step.Wget.Length,
+			Checksum: sum,
+		}, nil
+
+	default:
+		return &SetSysConfig{
+			Hostname:  step.SysConfig.Hostname,
+			Timezone:  step.SysConfig.Timezone,
+			NTPServer: step.SysConfig.NTPServer,
+			Locale:    step.SysConfig.Locale,
+		}, nil
+	}
+}
+
+// buildDownload builds the module of a download step. Because the module is
+// built again each time its state is restored, files are opened for each read
+// rather than held open, and archives are written once to a temporary file
+// which is removed when the step finishes.
+func (m *workflowModule) buildDownload(download *WorkflowDownload, guid protocol.GUID) (serviceinfo.OwnerModule, error) {
+	if download.Archive == "" {
+		if _, err := os.Stat(download.File); err != nil {
+			return nil, err
+		}
+		return &DownloadContents[*workflowFile]{
+			Name:         download.Name,
+			Contents:     &workflowFile{path: filepath.Clean(download.File)},
+			MustDownload: !m.step.MayFail,
+			Resume:       download.Resume,
+		}, nil
+	}
+
+	stepID := sha256.Sum256([]byte(m.step.Name))
+	m.archive = filepath.Join(os.TempDir(), fmt.Sprintf("fdo-workflow-%s-%x", guid, stepID[:8]))
+	if _, err := os.Stat(m.archive); errors.Is(err, fs.ErrNotExist) {
+		if err := writeWorkflowArchive(m.archive, download); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &DownloadContents[*workflowFile]{
+		Name:         download.Name,
+		Contents:     &workflowFile{path: m.archive},
+		MustDownload: !m.step.MayFail,
+		Resume:       download.Resume,
+		Archive:      download.Archive,
+	}, nil
+}
+
+// writeWorkflowArchive writes the archive of a download step to a temporary
+// file and then renames it, so that a partially written archive is never
+// read.
+func writeWorkflowArchive(name string, download *WorkflowDownload) (err error) {
+	dir, pattern := filepath.Split(download.File)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if err := WriteArchive(f, os.DirFS(dir), pattern, download.Archive); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// workflowFile is a seekable reader of a local file which opens the file for
+// each read, so that no file handle is held between TO2 messages.
+type workflowFile struct {
+	path   string
+	offset int64
+}
+
+func (f *workflowFile) Read(p []byte) (int, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = file.Close() }()
+	n, err := file.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *workflowFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		info, err := os.Stat(f.path)
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size()
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (m *workflowModule) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	m.start(ctx)
+	if m.err != nil || m.done {
+		// Discard messages for a step which already failed
+		_, _ = io.Copy(io.Discard, messageBody)
+		return nil
+	}
+	if err := m.OwnerModule.HandleInfo(ctx, messageName, messageBody); err != nil {
+		m.err = err
+		if !m.step.MayFail {
+			m.done = true
+			m.finish(ctx)
+			return fmt.Errorf("workflow step %q failed: %w", m.step.Name, err)
+		}
+		_, _ = io.Copy(io.Discard, messageBody)
+	}
+	return nil
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (m *workflowModule) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	m.start(ctx)
+	if m.err == nil && !m.done {
+		blockPeer, moduleDone, m.err = m.OwnerModule.ProduceInfo(ctx, producer)
+		if m.err == nil && !moduleDone {
+			return blockPeer, false, nil
+		}
+	}
+	if !m.done {
+		m.done = true
+		m.finish(ctx)
+	}
+	if m.err != nil && !m.step.MayFail {
+		return false, false, fmt.Errorf("workflow step %q failed: %w", m.step.Name, m.err)
+	}
+	return false, true, nil
+}
+
+// receiveExitCode stores the exit code of the command, if it has been sent.
+func (m *workflowModule) receiveExitCode() {
+	if m.exitCode == nil || m.exited {
+		return
+	}
+	select {
+	case m.exitStatus = <-m.exitCode:
+		m.exited = true
+	default:
+	}
+}
+
+// finish records the result of the step and removes its temporary files.
+func (m *workflowModule) finish(ctx context.Context) {
+	if m.archive != "" {
+		_ = os.Remove(m.archive)
+	}
+	result := m.result
+	result.Err = m.err
+	if m.exitCode != nil {
+		m.receiveExitCode()
+		if !m.exited {
+			result.ExitCode = -1
+		} else if result.ExitCode = m.exitStatus; result.ExitCode != 0 && result.Err == nil {
+			result.Err = fmt.Errorf("command exited with code %d", result.ExitCode)
+		}
+	}
+	if m.stdout != nil {
+		result.Stdout, result.Stderr = m.stdout.Bytes(), m.stderr.Bytes()
+	}
+	if m.err == nil {
+		result.Files = m.files
+	}
+	m.record(ctx, result)
+}
+
+type workflowModuleState struct {
+	Started bool
+	Done    bool
+	Failed  bool
+	Err     string
+
+	// Exit code received but not yet recorded, if any
+	Exited   bool
+	ExitCode int
+
+	Stdout []byte
+	Stderr []byte
+	Module []byte
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (m *workflowModule) MarshalBinary() ([]byte, error) {
+	state := workflowModuleState{Started: m.started, Done: m.done}
+	if m.err != nil {
+		state.Failed, state.Err = true, m.err.Error()
+	}
+	m.receiveExitCode()
+	state.Exited, state.ExitCode = m.exited, m.exitStatus
+	if m.stdout != nil {
+		state.Stdout, state.Stderr = m.stdout.Bytes(), m.stderr.Bytes()
+	}
+	if m.OwnerModule != nil {
+		module, ok := m.OwnerModule.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("workflow step %q module cannot be marshaled", m.step.Name)
+		}
+		var err error
+		if state.Module, err = module.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	}
+	return cbor.Marshal(state)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The module of the
+// step, unless it has finished, is built again before its state is restored.
+func (m *workflowModule) UnmarshalBinary(data []byte) error {
+	var state workflowModuleState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	m.started, m.done = state.Started, state.Done
+	if !m.started {
+		return nil
+	}
+
+	// Modules of finished steps are not used again, so they are not built
+	if !m.done {
+		m.OwnerModule, m.err = m.build(m.device)
+	}
+	if m.OwnerModule != nil && state.Module != nil {
+		module, ok := m.OwnerModule.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return fmt.Errorf("workflow step %q module cannot be unmarshaled", m.step.Name)
+		}
+		if err := module.UnmarshalBinary(state.Module); err != nil {
+			return fmt.Errorf("error restoring workflow step %q: %w", m.step.Name, err)
+		}
+	}
+	if state.Failed {
+		m.err = errors.New(state.Err)
+	}
+	m.exited, m.exitStatus = state.Exited, state.ExitCode
+	if m.stdout != nil {
+		_, _ = m.stdout.Write(state.Stdout)
+		_, _ = m.stderr.Write(state.Stderr)
+	}
+	return nil
+}
+
+// limitedBuffer captures up to maxCapturedOutput bytes and discards the rest.
+type limitedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := maxCapturedOutput - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
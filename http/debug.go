@@ -10,10 +10,11 @@ import (
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
 	"github.com/fido-device-onboard/go-fdo/cbor/cdn"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 )
 
-func debugEnabled() bool {
-	return slog.Default().Enabled(context.Background(), slog.LevelDebug)
+func debugEnabled(ctx context.Context) bool {
+	return protocol.LoggerFromContext(ctx).Enabled(ctx, slog.LevelDebug)
 }
 
 func tryDebugNotation(b []byte) string {
@@ -24,17 +25,17 @@ func tryDebugNotation(b []byte) string {
 	return d
 }
 
-func debugUnencryptedMessage(msgType uint8, msg any) {
-	if debugEnabled() {
+func debugUnencryptedMessage(ctx context.Context, msgType uint8, msg any) {
+	if !debugEnabled(ctx) {
 		return
 	}
 	body, _ := cbor.Marshal(msg)
-	slog.Debug("unencrypted request", "msg", msgType, "body", tryDebugNotation(body))
+	protocol.LoggerFromContext(ctx).Debug("unencrypted request", "msg", msgType, "body", tryDebugNotation(body))
 }
 
-func debugDecryptedMessage(msgType uint8, decrypted []byte) {
-	if debugEnabled() {
+func debugDecryptedMessage(ctx context.Context, msgType uint8, decrypted []byte) {
+	if !debugEnabled(ctx) {
 		return
 	}
-	slog.Debug("decrypted response", "msg", msgType, "body", tryDebugNotation(decrypted))
+	protocol.LoggerFromContext(ctx).Debug("decrypted response", "msg", msgType, "body", tryDebugNotation(decrypted))
 }
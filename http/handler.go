@@ -18,6 +18,7 @@ import (
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
 	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/metrics"
 	"github.com/fido-device-onboard/go-fdo/protocol"
 )
 
@@ -26,6 +27,10 @@ const bearerPrefix = "Bearer "
 // Handler implements http.Handler and responds to all DI, TO1, and TO2 message
 // types. It is expected that the request will use the POST method and the path
 // will be of the form "/fdo/$VER/msg/$MSG".
+//
+// Optionally, GET requests to [HealthPath], [ReadyPath], and
+// [CapabilitiesPath] are also served for use by load balancers and
+// monitoring.
 type Handler struct {
 	Tokens protocol.TokenService
 
@@ -37,6 +42,52 @@ type Handler struct {
 	// MaxContentLength defaults to 65535. Negative values disable content
 	// length checking.
 	MaxContentLength int64
+
+	// MaxContentLengths overrides MaxContentLength for specific message types,
+	// i.e. to allow large TO2.DeviceServiceInfo messages while keeping
+	// TO1.HelloRV and DI.AppStart small. Negative values disable content
+	// length checking for the message type.
+	MaxContentLengths map[uint8]int64
+
+	// SourceRateLimit, if non-nil, limits the rate of TO1.HelloRV,
+	// TO2.HelloDevice, and TO2.HelloDeviceProbe messages from each source IP.
+	SourceRateLimit *RateLimiter
+
+	// GUIDRateLimit, if non-nil, limits the rate of TO1.HelloRV,
+	// TO2.HelloDevice, and TO2.HelloDeviceProbe messages for each device GUID.
+	GUIDRateLimit *RateLimiter
+
+	// SourceAddr returns the source IP of a request for rate limiting. If nil,
+	// the host of the request's RemoteAddr is used. Set this when serving
+	// behind a trusted reverse proxy.
+	SourceAddr func(*http.Request) string
+
+	// Sessions, if non-nil, caps the number of concurrently open sessions for
+	// each protocol.
+	Sessions *SessionLimiter
+
+	// Health enables the liveness endpoint, which always responds with 200 OK
+	// and does not check any backend.
+	Health bool
+
+	// Readiness, if non-nil, enables the readiness endpoint, which responds
+	// with 200 OK when Ping succeeds and 503 Service Unavailable otherwise.
+	Readiness Pinger
+
+	// Discovery enables the capability discovery endpoint, which responds with
+	// a JSON encoded [Capabilities].
+	Discovery bool
+
+	// Metrics, if non-nil, receives a measurement of each FDO message request
+	// and each error message sent by a client.
+	Metrics metrics.Metrics
+
+	// Logger, if non-nil, is used in place of slog.Default() for all log
+	// output while handling requests, including by responders. Each message
+	// is logged with attributes identifying its protocol, message type, FDO
+	// version, and a hash of its session token. Token services which issue a
+	// new token for each message will produce a new hash for each message.
+	Logger *slog.Logger
 }
 
 // versionAndMsgFromPath parses the FDO version and message type from the URL path.
@@ -94,11 +145,19 @@ func isEncryptedTO2Message(msgType uint8) bool {
 }
 
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Serve health, readiness, and discovery endpoints, if enabled
+	if h.serveProbe(w, r) {
+		return
+	}
+
 	if h.Tokens == nil {
 		panic("token service not set")
 	}
 
 	ctx := r.Context()
+	if h.Logger != nil {
+		ctx = protocol.ContextWithLogger(ctx, h.Logger)
+	}
 
 	// Parse version and message type from request URL
 	version, msgType, ok := versionAndMsgFromPath(w, r)
@@ -108,6 +167,16 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Inject version into context for downstream handlers
 	ctx = protocol.ContextWithVersion(ctx, version)
+	ctx = protocol.ContextWithMessageLogAttrs(ctx, msgType)
+
+	// Record status code and latency once the response is written
+	if h.Metrics != nil {
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		w = sw
+		defer func(start time.Time) {
+			h.Metrics.ObserveRequest(ctx, msgType, sw.code, time.Since(start))
+		}(time.Now())
+	}
 
 	proto := protocol.Of(msgType)
 
@@ -119,12 +188,13 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	if token != "" {
 		token = strings.TrimPrefix(token, bearerPrefix)
-		ctx = h.Tokens.TokenContext(r.Context(), token)
+		ctx = h.Tokens.TokenContext(ctx, token)
+		ctx = protocol.ContextWithLogAttrs(ctx, "token_hash", protocol.TokenHash(token))
 	}
 
 	// Immediately respond to an error
 	if msgType == protocol.ErrorMsgType {
-		debugRequest(w, r, h.handleError(ctx, token))
+		debugRequest(ctx, w, r, h.handleError(ctx, token))
 		return
 	}
 
@@ -151,6 +221,11 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Apply rate limits before creating any session state
+	if isProtocolStart && !h.allowHello(ctx, w, r, msgType) {
+		return
+	}
+
 	// Inject token state into context to keep method signatures clean while
 	// allowing some implementations to mutate tokens on every message.
 	if isProtocolStart {
@@ -166,19 +241,39 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		ctx = h.Tokens.TokenContext(ctx, initToken)
+		ctx = protocol.ContextWithLogAttrs(ctx, "token_hash", protocol.TokenHash(initToken))
+		if !h.Sessions.open(proto, initToken) {
+			protocol.LoggerFromContext(ctx).Warn("session limit reached")
+			writeSessionLimitErr(w, msgType, proto)
+			h.invalidateToken(ctx)
+			return
+		}
+		token = initToken
 	}
+	sess := &limitedSession{token: token}
+	ctx = context.WithValue(ctx, limitedSessionKey{}, sess)
 
-	debugRequest(w, r, func(w http.ResponseWriter, r *http.Request) {
+	debugRequest(ctx, w, r, func(w http.ResponseWriter, r *http.Request) {
 		h.handleRequest(ctx, w, r, msgType, resp)
 	})
+
+	if !sess.closed {
+		newToken, _ := h.Tokens.TokenFromContext(ctx)
+		h.Sessions.touch(token, newToken)
+	}
 }
 
 func (h Handler) handleError(ctx context.Context, token string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var errMsg protocol.ErrorMessage
 		if err := cbor.NewDecoder(r.Body).Decode(&errMsg); err != nil {
-			slog.Warn("decoding error message request body", "error", err)
+			protocol.LoggerFromContext(ctx).Warn("decoding error message request body", "error", err)
 		} else {
+			protocol.LoggerFromContext(ctx).Warn("received error message",
+				"prevMsg", errMsg.PrevMsgType, "code", errMsg.Code, "error", errMsg.ErrString)
+			if h.Metrics != nil {
+				h.Metrics.ObservePeerError(ctx, errMsg)
+			}
 			switch protocol.Of(errMsg.PrevMsgType) {
 			case protocol.DIProtocol:
 				h.DIResponder.HandleError(ctx, errMsg)
@@ -192,8 +287,9 @@ func (h Handler) handleError(ctx context.Context, token string) http.HandlerFunc
 		}
 
 		if token != "" {
+			h.Sessions.close(token)
 			if err := h.Tokens.InvalidateToken(ctx); err != nil {
-				slog.Warn("invalidating token", "error", err)
+				protocol.LoggerFromContext(ctx).Warn("invalidating token", "error", err)
 			}
 		}
 	}
@@ -201,13 +297,15 @@ func (h Handler) handleError(ctx context.Context, token string) http.HandlerFunc
 
 func (h Handler) handleRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, msgType uint8, resp protocol.Responder) {
 	// Validate content length
-	maxSize := h.MaxContentLength
-	if maxSize == 0 {
-		maxSize = 65535
-	}
+	maxSize := h.maxContentLength(msgType)
 	if maxSize > 0 && r.ContentLength > maxSize {
 		_ = r.Body.Close()
-		writeErr(w, msgType, fmt.Errorf("content too large (%d bytes)", r.ContentLength))
+		writeErr(w, msgType, protocol.ErrorMessage{
+			Code:        protocol.MessageBodyErrCode,
+			PrevMsgType: msgType,
+			ErrString:   fmt.Sprintf("content too large (%d bytes)", r.ContentLength),
+			Timestamp:   time.Now().Unix(),
+		})
 		h.invalidateToken(ctx)
 		return
 	}
@@ -252,8 +350,8 @@ func (h Handler) handleRequest(ctx context.Context, w http.ResponseWriter, r *ht
 			return
 		}
 
-		if debugEnabled() {
-			slog.Debug("decrypted request", "msg", msgType, "body", tryDebugNotation(decrypted))
+		if debugEnabled(ctx) {
+			protocol.LoggerFromContext(ctx).Debug("decrypted request", "msg", msgType, "body", tryDebugNotation(decrypted))
 		}
 
 		msg = io.NopCloser(bytes.NewBuffer(decrypted))
@@ -267,8 +365,9 @@ func (h Handler) writeResponse(ctx context.Context, w http.ResponseWriter, msgTy
 	// Perform business logic of message handling
 	respType, respData := resp.Respond(ctx, msgType, msg)
 	if respType == protocol.ErrorMsgType {
+		h.closeSession(ctx)
 		if err := h.Tokens.InvalidateToken(ctx); err != nil {
-			slog.Warn("invalidating token", "error", err)
+			protocol.LoggerFromContext(ctx).Warn("invalidating token", "error", err)
 		}
 	}
 
@@ -284,9 +383,9 @@ func (h Handler) writeResponse(ctx context.Context, w http.ResponseWriter, msgTy
 		}
 		defer sess.Destroy()
 
-		if debugEnabled() {
+		if debugEnabled(ctx) {
 			body, _ := cbor.Marshal(respData)
-			slog.Debug("unencrypted response", "msg", respType, "body", tryDebugNotation(body))
+			protocol.LoggerFromContext(ctx).Debug("unencrypted response", "msg", respType, "body", tryDebugNotation(body))
 		}
 
 		respData, err = sess.Encrypt(rand.Reader, respData)
@@ -333,13 +432,14 @@ func (h Handler) invalidateToken(ctx context.Context) {
 	if token == "" {
 		return
 	}
+	h.closeSession(ctx)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	ctx = h.Tokens.TokenContext(ctx, token)
 	if err := h.Tokens.InvalidateToken(ctx); err != nil {
-		slog.Warn("invalidating token", "error", err)
+		protocol.LoggerFromContext(ctx).Warn("invalidating token", "error", err)
 	}
 }
 
@@ -364,3 +464,14 @@ func writeErr(w http.ResponseWriter, prevMsgType uint8, err error) {
 	w.WriteHeader(http.StatusInternalServerError)
 	_, _ = w.Write(body.Bytes())
 }
+
+// statusWriter captures the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -4,13 +4,26 @@
 package http_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/fido-device-onboard/go-fdo"
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/custom"
 	"github.com/fido-device-onboard/go-fdo/fdotest"
 	fdo_http "github.com/fido-device-onboard/go-fdo/http"
 	"github.com/fido-device-onboard/go-fdo/http/internal/httputil"
+	"github.com/fido-device-onboard/go-fdo/metrics"
 	"github.com/fido-device-onboard/go-fdo/protocol"
 )
 
@@ -38,9 +51,387 @@ func TestClient(t *testing.T) {
 		})
 	})
 
+	t.Run("With Metrics", func(t *testing.T) {
+		var m metrics.Prometheus
+		fdotest.RunClientTestSuite(t, fdotest.Config{
+			NoDebug: true,
+			NewTransport: func(t *testing.T, tokens protocol.TokenService, di, to0, to1, to2 protocol.Responder) fdo.Transport {
+				di.(*fdo.DIServer[custom.DeviceMfgInfo]).Metrics = &m
+				to0.(*fdo.TO0Server).Metrics = &m
+				to1.(*fdo.TO1Server).Metrics = &m
+				to2.(*fdo.TO2Server).Metrics = &m
+				tr := newTransport(t, tokens, di, to0, to1, to2).(*fdo_http.Transport)
+				tr.Metrics = &m
+				tr.Client.Transport.(*transport).Handler.(*fdo_http.Handler).Metrics = &m
+				return tr
+			},
+		})
+
+		var out strings.Builder
+		if _, err := m.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		for _, expect := range []string{
+			`fdo_server_protocols_completed_total{protocol="TO2"} `,
+			`fdo_client_protocols_completed_total{protocol="DI"} `,
+			`fdo_http_requests_total{msg_type="60",code="200"} `,
+			`fdo_server_message_duration_seconds_count{msg_type="68"} `,
+		} {
+			if !strings.Contains(out.String(), expect) {
+				t.Errorf("expected metrics to contain %q", expect)
+			}
+		}
+		if t.Failed() {
+			t.Log(out.String())
+		}
+	})
+
 	t.Run("With Debug", func(t *testing.T) {
 		fdotest.RunClientTestSuite(t, fdotest.Config{NewTransport: newTransport})
 	})
+
+	t.Run("With Logger", func(t *testing.T) {
+		var out lockedBuffer
+		logger := slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		fdotest.RunClientTestSuite(t, fdotest.Config{
+			NoDebug: true,
+			NewTransport: func(t *testing.T, tokens protocol.TokenService, di, to0, to1, to2 protocol.Responder) fdo.Transport {
+				tr := newTransport(t, tokens, di, to0, to1, to2).(*fdo_http.Transport)
+				tr.Client.Transport.(*transport).Handler.(*fdo_http.Handler).Logger = logger
+				return tr
+			},
+		})
+
+		var found bool
+		dec := json.NewDecoder(strings.NewReader(out.String()))
+		for {
+			var record struct {
+				Msg       string `json:"msg"`
+				Protocol  string `json:"protocol"`
+				MsgType   int    `json:"msg_type"`
+				Version   string `json:"version"`
+				TokenHash string `json:"token_hash"`
+			}
+			if err := dec.Decode(&record); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if record.Protocol == "TO2" && record.MsgType != 0 && record.Version != "" && record.TokenHash != "" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected a TO2 log record annotated with version and token hash")
+			t.Log(out.String())
+		}
+	})
+}
+
+func TestProbes(t *testing.T) {
+	get := func(t *testing.T, h http.Handler, path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := new(httputil.ResponseRecorder)
+		h.ServeHTTP(rr, req)
+		return rr.Result()
+	}
+
+	handler := &fdo_http.Handler{
+		TO2Responder: new(fdo.TO2Server),
+		Health:       true,
+		Readiness:    pinger(func(context.Context) error { return nil }),
+		Discovery:    true,
+	}
+
+	t.Run("Health", func(t *testing.T) {
+		if resp := get(t, handler, fdo_http.HealthPath); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %s", resp.Status)
+		}
+	})
+
+	t.Run("Ready", func(t *testing.T) {
+		if resp := get(t, handler, fdo_http.ReadyPath); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %s", resp.Status)
+		}
+
+		notReady := *handler
+		notReady.Readiness = pinger(func(context.Context) error { return errors.New("db down") })
+		if resp := get(t, &notReady, fdo_http.ReadyPath); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503, got %s", resp.Status)
+		}
+	})
+
+	t.Run("Capabilities", func(t *testing.T) {
+		resp := get(t, handler, fdo_http.CapabilitiesPath)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %s", resp.Status)
+		}
+		var caps fdo_http.Capabilities
+		if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(caps.Responders, []string{"TO2"}) {
+			t.Errorf("expected only TO2 responder, got %v", caps.Responders)
+		}
+		if !slices.Contains(caps.Versions, "200") {
+			t.Errorf("expected version 200 to be supported, got %v", caps.Versions)
+		}
+		if !slices.Contains(caps.KeyExchangeSuites, "ECDH384") {
+			t.Errorf("expected ECDH384 to be supported, got %v", caps.KeyExchangeSuites)
+		}
+		if !slices.Contains(caps.CipherSuites, "A256GCM") {
+			t.Errorf("expected A256GCM to be supported, got %v", caps.CipherSuites)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		// Unhandled paths fall through to FDO message handling, which only
+		// accepts POST
+		disabled := &fdo_http.Handler{Tokens: tokens{}}
+		if resp := get(t, disabled, fdo_http.HealthPath); resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("expected 405, got %s", resp.Status)
+		}
+	})
+}
+
+func TestLimits(t *testing.T) {
+	post := func(t *testing.T, h http.Handler, msgType uint8, token string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/fdo/101/msg/"+strconv.Itoa(int(msgType)), bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		rr := new(httputil.ResponseRecorder)
+		h.ServeHTTP(rr, req)
+		return rr.Result()
+	}
+	hello := func(t *testing.T, guid protocol.GUID) []byte {
+		body, err := cbor.Marshal([]any{guid, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	expectErr := func(t *testing.T, resp *http.Response, code uint16) {
+		t.Helper()
+		if typ := resp.Header.Get("Message-Type"); typ != "255" {
+			t.Fatalf("expected error message, got message type %q", typ)
+		}
+		var errMsg protocol.ErrorMessage
+		if err := cbor.NewDecoder(resp.Body).Decode(&errMsg); err != nil {
+			t.Fatal(err)
+		}
+		if errMsg.Code != code {
+			t.Fatalf("expected error code %d, got %v", code, errMsg)
+		}
+	}
+	expectOK := func(t *testing.T, resp *http.Response) {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %s", resp.Status)
+		}
+	}
+	newHandler := func() *fdo_http.Handler {
+		return &fdo_http.Handler{
+			Tokens: new(memTokens),
+			TO1Responder: respondFunc(func(_ context.Context, msgType uint8, _ io.Reader) (uint8, any) {
+				if msgType == protocol.TO1HelloRVMsgType {
+					return protocol.TO1HelloRVAckMsgType, []int{}
+				}
+				return protocol.TO1RVRedirectMsgType, []int{}
+			}),
+		}
+	}
+
+	t.Run("Message Size", func(t *testing.T) {
+		h := newHandler()
+		h.MaxContentLengths = map[uint8]int64{protocol.TO1HelloRVMsgType: 8}
+		expectErr(t, post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{})), protocol.MessageBodyErrCode)
+	})
+
+	t.Run("Source Rate", func(t *testing.T) {
+		h := newHandler()
+		h.SourceRateLimit = &fdo_http.RateLimiter{Rate: 0.01, Burst: 1}
+		expectOK(t, post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{1})))
+		resp := post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{2}))
+		expectErr(t, resp, protocol.InternalServerErrCode)
+		if resp.Header.Get("Retry-After") == "" {
+			t.Error("expected Retry-After header")
+		}
+	})
+
+	t.Run("GUID Rate", func(t *testing.T) {
+		h := newHandler()
+		h.GUIDRateLimit = &fdo_http.RateLimiter{Rate: 0.01, Burst: 1}
+		expectOK(t, post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{1})))
+		expectErr(t, post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{1})), protocol.InternalServerErrCode)
+		expectOK(t, post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{2})))
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		h := newHandler()
+		h.Sessions = &fdo_http.SessionLimiter{Max: map[protocol.Protocol]int{protocol.TO1Protocol: 1}}
+		resp := post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{1}))
+		expectOK(t, resp)
+		expectErr(t, post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{2})), protocol.InternalServerErrCode)
+
+		// Completing the first session allows another to open
+		expectOK(t, post(t, h, protocol.TO1ProveToRVMsgType, resp.Header.Get("Authorization"), []byte{0x80}))
+		expectOK(t, post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{2})))
+	})
+
+	t.Run("Sessions With Changing Tokens", func(t *testing.T) {
+		tokens := new(rotatingTokens)
+		h := &fdo_http.Handler{
+			Tokens: tokens,
+			TO1Responder: respondFunc(func(ctx context.Context, msgType uint8, _ io.Reader) (uint8, any) {
+				tokens.update(ctx)
+				switch msgType {
+				case protocol.TO1HelloRVMsgType:
+					return protocol.TO1HelloRVAckMsgType, []int{}
+				case protocol.TO1ProveToRVMsgType:
+					return protocol.TO1RVRedirectMsgType, []int{}
+				default:
+					return protocol.ErrorMsgType, protocol.ErrorMessage{Code: protocol.InvalidMessageErrCode, PrevMsgType: msgType}
+				}
+			}),
+			Sessions: &fdo_http.SessionLimiter{Max: map[protocol.Protocol]int{protocol.TO1Protocol: 1}},
+		}
+
+		// Failing the first session allows another to open
+		resp := post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{1}))
+		expectOK(t, resp)
+		expectErr(t, post(t, h, protocol.TO1HelloRVAckMsgType, resp.Header.Get("Authorization"), []byte{0x80}), protocol.InvalidMessageErrCode)
+
+		// Completing the second session allows another to open
+		resp = post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{2}))
+		expectOK(t, resp)
+		expectOK(t, post(t, h, protocol.TO1ProveToRVMsgType, resp.Header.Get("Authorization"), []byte{0x80}))
+		expectOK(t, post(t, h, protocol.TO1HelloRVMsgType, "", hello(t, protocol.GUID{3})))
+	})
+}
+
+type pinger func(context.Context) error
+
+func (p pinger) Ping(ctx context.Context) error { return p(ctx) }
+
+// tokens is a token service which must never be called.
+type tokens struct{ protocol.TokenService }
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type respondFunc func(context.Context, uint8, io.Reader) (uint8, any)
+
+func (f respondFunc) Respond(ctx context.Context, msgType uint8, msg io.Reader) (uint8, any) {
+	return f(ctx, msgType, msg)
+}
+
+func (f respondFunc) HandleError(context.Context, protocol.ErrorMessage) {}
+
+type tokenKey struct{}
+
+// memTokens is a minimal token service which tracks valid tokens in memory.
+type memTokens struct {
+	mu    sync.Mutex
+	next  int
+	valid map[string]bool
+}
+
+func (m *memTokens) NewToken(context.Context, protocol.Protocol) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.valid == nil {
+		m.valid = make(map[string]bool)
+	}
+	m.next++
+	token := strconv.Itoa(m.next)
+	m.valid[token] = true
+	return token, nil
+}
+
+func (m *memTokens) InvalidateToken(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, _ := ctx.Value(tokenKey{}).(string)
+	if !m.valid[token] {
+		return errors.New("not found")
+	}
+	delete(m.valid, token)
+	return nil
+}
+
+func (m *memTokens) TokenContext(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+func (m *memTokens) TokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenKey{}).(string)
+	return token, ok
+}
+
+// rotatingTokens is a token service which changes the token on every update,
+// as token services with token-encoded state do.
+type rotatingTokens struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (r *rotatingTokens) NewToken(context.Context, protocol.Protocol) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	return strconv.Itoa(r.next), nil
+}
+
+// update replaces the token of the current session.
+func (r *rotatingTokens) update(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if token, ok := ctx.Value(tokenKey{}).(*string); ok && *token != "" {
+		r.next++
+		*token = strconv.Itoa(r.next)
+	}
+}
+
+func (r *rotatingTokens) InvalidateToken(ctx context.Context) error {
+	if token, ok := ctx.Value(tokenKey{}).(*string); ok {
+		*token = ""
+	}
+	return nil
+}
+
+func (r *rotatingTokens) TokenContext(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, &token)
+}
+
+func (r *rotatingTokens) TokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(tokenKey{}).(*string)
+	if !ok {
+		return "", false
+	}
+	return *token, true
 }
 
 type transport struct {
@@ -0,0 +1,302 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// RateLimiter is a token bucket rate limiter keyed by an arbitrary string,
+// such as a source IP or device GUID. Each key may perform Burst events
+// immediately and then Rate events per second thereafter.
+//
+// Rate and Burst must not be modified after the first call to Allow.
+type RateLimiter struct {
+	// Rate is the number of events per second allowed for each key.
+	Rate float64
+
+	// Burst is the maximum number of events allowed at once for each key. If
+	// less than one, then one is used.
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// sweepInterval is the minimum time between removals of idle buckets.
+const sweepInterval = time.Minute
+
+// Allow reports whether an event for the key may happen now. If not, the
+// returned duration is the time to wait before the next event is allowed.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(max(l.Burst, 1))
+	now := time.Now()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+		l.lastSweep = now
+	}
+
+	// Remove buckets which have refilled, so that memory is not held for
+	// every key ever seen
+	if now.Sub(l.lastSweep) > sweepInterval {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.Rate <= 0 {
+		return false, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// SessionLimiter caps the number of concurrently open sessions for each
+// protocol. A session is open from its first message until its token is
+// invalidated, either by completing the protocol or by an error, or until no
+// message has been received for IdleTimeout.
+//
+// Limits are tracked in memory, so each server instance applies its limits
+// independently.
+type SessionLimiter struct {
+	// Max is the maximum number of open sessions for each protocol. Protocols
+	// which are not present are not limited.
+	Max map[protocol.Protocol]int
+
+	// IdleTimeout is the time after the last message of a session at which it
+	// is no longer counted as open. If zero, five minutes is used.
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*openSession
+}
+
+type openSession struct {
+	protocol protocol.Protocol
+	last     time.Time
+}
+
+const defaultSessionIdleTimeout = 5 * time.Minute
+
+// open starts tracking a new session, returning false if the protocol is at
+// its limit of open sessions.
+func (l *SessionLimiter) open(prot protocol.Protocol, token string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions == nil {
+		l.sessions = make(map[string]*openSession)
+	}
+	now := time.Now()
+	timeout := l.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultSessionIdleTimeout
+	}
+
+	if limit, ok := l.Max[prot]; ok {
+		var count int
+		for k, sess := range l.sessions {
+			if now.Sub(sess.last) > timeout {
+				delete(l.sessions, k)
+				continue
+			}
+			if sess.protocol == prot {
+				count++
+			}
+		}
+		if count >= limit {
+			return false
+		}
+	}
+
+	l.sessions[token] = &openSession{protocol: prot, last: now}
+	return true
+}
+
+// touch marks a session as active. If the token service mutated the token,
+// then the session is rekeyed to the new token.
+func (l *SessionLimiter) touch(oldToken, newToken string) {
+	if l == nil || oldToken == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sess, ok := l.sessions[oldToken]
+	if !ok {
+		return
+	}
+	sess.last = time.Now()
+	if newToken != "" && newToken != oldToken {
+		delete(l.sessions, oldToken)
+		l.sessions[newToken] = sess
+	}
+}
+
+// limitedSessionKey is the context key for the *limitedSession of a request.
+type limitedSessionKey struct{}
+
+// limitedSession is the session limiter state of a request. The session is
+// tracked by the token sent by the client, because the token service may
+// change the token while the message is handled.
+type limitedSession struct {
+	token  string
+	closed bool
+}
+
+// closeSession stops tracking the session of the current request.
+func (h Handler) closeSession(ctx context.Context) {
+	sess, ok := ctx.Value(limitedSessionKey{}).(*limitedSession)
+	if !ok || sess.closed {
+		return
+	}
+	sess.closed = true
+	h.Sessions.close(sess.token)
+}
+
+// close stops tracking a session.
+func (l *SessionLimiter) close(token string) {
+	if l == nil || token == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, token)
+}
+
+// maxContentLength returns the maximum request body size for a message type
+// or a negative value if unlimited.
+func (h Handler) maxContentLength(msgType uint8) int64 {
+	if maxSize, ok := h.MaxContentLengths[msgType]; ok {
+		return maxSize
+	}
+	if h.MaxContentLength == 0 {
+		return 65535
+	}
+	return h.MaxContentLength
+}
+
+// allowHello applies rate limits to the first message of TO1 and TO2. If the
+// message is not allowed, then an error response is written and false is
+// returned.
+func (h Handler) allowHello(ctx context.Context, w http.ResponseWriter, r *http.Request, msgType uint8) bool {
+	// Index of the GUID in the message body array
+	var guidIndex int
+	switch msgType {
+	case protocol.TO1HelloRVMsgType:
+		guidIndex = 0
+	case protocol.TO2HelloDeviceMsgType, protocol.TO2HelloDeviceProbeMsgType:
+		guidIndex = 1
+	default:
+		return true
+	}
+
+	if h.SourceRateLimit != nil {
+		addr := h.sourceAddr(r)
+		if ok, retry := h.SourceRateLimit.Allow(addr); !ok {
+			protocol.LoggerFromContext(ctx).Warn("rate limit exceeded", "source", addr)
+			writeRateLimitErr(w, msgType, retry)
+			return false
+		}
+	}
+
+	// Leave oversized or unsized bodies to be rejected by content length
+	// checks
+	maxSize := h.maxContentLength(msgType)
+	if h.GUIDRateLimit == nil || r.ContentLength <= 0 || (maxSize > 0 && r.ContentLength > maxSize) {
+		return true
+	}
+
+	// Read the body to find the GUID and then replace it for the responder
+	body, err := io.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+	_ = r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return true
+	}
+	var fields []cbor.RawBytes
+	var guid protocol.GUID
+	if err := cbor.Unmarshal(body, &fields); err != nil || len(fields) <= guidIndex {
+		return true
+	}
+	if err := cbor.Unmarshal(fields[guidIndex], &guid); err != nil {
+		return true
+	}
+	if ok, retry := h.GUIDRateLimit.Allow(guid.String()); !ok {
+		protocol.LoggerFromContext(ctx).Warn("rate limit exceeded", "guid", guid.String())
+		writeRateLimitErr(w, msgType, retry)
+		return false
+	}
+	return true
+}
+
+// sourceAddr returns the rate limiting key of the client.
+func (h Handler) sourceAddr(r *http.Request) string {
+	if h.SourceAddr != nil {
+		return h.SourceAddr(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeRateLimitErr(w http.ResponseWriter, prevMsgType uint8, retry time.Duration) {
+	if retry > 0 {
+		w.Header().Add("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	}
+	writeErr(w, prevMsgType, protocol.ErrorMessage{
+		Code:        protocol.InternalServerErrCode,
+		PrevMsgType: prevMsgType,
+		ErrString:   "rate limit exceeded",
+		Timestamp:   time.Now().Unix(),
+	})
+}
+
+func writeSessionLimitErr(w http.ResponseWriter, prevMsgType uint8, prot protocol.Protocol) {
+	writeErr(w, prevMsgType, protocol.ErrorMessage{
+		Code:        protocol.InternalServerErrCode,
+		PrevMsgType: prevMsgType,
+		ErrString:   fmt.Sprintf("too many open %s sessions", prot),
+		Timestamp:   time.Now().Unix(),
+	})
+}
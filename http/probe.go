@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// Paths of the optional probe and discovery endpoints served by Handler.
+const (
+	HealthPath       = "/health"
+	ReadyPath        = "/ready"
+	CapabilitiesPath = "/capabilities"
+)
+
+// Pinger is implemented by server state backends which can report whether
+// they are currently able to serve requests.
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// Capabilities is the JSON body served by the discovery endpoint.
+type Capabilities struct {
+	// Responders lists the protocols (DI, TO0, TO1, TO2) with a responder
+	// configured.
+	Responders []string `json:"responders"`
+
+	// Versions lists the FDO protocol versions accepted in request paths.
+	Versions []string `json:"versions"`
+
+	// KeyExchangeSuites lists the registered key exchange suite names.
+	KeyExchangeSuites []string `json:"kexSuites"`
+
+	// CipherSuites lists the registered cipher suite names.
+	CipherSuites []string `json:"cipherSuites"`
+}
+
+// serveProbe handles the health, readiness, and discovery endpoints when they
+// are enabled and reports whether the request was handled.
+func (h Handler) serveProbe(w http.ResponseWriter, r *http.Request) bool {
+	var probe http.HandlerFunc
+	switch {
+	case r.URL.Path == HealthPath && h.Health:
+		probe = h.health
+	case r.URL.Path == ReadyPath && h.Readiness != nil:
+		probe = h.ready
+	case r.URL.Path == CapabilitiesPath && h.Discovery:
+		probe = h.capabilities
+	default:
+		return false
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return true
+	}
+	probe(w, r)
+	return true
+}
+
+func (h Handler) health(w http.ResponseWriter, _ *http.Request) {
+	writeProbe(w, http.StatusOK, "text/plain; charset=utf-8", []byte("ok\n"))
+}
+
+func (h Handler) ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	// Do not expose backend errors to unauthenticated callers
+	if err := h.Readiness.Ping(ctx); err != nil {
+		protocol.LoggerFromContext(ctx).Warn("readiness check failed", "error", err)
+		writeProbe(w, http.StatusServiceUnavailable, "text/plain; charset=utf-8", []byte("not ready\n"))
+		return
+	}
+	writeProbe(w, http.StatusOK, "text/plain; charset=utf-8", []byte("ok\n"))
+}
+
+func (h Handler) capabilities(w http.ResponseWriter, _ *http.Request) {
+	body, err := json.Marshal(h.Capabilities())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeProbe(w, http.StatusOK, "application/json", body)
+}
+
+// Capabilities reports the responders, protocol versions, key exchange
+// suites, and cipher suites supported by the handler.
+func (h Handler) Capabilities() Capabilities {
+	caps := Capabilities{
+		Responders:        []string{},
+		Versions:          []string{protocol.Version101.String(), protocol.Version200.String()},
+		KeyExchangeSuites: []string{},
+		CipherSuites:      []string{},
+	}
+	for _, r := range []struct {
+		prot protocol.Protocol
+		resp protocol.Responder
+	}{
+		{protocol.DIProtocol, h.DIResponder},
+		{protocol.TO0Protocol, h.TO0Responder},
+		{protocol.TO1Protocol, h.TO1Responder},
+		{protocol.TO2Protocol, h.TO2Responder},
+	} {
+		if r.resp != nil {
+			caps.Responders = append(caps.Responders, r.prot.String())
+		}
+	}
+	for _, suite := range kex.Suites() {
+		caps.KeyExchangeSuites = append(caps.KeyExchangeSuites, string(suite))
+	}
+	for _, id := range kex.CipherSuites() {
+		caps.CipherSuites = append(caps.CipherSuites, id.String())
+	}
+	return caps
+}
+
+func writeProbe(w http.ResponseWriter, code int, contentType string, body []byte) {
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Add("Content-Type", contentType)
+	w.WriteHeader(code)
+	_, _ = w.Write(body)
+}
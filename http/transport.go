@@ -15,9 +15,11 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
 	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/metrics"
 	"github.com/fido-device-onboard/go-fdo/protocol"
 )
 
@@ -50,10 +52,23 @@ type Transport struct {
 	// FdoVersion specifies the FDO protocol version (101 for 1.01, 200 for 2.0).
 	// Defaults to 101 if not set.
 	FdoVersion protocol.Version
+
+	// Metrics, if non-nil, receives a measurement of each message round trip.
+	Metrics metrics.Metrics
 }
 
 // Send sends a single message and receives a single response message.
-func (t *Transport) Send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (respType uint8, _ io.ReadCloser, _ error) {
+func (t *Transport) Send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (uint8, io.ReadCloser, error) {
+	if t.Metrics == nil {
+		return t.send(ctx, msgType, msg, sess)
+	}
+	start := time.Now()
+	respType, resp, err := t.send(ctx, msgType, msg, sess)
+	t.Metrics.ObserveSend(ctx, msgType, respType, err, time.Since(start))
+	return respType, resp, err
+}
+
+func (t *Transport) send(ctx context.Context, msgType uint8, msg any, sess kex.Session) (respType uint8, _ io.ReadCloser, _ error) {
 	// Initialize default values
 	if t.Client == nil {
 		t.Client = http.DefaultClient
@@ -62,9 +77,11 @@ func (t *Transport) Send(ctx context.Context, msgType uint8, msg any, sess kex.S
 		t.Auth = make(jar)
 	}
 
+	ctx = protocol.ContextWithLogAttrs(ctx, "msg_type", msgType)
+
 	// Encrypt if a key exchange session is provided
 	if sess != nil {
-		debugUnencryptedMessage(msgType, msg)
+		debugUnencryptedMessage(ctx, msgType, msg)
 		var err error
 		msg, err = sess.Encrypt(rand.Reader, msg)
 		if err != nil {
@@ -184,7 +201,7 @@ func (t *Transport) handleResponse(resp *http.Response, sess kex.Session) (msgTy
 		if err != nil {
 			return 0, nil, fmt.Errorf("error decrypting message %d: %w", msgType, err)
 		}
-		debugDecryptedMessage(msgType, decrypted)
+		debugDecryptedMessage(resp.Request.Context(), msgType, decrypted)
 
 		content = io.NopCloser(bytes.NewBuffer(decrypted))
 	}
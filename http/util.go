@@ -7,15 +7,17 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"io"
-	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
 )
 
-func debugRequest(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
-	if !debugEnabled() {
+func debugRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	if !debugEnabled(ctx) {
 		handler.ServeHTTP(w, r)
 		return
 	}
@@ -26,14 +28,14 @@ func debugRequest(w http.ResponseWriter, r *http.Request, handler http.HandlerFu
 	if _, err := saveBody.ReadFrom(r.Body); err == nil {
 		r.Body = io.NopCloser(&saveBody)
 	}
-	slog.Debug("request", "dump", string(bytes.TrimSpace(debugReq)),
+	protocol.LoggerFromContext(ctx).Debug("request", "dump", string(bytes.TrimSpace(debugReq)),
 		"body", tryDebugNotation(saveBody.Bytes()))
 
 	// Dump response
 	rr := httptest.NewRecorder()
 	handler(rr, r)
 	debugResp, _ := httputil.DumpResponse(rr.Result(), false)
-	slog.Debug("response", "dump", string(bytes.TrimSpace(debugResp)),
+	protocol.LoggerFromContext(ctx).Debug("response", "dump", string(bytes.TrimSpace(debugResp)),
 		"body", tryDebugNotation(rr.Body.Bytes()))
 
 	// Copy recorded response into response writer
@@ -47,16 +49,18 @@ func debugRequest(w http.ResponseWriter, r *http.Request, handler http.HandlerFu
 }
 
 func debugRequestOut(req *http.Request, body *bytes.Buffer) {
-	if !debugEnabled() {
+	ctx := req.Context()
+	if !debugEnabled(ctx) {
 		return
 	}
 	debugReq, _ := httputil.DumpRequestOut(req, false)
-	slog.Debug("request", "dump", string(bytes.TrimSpace(debugReq)),
+	protocol.LoggerFromContext(ctx).Debug("request", "dump", string(bytes.TrimSpace(debugReq)),
 		"body", tryDebugNotation(body.Bytes()))
 }
 
 func debugResponse(resp *http.Response) {
-	if !debugEnabled() {
+	ctx := resp.Request.Context()
+	if !debugEnabled(ctx) {
 		return
 	}
 	debugResp, _ := httputil.DumpResponse(resp, false)
@@ -64,6 +68,6 @@ func debugResponse(resp *http.Response) {
 	if _, err := saveBody.ReadFrom(resp.Body); err == nil {
 		resp.Body = io.NopCloser(&saveBody)
 	}
-	slog.Debug("response", "dump", string(bytes.TrimSpace(debugResp)),
+	protocol.LoggerFromContext(ctx).Debug("response", "dump", string(bytes.TrimSpace(debugResp)),
 		"body", tryDebugNotation(saveBody.Bytes()))
 }
@@ -7,17 +7,18 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"strings"
 
 	"github.com/fido-device-onboard/go-fdo/http/internal/httputil"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 )
 
-func debugRequest(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
-	if !debugEnabled() {
+func debugRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	if !debugEnabled(ctx) {
 		handler(w, r)
 		return
 	}
@@ -28,7 +29,7 @@ func debugRequest(w http.ResponseWriter, r *http.Request, handler http.HandlerFu
 	if _, err := saveBody.ReadFrom(r.Body); err == nil {
 		r.Body = io.NopCloser(&saveBody)
 	}
-	slog.Debug("request", "dump", string(bytes.TrimSpace(debugReq)),
+	protocol.LoggerFromContext(ctx).Debug("request", "dump", string(bytes.TrimSpace(debugReq)),
 		"body", tryDebugNotation(saveBody.Bytes()))
 
 	// Dump response
@@ -37,7 +38,7 @@ func debugRequest(w http.ResponseWriter, r *http.Request, handler http.HandlerFu
 	resp := rr.Result()
 	debugResp, _ := dumpResponse(resp)
 	respBody, _ := io.ReadAll(resp.Body)
-	slog.Debug("response", "dump", string(bytes.TrimSpace(debugResp)),
+	protocol.LoggerFromContext(ctx).Debug("response", "dump", string(bytes.TrimSpace(debugResp)),
 		"body", tryDebugNotation(respBody))
 
 	// Copy recorded response into response writer
@@ -51,7 +52,8 @@ func debugRequest(w http.ResponseWriter, r *http.Request, handler http.HandlerFu
 }
 
 func debugRequestOut(req *http.Request, body *bytes.Buffer) {
-	if !debugEnabled() {
+	ctx := req.Context()
+	if !debugEnabled(ctx) {
 		return
 	}
 
@@ -59,12 +61,13 @@ func debugRequestOut(req *http.Request, body *bytes.Buffer) {
 	// transport to ensure that the output has all relevant headers updated and
 	// canonicalized. Improvements are welcome.
 	debugReq, _ := dumpRequest(req)
-	slog.Debug("request", "dump", string(bytes.TrimSpace(debugReq)),
+	protocol.LoggerFromContext(ctx).Debug("request", "dump", string(bytes.TrimSpace(debugReq)),
 		"body", tryDebugNotation(body.Bytes()))
 }
 
 func debugResponse(resp *http.Response) {
-	if !debugEnabled() {
+	ctx := resp.Request.Context()
+	if !debugEnabled(ctx) {
 		return
 	}
 
@@ -74,7 +77,7 @@ func debugResponse(resp *http.Response) {
 		resp.Body = io.NopCloser(&saveBody)
 	}
 	debugResp, _ := dumpResponse(resp)
-	slog.Debug("response", "dump", string(bytes.TrimSpace(debugResp)),
+	protocol.LoggerFromContext(ctx).Debug("response", "dump", string(bytes.TrimSpace(debugResp)),
 		"body", tryDebugNotation(saveBody.Bytes()))
 }
 
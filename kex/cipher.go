@@ -6,6 +6,8 @@ package kex
 import (
 	"crypto"
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -117,6 +119,10 @@ var ciphers = make(map[CipherSuiteID]CipherSuite)
 // implementing a cipher suite.
 func RegisterCipherSuite(id CipherSuiteID, suite CipherSuite) { ciphers[id] = suite }
 
+// CipherSuites returns the IDs of all registered cipher suites in ascending
+// order.
+func CipherSuites() []CipherSuiteID { return slices.Sorted(maps.Keys(ciphers)) }
+
 // ┌────────────────────────┬──────────────────────────────────────┬─────────────────────────────────────┐
 // │Cipher Suite Name       │ Initialization Vector (IVData.iv in  │ Notes                               │
 // │(see TO2.HelloDevice)   │ "ct" message header)                 │                                     │
@@ -4,13 +4,15 @@
 package kex
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rsa"
-	"log/slog"
+	"slices"
 
 	"github.com/fido-device-onboard/go-fdo/cose"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 )
 
 // Available returns whether the given key exchange and cipher suites are both
@@ -93,7 +95,14 @@ const (
 //	│ ECDSA NIST P-256      ECDSA NIST P-384            ECDH384 (Not a recommended configuration, see note)               │
 //	│ ECDSA NIST P-384      ECDSA NIST P-384            ECDH384                                                           │
 //	└─────────────────────────────────────────────────────────────────────────────────────────────────────────────────────┘
-func (s Suite) Valid(device, owner crypto.PublicKey) bool { //nolint:gocyclo
+func (s Suite) Valid(device, owner crypto.PublicKey) bool {
+	return s.ValidContext(context.Background(), device, owner)
+}
+
+// ValidContext is like [Suite.Valid], but warnings of configurations which
+// are not recommended are written to the logger of the context (see
+// [protocol.LoggerFromContext]).
+func (s Suite) ValidContext(ctx context.Context, device, owner crypto.PublicKey) bool { //nolint:gocyclo
 	var deviceIsP256, deviceIsP384, deviceIsRSA bool
 	switch deviceKey := device.(type) {
 	case *rsa.PublicKey:
@@ -131,20 +140,20 @@ func (s Suite) Valid(device, owner crypto.PublicKey) bool { //nolint:gocyclo
 	case deviceIsP256 && ownerIsRSA2048 && (s == DHKEXid14Suite || s == ASYMKEX2048Suite):
 		return true
 	case deviceIsP384 && ownerIsRSA2048 && (s == DHKEXid14Suite || s == ASYMKEX2048Suite):
-		slog.Warn("Device P-384/Owner RSA2048 is not a recommended configuration")
+		protocol.LoggerFromContext(ctx).Warn("Device P-384/Owner RSA2048 is not a recommended configuration")
 		return true
 	case deviceIsP256 && ownerIsRSA3072 && (s == DHKEXid15Suite || s == ASYMKEX3072Suite):
-		slog.Warn("Device P-256/Owner RSA3072 is not a recommended configuration")
+		protocol.LoggerFromContext(ctx).Warn("Device P-256/Owner RSA3072 is not a recommended configuration")
 		return true
 	case deviceIsP384 && ownerIsRSA3072 && (s == DHKEXid15Suite || s == ASYMKEX3072Suite):
 		return true
 	case deviceIsP256 && ownerIsP256 && s == ECDH256Suite:
 		return true
 	case deviceIsP384 && ownerIsP256 && s == ECDH256Suite:
-		slog.Warn("Device P-384/Owner P-256 is not a recommended configuration")
+		protocol.LoggerFromContext(ctx).Warn("Device P-384/Owner P-256 is not a recommended configuration")
 		return true
 	case deviceIsP256 && ownerIsP384 && s == ECDH384Suite:
-		slog.Warn("Device P-256/Owner P-384 is not a recommended configuration")
+		protocol.LoggerFromContext(ctx).Warn("Device P-256/Owner P-384 is not a recommended configuration")
 		return true
 	case deviceIsP384 && ownerIsP384 && s == ECDH384Suite:
 		return true
@@ -160,6 +169,17 @@ func RegisterKeyExchangeSuite(name string, f func([]byte, CipherSuiteID) Session
 	constructors[name] = f
 }
 
+// Suites returns the names of all registered key exchange suites in lexical
+// order.
+func Suites() []Suite {
+	suites := make([]Suite, 0, len(constructors))
+	for name := range constructors {
+		suites = append(suites, Suite(name))
+	}
+	slices.Sort(suites)
+	return suites
+}
+
 // New returns a Session for the given key exchange suite. If no session
 // constructor is registered for the suite, then the return value is nil.
 //
@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+// Package metrics defines instrumentation hooks for FDO responders and
+// transports and provides an implementation which serves Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// Metrics receives measurements from protocol responders and transports.
+// Implementations must be safe for concurrent use and should return quickly,
+// as they are called inline with message handling.
+type Metrics interface {
+	// ObserveResponse is called by the DI, TO0, TO1, and TO2 responders after
+	// handling each request message. If respType is protocol.ErrorMsgType,
+	// then errCode is the code of the error message being returned, otherwise
+	// it is zero.
+	ObserveResponse(ctx context.Context, msgType, respType uint8, errCode uint16, elapsed time.Duration)
+
+	// ObserveRequest is called by a server transport after writing the
+	// response to each request message.
+	ObserveRequest(ctx context.Context, msgType uint8, statusCode int, elapsed time.Duration)
+
+	// ObservePeerError is called by a server transport when the peer sends an
+	// error message.
+	ObservePeerError(ctx context.Context, errMsg protocol.ErrorMessage)
+
+	// ObserveSend is called by a client transport after each request message
+	// is sent and its response received. If err is non-nil, then respType is
+	// not meaningful.
+	ObserveSend(ctx context.Context, msgType, respType uint8, err error, elapsed time.Duration)
+}
+
+// IsFinal reports whether a response message type successfully completes its
+// protocol: DI.Done, TO0.AcceptOwner, TO1.RVRedirect, TO2.Done2, or
+// TO2.DoneAck (2.0).
+func IsFinal(respType uint8) bool {
+	switch respType {
+	case protocol.DIDoneMsgType, protocol.TO0AcceptOwnerMsgType, protocol.TO1RVRedirectMsgType,
+		protocol.TO2Done2MsgType, protocol.TO2DoneAck20MsgType:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,287 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// DefaultBuckets are the histogram upper bounds, in seconds, used when
+// Prometheus.Buckets is not set.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Prometheus implements Metrics by aggregating counters and latency
+// histograms in memory. It also implements http.Handler, serving the
+// aggregated values in the Prometheus text exposition format (version 0.0.4).
+//
+// The zero value is ready to use.
+type Prometheus struct {
+	// Buckets are the upper bounds, in seconds, of latency histogram buckets.
+	// It must not be modified after the first observation. If nil,
+	// DefaultBuckets is used.
+	Buckets []float64
+
+	once sync.Once
+	mu   sync.Mutex
+
+	serverMessages  *counterVec
+	serverErrors    *counterVec
+	serverDuration  *histogramVec
+	serverCompleted *counterVec
+	httpRequests    *counterVec
+	httpDuration    *histogramVec
+	peerErrors      *counterVec
+	clientMessages  *counterVec
+	clientDuration  *histogramVec
+	clientCompleted *counterVec
+	families        []family
+}
+
+var _ Metrics = (*Prometheus)(nil)
+var _ http.Handler = (*Prometheus)(nil)
+
+func (p *Prometheus) init() {
+	p.once.Do(func() {
+		buckets := p.Buckets
+		if buckets == nil {
+			buckets = DefaultBuckets
+		}
+		buckets = slices.Clone(buckets)
+		slices.Sort(buckets)
+
+		p.serverMessages = newCounterVec("fdo_server_messages_total",
+			"Request messages handled by FDO responders.", "protocol", "msg_type", "result")
+		p.serverErrors = newCounterVec("fdo_server_errors_total",
+			"Error messages returned by FDO responders.", "protocol", "msg_type", "code")
+		p.serverDuration = newHistogramVec("fdo_server_message_duration_seconds",
+			"Time taken by FDO responders to handle request messages.", buckets, "msg_type")
+		p.serverCompleted = newCounterVec("fdo_server_protocols_completed_total",
+			"FDO protocols completed successfully by responders. TO2 completions are onboardings.", "protocol")
+		p.httpRequests = newCounterVec("fdo_http_requests_total",
+			"FDO message requests served over HTTP.", "msg_type", "code")
+		p.httpDuration = newHistogramVec("fdo_http_request_duration_seconds",
+			"Time taken to serve FDO message requests over HTTP.", buckets, "msg_type")
+		p.peerErrors = newCounterVec("fdo_peer_errors_total",
+			"Error messages received from peers.", "protocol", "code")
+		p.clientMessages = newCounterVec("fdo_client_messages_total",
+			"Request messages sent by FDO clients.", "protocol", "msg_type", "result")
+		p.clientDuration = newHistogramVec("fdo_client_message_duration_seconds",
+			"Round trip time of FDO client request messages.", buckets, "msg_type")
+		p.clientCompleted = newCounterVec("fdo_client_protocols_completed_total",
+			"FDO protocols completed successfully by clients.", "protocol")
+		p.families = []family{
+			p.serverMessages, p.serverErrors, p.serverDuration, p.serverCompleted,
+			p.httpRequests, p.httpDuration, p.peerErrors,
+			p.clientMessages, p.clientDuration, p.clientCompleted,
+		}
+	})
+}
+
+// ObserveResponse implements Metrics.
+func (p *Prometheus) ObserveResponse(_ context.Context, msgType, respType uint8, errCode uint16, elapsed time.Duration) {
+	p.init()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prot, typ := protocol.Of(msgType).String(), strconv.Itoa(int(msgType))
+	switch {
+	case respType == protocol.ErrorMsgType:
+		p.serverMessages.inc(prot, typ, "error")
+		p.serverErrors.inc(prot, typ, strconv.Itoa(int(errCode)))
+	default:
+		p.serverMessages.inc(prot, typ, "ok")
+	}
+	if IsFinal(respType) {
+		p.serverCompleted.inc(prot)
+	}
+	p.serverDuration.observe(elapsed.Seconds(), typ)
+}
+
+// ObserveRequest implements Metrics.
+func (p *Prometheus) ObserveRequest(_ context.Context, msgType uint8, statusCode int, elapsed time.Duration) {
+	p.init()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	typ := strconv.Itoa(int(msgType))
+	p.httpRequests.inc(typ, strconv.Itoa(statusCode))
+	p.httpDuration.observe(elapsed.Seconds(), typ)
+}
+
+// ObservePeerError implements Metrics.
+func (p *Prometheus) ObservePeerError(_ context.Context, errMsg protocol.ErrorMessage) {
+	p.init()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.peerErrors.inc(protocol.Of(errMsg.PrevMsgType).String(), strconv.Itoa(int(errMsg.Code)))
+}
+
+// ObserveSend implements Metrics.
+func (p *Prometheus) ObserveSend(_ context.Context, msgType, respType uint8, err error, elapsed time.Duration) {
+	p.init()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prot, typ := protocol.Of(msgType).String(), strconv.Itoa(int(msgType))
+	switch {
+	case err != nil:
+		p.clientMessages.inc(prot, typ, "transport_error")
+	case respType == protocol.ErrorMsgType:
+		p.clientMessages.inc(prot, typ, "error")
+	default:
+		p.clientMessages.inc(prot, typ, "ok")
+		if IsFinal(respType) {
+			p.clientCompleted.inc(prot)
+		}
+	}
+	p.clientDuration.observe(elapsed.Seconds(), typ)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body bytes.Buffer
+	if _, err := p.WriteTo(&body); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(body.Bytes())
+	}
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	p.init()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, f := range p.families {
+		f.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+type family interface {
+	write(*bytes.Buffer)
+}
+
+// labelSep joins label values into map keys. It is not valid UTF-8, so it
+// cannot collide with label values.
+const labelSep = "\xff"
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	values     map[string]uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]uint64)}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.values[strings.Join(labelValues, labelSep)]++
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s%s %d\n", c.name, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	values     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // cumulative is computed on write
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSep)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		labels := formatLabels(h.labels, key)
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name,
+				formatLabels(append(slices.Clone(h.labels), "le"), key+labelSep+strconv.FormatFloat(le, 'g', -1, 64)),
+				cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name,
+			formatLabels(append(slices.Clone(h.labels), "le"), key+labelSep+"+Inf"), hist.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, labels, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, labels, hist.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, labelSep)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/metrics"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+func TestPrometheus(t *testing.T) {
+	ctx := context.Background()
+	m := &metrics.Prometheus{Buckets: []float64{0.1, 1}}
+
+	m.ObserveResponse(ctx, protocol.TO2HelloDeviceMsgType, protocol.TO2ProveOVHdrMsgType, 0, 50*time.Millisecond)
+	m.ObserveResponse(ctx, protocol.TO2DoneMsgType, protocol.TO2Done2MsgType, 0, 500*time.Millisecond)
+	m.ObserveResponse(ctx, protocol.TO2ProveDeviceMsgType, protocol.ErrorMsgType, protocol.InvalidMessageErrCode, 2*time.Second)
+	m.ObserveRequest(ctx, protocol.TO1HelloRVMsgType, 500, time.Millisecond)
+	m.ObservePeerError(ctx, protocol.ErrorMessage{Code: protocol.ResourceNotFound, PrevMsgType: protocol.TO2HelloDeviceMsgType})
+	m.ObserveSend(ctx, protocol.DISetHmacMsgType, protocol.DIDoneMsgType, nil, time.Millisecond)
+	m.ObserveSend(ctx, protocol.DIAppStartMsgType, 0, errors.New("connection refused"), time.Millisecond)
+
+	var out strings.Builder
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"# TYPE fdo_server_messages_total counter\n",
+		`fdo_server_messages_total{protocol="TO2",msg_type="60",result="ok"} 1` + "\n",
+		`fdo_server_messages_total{protocol="TO2",msg_type="64",result="error"} 1` + "\n",
+		`fdo_server_errors_total{protocol="TO2",msg_type="64",code="101"} 1` + "\n",
+		`fdo_server_protocols_completed_total{protocol="TO2"} 1` + "\n",
+		"# TYPE fdo_server_message_duration_seconds histogram\n",
+		`fdo_server_message_duration_seconds_bucket{msg_type="70",le="0.1"} 0` + "\n",
+		`fdo_server_message_duration_seconds_bucket{msg_type="70",le="1"} 1` + "\n",
+		`fdo_server_message_duration_seconds_bucket{msg_type="70",le="+Inf"} 1` + "\n",
+		`fdo_server_message_duration_seconds_bucket{msg_type="64",le="1"} 0` + "\n",
+		`fdo_server_message_duration_seconds_bucket{msg_type="64",le="+Inf"} 1` + "\n",
+		`fdo_server_message_duration_seconds_sum{msg_type="60"} 0.05` + "\n",
+		`fdo_server_message_duration_seconds_count{msg_type="60"} 1` + "\n",
+		`fdo_http_requests_total{msg_type="30",code="500"} 1` + "\n",
+		`fdo_peer_errors_total{protocol="TO2",code="6"} 1` + "\n",
+		`fdo_client_messages_total{protocol="DI",msg_type="12",result="ok"} 1` + "\n",
+		`fdo_client_messages_total{protocol="DI",msg_type="10",result="transport_error"} 1` + "\n",
+		`fdo_client_protocols_completed_total{protocol="DI"} 1` + "\n",
+	} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("expected output to contain %q", expect)
+		}
+	}
+	if t.Failed() {
+		t.Log(out.String())
+	}
+}
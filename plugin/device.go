@@ -79,6 +79,9 @@ func (m *DeviceModule) Yield(ctx context.Context, respond func(message string) i
 		case dBreak:
 			yield()
 
+		case dError:
+			return fmt.Errorf("plugin error: %s", param)
+
 		case dKey:
 			message := param.(string)
 			w := respond(message)
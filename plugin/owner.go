@@ -31,6 +31,11 @@ var _ serviceinfo.OwnerModule = (*OwnerModule)(nil)
 //
 // TODO: Allow plugin to declare maximum chunk size?
 func (m *OwnerModule) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	m.once.Do(m.start)
+	if m.err != nil {
+		return m.err
+	}
+
 	name := m.name + ":" + messageName
 
 	// Decode CBOR and encode to plugin protocol
@@ -51,20 +56,9 @@ func (m *OwnerModule) HandleInfo(ctx context.Context, messageName string, messag
 // ProduceInfo implements serviceinfo.OwnerModule.
 func (m *OwnerModule) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, err error) {
 	// Perform plugin startup sequence the first time
-	m.once.Do(func() {
-		w, r, err := m.Start()
-		if err != nil {
-			m.err = err
-			return
-		}
-		m.proto = &protocol{in: w, out: bufio.NewScanner(r)}
-
-		if m.name, m.err = m.proto.ModuleName(); m.err != nil {
-			return
-		}
-	})
+	m.once.Do(m.start)
 	if m.err != nil {
-		return false, false, err
+		return false, false, m.err
 	}
 
 	// Send a yield to let owner know it can start sending info
@@ -123,6 +117,16 @@ func (m *OwnerModule) decodeAndProduce(messageName string, producer *serviceinfo
 	return nil
 }
 
+func (m *OwnerModule) start() {
+	w, r, err := m.Start()
+	if err != nil {
+		m.err = err
+		return
+	}
+	m.proto = &protocol{in: w, out: bufio.NewScanner(r)}
+	m.name, m.err = m.proto.ModuleName()
+}
+
 // Stop calls the Stop method of the underlying plugin.Module. It also makes
 // sure that the next HandleInfo/ProduceInfo will start the plugin again.
 func (m *OwnerModule) Stop() error {
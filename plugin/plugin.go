@@ -42,6 +42,18 @@ func ModuleName(p Module) (string, error) {
 	return proto.ModuleName()
 }
 
+// ModuleVersion returns the module version of a plugin.
+func ModuleVersion(p Module) (string, error) {
+	w, r, err := p.Start()
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = p.Stop() }()
+
+	proto := &protocol{in: w, out: bufio.NewScanner(r)}
+	return proto.ModuleVersion()
+}
+
 // NewCommandPluginModule constructs a plugin.Module from an OS executable.
 //
 // For graceful stop behavior, a custom plugin.Module implementation should be used.
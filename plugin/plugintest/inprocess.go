@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package plugintest
+
+import (
+	"context"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo/plugin"
+)
+
+// InProcess returns a module which serves a plugin in a goroutine, so that
+// plugins written with [plugin.Plugin] may be tested without building an
+// executable. Like an executable, the plugin starts with new state each time
+// the module is started, so newPlugin is called on each start.
+func InProcess(newPlugin func() *plugin.Plugin) plugin.Module {
+	return &inProcess{newPlugin: newPlugin}
+}
+
+type inProcess struct {
+	newPlugin func() *plugin.Plugin
+	cancel    context.CancelFunc
+	stdin     io.Closer
+	stdout    io.Closer
+	errc      <-chan error
+}
+
+func (m *inProcess) Start() (io.Writer, io.Reader, error) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	p := m.newPlugin()
+	go func() {
+		err := p.Serve(ctx, stdinR, stdoutW)
+		_ = stdinR.CloseWithError(io.ErrClosedPipe)
+		_ = stdoutW.CloseWithError(err)
+		errc <- err
+	}()
+
+	m.cancel, m.stdin, m.stdout, m.errc = cancel, stdinW, stdoutR, errc
+	return stdinW, stdoutR, nil
+}
+
+func (m *inProcess) Stop() error {
+	if m.cancel == nil {
+		return nil
+	}
+	defer func() { m.cancel, m.stdin, m.stdout, m.errc = nil, nil, nil, nil }()
+
+	m.cancel()
+	_ = m.stdin.Close()
+	_ = m.stdout.Close()
+	return <-m.errc
+}
+
+func (m *inProcess) GracefulStop(ctx context.Context) error { return nil }
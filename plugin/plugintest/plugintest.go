@@ -0,0 +1,332 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+// Package plugintest provides a conformance test harness for service info
+// module plugins. The plugin is driven through the same adapters used by
+// clients and owner services, so a plugin which passes is compatible with the
+// host side of the protocol.
+//
+// A plugin author, whether or not the plugin is written in Go, generally adds
+// a single test to their repository:
+//
+//	func TestConformance(t *testing.T) {
+//		plugintest.Run(t, func() plugin.Module {
+//			return plugin.NewCommandPluginModule(exec.Command("./my-plugin"))
+//		}, plugintest.Suite{
+//			Name: "com.example.hello",
+//			Rounds: []plugintest.Round{
+//				{Send: []plugintest.KV{{"greet", "world"}}, Expect: []plugintest.KV{{"greeting", "hello, world"}}},
+//			},
+//		})
+//	}
+package plugintest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/plugin"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// Maximum size of service info produced by an owner plugin in a round
+const mtu = 1300
+
+// KV is a service info message. Name excludes the module name prefix and
+// Value may be any CBOR-encodable value.
+type KV struct {
+	Name  string
+	Value any
+}
+
+// Round is one exchange between the host and the plugin: service info is sent
+// to the plugin, then the plugin is yielded to and produces service info.
+type Round struct {
+	// Send is the service info sent to the plugin before it is yielded to.
+	Send []KV
+
+	// Expect is the service info the plugin must produce, compared by CBOR
+	// encoding. If nil, the produced service info is not checked.
+	Expect []KV
+
+	// Block is whether the plugin breaks. For device plugins, this is a break
+	// command before yielding. For owner plugins, this is the blockPeer
+	// result.
+	Block bool
+
+	// Done is whether an owner plugin reports that the module is done.
+	Done bool
+
+	// Err is whether the plugin reports an error.
+	Err bool
+
+	// Check, if set, is called with the produced service info.
+	Check func(t testing.TB, produced []KV)
+}
+
+// Suite describes the expected behavior of a plugin.
+type Suite struct {
+	// Name is the expected module name.
+	Name string
+
+	// Version is the expected module version. If empty, the version is not
+	// checked.
+	Version string
+
+	// Owner is set for owner plugins. Otherwise, the plugin is a device
+	// plugin.
+	Owner bool
+
+	// Rounds is run in order, with the plugin started once.
+	Rounds []Round
+}
+
+// Run runs the conformance suite as subtests of t. A new module is created
+// for each subtest.
+//
+// The generated subtests check that:
+//
+//   - the module name and version are responded to
+//   - a device plugin yields when no service info is sent
+//   - each round produces the expected service info
+//   - the rounds produce the same service info after the plugin is restarted
+func Run(t *testing.T, newModule func() plugin.Module, s Suite) {
+	t.Helper()
+
+	t.Run("Name", func(t *testing.T) {
+		name, err := plugin.ModuleName(newModule())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != s.Name {
+			t.Fatalf("expected module name %q, got %q", s.Name, name)
+		}
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		version, err := plugin.ModuleVersion(newModule())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Version != "" && version != s.Version {
+			t.Fatalf("expected module version %q, got %q", s.Version, version)
+		}
+	})
+
+	if !s.Owner {
+		t.Run("Empty yield", func(t *testing.T) {
+			h := &harness{module: newModule()}
+			defer h.stop(t)
+			h.round(t, Round{})
+		})
+	}
+
+	t.Run("Rounds", func(t *testing.T) {
+		h := &harness{module: newModule(), owner: s.Owner}
+		defer h.stop(t)
+		for i, round := range s.Rounds {
+			if !h.round(t, round) {
+				t.Fatalf("round %d failed", i)
+			}
+		}
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		h := &harness{module: newModule(), owner: s.Owner}
+		defer h.stop(t)
+		for attempt := range 2 {
+			for i, round := range s.Rounds {
+				if !h.round(t, round) {
+					t.Fatalf("attempt %d: round %d failed", attempt+1, i)
+				}
+			}
+			h.stop(t)
+		}
+	})
+}
+
+// harness drives a plugin through the device or owner module adapter.
+type harness struct {
+	module plugin.Module
+	owner  bool
+
+	device *plugin.DeviceModule
+	ownerM *plugin.OwnerModule
+}
+
+func (h *harness) stop(t testing.TB) {
+	var err error
+	switch {
+	case h.device != nil:
+		err = h.device.Stop()
+	case h.ownerM != nil:
+		err = h.ownerM.Stop()
+	default:
+		return
+	}
+	h.device, h.ownerM = nil, nil
+	// Killing the plugin process is reported as an exit error by
+	// exec.Cmd.Wait
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Errorf("error stopping plugin: %v", err)
+	}
+}
+
+// round runs a round and reports whether it passed.
+func (h *harness) round(t testing.TB, r Round) bool {
+	t.Helper()
+	produced, block, done, err := h.exchange(t.Context(), r.Send)
+	switch {
+	case r.Err && err == nil:
+		t.Errorf("expected plugin error")
+		return false
+	case r.Err:
+		return true
+	case err != nil:
+		t.Errorf("plugin error: %v", err)
+		return false
+	}
+
+	passed := true
+	if block != r.Block {
+		t.Errorf("expected break %t, got %t", r.Block, block)
+		passed = false
+	}
+	if done != r.Done {
+		t.Errorf("expected done %t, got %t", r.Done, done)
+		passed = false
+	}
+	if r.Expect != nil && !equal(t, r.Expect, produced) {
+		t.Errorf("expected service info %s, got %s", format(r.Expect), format(produced))
+		passed = false
+	}
+	if r.Check != nil {
+		r.Check(t, produced)
+	}
+	return passed && !t.Failed()
+}
+
+// exchange sends service info to the plugin and returns the service info it
+// produces.
+func (h *harness) exchange(ctx context.Context, send []KV) (_ []KV, block, done bool, _ error) {
+	if h.owner {
+		return h.exchangeOwner(ctx, send)
+	}
+	return h.exchangeDevice(ctx, send)
+}
+
+func (h *harness) exchangeDevice(ctx context.Context, send []KV) (_ []KV, block, done bool, _ error) {
+	if h.device == nil {
+		h.device = &plugin.DeviceModule{Module: h.module}
+	}
+
+	var responses []*response
+	respond := func(messageName string) io.Writer {
+		resp := &response{name: messageName}
+		responses = append(responses, resp)
+		return &resp.body
+	}
+	yield := func() { block = true }
+
+	for _, kv := range send {
+		body, err := cbor.Marshal(kv.Value)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("error encoding %q: %w", kv.Name, err)
+		}
+		if err := h.device.Receive(ctx, kv.Name, bytes.NewReader(body), respond, yield); err != nil {
+			return nil, false, false, err
+		}
+	}
+	if err := h.device.Yield(ctx, respond, yield); err != nil {
+		return nil, false, false, err
+	}
+
+	produced := make([]KV, len(responses))
+	for i, resp := range responses {
+		produced[i] = KV{Name: resp.name, Value: resp.body.Bytes()}
+	}
+	produced, err := decode(produced)
+	return produced, block, false, err
+}
+
+func (h *harness) exchangeOwner(ctx context.Context, send []KV) (_ []KV, block, done bool, _ error) {
+	if h.ownerM == nil {
+		h.ownerM = &plugin.OwnerModule{Module: h.module}
+	}
+
+	for _, kv := range send {
+		body, err := cbor.Marshal(kv.Value)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("error encoding %q: %w", kv.Name, err)
+		}
+		if err := h.ownerM.HandleInfo(ctx, kv.Name, bytes.NewReader(body)); err != nil {
+			return nil, false, false, err
+		}
+	}
+
+	producer := serviceinfo.NewProducer("", mtu)
+	block, done, err := h.ownerM.ProduceInfo(ctx, producer)
+	if err != nil {
+		return nil, false, false, err
+	}
+	var produced []KV
+	for _, kv := range producer.ServiceInfo() {
+		produced = append(produced, KV{Name: strings.TrimPrefix(kv.Key, ":"), Value: kv.Val})
+	}
+	produced, err = decode(produced)
+	return produced, block, done, err
+}
+
+type response struct {
+	name string
+	body bytes.Buffer
+}
+
+// decode replaces the CBOR-encoded values of produced service info with the
+// decoded values.
+func decode(produced []KV) ([]KV, error) {
+	for i, kv := range produced {
+		var val any
+		if err := cbor.Unmarshal(kv.Value.([]byte), &val); err != nil {
+			return nil, fmt.Errorf("plugin produced invalid CBOR for %q: %w", kv.Name, err)
+		}
+		produced[i].Value = val
+	}
+	return produced, nil
+}
+
+// equal compares service info by the CBOR encoding of each value.
+func equal(t testing.TB, expected, produced []KV) bool {
+	t.Helper()
+	return slices.EqualFunc(expected, produced, func(a, b KV) bool {
+		if a.Name != b.Name {
+			return false
+		}
+		aBody, err := cbor.Marshal(a.Value)
+		if err != nil {
+			t.Fatalf("error encoding expected value of %q: %v", a.Name, err)
+		}
+		bBody, err := cbor.Marshal(b.Value)
+		if err != nil {
+			t.Fatalf("error encoding produced value of %q: %v", b.Name, err)
+		}
+		return bytes.Equal(aBody, bBody)
+	})
+}
+
+func format(info []KV) string {
+	parts := make([]string, len(info))
+	for i, kv := range info {
+		parts[i] = fmt.Sprintf("%s=%#v", kv.Name, kv.Value)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -213,7 +213,7 @@ func (p *protocol) Peek() (command, []byte, error) {
 		if err := p.out.Err(); err != nil {
 			return invalidPluginCommand, nil, fmt.Errorf("error reading from plugin: %w", err)
 		}
-		return invalidPluginCommand, nil, fmt.Errorf("plugin exited")
+		return invalidPluginCommand, nil, errExited
 	}
 
 	// Skip empty lines
@@ -250,6 +250,10 @@ func (p *protocol) Recv() (command, interface{}, error) {
 
 var errEndCollection = errors.New("unexpected end of collection command")
 
+// errExited is returned when the peer closes its output. The message refers
+// to the plugin, because the host is the usual reader.
+var errExited = errors.New("plugin exited")
+
 func (p *protocol) DecodeValue() (interface{}, error) {
 	c, param, err := p.Recv()
 	if err != nil {
@@ -314,6 +318,21 @@ func (p *protocol) EncodeValue(v interface{}) error {
 		return p.Send(dNull, nil)
 	}
 
+	switch tag := v.(type) {
+	case cbor.Tag[any]:
+		if err := p.Send(dTag, tag.Num); err != nil {
+			return err
+		}
+		return p.EncodeValue(tag.Val)
+
+	case cbor.Tag[cbor.RawBytes]:
+		var val any
+		if err := cbor.Unmarshal(tag.Val, &val); err != nil {
+			return fmt.Errorf("error decoding tag %d value: %w", tag.Num, err)
+		}
+		return p.EncodeValue(cbor.Tag[any]{Num: tag.Num, Val: val})
+	}
+
 	switch t := reflect.TypeOf(v); t.Kind() {
 	case reflect.Bool:
 		var param int
@@ -343,7 +362,7 @@ func (p *protocol) EncodeValue(v interface{}) error {
 		return p.EncodeValue(reflect.ValueOf(v).Elem().Interface())
 	}
 
-	panic(fmt.Sprintf("invalid type for encoding to plugin protocol value: %T", v))
+	return fmt.Errorf("invalid type for encoding to plugin protocol value: %T", v)
 }
 
 func (p *protocol) encodeArray(v interface{}) error {
@@ -390,22 +409,30 @@ func (p *protocol) encodeMap(v interface{}) error {
 }
 
 func (p *protocol) ModuleName() (string, error) {
-	// Request and receive the module name
-	if err := p.Send(cModuleName, nil); err != nil {
-		return "", fmt.Errorf("error sending module name command: %w", err)
+	return p.control(cModuleName, "module name")
+}
+
+func (p *protocol) ModuleVersion() (string, error) {
+	return p.control(cModuleVersion, "module version")
+}
+
+func (p *protocol) control(cmd command, desc string) (string, error) {
+	// Request and receive the control value
+	if err := p.Send(cmd, nil); err != nil {
+		return "", fmt.Errorf("error sending %s command: %w", desc, err)
 	}
 	c, val, err := p.Recv()
-	if c != cModuleName {
-		return "", fmt.Errorf("plugin responded incorrectly to module name command: received %q command", c)
-	}
 	if err != nil {
-		return "", fmt.Errorf("error receiving module name response: %w", err)
+		return "", fmt.Errorf("error receiving %s response: %w", desc, err)
+	}
+	if c != cmd {
+		return "", fmt.Errorf("plugin responded incorrectly to %s command: received %q command", desc, c)
 	}
-	name := val.(string) // safe due to internal parsing in Recv()
+	s, _ := val.(string) // nil if the parameter was empty
 
-	// Validate and return module name
-	if !utf8.ValidString(name) {
-		return "", fmt.Errorf("plugin returned a module name that was not valid UTF-8")
+	// Validate and return value
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("plugin returned a %s that was not valid UTF-8", desc)
 	}
-	return string(name), nil
+	return s, nil
 }
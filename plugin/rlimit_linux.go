@@ -0,0 +1,26 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package plugin
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// setLimits applies resource limits to a running process with prlimit(2).
+// The process runs without the limits for the short time between being
+// started and this call, and children it starts in that time keep no limits,
+// so limits are only best-effort.
+func setLimits(pid int, limits []ResourceLimit) error {
+	for _, limit := range limits {
+		rlimit := syscall.Rlimit{Cur: limit.Soft, Max: limit.Hard}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64,
+			uintptr(pid), uintptr(limit.Resource), uintptr(unsafe.Pointer(&rlimit)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("resource %d: %w", limit.Resource, errno)
+		}
+	}
+	return nil
+}
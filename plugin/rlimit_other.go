@@ -0,0 +1,15 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build !linux
+
+package plugin
+
+import "errors"
+
+func setLimits(_ int, limits []ResourceLimit) error {
+	if len(limits) > 0 {
+		return errors.New("plugin resource limits are not supported on this platform")
+	}
+	return nil
+}
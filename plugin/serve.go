@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+)
+
+// Plugin implements the plugin side of the protocol, so that plugins may be
+// written in Go without handling the line-based encoding. Exactly one of
+// Device or Owner must be set.
+//
+// A plugin executable generally consists of only a main function calling
+// [Plugin.Run].
+type Plugin struct {
+	// Name is the module name responded to the M command.
+	Name string
+
+	// Version is the module version responded to the V command.
+	Version string
+
+	// Device handles service info when the plugin is run by a client using
+	// DeviceModule.
+	Device DeviceHandler
+
+	// Owner handles service info when the plugin is run by an owner service
+	// using OwnerModule.
+	Owner OwnerHandler
+}
+
+// DeviceHandler is implemented by device plugins. It mirrors
+// serviceinfo.DeviceModule.
+type DeviceHandler interface {
+	// Receive handles a message sent by the owner module. Responses may be
+	// sent immediately and will be forwarded when the host yields.
+	Receive(ctx context.Context, msg Message, send *Sender) error
+
+	// Yield is called when all messages sent by the owner module in a TO2
+	// message have been received, after which the plugin yields to the
+	// owner.
+	Yield(ctx context.Context, send *Sender) error
+}
+
+// OwnerHandler is implemented by owner plugins. It mirrors
+// serviceinfo.OwnerModule.
+type OwnerHandler interface {
+	// HandleInfo handles a message sent by the device module.
+	HandleInfo(ctx context.Context, msg Message) error
+
+	// ProduceInfo sends messages to the device module. See
+	// serviceinfo.OwnerModule for the meaning of the returned flags.
+	ProduceInfo(ctx context.Context, send *Sender) (blockPeer, moduleDone bool, _ error)
+}
+
+// Message is service info received from the peer module.
+type Message struct {
+	// Name is the message name, without the module name prefix.
+	Name string
+
+	// Body is the CBOR-encoded message value.
+	Body []byte
+}
+
+// Decode unmarshals the message body into v.
+func (m Message) Decode(v any) error {
+	if err := cbor.Unmarshal(m.Body, v); err != nil {
+		return fmt.Errorf("error decoding message %q body: %w", m.Name, err)
+	}
+	return nil
+}
+
+// Sender sends service info to the peer module.
+type Sender struct {
+	proto *protocol
+	owner bool
+}
+
+// Send sends a message with a value of any type which can be CBOR encoded,
+// except floating point numbers, which are not supported by the protocol.
+func (s *Sender) Send(messageName string, v any) error {
+	body, err := cbor.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding message %q: %w", messageName, err)
+	}
+	var val any
+	if err := cbor.Unmarshal(body, &val); err != nil {
+		return fmt.Errorf("error encoding message %q: %w", messageName, err)
+	}
+
+	// Encode to a buffer first so that a partial value is never sent
+	var buf bytes.Buffer
+	if err := (&protocol{in: &buf}).EncodeValue(val); err != nil {
+		return fmt.Errorf("error encoding message %q: %w", messageName, err)
+	}
+	if err := s.proto.Send(dKey, messageName); err != nil {
+		return err
+	}
+	_, err = s.proto.in.Write(buf.Bytes())
+	return err
+}
+
+// Break causes the following messages to be sent in the next TO2 message,
+// without yielding to the owner. It may only be used by device plugins.
+func (s *Sender) Break() error {
+	if s.owner {
+		return errors.New("break is not supported by owner plugins: return blockPeer from ProduceInfo")
+	}
+	return s.proto.Send(dBreak, nil)
+}
+
+// Run serves the plugin over stdin and stdout and then exits the process.
+// Errors are written to stderr.
+func (p *Plugin) Run() {
+	if err := p.Serve(context.Background(), os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Serve handles commands read from r and writes responses to w until r is
+// closed or an error command is received from the host, in which case nil is
+// returned.
+//
+// Errors returned by the handler are sent to the host, which fails TO2.
+func (p *Plugin) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	if (p.Device == nil) == (p.Owner == nil) {
+		return errors.New("plugin must have exactly one of a device or owner handler")
+	}
+
+	// Data is buffered until the host reads it, after sending a yield
+	// command, so that neither side blocks writing to the other. Control
+	// commands are responded to immediately.
+	var buf bytes.Buffer
+	host := &protocol{in: &buf, out: bufio.NewScanner(r)}
+	control := &protocol{in: w}
+	send := &Sender{proto: host, owner: p.Owner != nil}
+	var handlerErr error
+
+	for {
+		c, param, err := host.Recv()
+		if errors.Is(err, errExited) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch c {
+		case cModuleName:
+			err = control.Send(cModuleName, p.Name)
+
+		case cModuleVersion:
+			err = control.Send(cModuleVersion, p.Version)
+
+		case dKey:
+			err = p.handle(ctx, host, send, param.(string), &handlerErr)
+
+		case dYield:
+			if err := p.yield(ctx, host, send, &handlerErr); err != nil {
+				return err
+			}
+			_, err = buf.WriteTo(w)
+
+		case dError:
+			return nil
+
+		default:
+			return fmt.Errorf("invalid data: got unexpected command %q from host", c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handle decodes a message value and passes it to the handler. Handler errors
+// are held until the next yield, when the host reads the plugin output.
+func (p *Plugin) handle(ctx context.Context, host *protocol, send *Sender, messageName string, handlerErr *error) error {
+	val, err := host.DecodeValue()
+	if err != nil {
+		return fmt.Errorf("error decoding message %q value: %w", messageName, err)
+	}
+	if *handlerErr != nil {
+		return nil
+	}
+	body, err := cbor.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("error encoding message %q body: %w", messageName, err)
+	}
+
+	msg := Message{Name: messageName, Body: body}
+	if p.Device != nil {
+		*handlerErr = p.Device.Receive(ctx, msg, send)
+	} else {
+		*handlerErr = p.Owner.HandleInfo(ctx, msg)
+	}
+	return nil
+}
+
+// yield calls the handler to produce service info and writes the command
+// which ends the plugin's output.
+func (p *Plugin) yield(ctx context.Context, host *protocol, send *Sender, handlerErr *error) error {
+	if *handlerErr != nil {
+		err := *handlerErr
+		*handlerErr = nil
+		return host.Send(dError, err.Error())
+	}
+
+	if p.Device != nil {
+		if err := p.Device.Yield(ctx, send); err != nil {
+			return host.Send(dError, err.Error())
+		}
+		return host.Send(dYield, nil)
+	}
+
+	blockPeer, moduleDone, err := p.Owner.ProduceInfo(ctx, send)
+	switch {
+	case err != nil:
+		return host.Send(dError, err.Error())
+	case moduleDone:
+		return host.Send(dDone, nil)
+	case blockPeer:
+		return host.Send(dBreak, nil)
+	default:
+		return host.Send(dYield, nil)
+	}
+}
@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package plugin_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/plugin"
+	"github.com/fido-device-onboard/go-fdo/plugin/plugintest"
+)
+
+type greeting struct {
+	Text  string
+	Count uint
+	Tags  map[string]bool
+}
+
+// echoDevice responds to each "greet" message with a "greeting" message.
+type echoDevice struct{ count uint }
+
+func (d *echoDevice) Receive(ctx context.Context, msg plugin.Message, send *plugin.Sender) error {
+	if msg.Name != "greet" {
+		return fmt.Errorf("unknown message %q", msg.Name)
+	}
+	var name string
+	if err := msg.Decode(&name); err != nil {
+		return err
+	}
+	d.count++
+	return send.Send("greeting", greeting{Text: "hello, " + name, Count: d.count, Tags: map[string]bool{"sdk": true}})
+}
+
+func (d *echoDevice) Yield(ctx context.Context, send *plugin.Sender) error {
+	if d.count > 1 {
+		return send.Break()
+	}
+	return nil
+}
+
+// countdownOwner sends a number each round until it reaches zero, blocking
+// the device until the device acknowledges it.
+type countdownOwner struct {
+	next  int
+	acked bool
+}
+
+func (o *countdownOwner) HandleInfo(ctx context.Context, msg plugin.Message) error {
+	if msg.Name != "ack" {
+		return fmt.Errorf("unknown message %q", msg.Name)
+	}
+	return msg.Decode(&o.acked)
+}
+
+func (o *countdownOwner) ProduceInfo(ctx context.Context, send *plugin.Sender) (blockPeer, moduleDone bool, _ error) {
+	if o.next == 0 {
+		return false, true, nil
+	}
+	if err := send.Send("count", o.next); err != nil {
+		return false, false, err
+	}
+	o.next--
+	return !o.acked, false, nil
+}
+
+func TestServeDevice(t *testing.T) {
+	plugintest.Run(t, func() plugin.Module {
+		return plugintest.InProcess(func() *plugin.Plugin {
+			return &plugin.Plugin{
+				Name:    "com.example.greet",
+				Version: "1.0.0",
+				Device:  new(echoDevice),
+			}
+		})
+	}, plugintest.Suite{
+		Name:    "com.example.greet",
+		Version: "1.0.0",
+		Rounds: []plugintest.Round{
+			{
+				Send: []plugintest.KV{{Name: "greet", Value: "world"}},
+				Expect: []plugintest.KV{
+					{Name: "greeting", Value: greeting{Text: "hello, world", Count: 1, Tags: map[string]bool{"sdk": true}}},
+				},
+			},
+			{
+				Send: []plugintest.KV{{Name: "greet", Value: "again"}},
+				Expect: []plugintest.KV{
+					{Name: "greeting", Value: greeting{Text: "hello, again", Count: 2, Tags: map[string]bool{"sdk": true}}},
+				},
+				Block: true,
+			},
+			{
+				Send: []plugintest.KV{{Name: "unknown", Value: []byte{0x01}}},
+				Err:  true,
+			},
+		},
+	})
+}
+
+func TestServeOwner(t *testing.T) {
+	plugintest.Run(t, func() plugin.Module {
+		return plugintest.InProcess(func() *plugin.Plugin {
+			return &plugin.Plugin{
+				Name:  "com.example.countdown",
+				Owner: &countdownOwner{next: 2},
+			}
+		})
+	}, plugintest.Suite{
+		Name:  "com.example.countdown",
+		Owner: true,
+		Rounds: []plugintest.Round{
+			{Expect: []plugintest.KV{{Name: "count", Value: 2}}, Block: true},
+			{Send: []plugintest.KV{{Name: "ack", Value: true}}, Expect: []plugintest.KV{{Name: "count", Value: 1}}},
+			{Expect: []plugintest.KV{}, Done: true},
+		},
+	})
+}
+
+func TestServeErrors(t *testing.T) {
+	t.Run("No handler", func(t *testing.T) {
+		if err := (&plugin.Plugin{Name: "empty"}).Serve(t.Context(), nil, nil); err == nil {
+			t.Fatal("expected error serving plugin without a handler")
+		}
+	})
+
+	t.Run("Unsupported value", func(t *testing.T) {
+		owner := &plugin.OwnerModule{Module: plugintest.InProcess(func() *plugin.Plugin {
+			return &plugin.Plugin{Name: "com.example.float", Owner: floatOwner{}}
+		})}
+		defer func() { _ = owner.Stop() }()
+
+		_, _, err := owner.ProduceInfo(t.Context(), nil)
+		if err == nil {
+			t.Fatal("expected plugin error for floating point value")
+		}
+	})
+}
+
+type floatOwner struct{}
+
+func (floatOwner) HandleInfo(context.Context, plugin.Message) error { return nil }
+
+func (floatOwner) ProduceInfo(ctx context.Context, send *plugin.Sender) (blockPeer, moduleDone bool, _ error) {
+	if err := send.Send("pi", 3.14); err != nil {
+		return false, false, err
+	}
+	return false, false, errors.New("expected float to be unsupported")
+}
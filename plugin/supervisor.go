@@ -0,0 +1,409 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTimeout is returned when a supervised plugin does not respond within the
+// message timeout.
+var ErrTimeout = errors.New("plugin timed out")
+
+// ErrTooManyRestarts is returned when a supervised plugin has crashed more
+// times in a row than allowed.
+var ErrTooManyRestarts = errors.New("plugin crashed too many times")
+
+// ResourceLimit is a limit applied to a plugin process, as with setrlimit(2).
+type ResourceLimit struct {
+	// Resource is the platform-specific resource number, i.e.
+	// syscall.RLIMIT_NOFILE.
+	Resource int
+
+	// Soft and Hard are the soft and hard limits.
+	Soft, Hard uint64
+}
+
+// Supervisor is a Module which runs an OS executable plugin with the checks
+// and limits needed by long-running services. Unlike
+// [NewCommandPluginModule], it verifies the module name and version reported
+// by the plugin, stops plugins which hang, logs plugin stderr, and implements
+// GracefulStop by closing the plugin's stdin.
+//
+// A new process is started each time Start is called, generally once per TO2
+// session. A plugin which exits with a non-zero status or is killed by a
+// signal not sent by the supervisor, rather than being stopped, is considered
+// crashed and is restarted on the next Start, up to MaxRestarts times in a
+// row. Plugins which exit with a zero status, i.e. after the host sends an
+// error, have not crashed.
+//
+// A Supervisor runs at most one process at a time, so it must not be used by
+// concurrent TO2 sessions.
+type Supervisor struct {
+	// Cmd is the plugin command, which is copied each time the plugin is
+	// started. Its Stdin and Stdout must not be set and its Stderr is
+	// replaced.
+	Cmd *exec.Cmd
+
+	// Name, if set, must match the module name reported by the plugin.
+	Name string
+
+	// Versions, if set, is the list of module versions accepted from the
+	// plugin.
+	Versions []string
+
+	// MessageTimeout, if set, stops the plugin when a single read from or
+	// write to it blocks longer than the timeout.
+	MessageTimeout time.Duration
+
+	// IdleTimeout, if set, stops the plugin when it has not been read from
+	// or written to for the timeout, i.e. when a TO2 session is abandoned.
+	IdleTimeout time.Duration
+
+	// MaxRestarts, if set, is the number of times in a row that a crashed
+	// plugin is restarted. After MaxRestarts+1 consecutive crashes, Start
+	// fails with ErrTooManyRestarts.
+	MaxRestarts int
+
+	// User, if set, is the user name or uid to run the plugin as. Unless
+	// Group is also set, the primary group of the user is used. Only
+	// supported on Unix.
+	User string
+
+	// Group, if set, is the group name or gid to run the plugin as. Only
+	// supported on Unix.
+	Group string
+
+	// Limits are applied to the plugin process after it starts. Only
+	// supported on Linux.
+	//
+	// Limits are best-effort and are not a sandbox: the plugin runs without
+	// them until they are applied, so it and any processes it starts in that
+	// time are not limited. Use the wasi module to run untrusted plugins.
+	Limits []ResourceLimit
+
+	// Logger receives lines written by the plugin to stderr and plugin
+	// lifecycle events. If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	proc    *process
+	crashes int
+}
+
+var _ Module = (*Supervisor)(nil)
+
+// process is a single run of a supervised plugin.
+type process struct {
+	cmd    *exec.Cmd
+	stdin  io.Closer
+	stdout io.Closer
+	idle   *time.Timer
+
+	killed   atomic.Bool // set when the supervisor kills the process
+	stopping atomic.Bool // set when the process is asked to exit
+	timedOut atomic.Bool
+	done     chan struct{} // closed when the process has exited
+
+	// valid after done is closed
+	err     error
+	crashed bool
+}
+
+func (p *process) kill() {
+	p.killed.Store(true)
+	_ = p.cmd.Process.Kill()
+}
+
+func (s *Supervisor) logger() *slog.Logger {
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With("plugin", filepath.Base(s.Cmd.Path))
+}
+
+// Start implements Module.
+func (s *Supervisor) Start() (io.Writer, io.Reader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Stop any process left by a session which did not call Stop
+	if s.proc != nil {
+		_ = s.stop()
+	}
+	if s.MaxRestarts > 0 && s.crashes > s.MaxRestarts {
+		return nil, nil, fmt.Errorf("%w: %d consecutive crashes", ErrTooManyRestarts, s.crashes)
+	}
+	if s.crashes > 0 {
+		s.logger().Info("restarting crashed plugin", "crashes", s.crashes)
+	}
+
+	proc, w, r, err := s.start()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.proc = proc
+
+	if err := s.verify(w, r); err != nil {
+		_ = s.stop()
+		return nil, nil, err
+	}
+	return w, r, nil
+}
+
+func (s *Supervisor) start() (_ *process, _ io.Writer, _ io.Reader, err error) {
+	if s.Cmd.Stdin != nil || s.Cmd.Stdout != nil {
+		return nil, nil, nil, errors.New("plugin command must not set stdin or stdout")
+	}
+	logger := s.logger()
+
+	// Duplicate command so that plugin can be started multiple times
+	dupcmd := *s.Cmd
+	cmd := &dupcmd
+	stderr := &logWriter{logger: logger}
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second
+	if s.User != "" || s.Group != "" {
+		if err := runAs(cmd, s.User, s.Group); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error opening stdin pipe to plugin executable: %w", err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error opening stdout pipe to plugin executable: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, nil, fmt.Errorf("error starting plugin executable: %w", err)
+	}
+	if err := setLimits(cmd.Process.Pid, s.Limits); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, nil, nil, fmt.Errorf("error setting plugin resource limits: %w", err)
+	}
+
+	proc := &process{cmd: cmd, stdin: in, stdout: out, done: make(chan struct{})}
+	if s.IdleTimeout > 0 {
+		proc.idle = time.AfterFunc(s.IdleTimeout, func() {
+			select {
+			case <-proc.done:
+				return
+			default:
+			}
+			logger.Warn("stopping idle plugin", "timeout", s.IdleTimeout)
+			proc.kill()
+		})
+	}
+	go func() {
+		proc.err = cmd.Wait()
+		stderr.Flush()
+		if proc.idle != nil {
+			proc.idle.Stop()
+		}
+
+		// The process crashed if it exited with an error or was killed by a
+		// signal not sent by the supervisor, without being asked to stop
+		state := cmd.ProcessState
+		proc.crashed = !proc.stopping.Load() &&
+			((state.Exited() && state.ExitCode() != 0) || (!state.Exited() && !proc.killed.Load()))
+		if proc.crashed {
+			logger.Warn("plugin exited unexpectedly", "error", proc.err)
+		}
+		close(proc.done)
+	}()
+
+	return proc,
+		&timeoutWriter{w: in, proc: proc, timeout: s.MessageTimeout, idleTimeout: s.IdleTimeout},
+		&timeoutReader{r: out, proc: proc, timeout: s.MessageTimeout, idleTimeout: s.IdleTimeout},
+		nil
+}
+
+// verify checks the module name and version of the plugin. Responses are
+// read a byte at a time so that no data is buffered which the module adapter
+// would need to read.
+func (s *Supervisor) verify(w io.Writer, r io.Reader) error {
+	if s.Name == "" && len(s.Versions) == 0 {
+		return nil
+	}
+	proto := &protocol{in: w, out: bufio.NewScanner(oneByteReader{r})}
+
+	name, err := proto.ModuleName()
+	if err != nil {
+		return err
+	}
+	if s.Name != "" && name != s.Name {
+		return fmt.Errorf("plugin module name %q does not match expected %q", name, s.Name)
+	}
+
+	version, err := proto.ModuleVersion()
+	if err != nil {
+		return err
+	}
+	if len(s.Versions) > 0 && !slices.Contains(s.Versions, version) {
+		return fmt.Errorf("plugin module %q version %q is not supported", name, version)
+	}
+	return nil
+}
+
+// Stop implements Module.
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stop()
+}
+
+func (s *Supervisor) stop() error {
+	proc := s.proc
+	if proc == nil {
+		return nil
+	}
+	s.proc = nil
+
+	proc.kill()
+	<-proc.done
+	if proc.crashed {
+		s.crashes++
+		return proc.err
+	}
+	s.crashes = 0
+	return nil
+}
+
+// GracefulStop implements Module by closing the plugin's stdin and waiting
+// for it to exit.
+func (s *Supervisor) GracefulStop(ctx context.Context) error {
+	s.mu.Lock()
+	proc := s.proc
+	s.mu.Unlock()
+	if proc == nil {
+		return nil
+	}
+
+	proc.stopping.Store(true)
+	if err := proc.stdin.Close(); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-proc.done:
+		return nil
+	}
+}
+
+// timeout stops the process after the message timeout. The idle timer is
+// paused until the result of the read or write.
+func (p *process) timeout(timeout time.Duration) *time.Timer {
+	if p.idle != nil {
+		p.idle.Stop()
+	}
+	if timeout <= 0 {
+		return nil
+	}
+	return time.AfterFunc(timeout, func() {
+		p.timedOut.Store(true)
+		p.kill()
+		_ = p.stdin.Close()
+		_ = p.stdout.Close()
+	})
+}
+
+func (p *process) result(timer *time.Timer, idleTimeout time.Duration, err error) error {
+	if timer != nil {
+		timer.Stop()
+	}
+	if p.idle != nil {
+		p.idle.Reset(idleTimeout)
+	}
+	if err != nil && p.timedOut.Load() {
+		return ErrTimeout
+	}
+	return err
+}
+
+type timeoutReader struct {
+	r           io.Reader
+	proc        *process
+	timeout     time.Duration
+	idleTimeout time.Duration
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	timer := t.proc.timeout(t.timeout)
+	n, err := t.r.Read(p)
+	return n, t.proc.result(timer, t.idleTimeout, err)
+}
+
+type timeoutWriter struct {
+	w           io.Writer
+	proc        *process
+	timeout     time.Duration
+	idleTimeout time.Duration
+}
+
+func (t *timeoutWriter) Write(p []byte) (int, error) {
+	timer := t.proc.timeout(t.timeout)
+	n, err := t.w.Write(p)
+	return n, t.proc.result(timer, t.idleTimeout, err)
+}
+
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+// logWriter logs each line written to it.
+type logWriter struct {
+	logger *slog.Logger
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+	for {
+		line, rest, ok := bytes.Cut(l.buf, []byte("\n"))
+		if !ok {
+			break
+		}
+		l.logger.Info("plugin stderr", "line", string(line))
+		l.buf = rest
+	}
+	return len(p), nil
+}
+
+// Flush logs any partial line.
+func (l *logWriter) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buf) > 0 {
+		l.logger.Info("plugin stderr", "line", string(l.buf))
+		l.buf = nil
+	}
+}
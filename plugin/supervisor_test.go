@@ -0,0 +1,231 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package plugin_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/plugin"
+	"github.com/fido-device-onboard/go-fdo/plugin/plugintest"
+)
+
+// The test binary is run as a plugin when this environment variable is set to
+// the plugin behavior.
+const pluginModeEnv = "GO_FDO_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(pluginModeEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "echo":
+		(&plugin.Plugin{Name: "com.example.greet", Version: "1.0.0", Device: new(echoDevice)}).Run()
+	case "hang":
+		(&plugin.Plugin{Name: "com.example.greet", Version: "1.0.0", Device: hangDevice{}}).Run()
+	case "crash":
+		(&plugin.Plugin{Name: "com.example.greet", Version: "1.0.0", Device: crashDevice{}}).Run()
+	}
+}
+
+type hangDevice struct{}
+
+func (hangDevice) Receive(context.Context, plugin.Message, *plugin.Sender) error { return nil }
+func (hangDevice) Yield(context.Context, *plugin.Sender) error {
+	time.Sleep(time.Minute)
+	return nil
+}
+
+type crashDevice struct{}
+
+func (crashDevice) Receive(context.Context, plugin.Message, *plugin.Sender) error { return nil }
+func (crashDevice) Yield(context.Context, *plugin.Sender) error {
+	_, _ = os.Stderr.WriteString("crashing\n")
+	os.Exit(3)
+	return nil
+}
+
+func pluginCmd(t *testing.T, mode string) *exec.Cmd {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), pluginModeEnv+"="+mode)
+	return cmd
+}
+
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestSupervisorConformance(t *testing.T) {
+	plugintest.Run(t, func() plugin.Module {
+		return &plugin.Supervisor{
+			Cmd:            pluginCmd(t, "echo"),
+			Name:           "com.example.greet",
+			Versions:       []string{"0.9.0", "1.0.0"},
+			MessageTimeout: 10 * time.Second,
+			IdleTimeout:    10 * time.Second,
+		}
+	}, plugintest.Suite{
+		Name:    "com.example.greet",
+		Version: "1.0.0",
+		Rounds: []plugintest.Round{
+			{
+				Send: []plugintest.KV{{Name: "greet", Value: "supervisor"}},
+				Expect: []plugintest.KV{
+					{Name: "greeting", Value: greeting{Text: "hello, supervisor", Count: 1, Tags: map[string]bool{"sdk": true}}},
+				},
+			},
+		},
+	})
+}
+
+func TestSupervisor(t *testing.T) {
+	discard := func(string) io.Writer { return io.Discard }
+
+	t.Run("Version mismatch", func(t *testing.T) {
+		s := &plugin.Supervisor{Cmd: pluginCmd(t, "echo"), Versions: []string{"2.0.0"}}
+		if _, _, err := s.Start(); err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Fatalf("expected unsupported version error, got %v", err)
+		}
+	})
+
+	t.Run("Name mismatch", func(t *testing.T) {
+		s := &plugin.Supervisor{Cmd: pluginCmd(t, "echo"), Name: "com.example.other"}
+		if _, _, err := s.Start(); err == nil || !strings.Contains(err.Error(), "does not match") {
+			t.Fatalf("expected module name error, got %v", err)
+		}
+	})
+
+	t.Run("Message timeout", func(t *testing.T) {
+		device := &plugin.DeviceModule{Module: &plugin.Supervisor{
+			Cmd:            pluginCmd(t, "hang"),
+			MessageTimeout: 100 * time.Millisecond,
+		}}
+		defer func() { _ = device.Stop() }()
+
+		if err := device.Yield(t.Context(), discard, func() {}); !errors.Is(err, plugin.ErrTimeout) {
+			t.Fatalf("expected timeout, got %v", err)
+		}
+	})
+
+	t.Run("Idle timeout", func(t *testing.T) {
+		var logs logBuffer
+		s := &plugin.Supervisor{
+			Cmd:         pluginCmd(t, "echo"),
+			IdleTimeout: 100 * time.Millisecond,
+			Logger:      slog.New(slog.NewTextHandler(&logs, nil)),
+		}
+		if _, _, err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(500 * time.Millisecond)
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(logs.String(), "stopping idle plugin") {
+			t.Fatalf("expected idle plugin to be stopped, got logs:\n%s", logs.String())
+		}
+	})
+
+	t.Run("Crash and restart", func(t *testing.T) {
+		var logs logBuffer
+		s := &plugin.Supervisor{
+			Cmd:         pluginCmd(t, "crash"),
+			MaxRestarts: 1,
+			Logger:      slog.New(slog.NewTextHandler(&logs, nil)),
+		}
+		device := &plugin.DeviceModule{Module: s}
+
+		// The first run and one restart crash, then no more restarts are
+		// allowed
+		for range s.MaxRestarts + 1 {
+			if err := device.Yield(t.Context(), discard, func() {}); err == nil {
+				t.Fatal("expected crashed plugin to fail")
+			}
+			if err := device.Stop(); err == nil {
+				t.Fatal("expected stop to report crash")
+			}
+		}
+		if err := device.Yield(t.Context(), discard, func() {}); !errors.Is(err, plugin.ErrTooManyRestarts) {
+			t.Fatalf("expected too many restarts, got %v", err)
+		}
+
+		for _, expected := range []string{"line=crashing", "plugin exited unexpectedly", "restarting crashed plugin"} {
+			if !strings.Contains(logs.String(), expected) {
+				t.Errorf("expected %q in logs:\n%s", expected, logs.String())
+			}
+		}
+	})
+
+	t.Run("Clean exit", func(t *testing.T) {
+		var logs logBuffer
+		s := &plugin.Supervisor{
+			Cmd:         pluginCmd(t, "echo"),
+			MaxRestarts: 1,
+			Logger:      slog.New(slog.NewTextHandler(&logs, nil)),
+		}
+		for range 3 {
+			w, r, err := s.Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The plugin exits with a zero status after the host sends an
+			// error
+			if _, err := io.WriteString(w, "E\n"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Stop(); err != nil {
+				t.Fatalf("expected clean exit not to be reported, got %v", err)
+			}
+		}
+		for _, unexpected := range []string{"plugin exited unexpectedly", "restarting crashed plugin"} {
+			if strings.Contains(logs.String(), unexpected) {
+				t.Errorf("expected no %q in logs:\n%s", unexpected, logs.String())
+			}
+		}
+	})
+
+	t.Run("Graceful stop", func(t *testing.T) {
+		s := &plugin.Supervisor{Cmd: pluginCmd(t, "echo")}
+		if _, _, err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if err := s.GracefulStop(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build unix
+
+package plugin
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func runAs(cmd *exec.Cmd, username, groupname string) error {
+	var uid, gid uint64
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			if u, err = user.LookupId(username); err != nil {
+				return fmt.Errorf("unknown user %q", username)
+			}
+		}
+		if uid, err = strconv.ParseUint(u.Uid, 10, 32); err != nil {
+			return fmt.Errorf("invalid uid for user %q: %w", username, err)
+		}
+		if gid, err = strconv.ParseUint(u.Gid, 10, 32); err != nil {
+			return fmt.Errorf("invalid gid for user %q: %w", username, err)
+		}
+	} else {
+		uid = uint64(syscall.Getuid())
+	}
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupname); err != nil {
+				return fmt.Errorf("unknown group %q", groupname)
+			}
+		}
+		if gid, err = strconv.ParseUint(g.Gid, 10, 32); err != nil {
+			return fmt.Errorf("invalid gid for group %q: %w", groupname, err)
+		}
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	return nil
+}
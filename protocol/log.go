@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package protocol
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// loggerContextKey is the context key for the *contextLogger of a session.
+type loggerContextKey struct{}
+
+// contextLogger is a session logger along with the logger it was derived from
+// and the attributes added by ContextWithLogAttrs, so that annotating a
+// context again replaces attributes rather than repeating them.
+type contextLogger struct {
+	base   *slog.Logger
+	attrs  []slog.Attr
+	logger *slog.Logger
+}
+
+// ContextWithLogger returns a new context carrying a logger. All log output
+// of the library for the protocol session using the context is written to
+// this logger.
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, &contextLogger{base: logger, logger: logger})
+}
+
+// LoggerFromContext returns the logger carried by the context. Returns
+// slog.Default() if not set.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*contextLogger); ok && l.logger != nil {
+		return l.logger
+	}
+	return slog.Default()
+}
+
+// ContextWithLogAttrs returns a new context carrying the logger of the parent
+// context annotated with the given attributes. Arguments are handled in the
+// same way as [slog.Logger.With], except that an attribute with the same key
+// as one previously added with ContextWithLogAttrs replaces it.
+func ContextWithLogAttrs(ctx context.Context, args ...any) context.Context {
+	base, attrs := slog.Default(), []slog.Attr(nil)
+	if l, ok := ctx.Value(loggerContextKey{}).(*contextLogger); ok && l.base != nil {
+		base, attrs = l.base, slices.Clone(l.attrs)
+	}
+
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(args...)
+	r.Attrs(func(attr slog.Attr) bool {
+		if i := slices.IndexFunc(attrs, func(a slog.Attr) bool { return a.Key == attr.Key }); i >= 0 {
+			attrs[i] = attr
+		} else {
+			attrs = append(attrs, attr)
+		}
+		return true
+	})
+
+	with := make([]any, len(attrs))
+	for i, attr := range attrs {
+		with[i] = attr
+	}
+	return context.WithValue(ctx, loggerContextKey{}, &contextLogger{
+		base:   base,
+		attrs:  attrs,
+		logger: base.With(with...),
+	})
+}
+
+// ContextWithMessageLogAttrs returns a new context carrying the logger of the
+// parent context annotated with the protocol, message type, and FDO version
+// of a message being handled. Annotating a context again, such as by both a
+// transport and a responder, replaces these attributes.
+func ContextWithMessageLogAttrs(ctx context.Context, msgType uint8) context.Context {
+	return ContextWithLogAttrs(ctx,
+		"protocol", Of(msgType).String(),
+		"msg_type", msgType,
+		"version", VersionFromContext(ctx).String(),
+	)
+}
+
+// TokenHash returns a short, non-reversible identifier of a session token
+// which is safe to include in logs for correlating messages.
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package protocol_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+func TestContextWithLogAttrs(t *testing.T) {
+	var out bytes.Buffer
+	ctx := protocol.ContextWithLogger(context.Background(), slog.New(slog.NewTextHandler(&out, nil)))
+	ctx = protocol.ContextWithLogAttrs(ctx, "protocol", "TO2", "guid", "abc")
+
+	// Annotating each message replaces the attributes of the previous one
+	for _, msgType := range []uint8{60, 62} {
+		ctx = protocol.ContextWithMessageLogAttrs(ctx, msgType)
+		ctx = protocol.ContextWithLogAttrs(ctx, "msg_type", msgType)
+	}
+	protocol.LoggerFromContext(ctx).Info("hello", "extra", 1)
+
+	line := out.String()
+	for key, count := range map[string]int{"protocol=": 1, "guid=": 1, "msg_type=": 1, "version=": 1, "extra=": 1} {
+		if got := strings.Count(line, key); got != count {
+			t.Errorf("expected %d %q attributes, got %d: %s", count, key, got, line)
+		}
+	}
+	if !strings.Contains(line, "msg_type=62") || !strings.Contains(line, "guid=abc") {
+		t.Errorf("expected latest message type and session GUID: %s", line)
+	}
+}
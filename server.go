@@ -9,11 +9,13 @@ import (
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"time"
 
 	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/metrics"
 	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
@@ -51,6 +53,9 @@ type DIServer[T any] struct {
 
 	// Rendezvous directives
 	RvInfo func(context.Context, *Voucher) ([][]protocol.RvInstruction, error)
+
+	// Metrics, if non-nil, receives a measurement of each handled message.
+	Metrics metrics.Metrics
 }
 
 // Respond validates a request and returns the appropriate response message.
@@ -59,6 +64,10 @@ func (s *DIServer[T]) Respond(ctx context.Context, msgType uint8, msg io.Reader)
 	// complex error wrapping or overburdened method signatures.
 	ctx = contextWithErrMsg(ctx)
 	captureMsgType(ctx, msgType)
+	ctx = protocol.ContextWithMessageLogAttrs(ctx, msgType)
+	if s.Metrics != nil {
+		defer observeResponse(ctx, s.Metrics, msgType, time.Now(), &respType, &resp)
+	}
 
 	// Handle each message type
 	var err error
@@ -86,6 +95,7 @@ func (s *DIServer[T]) Respond(ctx context.Context, msgType uint8, msg io.Reader)
 	if errMsg.Timestamp == 0 {
 		errMsg.Timestamp = time.Now().Unix()
 	}
+	protocol.LoggerFromContext(ctx).Warn("responding with error", "code", errMsg.Code, "error", err)
 	return protocol.ErrorMsgType, errMsg
 }
 
@@ -107,6 +117,9 @@ type TO0Server struct {
 	// requested TTL will be used. It is expected that some other means of
 	// authorization is used in this case.
 	AcceptVoucher func(ctx context.Context, ov Voucher, requestedTTLSecs uint32) (ttlSecs uint32, err error)
+
+	// Metrics, if non-nil, receives a measurement of each handled message.
+	Metrics metrics.Metrics
 }
 
 // Respond validates a request and returns the appropriate response message.
@@ -115,6 +128,10 @@ func (s *TO0Server) Respond(ctx context.Context, msgType uint8, msg io.Reader) (
 	// complex error wrapping or overburdened method signatures.
 	ctx = contextWithErrMsg(ctx)
 	captureMsgType(ctx, msgType)
+	ctx = protocol.ContextWithMessageLogAttrs(ctx, msgType)
+	if s.Metrics != nil {
+		defer observeResponse(ctx, s.Metrics, msgType, time.Now(), &respType, &resp)
+	}
 
 	// Handle each message type
 	var err error
@@ -142,6 +159,7 @@ func (s *TO0Server) Respond(ctx context.Context, msgType uint8, msg io.Reader) (
 	if errMsg.Timestamp == 0 {
 		errMsg.Timestamp = time.Now().Unix()
 	}
+	protocol.LoggerFromContext(ctx).Warn("responding with error", "code", errMsg.Code, "error", err)
 	return protocol.ErrorMsgType, errMsg
 }
 
@@ -152,6 +170,9 @@ func (s *TO0Server) HandleError(ctx context.Context, errMsg protocol.ErrorMessag
 type TO1Server struct {
 	Session TO1SessionState
 	RVBlobs RendezvousBlobPersistentState
+
+	// Metrics, if non-nil, receives a measurement of each handled message.
+	Metrics metrics.Metrics
 }
 
 // Respond validates a request and returns the appropriate response message.
@@ -160,6 +181,10 @@ func (s *TO1Server) Respond(ctx context.Context, msgType uint8, msg io.Reader) (
 	// complex error wrapping or overburdened method signatures.
 	ctx = contextWithErrMsg(ctx)
 	captureMsgType(ctx, msgType)
+	ctx = protocol.ContextWithMessageLogAttrs(ctx, msgType)
+	if s.Metrics != nil {
+		defer observeResponse(ctx, s.Metrics, msgType, time.Now(), &respType, &resp)
+	}
 
 	// Handle each message type
 	var err error
@@ -187,6 +212,7 @@ func (s *TO1Server) Respond(ctx context.Context, msgType uint8, msg io.Reader) (
 	if errMsg.Timestamp == 0 {
 		errMsg.Timestamp = time.Now().Unix()
 	}
+	protocol.LoggerFromContext(ctx).Warn("responding with error", "code", errMsg.Code, "error", err)
 	return protocol.ErrorMsgType, errMsg
 }
 
@@ -233,11 +259,39 @@ type TO2Server struct {
 	// a well understood network.
 	MaxDeviceServiceInfoSize func(context.Context, Voucher) (uint16, error)
 
+	// DevmodSchema, if non-nil, declares devmod extensions accepted from
+	// devices and policies which reject devices based on their devmod. See
+	// [serviceinfo.DevmodSchema].
+	DevmodSchema *serviceinfo.DevmodSchema
+
 	// Use this delegate cert for onboarding (or empty string)
 	OnboardDelegate string
 
 	// Use this delegate cert for rendezvous (or empty string)
 	RvDelegate string
+
+	// OnEvent, if non-nil, is called synchronously with each onboarding
+	// lifecycle event. See [TO2Event] for the event types. It should return
+	// quickly, handing off any slow work, such as calling webhooks, to another
+	// goroutine.
+	OnEvent func(context.Context, TO2Event)
+
+	// Metrics, if non-nil, receives a measurement of each handled message.
+	Metrics metrics.Metrics
+
+	// SessionTimeout is the time after which state held in memory for a TO2
+	// session, such as owner service info which did not fit in the MTU and
+	// the start times of events, is discarded if it has not been updated, so
+	// that abandoned sessions do not hold memory forever. If zero, one hour is
+	// used.
+	SessionTimeout time.Duration
+
+	// Start times of TO2 sessions, used for event durations
+	provedAt sessionMap[time.Time]
+
+	// Owner service info which did not fit in the MTU by session, unless
+	// Session implements TO2ServiceInfoState
+	pendingInfo sessionMap[*pendingServiceInfo]
 }
 
 // Resell implements the FDO Resale Protocol by removing a voucher from
@@ -293,6 +347,15 @@ func (s *TO2Server) Respond(ctx context.Context, msgType uint8, msg io.Reader) (
 	// complex error wrapping or overburdened method signatures.
 	ctx = contextWithErrMsg(ctx)
 	captureMsgType(ctx, msgType)
+	ctx = protocol.ContextWithMessageLogAttrs(ctx, msgType)
+	if msgType != protocol.TO2HelloDeviceMsgType && msgType != protocol.TO2HelloDeviceProbeMsgType {
+		if guid, err := s.Session.GUID(ctx); err == nil {
+			ctx = protocol.ContextWithLogAttrs(ctx, "guid", guid.String())
+		}
+	}
+	if s.Metrics != nil {
+		defer observeResponse(ctx, s.Metrics, msgType, time.Now(), &respType, &resp)
+	}
 
 	// Handle each message type
 	var err error
@@ -314,10 +377,10 @@ func (s *TO2Server) Respond(ctx context.Context, msgType uint8, msg io.Reader) (
 		respType = protocol.TO2OwnerServiceInfoMsgType
 		resp, err = s.ownerServiceInfo(ctx, msg)
 		if err != nil {
-			s.Modules.CleanupModules(ctx)
+			s.cleanupModules(ctx)
 		}
 	case protocol.TO2DoneMsgType:
-		s.Modules.CleanupModules(ctx)
+		s.cleanupModules(ctx)
 		respType = protocol.TO2Done2MsgType
 		resp, err = s.to2Done2(ctx, msg)
 
@@ -339,10 +402,10 @@ func (s *TO2Server) Respond(ctx context.Context, msgType uint8, msg io.Reader) (
 		respType = protocol.TO2OwnerSvcInfo20MsgType
 		resp, err = s.ownerSvcInfo20(ctx, msg)
 		if err != nil {
-			s.Modules.CleanupModules(ctx)
+			s.cleanupModules(ctx)
 		}
 	case protocol.TO2Done20MsgType:
-		s.Modules.CleanupModules(ctx)
+		s.cleanupModules(ctx)
 		respType = protocol.TO2DoneAck20MsgType
 		resp, err = s.doneAck20(ctx, msg)
 	}
@@ -364,6 +427,8 @@ func (s *TO2Server) Respond(ctx context.Context, msgType uint8, msg io.Reader) (
 	if errMsg.Timestamp == 0 {
 		errMsg.Timestamp = time.Now().Unix()
 	}
+	protocol.LoggerFromContext(ctx).Warn("responding with error", "code", errMsg.Code, "error", err)
+	s.forgetProved(ctx)
 	return protocol.ErrorMsgType, errMsg
 }
 
@@ -377,5 +442,88 @@ func (s *TO2Server) CryptSession(ctx context.Context) (kex.Session, error) {
 func (s *TO2Server) HandleError(ctx context.Context, errMsg protocol.ErrorMessage) {
 	// This should only be applicable if errMsg.PrevMsgType == 69, but the
 	// device reported error message cannot be completely trusted
+	s.abortModule(ctx, errMsg)
+	s.cleanupModules(ctx)
+
+	if s.OnEvent != nil {
+		guid := s.sessionGUID(ctx)
+		s.emit(ctx, DeviceErrorEvent{
+			GUID:     guid,
+			Error:    errMsg,
+			Duration: s.sinceProved(ctx, true),
+		})
+	}
+}
+
+// cleanupModules cleans up service info module state of the current session.
+func (s *TO2Server) cleanupModules(ctx context.Context) {
 	s.Modules.CleanupModules(ctx)
+	if key, ok := s.sessionKey(ctx); ok {
+		s.pendingInfo.delete(key)
+	}
+}
+
+// TO2DeviceInfo returns a func which loads information about the device in a
+// TO2 session from session state and the device's voucher. It is intended for
+// use as the Device func of a [serviceinfo.PlanStateMachine].
+func TO2DeviceInfo(session TO2SessionState, vouchers VoucherPersistentState) func(context.Context) (*serviceinfo.DeviceInfo, error) {
+	return func(ctx context.Context) (*serviceinfo.DeviceInfo, error) {
+		guid, err := session.GUID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving associated device GUID of TO2 session: %w", err)
+		}
+
+		ov, err := vouchers.Voucher(ctx, guid)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving voucher for device %x: %w", guid, err)
+		}
+
+		replacementGUID, err := session.ReplacementGUID(ctx)
+		if errors.Is(err, ErrNotFound) {
+			// replacement GUID is not found when using the Credential Reuse Protocol
+			replacementGUID = guid
+		} else if err != nil {
+			return nil, fmt.Errorf("error retrieving replacement GUID for device: %w", err)
+		}
+
+		devmod, modules, devmodComplete, err := session.Devmod(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving devmod info for device %x: %w", guid, err)
+		}
+		if !devmodComplete {
+			return nil, fmt.Errorf("devmod did not complete")
+		}
+
+		var deviceCertChain []*x509.Certificate
+		if ov.CertChain != nil {
+			deviceCertChain = make([]*x509.Certificate, len(*ov.CertChain))
+			for i, cert := range *ov.CertChain {
+				deviceCertChain[i] = (*x509.Certificate)(cert)
+			}
+		}
+
+		return &serviceinfo.DeviceInfo{
+			GUID:            guid,
+			ReplacementGUID: replacementGUID,
+			Info:            ov.Header.Val.DeviceInfo,
+			CertChain:       deviceCertChain,
+			Devmod:          devmod,
+			Modules:         modules,
+		}, nil
+	}
+}
+
+// observeResponse reports the result of handling a request message to a
+// responder's metrics.
+func observeResponse(ctx context.Context, m metrics.Metrics, msgType uint8, start time.Time, respType *uint8, resp *any) {
+	var errCode uint16
+	if *respType == protocol.ErrorMsgType {
+		switch errMsg := (*resp).(type) {
+		case *protocol.ErrorMessage:
+			errCode = errMsg.Code
+		case protocol.ErrorMessage:
+			errCode = errMsg.Code
+		}
+	}
+	m.ObserveResponse(ctx, msgType, *respType, errCode, time.Since(start))
 }
@@ -147,6 +147,21 @@ type TO2SessionState interface {
 	Devmod(context.Context) (_ serviceinfo.Devmod, modules []string, complete bool, _ error)
 }
 
+// TO2ServiceInfoState is an optional interface which may be implemented by
+// TO2SessionState to store owner service info which did not fit in the
+// previous TO2.OwnerServiceInfo message (see [serviceinfo.Producer]).
+// Otherwise, it is held in memory and the TO2 session must be handled by the
+// same owner service instance until all of it has been sent.
+type TO2ServiceInfoState interface {
+	// SetPendingServiceInfo stores encoded owner service info to send in
+	// following messages. A nil value removes it.
+	SetPendingServiceInfo(context.Context, []byte) error
+
+	// PendingServiceInfo returns the owner service info stored by
+	// SetPendingServiceInfo or ErrNotFound.
+	PendingServiceInfo(context.Context) ([]byte, error)
+}
+
 // RendezvousBlobPersistentState maintains device to owner info state used in
 // TO0 and TO1.
 type RendezvousBlobPersistentState interface {
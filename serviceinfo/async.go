@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package serviceinfo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Default time that AsyncOwnerModule waits for its job before responding
+const defaultAsyncPollInterval = time.Second
+
+// ErrJobTimeout is returned by AsyncOwnerModule when its job does not complete
+// within the timeout.
+var ErrJobTimeout = errors.New("service info module job timed out")
+
+// AsyncOwnerModule is an OwnerModule for owner services which must do slow
+// work, such as querying an inventory system or waiting for approval, before
+// they can produce service info for a device.
+//
+// The job is started in the background on the first call to ProduceInfo.
+// Until it completes, each call waits up to PollInterval and then responds
+// with no service info and blockPeer set, keeping the device in the 68/69 loop
+// without it sending any service info. When the job completes, the module it
+// returns handles all further calls, beginning with any service info received
+// while waiting. If the job fails or times out, the error is returned from
+// ProduceInfo, failing TO2.
+//
+// The job runs in the memory of one owner service instance, so
+// AsyncOwnerModule cannot be restored by a ModuleRestorer.
+type AsyncOwnerModule struct {
+	// Job runs in the background and returns the module which will produce
+	// service info. The context contains the same values as the context of
+	// ProduceInfo, but is not canceled when the TO2 message is responded to.
+	Job func(context.Context) (OwnerModule, error)
+
+	// Timeout is the maximum duration of Job. If zero, there is no timeout
+	// and the job runs to completion even if TO2 fails.
+	Timeout time.Duration
+
+	// PollInterval is how long each TO2.DeviceServiceInfo waits for the job
+	// before the owner service responds. If zero, one second is used.
+	PollInterval time.Duration
+
+	started bool
+	result  chan asyncResult
+	expired <-chan struct{} // closed when the job context is done
+	module  OwnerModule
+	pending []*KV // service info received before the job completed
+}
+
+type asyncResult struct {
+	module OwnerModule
+	err    error
+}
+
+var _ OwnerModule = (*AsyncOwnerModule)(nil)
+
+// HandleInfo implements OwnerModule.
+func (a *AsyncOwnerModule) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	if a.module != nil {
+		return a.module.HandleInfo(ctx, messageName, messageBody)
+	}
+	body, err := io.ReadAll(messageBody)
+	if err != nil {
+		return fmt.Errorf("error reading message %q: %w", messageName, err)
+	}
+	a.pending = append(a.pending, &KV{Key: messageName, Val: body})
+	return nil
+}
+
+// ProduceInfo implements OwnerModule.
+func (a *AsyncOwnerModule) ProduceInfo(ctx context.Context, producer *Producer) (blockPeer, moduleDone bool, _ error) {
+	if a.module == nil {
+		if !a.started {
+			a.start(ctx)
+		}
+		if ok, err := a.wait(ctx); err != nil {
+			return false, false, err
+		} else if !ok {
+			return true, false, nil
+		}
+	}
+	return a.module.ProduceInfo(ctx, producer)
+}
+
+func (a *AsyncOwnerModule) start(ctx context.Context) {
+	a.started = true
+	a.result = make(chan asyncResult, 1)
+
+	ctx = context.WithoutCancel(ctx)
+	cancel := func() {}
+	if a.Timeout > 0 {
+		ctx, cancel = context.WithTimeoutCause(ctx, a.Timeout, ErrJobTimeout)
+	}
+	a.expired = ctx.Done()
+	go func() {
+		defer cancel()
+		module, err := a.Job(ctx)
+		if err == nil && module == nil {
+			err = errors.New("job returned no module")
+		}
+		if err != nil && errors.Is(context.Cause(ctx), ErrJobTimeout) {
+			err = ErrJobTimeout
+		}
+		a.result <- asyncResult{module: module, err: err}
+	}()
+}
+
+// wait returns true once the job has completed and its module has handled the
+// service info received while waiting.
+func (a *AsyncOwnerModule) wait(ctx context.Context) (bool, error) {
+	interval := a.PollInterval
+	if interval <= 0 {
+		interval = defaultAsyncPollInterval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	var result asyncResult
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-timer.C:
+		return false, nil
+	case result = <-a.result:
+	case <-a.expired:
+		// The job may have completed just before its context was canceled
+		select {
+		case result = <-a.result:
+		default:
+			return false, ErrJobTimeout
+		}
+	}
+	if result.err != nil {
+		return false, fmt.Errorf("service info module job: %w", result.err)
+	}
+
+	a.module = result.module
+	for _, kv := range a.pending {
+		if err := a.module.HandleInfo(ctx, kv.Key, bytes.NewReader(kv.Val)); err != nil {
+			return false, err
+		}
+	}
+	a.pending = nil
+	return true, nil
+}
@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package serviceinfo_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/fdotest"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+func TestClientWithAsyncOwnerModule(t *testing.T) {
+	var received atomic.Int32
+	deviceModule := &fdotest.MockDeviceModule{
+		ReceiveFunc: func(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+			var version string
+			if err := cbor.NewDecoder(messageBody).Decode(&version); err != nil {
+				return fmt.Errorf("error decoding %s: %w", messageName, err)
+			}
+			if messageName != "firmware" || version != "1.2.3" {
+				return fmt.Errorf("unexpected message %s: %q", messageName, version)
+			}
+			received.Add(1)
+			return nil
+		},
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			mockModuleName: deviceModule,
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield(mockModuleName, &serviceinfo.AsyncOwnerModule{
+					Job: func(ctx context.Context) (serviceinfo.OwnerModule, error) {
+						if _, ok := serviceinfo.GUIDFromContext(ctx); !ok {
+							return nil, errors.New("expected device GUID in job context")
+						}
+						time.Sleep(50 * time.Millisecond)
+						return &fdotest.MockOwnerModule{
+							ProduceInfoFunc: func(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+								if err := producer.WriteChunk("active", []byte{0xf5}); err != nil {
+									return false, false, err
+								}
+								if err := cbor.NewEncoder(producer.Message("firmware")).Encode("1.2.3"); err != nil {
+									return false, false, err
+								}
+								return false, true, nil
+							},
+						}, nil
+					},
+					Timeout:      10 * time.Second,
+					PollInterval: 10 * time.Millisecond,
+				})
+			}
+		},
+	})
+
+	if received.Load() == 0 {
+		t.Fatal("expected device module to receive service info produced after the job")
+	}
+}
+
+func TestAsyncOwnerModule(t *testing.T) {
+	t.Run("pending info", func(t *testing.T) {
+		var handled []string
+		module := &serviceinfo.AsyncOwnerModule{
+			Job: func(context.Context) (serviceinfo.OwnerModule, error) {
+				return &fdotest.MockOwnerModule{
+					HandleInfoFunc: func(_ context.Context, messageName string, messageBody io.Reader) error {
+						body, err := io.ReadAll(messageBody)
+						handled = append(handled, messageName+"="+string(body))
+						return err
+					},
+				}, nil
+			},
+			PollInterval: time.Second,
+		}
+		if err := module.HandleInfo(t.Context(), "active", bytes.NewReader([]byte{0xf5})); err != nil {
+			t.Fatal(err)
+		}
+		blockPeer, done, err := module.ProduceInfo(t.Context(), serviceinfo.NewProducer(mockModuleName, 1300))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blockPeer || !done {
+			t.Errorf("expected inner module result, got blockPeer=%t, done=%t", blockPeer, done)
+		}
+		if fmt.Sprint(handled) != "[active=\xf5]" {
+			t.Errorf("expected service info received before job completed to be handled, got %q", handled)
+		}
+	})
+
+	t.Run("polling", func(t *testing.T) {
+		release := make(chan struct{})
+		module := &serviceinfo.AsyncOwnerModule{
+			Job: func(context.Context) (serviceinfo.OwnerModule, error) {
+				<-release
+				return &fdotest.MockOwnerModule{}, nil
+			},
+			PollInterval: 10 * time.Millisecond,
+		}
+		producer := serviceinfo.NewProducer(mockModuleName, 1300)
+		for range 3 {
+			blockPeer, done, err := module.ProduceInfo(t.Context(), producer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !blockPeer || done {
+				t.Fatalf("expected device to be blocked while job runs, got blockPeer=%t, done=%t", blockPeer, done)
+			}
+		}
+		close(release)
+		for {
+			blockPeer, done, err := module.ProduceInfo(t.Context(), producer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done {
+				break
+			}
+			if !blockPeer {
+				t.Fatal("expected device to be blocked while job runs")
+			}
+		}
+	})
+
+	t.Run("job error", func(t *testing.T) {
+		module := &serviceinfo.AsyncOwnerModule{
+			Job: func(context.Context) (serviceinfo.OwnerModule, error) {
+				return nil, errors.New("inventory unavailable")
+			},
+		}
+		_, _, err := module.ProduceInfo(t.Context(), serviceinfo.NewProducer(mockModuleName, 1300))
+		if err == nil || !strings.Contains(err.Error(), "inventory unavailable") {
+			t.Fatalf("expected job error, got %v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		module := &serviceinfo.AsyncOwnerModule{
+			Job: func(ctx context.Context) (serviceinfo.OwnerModule, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			Timeout:      20 * time.Millisecond,
+			PollInterval: 5 * time.Millisecond,
+		}
+		producer := serviceinfo.NewProducer(mockModuleName, 1300)
+		for {
+			blockPeer, _, err := module.ProduceInfo(t.Context(), producer)
+			if errors.Is(err, serviceinfo.ErrJobTimeout) {
+				break
+			}
+			if err != nil || !blockPeer {
+				t.Fatalf("expected job to time out, got blockPeer=%t, err=%v", blockPeer, err)
+			}
+		}
+	})
+}
@@ -6,11 +6,15 @@ package serviceinfo
 import (
 	"context"
 	"crypto/x509"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
 )
 
 type (
 	devmodKey struct{}
 	devcrtKey struct{}
+	guidKey   struct{}
+	modsKey   struct{}
 )
 
 // Context creates a context with the values expected by native FSIM
@@ -35,3 +39,31 @@ func DeviceCertificateFromContext(ctx context.Context) (devCert []*x509.Certific
 	devCert, ok = ctx.Value(devcrtKey{}).([]*x509.Certificate)
 	return
 }
+
+// ContextWithGUID creates a context with the GUID of the device, as known at
+// the start of TO2, for use by native FSIM implementations.
+func ContextWithGUID(parent context.Context, guid protocol.GUID) context.Context {
+	return context.WithValue(parent, guidKey{}, guid)
+}
+
+// GUIDFromContext returns the GUID of the device for the current session,
+// before any replacement at the end of TO2. The ctx must be from the first
+// argument of HandleInfo or ProduceInfo for an OwnerModule.
+func GUIDFromContext(ctx context.Context) (guid protocol.GUID, ok bool) {
+	guid, ok = ctx.Value(guidKey{}).(protocol.GUID)
+	return
+}
+
+// ContextWithModules creates a context with the service info modules
+// advertised by the device in devmod, for use by native FSIM implementations.
+func ContextWithModules(parent context.Context, modules []string) context.Context {
+	return context.WithValue(parent, modsKey{}, modules)
+}
+
+// ModulesFromContext returns the service info modules advertised by the
+// device in devmod. The ctx must be from the first argument of HandleInfo or
+// ProduceInfo for an OwnerModule.
+func ModulesFromContext(ctx context.Context) (modules []string, ok bool) {
+	modules, ok = ctx.Value(modsKey{}).([]string)
+	return
+}
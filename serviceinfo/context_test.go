@@ -38,6 +38,10 @@ func TestOwnerModuleContextValues(t *testing.T) {
 				t.Errorf("expected device certificate chain %+v, got %+v", expectedCertChain, gotCertChain)
 			}
 
+			if _, ok := serviceinfo.GUIDFromContext(ctx); !ok {
+				t.Error("device GUID from context is empty")
+			}
+
 			return false, true, nil
 		},
 	}
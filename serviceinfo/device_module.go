@@ -75,6 +75,26 @@ type DeviceModule interface {
 	Yield(ctx context.Context, respond func(message string) io.Writer, yield func()) error
 }
 
+// TransactionalModule is an optional extension of DeviceModule for modules
+// which stage changes while service info is exchanged and only apply them
+// once TO2 completes.
+//
+// Exactly one of Commit or Abort is called after each TO2 which reached the
+// service info exchange, regardless of whether the module was activated.
+type TransactionalModule interface {
+	DeviceModule
+
+	// Commit applies all staged changes. It is called only after the owner
+	// service has acknowledged the completion of TO2 (TO2.Done2 or
+	// TO2.DoneAck20 has been verified). Because the owner service already
+	// considers the device onboarded, errors cannot be reported to it.
+	Commit(ctx context.Context) error
+
+	// Abort discards all staged changes. It is called when TO2 fails after
+	// the service info exchange has started.
+	Abort(ctx context.Context) error
+}
+
 // UnknownModule handles receiving and responding to service info for an
 // inactive or missing module.
 //
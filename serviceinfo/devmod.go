@@ -7,7 +7,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
 	"reflect"
+	"slices"
 	"strings"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
@@ -89,6 +91,12 @@ type Devmod struct {
 	ProgEnv string `devmod:"progenv"`
 	Bin     string `devmod:"bin,required"`
 	MudURL  string `devmod:"mudurl"`
+
+	// Extensions are devmod messages not defined by the FDO spec, keyed by
+	// message name, with CBOR-encoded values. Devices send them after the
+	// spec-defined messages. Owner services only accept extensions declared
+	// in a DevmodSchema.
+	Extensions map[string][]byte `cbor:",omitempty"`
 }
 
 // Write the devmod messages.
@@ -150,7 +158,7 @@ func (d *Devmod) writeDescriptorMessages(w *UnchunkWriter) error {
 	for i := 0; i < dm.NumField(); i++ {
 		tag := dm.Type().Field(i).Tag.Get("devmod")
 		messageName, _, _ := strings.Cut(tag, ",")
-		if dm.Field(i).Len() == 0 {
+		if messageName == "" || dm.Field(i).Len() == 0 {
 			continue
 		}
 		if err := w.NextServiceInfo(devmodModuleName, messageName); err != nil {
@@ -161,9 +169,47 @@ func (d *Devmod) writeDescriptorMessages(w *UnchunkWriter) error {
 		}
 	}
 
+	// Extension values are already encoded
+	for _, messageName := range slices.Sorted(maps.Keys(d.Extensions)) {
+		if err := w.NextServiceInfo(devmodModuleName, messageName); err != nil {
+			return err
+		}
+		if _, err := w.Write(d.Extensions[messageName]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// Field returns the value of the field with the given devmod message name,
+// i.e. "arch". The serial number is returned as a string of its bytes. If no
+// field has the name, ok is false.
+func (d *Devmod) Field(messageName string) (value string, ok bool) {
+	dm := reflect.ValueOf(d).Elem()
+	for i := 0; i < dm.NumField(); i++ {
+		tag := dm.Type().Field(i).Tag.Get("devmod")
+		if name, _, _ := strings.Cut(tag, ","); name == "" || name != messageName {
+			continue
+		}
+		if b, isBytes := dm.Field(i).Interface().([]byte); isBytes {
+			return string(b), true
+		}
+		return dm.Field(i).String(), true
+	}
+	return "", false
+}
+
+// Extension decodes the value of the extension with the given message name
+// into v. If the device did not send the extension, ok is false.
+func (d *Devmod) Extension(messageName string, v any) (ok bool, err error) {
+	raw, ok := d.Extensions[messageName]
+	if !ok {
+		return false, nil
+	}
+	return true, cbor.Unmarshal(raw, v)
+}
+
 // Validate checks that all required fields are not their zero value.
 func (d *Devmod) Validate() error {
 	// Use reflection to get each field and check required fields are not empty
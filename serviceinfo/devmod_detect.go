@@ -0,0 +1,197 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package serviceinfo
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DetectDevmod returns the devmod of the running device. See
+// [DevmodDetector.Detect] for details.
+func DetectDevmod() Devmod {
+	return DevmodDetector{}.Detect()
+}
+
+// DevmodDetector detects devmod values from the running system and the files
+// of a Linux root filesystem.
+type DevmodDetector struct {
+	// FS is the root filesystem of the device. If nil, the host root
+	// filesystem is used.
+	FS fs.FS
+
+	// Path is the list of directories, separated by the OS path list
+	// separator, searched for programming environments. If empty, the PATH
+	// environment variable is used.
+	Path string
+}
+
+// Detect returns a devmod populated from the following sources. Values which
+// cannot be read (e.g. because the file does not exist or requires root
+// permissions) are left empty, so callers should set any missing required
+// fields, which may be checked with [Devmod.Validate].
+//
+//   - os, arch, pathsep, sep, nl, and tmp from the Go runtime
+//   - version from PRETTY_NAME (or NAME and VERSION_ID) of /etc/os-release or
+//     /usr/lib/os-release
+//   - device and sn from DMI (/sys/class/dmi/id/product_name and
+//     product_serial) or else the device tree model and serial-number
+//   - bin from the architecture and any enabled QEMU binfmt_misc handlers
+//   - progenv from interpreters found in PATH
+func (d DevmodDetector) Detect() Devmod {
+	fsys := d.FS
+	if fsys == nil {
+		fsys = os.DirFS("/")
+	}
+	searchPath := d.Path
+	if searchPath == "" {
+		searchPath = os.Getenv("PATH")
+	}
+
+	sep := string(os.PathListSeparator)
+	devmod := Devmod{
+		Os:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Version: osRelease(fsys),
+		Device:  firstValue(fsys, "sys/class/dmi/id/product_name", "sys/firmware/devicetree/base/model"),
+		PathSep: string(os.PathSeparator),
+		FileSep: sep,
+		Newline: "\n",
+		Temp:    os.TempDir(),
+		ProgEnv: strings.Join(progEnv(fsys, searchPath), sep),
+		Bin:     strings.Join(binFormats(fsys), sep),
+	}
+	if runtime.GOOS == "windows" {
+		devmod.Newline = "\r\n"
+	}
+	if serial := firstValue(fsys, "sys/class/dmi/id/product_serial", "sys/firmware/devicetree/base/serial-number"); serial != "" {
+		devmod.Serial = []byte(serial)
+	}
+	return devmod
+}
+
+// osRelease returns the OS version from os-release(5).
+func osRelease(fsys fs.FS) string {
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			continue
+		}
+		vars := make(map[string]string)
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			key, val, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+			if !ok || strings.HasPrefix(key, "#") {
+				continue
+			}
+			if unquoted, err := strconv.Unquote(val); err == nil {
+				val = unquoted
+			} else {
+				val = strings.Trim(val, `'"`)
+			}
+			vars[key] = val
+		}
+		if pretty := vars["PRETTY_NAME"]; pretty != "" {
+			return pretty
+		}
+		return strings.TrimSpace(vars["NAME"] + " " + vars["VERSION_ID"])
+	}
+	return ""
+}
+
+// firstValue returns the trimmed contents of the first readable, non-empty
+// file. Device tree values are NUL-terminated.
+func firstValue(fsys fs.FS, names ...string) string {
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			continue
+		}
+		if val := strings.TrimSpace(strings.TrimRight(string(data), "\x00")); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// QEMU binfmt_misc handler names which differ from GOARCH values
+var qemuArch = map[string]string{
+	"aarch64":  "arm64",
+	"i386":     "386",
+	"x86_64":   "amd64",
+	"mips64el": "mips64le",
+	"mipsel":   "mipsle",
+}
+
+// binFormats returns the native architecture followed by the architectures
+// of enabled QEMU user mode emulators registered with binfmt_misc.
+func binFormats(fsys fs.FS) []string {
+	formats := []string{runtime.GOARCH}
+	const dir = "proc/sys/fs/binfmt_misc"
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return formats
+	}
+	for _, entry := range entries {
+		arch, ok := strings.CutPrefix(entry.Name(), "qemu-")
+		if !ok {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if status, _, _ := strings.Cut(string(data), "\n"); status != "enabled" {
+			continue
+		}
+		if goarch, ok := qemuArch[arch]; ok {
+			arch = goarch
+		}
+		if !slices.Contains(formats, arch) {
+			formats = append(formats, arch)
+		}
+	}
+	return formats
+}
+
+// Interpreters by progenv value, in order of preference
+var progEnvInterpreters = []struct{ env, name string }{
+	{env: "py3", name: "python3"},
+	{env: "py2", name: "python2"},
+	{env: "java", name: "java"},
+}
+
+// progEnv returns "bin" followed by the programming environments with an
+// interpreter executable found in the search path.
+func progEnv(fsys fs.FS, searchPath string) []string {
+	envs := []string{"bin"}
+	for _, interpreter := range progEnvInterpreters {
+		if lookPath(fsys, searchPath, interpreter.name) {
+			envs = append(envs, interpreter.env)
+		}
+	}
+	return envs
+}
+
+// lookPath reports whether an executable file with the given name is in an
+// absolute directory of the search path.
+func lookPath(fsys fs.FS, searchPath, name string) bool {
+	for _, dir := range strings.Split(searchPath, string(os.PathListSeparator)) {
+		if !path.IsAbs(dir) {
+			continue
+		}
+		info, err := fs.Stat(fsys, path.Join(strings.TrimPrefix(dir, "/"), name))
+		if err == nil && !info.IsDir() && info.Mode().Perm()&0o111 != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package serviceinfo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+)
+
+// DevmodType is the CBOR type of a devmod extension value.
+type DevmodType int
+
+// Devmod extension value types
+const (
+	DevmodString DevmodType = iota + 1 // tstr, decoded as string
+	DevmodBytes                        // bstr, decoded as []byte
+	DevmodUint                         // uint, decoded as uint64
+	DevmodInt                          // int, decoded as int64
+	DevmodBool                         // bool, decoded as bool
+)
+
+func (t DevmodType) String() string {
+	switch t {
+	case DevmodString:
+		return "tstr"
+	case DevmodBytes:
+		return "bstr"
+	case DevmodUint:
+		return "uint"
+	case DevmodInt:
+		return "int"
+	case DevmodBool:
+		return "bool"
+	default:
+		return fmt.Sprintf("DevmodType(%d)", int(t))
+	}
+}
+
+// value returns a pointer to a new value of the Go type of t.
+func (t DevmodType) value() any {
+	switch t {
+	case DevmodString:
+		return new(string)
+	case DevmodBytes:
+		return new([]byte)
+	case DevmodUint:
+		return new(uint64)
+	case DevmodInt:
+		return new(int64)
+	case DevmodBool:
+		return new(bool)
+	default:
+		return nil
+	}
+}
+
+// DevmodExtension declares a devmod message which is not defined by the FDO
+// spec, i.e. a vendor-specific "devmod:x-sku".
+type DevmodExtension struct {
+	// Name is the message name, without the "devmod:" prefix.
+	Name string
+
+	// Type is the CBOR type which the value must have.
+	Type DevmodType
+
+	// Required causes devices which do not send the message to be rejected.
+	Required bool
+}
+
+// DevmodPolicy checks the complete devmod of a device during TO2. Returning
+// an error rejects the device, failing TO2.
+type DevmodPolicy func(*Devmod) error
+
+// DevmodSchema declares the devmod an owner service accepts from devices.
+//
+// Without a schema, devmod messages not defined by the FDO spec cause TO2 to
+// fail. Messages declared as extensions are type checked and stored in
+// [Devmod.Extensions], so that owner modules may read them with
+// [DevmodFromContext] and [Devmod.Extension]. Once all devmod has been
+// received and the fields required by the spec are validated, required
+// extensions are checked and then each policy is applied in order.
+type DevmodSchema struct {
+	Extensions []DevmodExtension
+	Policies   []DevmodPolicy
+}
+
+// ErrDevmodRejected is wrapped by errors returned when a device's devmod
+// violates the schema of the owner service.
+var ErrDevmodRejected = errors.New("devmod rejected")
+
+// DecodeExtension reads the body of a devmod message which is not defined by
+// the FDO spec. If the schema declares the message, the value is checked
+// against its declared type and returned as raw CBOR. Otherwise, ok is false.
+func (s *DevmodSchema) DecodeExtension(messageName string, messageBody io.Reader) (raw []byte, ok bool, err error) {
+	if s == nil {
+		return nil, false, nil
+	}
+	i := slices.IndexFunc(s.Extensions, func(ext DevmodExtension) bool { return ext.Name == messageName })
+	if i == -1 {
+		return nil, false, nil
+	}
+	ext := s.Extensions[i]
+
+	raw, err = io.ReadAll(messageBody)
+	if err != nil {
+		return nil, true, err
+	}
+	if err := unmarshalExtension(raw, ext.Type); err != nil {
+		return nil, true, fmt.Errorf("%w: devmod:%s must be %s: %w", ErrDevmodRejected, messageName, ext.Type, err)
+	}
+	return raw, true, nil
+}
+
+// Check checks that all required extensions are present and applies each
+// policy.
+func (s *DevmodSchema) Check(devmod *Devmod) error {
+	if s == nil {
+		return nil
+	}
+	for _, ext := range s.Extensions {
+		if _, ok := devmod.Extensions[ext.Name]; ext.Required && !ok {
+			return fmt.Errorf("%w: missing required devmod field: %s", ErrDevmodRejected, ext.Name)
+		}
+	}
+	for _, policy := range s.Policies {
+		if err := policy(devmod); err != nil {
+			return fmt.Errorf("%w: %w", ErrDevmodRejected, err)
+		}
+	}
+	return nil
+}
+
+// unmarshalExtension checks that raw is a single CBOR item of type t.
+func unmarshalExtension(raw []byte, t DevmodType) error {
+	v := t.value()
+	if v == nil {
+		return fmt.Errorf("unsupported type %s", t)
+	}
+	r := bytes.NewReader(raw)
+	if err := cbor.NewDecoder(r).Decode(v); err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return errors.New("trailing data")
+	}
+	return nil
+}
+
+// RequireDevmod returns a policy rejecting devices which do not send any of
+// the given devmod messages, i.e. "sn". Both spec-defined fields and
+// extensions may be named.
+func RequireDevmod(messageNames ...string) DevmodPolicy {
+	return func(devmod *Devmod) error {
+		for _, name := range messageNames {
+			if value, ok := devmod.Field(name); ok && value != "" {
+				continue
+			}
+			if _, ok := devmod.Extensions[name]; ok {
+				continue
+			}
+			return fmt.Errorf("missing devmod field: %s", name)
+		}
+		return nil
+	}
+}
+
+// AllowDevmod returns a policy rejecting devices which send a value for the
+// spec-defined devmod field other than those allowed, i.e. arch of "amd64" or
+// "arm64". Devices which do not send the field are not rejected; combine with
+// [RequireDevmod] for optional fields.
+func AllowDevmod(messageName string, allowed ...string) DevmodPolicy {
+	return func(devmod *Devmod) error {
+		value, ok := devmod.Field(messageName)
+		if !ok {
+			return fmt.Errorf("unknown devmod field: %s", messageName)
+		}
+		if value == "" || slices.Contains(allowed, value) {
+			return nil
+		}
+		return fmt.Errorf("devmod:%s value %q is not allowed", messageName, value)
+	}
+}
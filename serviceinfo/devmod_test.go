@@ -4,14 +4,19 @@
 package serviceinfo_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
 
+	"github.com/fido-device-onboard/go-fdo/cbor"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
 
@@ -106,3 +111,140 @@ func TestDevmod(t *testing.T) {
 		t.Errorf("expected devmod:modules to be written in 3 chunks, got %d", modChunks)
 	}
 }
+
+func TestDevmodDetector(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("devmod detection reads Linux filesystem paths")
+	}
+
+	fsys := fstest.MapFS{
+		"etc/os-release": &fstest.MapFile{Data: []byte(`NAME="Debian GNU/Linux"
+VERSION_ID="12"
+# comment
+PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+`)},
+		"sys/class/dmi/id/product_name":              &fstest.MapFile{Data: []byte("UnitMcUnitFace\n")},
+		"sys/firmware/devicetree/base/serial-number": &fstest.MapFile{Data: []byte("SN-1234\x00")},
+		"proc/sys/fs/binfmt_misc/qemu-aarch64":       &fstest.MapFile{Data: []byte("enabled\ninterpreter /usr/bin/qemu-aarch64\n")},
+		"proc/sys/fs/binfmt_misc/qemu-riscv64":       &fstest.MapFile{Data: []byte("disabled\n")},
+		"proc/sys/fs/binfmt_misc/status":             &fstest.MapFile{Data: []byte("enabled\n")},
+		"usr/bin/python3":                            &fstest.MapFile{Mode: 0o755},
+		"usr/bin/java":                               &fstest.MapFile{Mode: 0o644},
+		"opt/bin/python2":                            &fstest.MapFile{Mode: 0o755},
+	}
+	devmod := serviceinfo.DevmodDetector{FS: fsys, Path: "/usr/bin:opt/bin"}.Detect()
+
+	if err := devmod.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []struct{ name, got, expected string }{
+		{"os", devmod.Os, runtime.GOOS},
+		{"arch", devmod.Arch, runtime.GOARCH},
+		{"version", devmod.Version, "Debian GNU/Linux 12 (bookworm)"},
+		{"device", devmod.Device, "UnitMcUnitFace"},
+		{"sn", string(devmod.Serial), "SN-1234"},
+		{"sep", devmod.FileSep, ":"},
+		{"bin", devmod.Bin, strings.Join(slices.Compact([]string{runtime.GOARCH, "arm64"}), ":")},
+		{"progenv", devmod.ProgEnv, "bin:py3"},
+	} {
+		if field.got != field.expected {
+			t.Errorf("expected %s %q, got %q", field.name, field.expected, field.got)
+		}
+	}
+
+	// Fall back to os-release in /usr/lib and NAME with VERSION_ID
+	devmod = serviceinfo.DevmodDetector{FS: fstest.MapFS{
+		"usr/lib/os-release": &fstest.MapFile{Data: []byte("NAME=Fedora\nVERSION_ID=40\n")},
+	}, Path: "/usr/bin"}.Detect()
+	if devmod.Version != "Fedora 40" {
+		t.Errorf("expected version from /usr/lib/os-release, got %q", devmod.Version)
+	}
+	if devmod.Device != "" || devmod.Serial != nil {
+		t.Errorf("expected undetected device and sn to be empty, got %q, %q", devmod.Device, devmod.Serial)
+	}
+}
+
+func TestDevmodSchema(t *testing.T) {
+	sku, _ := cbor.Marshal("SKU-1")
+	devmod := serviceinfo.Devmod{
+		Os:         "linux",
+		Arch:       "amd64",
+		Version:    "TestOS",
+		Device:     "UnitMcUnitFace",
+		FileSep:    ";",
+		Bin:        "amd64",
+		Extensions: map[string][]byte{"x-sku": sku},
+	}
+
+	// Extensions are written by devices after the spec-defined fields
+	r, w := serviceinfo.NewChunkOutPipe(0)
+	go devmod.Write(context.Background(), nil, 1300, w)
+	var last *serviceinfo.KV
+	for {
+		chunk, err := r.ReadChunk(1300)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, serviceinfo.ErrSizeTooSmall) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk.Key == "devmod:x-sku" {
+			last = chunk
+		}
+	}
+	if last == nil || !bytes.Equal(last.Val, sku) {
+		t.Errorf("expected extension to be written, got %+v", last)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		schema *serviceinfo.DevmodSchema
+		errMsg string
+	}{
+		{name: "nil schema"},
+		{
+			name: "required extension",
+			schema: &serviceinfo.DevmodSchema{Extensions: []serviceinfo.DevmodExtension{
+				{Name: "x-sku", Type: serviceinfo.DevmodString, Required: true},
+				{Name: "x-rack", Type: serviceinfo.DevmodUint, Required: true},
+			}},
+			errMsg: "missing required devmod field: x-rack",
+		},
+		{
+			name:   "allowed arch",
+			schema: &serviceinfo.DevmodSchema{Policies: []serviceinfo.DevmodPolicy{serviceinfo.AllowDevmod("arch", "amd64", "arm64")}},
+		},
+		{
+			name:   "unsupported arch",
+			schema: &serviceinfo.DevmodSchema{Policies: []serviceinfo.DevmodPolicy{serviceinfo.AllowDevmod("arch", "arm64")}},
+			errMsg: `devmod:arch value "amd64" is not allowed`,
+		},
+		{
+			name:   "missing serial",
+			schema: &serviceinfo.DevmodSchema{Policies: []serviceinfo.DevmodPolicy{serviceinfo.RequireDevmod("x-sku", "sn")}},
+			errMsg: "missing devmod field: sn",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.schema.Check(&devmod)
+			switch {
+			case tc.errMsg == "" && err != nil:
+				t.Fatal(err)
+			case tc.errMsg != "" && (!errors.Is(err, serviceinfo.ErrDevmodRejected) || !strings.Contains(fmt.Sprint(err), tc.errMsg)):
+				t.Fatalf("expected rejection %q, got %v", tc.errMsg, err)
+			}
+		})
+	}
+
+	// Extension values are type checked
+	schema := &serviceinfo.DevmodSchema{Extensions: []serviceinfo.DevmodExtension{{Name: "x-rack", Type: serviceinfo.DevmodUint}}}
+	if _, ok, err := schema.DecodeExtension("x-rack", bytes.NewReader(sku)); !ok || !errors.Is(err, serviceinfo.ErrDevmodRejected) {
+		t.Errorf("expected wrong type to be rejected, got %t, %v", ok, err)
+	}
+	if _, ok, err := schema.DecodeExtension("x-other", bytes.NewReader(sku)); ok || err != nil {
+		t.Errorf("expected undeclared extension to not be decoded, got %t, %v", ok, err)
+	}
+}
@@ -99,3 +99,17 @@ type ModulePersister interface {
 	// database and table schema.
 	PersistModule(ctx context.Context, name string, module OwnerModule) error
 }
+
+// ModuleRestorer is an optional interface which may be implemented by
+// ModulePersisters to load the state stored by PersistModule. Together, they
+// allow the 68->69 loop of a TO2 session to continue on any instance of a
+// horizontally scaled owner service.
+type ModuleRestorer interface {
+	// RestoreModule decodes the state most recently stored by PersistModule
+	// in the TO2 session of the context into module and returns the name it
+	// was stored with. If no state has been stored, ok is false.
+	//
+	// Module state is encoded with encoding.BinaryMarshaler and decoded with
+	// encoding.BinaryUnmarshaler.
+	RestoreModule(ctx context.Context, module OwnerModule) (name string, ok bool, err error)
+}
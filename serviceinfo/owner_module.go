@@ -5,7 +5,10 @@ package serviceinfo
 
 import (
 	"context"
+	"fmt"
 	"io"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
 )
 
 // OwnerModule implements the owner service role for a service info module.
@@ -44,12 +47,46 @@ type OwnerModule interface {
 	ProduceInfo(ctx context.Context, producer *Producer) (blockPeer, moduleDone bool, _ error)
 }
 
+// AbortableOwnerModule is an optional extension of OwnerModule for modules
+// which must know when the device fails TO2 while they are running.
+type AbortableOwnerModule interface {
+	OwnerModule
+
+	// Abort is called with the device's error message when the device sends
+	// an error while the module is the current service info module. It is
+	// not called when the error is returned by the module itself.
+	Abort(ctx context.Context, err error)
+}
+
 // Producer allows an owner service info module to produce service info either
-// with auto-chunking (not yet implemented) or manually.
+// with auto-chunking, using [Producer.Message], or manually, using
+// [Producer.Available] and [Producer.WriteChunk].
+//
+// Service info written with Message which does not fit within the MTU is held
+// by the owner service and sent in following TO2.OwnerServiceInfo messages
+// with IsMoreServiceInfo set. ProduceInfo is not called again until all of it has been sent, and if
+// the module indicated that it was done, the next module is not started until
+// then.
+//
+// Devices buffer all service info received while IsMoreServiceInfo is set
+// before handling any of it (go-fdo devices buffer up to 1000 KVs), so very
+// large values should still be sent over multiple calls to ProduceInfo.
 type Producer struct {
 	moduleName string
 	mtu        uint16
 	info       []*KV
+
+	// Writer of the last KV in info, which it may extend
+	last *messageWriter
+
+	// Service info to send in following messages
+	overflow []overflowInfo
+}
+
+type overflowInfo struct {
+	messageName string
+	body        []byte
+	writer      *messageWriter
 }
 
 // NewProducer creates a new producer instance for the given MTU.
@@ -69,7 +106,13 @@ func NewProducer(moduleName string, mtu uint16) *Producer {
 // If the next service info will not fit in the remaining bytes, then the
 // module should return and on the next ProduceInfo the full MTU will be
 // available.
+//
+// Once a message written with [Producer.Message] has exceeded the MTU,
+// Available returns zero.
 func (p *Producer) Available(messageName string) int {
+	if len(p.overflow) > 0 {
+		return 0
+	}
 	return int(p.mtu) - int(ArraySizeCBOR(append(p.info, &KV{Key: p.moduleName + ":" + messageName}))) +
 		1 // 1 represents overcounting the size of the last KV, because the Val will be 1 byte
 }
@@ -77,12 +120,168 @@ func (p *Producer) Available(messageName string) int {
 // WriteChunk queues a single service info. If messageBody is larger than the
 // bytes available, WriteChunk will fail and no service info will be queued.
 func (p *Producer) WriteChunk(messageName string, messageBody []byte) error {
+	if len(messageBody)+cborHeaderLen(len(messageBody)) > p.Available(messageName) {
+		return fmt.Errorf("service info %q of %d bytes exceeds the space available", messageName, len(messageBody))
+	}
 	p.info = append(p.info, &KV{
 		Key: p.moduleName + ":" + messageName,
 		Val: messageBody,
 	})
+	p.last = nil
 	return nil
 }
 
+// Message returns a writer for the body of a service info message, similar to
+// the respond func given to device modules. Bodies of any size may be written
+// and are split across as many KVs and TO2.OwnerServiceInfo messages as
+// needed. The device concatenates the KVs into a single message body.
+//
+// Each call returns a new message, even if the message name is the same as
+// the previous call.
+func (p *Producer) Message(messageName string) io.Writer {
+	return &messageWriter{p: p, messageName: messageName}
+}
+
+type messageWriter struct {
+	p           *Producer
+	messageName string
+}
+
+func (w *messageWriter) Write(b []byte) (int, error) {
+	p, n := w.p, len(b)
+	for len(b) > 0 && len(p.overflow) == 0 {
+		// Extend the last KV if it was written by w, otherwise start a new one
+		if p.last == w {
+			kv := p.info[len(p.info)-1]
+			room := int(p.mtu) - int(ArraySizeCBOR(p.info))
+			grow := min(room, 65535-len(kv.Val), len(b))
+			for ; grow > 0; grow-- {
+				if cborHeaderLen(len(kv.Val)+grow)-cborHeaderLen(len(kv.Val))+grow <= room {
+					break
+				}
+			}
+			if grow <= 0 {
+				break
+			}
+			kv.Val, b = append(kv.Val, b[:grow]...), b[grow:]
+			continue
+		}
+
+		avail := p.Available(w.messageName)
+		size := min(avail-cborHeaderLen(avail), len(b))
+		if size <= 0 {
+			break
+		}
+		p.info = append(p.info, &KV{
+			Key: p.moduleName + ":" + w.messageName,
+			Val: append([]byte(nil), b[:size]...),
+		})
+		p.last, b = w, b[size:]
+	}
+	if len(b) == 0 {
+		return n, nil
+	}
+
+	// Hold the rest for following messages
+	if last := len(p.overflow) - 1; last >= 0 && p.overflow[last].writer == w {
+		p.overflow[last].body = append(p.overflow[last].body, b...)
+	} else {
+		p.overflow = append(p.overflow, overflowInfo{
+			messageName: w.messageName,
+			body:        append([]byte(nil), b...),
+			writer:      w,
+		})
+	}
+	return n, nil
+}
+
+func cborHeaderLen(n int) int {
+	switch {
+	case n < 24:
+		return 1
+	case n < 256:
+		return 2
+	default:
+		return 3
+	}
+}
+
 // ServiceInfo returns all ServiceInfo, guaranteed to fit within the MTU.
 func (p *Producer) ServiceInfo() []*KV { return p.info }
+
+// Remaining returns a producer holding the service info which did not fit in
+// the MTU, or nil if all service info was returned by ServiceInfo. The
+// ServiceInfo of the returned producer is the next message to send.
+func (p *Producer) Remaining() *Producer {
+	if len(p.overflow) == 0 {
+		return nil
+	}
+	next := &Producer{moduleName: p.moduleName, mtu: p.mtu}
+	writers := make(map[*messageWriter]*messageWriter)
+	for _, info := range p.overflow {
+		w, ok := writers[info.writer]
+		if !ok {
+			w = &messageWriter{p: next, messageName: info.messageName}
+			writers[info.writer] = w
+		}
+		_, _ = w.Write(info.body)
+	}
+	return next
+}
+
+type producerState struct {
+	ModuleName string
+	MTU        uint16
+	Info       []*KV
+	Overflow   []overflowState
+}
+
+type overflowState struct {
+	MessageName string
+	Body        []byte
+	Writer      int
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, so that service info
+// held for following messages may be stored by the owner service. Writers
+// returned by Message are not valid after the producer is restored.
+func (p *Producer) MarshalBinary() ([]byte, error) {
+	state := producerState{ModuleName: p.moduleName, MTU: p.mtu, Info: p.info}
+	writers := make(map[*messageWriter]int)
+	for _, info := range p.overflow {
+		id := writers[info.writer]
+		if id == 0 {
+			id = len(writers) + 1
+			writers[info.writer] = id
+		}
+		state.Overflow = append(state.Overflow, overflowState{
+			MessageName: info.messageName,
+			Body:        info.body,
+			Writer:      id,
+		})
+	}
+	return cbor.Marshal(state)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (p *Producer) UnmarshalBinary(data []byte) error {
+	var state producerState
+	if err := cbor.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*p = Producer{moduleName: state.ModuleName, mtu: state.MTU, info: state.Info}
+	writers := make(map[int]*messageWriter)
+	for _, info := range state.Overflow {
+		w := writers[info.Writer]
+		if w == nil {
+			w = &messageWriter{p: p, messageName: info.MessageName}
+			writers[info.Writer] = w
+		}
+		p.overflow = append(p.overflow, overflowInfo{
+			messageName: info.MessageName,
+			body:        info.Body,
+			writer:      w,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package serviceinfo
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"sync"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// DeviceInfo describes the device being onboarded in a TO2 session. It is
+// used to plan which owner service info modules to run.
+type DeviceInfo struct {
+	// GUID is the GUID of the device at the start of TO2.
+	GUID protocol.GUID
+
+	// ReplacementGUID is the GUID the device will have after TO2. It is equal
+	// to GUID when the Credential Reuse Protocol is used.
+	ReplacementGUID protocol.GUID
+
+	// Info is the DeviceInfo field of the voucher header.
+	Info string
+
+	// CertChain is the device certificate chain of the voucher, if any.
+	CertChain []*x509.Certificate
+
+	// Devmod and Modules are the devmod values and the service info modules
+	// advertised by the device.
+	Devmod  Devmod
+	Modules []string
+}
+
+// Plan returns the owner service info modules to run for a device, in order.
+// Modules which the device did not advertise are skipped, so a Plan may
+// yield modules without checking device support.
+//
+// The context is that of the request which started the first module and
+// carries the values expected by native FSIMs (see [Context] and
+// [ContextWithGUID]). It should not be retained after the iterator yields.
+type Plan func(ctx context.Context, device *DeviceInfo) iter.Seq2[string, OwnerModule]
+
+// PlanStateMachine implements ModuleStateMachine by running the modules of a
+// Plan for each TO2 session. It is safe for concurrent use by multiple
+// sessions.
+//
+// Module state is held in memory, so all messages of a TO2 session must be
+// handled by the same instance. Set Persister to additionally store module
+// state after each message.
+//
+// If Persister also implements [ModuleRestorer], then module state is not
+// held in memory between messages, so that they may be handled by any
+// instance. Instead, the Plan is started again for each message and the
+// current module, found by its position in the Plan, is restored. A Plan must
+// then yield the same modules each time it is started for a device, and
+// modules must implement [encoding.BinaryMarshaler] and
+// [encoding.BinaryUnmarshaler] for any state not set by the Plan.
+type PlanStateMachine struct {
+	// Session returns a key which uniquely identifies the TO2 session of the
+	// context, i.e. the session token. It is required.
+	Session func(context.Context) (string, bool)
+
+	// Device loads information about the device in the TO2 session of the
+	// context. It is required.
+	Device func(context.Context) (*DeviceInfo, error)
+
+	// Plan chooses the modules to run for each device. It is required.
+	Plan Plan
+
+	// Persister optionally stores the state of the current module.
+	Persister ModulePersister
+
+	mu       sync.Mutex
+	sessions map[string]*planState
+}
+
+type planState struct {
+	name    string
+	module  OwnerModule
+	index   int // position of module among supported modules, starting at 1
+	modules []string
+	next    func() (string, OwnerModule, bool)
+	stop    func()
+}
+
+// advance progresses to the next module which the device supports.
+func (state *planState) advance(ctx context.Context) bool {
+	for {
+		name, module, valid := state.next()
+		if !valid {
+			state.name, state.module = "", nil
+			return false
+		}
+		if slices.Contains(state.modules, name) {
+			state.name, state.module = name, module
+			state.index++
+			return true
+		}
+		protocol.LoggerFromContext(ctx).Debug("skipping service info module not supported by device", "module", name)
+	}
+}
+
+var (
+	_ ModuleStateMachine = (*PlanStateMachine)(nil)
+	_ ModulePersister    = (*PlanStateMachine)(nil)
+)
+
+// state returns the state of the session, restoring it from persisted state
+// if it is not held in memory. If position is true, then only the position of
+// the current module in the plan is restored, and not the module's state.
+func (p *PlanStateMachine) state(ctx context.Context, position bool) (string, *planState, error) {
+	if p.Session == nil {
+		return "", nil, errors.New("plan state machine has no session func")
+	}
+	key, ok := p.Session(ctx)
+	if !ok {
+		return "", nil, errors.New("invalid context: no session")
+	}
+	p.mu.Lock()
+	state := p.sessions[key]
+	p.mu.Unlock()
+	if state != nil {
+		return key, state, nil
+	}
+
+	// Restore the session from persisted state, if possible
+	restorer, ok := p.Persister.(ModuleRestorer)
+	if !ok {
+		return key, nil, nil
+	}
+	state, err := p.restore(ctx, restorer, position)
+	if err != nil || state == nil {
+		return key, nil, err
+	}
+	p.store(key, state)
+	return key, state, nil
+}
+
+func (p *PlanStateMachine) store(key string, state *planState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions == nil {
+		p.sessions = make(map[string]*planState)
+	}
+	p.sessions[key] = state
+}
+
+// release removes the state of a session from memory and stops its plan.
+func (p *PlanStateMachine) release(key string) {
+	p.mu.Lock()
+	state, ok := p.sessions[key]
+	delete(p.sessions, key)
+	p.mu.Unlock()
+	if ok {
+		state.stop()
+	}
+}
+
+// Module implements ModuleStateMachine.
+func (p *PlanStateMachine) Module(ctx context.Context) (string, OwnerModule, error) {
+	_, state, err := p.state(ctx, false)
+	if err != nil {
+		return "", nil, err
+	}
+	if state == nil {
+		return "", nil, errors.New("NextModule not called")
+	}
+	if state.module == nil {
+		return "", nil, errors.New("NextModule already returned false")
+	}
+	return state.name, state.module, nil
+}
+
+// NextModule implements ModuleStateMachine.
+func (p *PlanStateMachine) NextModule(ctx context.Context) (bool, error) {
+	key, state, err := p.state(ctx, true)
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		if state, err = p.start(ctx); err != nil {
+			return false, err
+		}
+		p.store(key, state)
+	}
+	valid := state.advance(ctx)
+
+	// Store the position of the next module, so that it may be restored
+	if _, ok := p.Persister.(ModuleRestorer); ok {
+		defer p.release(key)
+		if valid {
+			if err := p.Persister.PersistModule(ctx, state.name, &planModule{
+				OwnerModule: state.module,
+				index:       state.index,
+				fresh:       true,
+			}); err != nil {
+				return false, err
+			}
+		}
+	}
+	return valid, nil
+}
+
+func (p *PlanStateMachine) start(ctx context.Context) (*planState, error) {
+	if p.Device == nil || p.Plan == nil {
+		return nil, errors.New("plan state machine requires Device and Plan funcs")
+	}
+	device, err := p.Device(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading device info: %w", err)
+	}
+
+	// Set the context values that FSIMs expect, so that plans may use them
+	ctx = ContextWithGUID(Context(ctx, &device.Devmod, device.CertChain), device.GUID)
+	ctx = ContextWithModules(ctx, device.Modules)
+
+	next, stop := iter.Pull2(p.Plan(ctx, device))
+	return &planState{
+		modules: device.Modules,
+		next:    next,
+		stop:    stop,
+	}, nil
+}
+
+func (p *PlanStateMachine) restore(ctx context.Context, restorer ModuleRestorer, position bool) (*planState, error) {
+	var saved planModule
+	name, ok, err := restorer.RestoreModule(ctx, &saved)
+	if err != nil {
+		return nil, fmt.Errorf("error restoring service info module state: %w", err)
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	// Run the plan until the stored module is reached
+	state, err := p.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for state.index < saved.index {
+		if !state.advance(ctx) {
+			state.stop()
+			return nil, fmt.Errorf("plan ended before restoring service info module %q", name)
+		}
+	}
+	if state.name != name {
+		state.stop()
+		return nil, fmt.Errorf("plan yielded service info module %q in place of %q", state.name, name)
+	}
+	if saved.fresh || position {
+		return state, nil
+	}
+
+	module, ok := state.module.(encoding.BinaryUnmarshaler)
+	if !ok {
+		state.stop()
+		return nil, fmt.Errorf("service info module %q (%T) does not implement encoding.BinaryUnmarshaler", name, state.module)
+	}
+	if err := module.UnmarshalBinary(saved.state); err != nil {
+		state.stop()
+		return nil, fmt.Errorf("error restoring service info module %q: %w", name, err)
+	}
+	return state, nil
+}
+
+// planModule is persisted in place of the current module, so that the
+// module's position in the plan is restored along with its state.
+type planModule struct {
+	OwnerModule
+	index int
+	fresh bool   // module has not yet been used, so it has no state
+	state []byte // set by UnmarshalBinary
+}
+
+type planModuleState struct {
+	Index int
+	Fresh bool
+	State []byte
+}
+
+func (m *planModule) MarshalBinary() ([]byte, error) {
+	saved := planModuleState{Index: m.index, Fresh: m.fresh}
+	if !m.fresh {
+		module, ok := m.OwnerModule.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("%T does not implement encoding.BinaryMarshaler", m.OwnerModule)
+		}
+		var err error
+		if saved.State, err = module.MarshalBinary(); err != nil {
+			return nil, err
+		}
+	}
+	return cbor.Marshal(saved)
+}
+
+func (m *planModule) UnmarshalBinary(data []byte) error {
+	var saved planModuleState
+	if err := cbor.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	m.index, m.fresh, m.state = saved.Index, saved.Fresh, saved.State
+	return nil
+}
+
+// PersistModule implements ModulePersister by calling Persister, if set.
+func (p *PlanStateMachine) PersistModule(ctx context.Context, name string, module OwnerModule) error {
+	if p.Persister == nil {
+		return nil
+	}
+	if _, ok := p.Persister.(ModuleRestorer); !ok {
+		return p.Persister.PersistModule(ctx, name, module)
+	}
+
+	// Store the module with its position and release it from memory
+	key, state, err := p.state(ctx, false)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		// The devmod module is run by the TO2 server before the plan starts
+		// and its state is stored with the session
+		if name == devmodModuleName {
+			return nil
+		}
+		return errors.New("NextModule not called")
+	}
+	defer p.release(key)
+	return p.Persister.PersistModule(ctx, name, &planModule{OwnerModule: module, index: state.index})
+}
+
+// CleanupModules implements ModuleStateMachine.
+func (p *PlanStateMachine) CleanupModules(ctx context.Context) {
+	if p.Session == nil {
+		return
+	}
+	if key, ok := p.Session(ctx); ok {
+		p.release(key)
+	}
+}
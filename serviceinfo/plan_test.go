@@ -0,0 +1,223 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package serviceinfo_test
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"iter"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/fdotest"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+type sessionKey struct{}
+
+func TestPlanStateMachine(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		stopped int
+	)
+	plans := &serviceinfo.PlanStateMachine{
+		Session: func(ctx context.Context) (string, bool) {
+			key, ok := ctx.Value(sessionKey{}).(string)
+			return key, ok
+		},
+		Device: func(ctx context.Context) (*serviceinfo.DeviceInfo, error) {
+			key, _ := ctx.Value(sessionKey{}).(string)
+			return &serviceinfo.DeviceInfo{
+				Devmod:  serviceinfo.Devmod{Arch: key},
+				Modules: []string{"devmod", "fdo.a", "fdo.c"},
+			}, nil
+		},
+		Plan: func(ctx context.Context, device *serviceinfo.DeviceInfo) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				defer func() { mu.Lock(); stopped++; mu.Unlock() }()
+				if devmod, ok := serviceinfo.DevmodFromContext(ctx); !ok || devmod.Arch != device.Devmod.Arch {
+					t.Error("expected devmod in plan context")
+				}
+				for _, name := range []string{"fdo.a", "fdo.b", "fdo.c"} {
+					if !yield(name, &fdotest.MockOwnerModule{}) {
+						return
+					}
+				}
+			}
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := context.WithValue(context.Background(), sessionKey{}, fmt.Sprintf("session-%d", i))
+
+			if _, _, err := plans.Module(ctx); err == nil {
+				t.Error("expected error before NextModule")
+			}
+			var names []string
+			for {
+				valid, err := plans.NextModule(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !valid {
+					break
+				}
+				name, _, err := plans.Module(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				names = append(names, name)
+			}
+			if fmt.Sprint(names) != "[fdo.a fdo.c]" {
+				t.Errorf("expected unsupported module to be skipped, got %v", names)
+			}
+			plans.CleanupModules(ctx)
+			if _, _, err := plans.Module(ctx); err == nil {
+				t.Error("expected error after cleanup")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stopped != 10 {
+		t.Errorf("expected 10 plans to complete, got %d", stopped)
+	}
+
+	// Cleanup stops a plan before it completes
+	ctx := context.WithValue(context.Background(), sessionKey{}, "cleanup")
+	if valid, err := plans.NextModule(ctx); err != nil || !valid {
+		t.Fatalf("expected first module, got %v, %v", valid, err)
+	}
+	plans.CleanupModules(ctx)
+	if stopped != 11 {
+		t.Error("expected cleanup to stop the plan")
+	}
+}
+
+// mapRestorer stores module state in memory by session, in place of a
+// database shared by owner service instances.
+type mapRestorer struct {
+	mu    sync.Mutex
+	names map[string]string
+	state map[string][]byte
+}
+
+func (r *mapRestorer) PersistModule(ctx context.Context, name string, module serviceinfo.OwnerModule) error {
+	data, err := module.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	key := ctx.Value(sessionKey{}).(string)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names[key], r.state[key] = name, data
+	return nil
+}
+
+func (r *mapRestorer) RestoreModule(ctx context.Context, module serviceinfo.OwnerModule) (string, bool, error) {
+	key := ctx.Value(sessionKey{}).(string)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name, ok := r.names[key]
+	if !ok {
+		return "", false, nil
+	}
+	return name, true, module.(encoding.BinaryUnmarshaler).UnmarshalBinary(r.state[key])
+}
+
+// counterModule counts the times it produces info and completes after three.
+type counterModule struct {
+	fdotest.MockOwnerModule
+	count int
+}
+
+func (m *counterModule) ProduceInfo(context.Context, *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	m.count++
+	return false, m.count == 3, nil
+}
+
+func (m *counterModule) MarshalBinary() ([]byte, error) {
+	return []byte(strconv.Itoa(m.count)), nil
+}
+
+func (m *counterModule) UnmarshalBinary(data []byte) (err error) {
+	m.count, err = strconv.Atoi(string(data))
+	return err
+}
+
+func TestPlanStateMachineRestore(t *testing.T) {
+	restorer := &mapRestorer{names: make(map[string]string), state: make(map[string][]byte)}
+	newInstance := func() *serviceinfo.PlanStateMachine {
+		return &serviceinfo.PlanStateMachine{
+			Session: func(ctx context.Context) (string, bool) {
+				key, ok := ctx.Value(sessionKey{}).(string)
+				return key, ok
+			},
+			Device: func(context.Context) (*serviceinfo.DeviceInfo, error) {
+				return &serviceinfo.DeviceInfo{Modules: []string{"devmod", "fdo.a", "fdo.c"}}, nil
+			},
+			Plan: func(ctx context.Context, device *serviceinfo.DeviceInfo) iter.Seq2[string, serviceinfo.OwnerModule] {
+				return func(yield func(string, serviceinfo.OwnerModule) bool) {
+					for _, name := range []string{"fdo.a", "fdo.b", "fdo.c"} {
+						if !yield(name, &counterModule{}) {
+							return
+						}
+					}
+				}
+			},
+			Persister: restorer,
+		}
+	}
+	instances := []*serviceinfo.PlanStateMachine{newInstance(), newInstance()}
+	ctx := context.WithValue(context.Background(), sessionKey{}, "session")
+
+	// Alternate instances on every call, as a load balancer without session
+	// affinity would
+	var call int
+	next := func() *serviceinfo.PlanStateMachine { call++; return instances[call%2] }
+
+	if err := next().PersistModule(ctx, "devmod", &fdotest.MockOwnerModule{}); err != nil {
+		t.Fatalf("expected devmod to be ignored, got %v", err)
+	}
+	var names []string
+	for {
+		valid, err := next().NextModule(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid {
+			break
+		}
+		for done := false; !done; {
+			name, module, err := next().Module(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, done, err = module.ProduceInfo(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := next().PersistModule(ctx, name, module); err != nil {
+				t.Fatal(err)
+			}
+			if done {
+				if got := module.(*counterModule).count; got != 3 {
+					t.Errorf("%s: expected state to be restored, got count %d", name, got)
+				}
+				names = append(names, name)
+			}
+		}
+	}
+	if fmt.Sprint(names) != "[fdo.a fdo.c]" {
+		t.Errorf("expected modules [fdo.a fdo.c], got %v", names)
+	}
+}
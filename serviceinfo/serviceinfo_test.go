@@ -5,9 +5,17 @@ package serviceinfo_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"iter"
+	"slices"
 	"testing"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/fdotest"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
 
@@ -45,4 +53,113 @@ func TestProducerAvailable(t *testing.T) {
 	if available := producer.Available(""); available >= 0 {
 		t.Fatalf("expected available bytes < 0, got %d", available)
 	}
+
+	producer = serviceinfo.NewProducer(moduleName, mtu)
+	if err := producer.WriteChunk(messageName, append(messageBody, 0)); err == nil {
+		t.Fatal("expected chunk larger than available bytes to fail")
+	}
+	if info := producer.ServiceInfo(); len(info) > 0 {
+		t.Fatalf("expected no service info to be queued, got %d", len(info))
+	}
+}
+
+func TestProducerMessage(t *testing.T) {
+	const moduleName, mtu = "module", 1300
+	body := bytes.Repeat([]byte("0123456789"), 20_000)
+
+	producer := serviceinfo.NewProducer(moduleName, mtu)
+	if err := producer.WriteChunk("first", []byte{0xf5}); err != nil {
+		t.Fatal(err)
+	}
+	w := producer.Message("large")
+	for chunk := range slices.Chunk(body, 333) {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if available := producer.Available("more"); available != 0 {
+		t.Errorf("expected no bytes available after overflow, got %d", available)
+	}
+	if err := producer.WriteChunk("last", []byte{0xf5}); err == nil {
+		t.Error("expected chunk to fail after overflow")
+	}
+	if _, err := producer.Message("last").Write([]byte{0xf5}); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	var got []byte
+	rounds := 0
+	for ; producer != nil; producer = producer.Remaining() {
+		rounds++
+		info := producer.ServiceInfo()
+		if size := serviceinfo.ArraySizeCBOR(info); size > mtu-3 {
+			t.Fatalf("round %d: service info size %d exceeds MTU", rounds, size)
+		}
+		for _, kv := range info {
+			if len(keys) == 0 || keys[len(keys)-1] != kv.Key {
+				keys = append(keys, kv.Key)
+			}
+			if kv.Key == moduleName+":large" {
+				got = append(got, kv.Val...)
+			}
+		}
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("expected body of %d bytes, got %d bytes", len(body), len(got))
+	}
+	if expect := []string{"module:first", "module:large", "module:last"}; !slices.Equal(keys, expect) {
+		t.Errorf("expected keys %v, got %v", expect, keys)
+	}
+	if minRounds := len(body) / mtu; rounds <= minRounds {
+		t.Errorf("expected more than %d rounds, got %d", minRounds, rounds)
+	}
+}
+
+func TestClientWithLargeOwnerServiceInfo(t *testing.T) {
+	body := bytes.Repeat([]byte("Hello World!\n"), 6_000)
+
+	var received [][]byte
+	deviceModule := &fdotest.MockDeviceModule{
+		ReceiveFunc: func(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+			if messageName != "data" {
+				return fmt.Errorf("unknown message %s", messageName)
+			}
+			var got []byte
+			if err := cbor.NewDecoder(messageBody).Decode(&got); err != nil {
+				return fmt.Errorf("error decoding %s: %w", messageName, err)
+			}
+			received = append(received, got)
+			return nil
+		},
+	}
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			mockModuleName: deviceModule,
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield(mockModuleName, &fdotest.MockOwnerModule{
+					ProduceInfoFunc: func(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+						if err := producer.WriteChunk("active", []byte{0xf5}); err != nil {
+							return false, false, err
+						}
+						if err := cbor.NewEncoder(producer.Message("data")).Encode(body); err != nil {
+							return false, false, err
+						}
+						return false, true, nil
+					},
+				})
+			}
+		},
+	})
+
+	if len(received) == 0 {
+		t.Fatal("expected device module to receive data")
+	}
+	for _, got := range received {
+		if !bytes.Equal(got, body) {
+			t.Fatalf("expected %d bytes, got %d", len(body), len(got))
+		}
+	}
 }
@@ -126,6 +126,13 @@ func Init(db *sql.DB) error {
 			, devmod_complete BOOLEAN CHECK (devmod_complete IN (0, 1))
 			, FOREIGN KEY(session) REFERENCES sessions(id) ON DELETE CASCADE
 			)`,
+		`CREATE TABLE IF NOT EXISTS to2_service_info
+			( session BLOB UNIQUE NOT NULL
+			, module_name TEXT
+			, module_state BLOB
+			, pending BLOB
+			, FOREIGN KEY(session) REFERENCES sessions(id) ON DELETE CASCADE
+			)`,
 		`CREATE TABLE IF NOT EXISTS vouchers
 			( guid BLOB PRIMARY KEY
 			, device_info TEXT NOT NULL
@@ -169,6 +176,10 @@ func (db *DB) Close() error { return db.db.Close() }
 // DB returns the underlying database/sql DB.
 func (db *DB) DB() *sql.DB { return db.db }
 
+// Ping verifies that the database connection is still alive. It may be used
+// for readiness checks.
+func (db *DB) Ping(ctx context.Context) error { return db.db.PingContext(ctx) }
+
 type debugLogKey struct{}
 
 func (db *DB) debugCtx(parent context.Context) context.Context {
@@ -191,6 +202,9 @@ var _ interface {
 	fdo.TO0SessionState
 	fdo.TO1SessionState
 	fdo.TO2SessionState
+	fdo.TO2ServiceInfoState
+	serviceinfo.ModulePersister
+	serviceinfo.ModuleRestorer
 	fdo.RendezvousBlobPersistentState
 	fdo.OwnerVoucherPersistentState
 	fdo.OwnerKeyPersistentState
@@ -1341,6 +1355,98 @@ func (db *DB) Devmod(ctx context.Context) (devmod serviceinfo.Devmod, modules []
 	return devmod, modules, complete, nil
 }
 
+// PersistModule stores the state of the current service info module, which
+// must implement encoding.BinaryMarshaler, so that the TO2 session may
+// continue on any owner service instance using the same database.
+func (db *DB) PersistModule(ctx context.Context, name string, module serviceinfo.OwnerModule) error {
+	sessID, ok := db.sessionID(ctx)
+	if !ok {
+		return fdo.ErrInvalidSession
+	}
+	marshaler, ok := module.(encoding.BinaryMarshaler)
+	if !ok {
+		return fmt.Errorf("service info module %q does not implement encoding.BinaryMarshaler", name)
+	}
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("error marshaling service info module %q state: %w", name, err)
+	}
+	return db.insert(ctx, "to2_service_info", map[string]any{
+		"session":      sessID,
+		"module_name":  name,
+		"module_state": state,
+	}, []string{"session"})
+}
+
+// RestoreModule decodes the state stored by PersistModule into module, which
+// must implement encoding.BinaryUnmarshaler.
+func (db *DB) RestoreModule(ctx context.Context, module serviceinfo.OwnerModule) (name string, ok bool, err error) {
+	sessID, ok := db.sessionID(ctx)
+	if !ok {
+		return "", false, fdo.ErrInvalidSession
+	}
+
+	var (
+		nameVal sql.NullString
+		state   sql.Null[[]byte]
+	)
+	if err := db.query(ctx, "to2_service_info", []string{
+		"module_name",
+		"module_state",
+	}, map[string]any{
+		"session": sessID,
+	}, &nameVal, &state); errors.Is(err, fdo.ErrNotFound) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	if !nameVal.Valid {
+		return "", false, nil
+	}
+
+	unmarshaler, ok := module.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return "", false, fmt.Errorf("%T does not implement encoding.BinaryUnmarshaler", module)
+	}
+	if err := unmarshaler.UnmarshalBinary(state.V); err != nil {
+		return "", false, fmt.Errorf("error unmarshaling service info module %q state: %w", nameVal.String, err)
+	}
+	return nameVal.String, true, nil
+}
+
+// SetPendingServiceInfo stores owner service info to send in following
+// messages.
+func (db *DB) SetPendingServiceInfo(ctx context.Context, info []byte) error {
+	sessID, ok := db.sessionID(ctx)
+	if !ok {
+		return fdo.ErrInvalidSession
+	}
+	return db.insert(ctx, "to2_service_info", map[string]any{
+		"session": sessID,
+		"pending": info,
+	}, []string{"session"})
+}
+
+// PendingServiceInfo returns the owner service info to send in following
+// messages.
+func (db *DB) PendingServiceInfo(ctx context.Context) ([]byte, error) {
+	sessID, ok := db.sessionID(ctx)
+	if !ok {
+		return nil, fdo.ErrInvalidSession
+	}
+
+	var info sql.Null[[]byte]
+	if err := db.query(ctx, "to2_service_info", []string{"pending"}, map[string]any{
+		"session": sessID,
+	}, &info); err != nil {
+		return nil, err
+	}
+	if !info.Valid || len(info.V) == 0 {
+		return nil, fdo.ErrNotFound
+	}
+	return info.V, nil
+}
+
 // SetRVBlob sets the owner rendezvous blob for a device.
 func (db *DB) SetRVBlob(ctx context.Context, ov *fdo.Voucher, to1d *cose.Sign1[protocol.To1d, []byte], exp time.Time) error {
 	blob, err := cbor.Marshal(to1d)
@@ -47,6 +47,10 @@ type TO0Client struct {
 // before the rendezvous blob must be refreshed by calling [RegisterBlob] again.
 func (c *TO0Client) RegisterBlob(ctx context.Context, transport Transport, guid protocol.GUID, addrs []protocol.RvTO2Addr, delegateName string) (uint32, error) {
 	ctx = contextWithErrMsg(ctx)
+	ctx = protocol.ContextWithLogAttrs(ctx,
+		"protocol", protocol.TO0Protocol.String(),
+		"guid", guid.String(),
+	)
 
 	nonce, err := c.hello(ctx, transport)
 	if err != nil {
@@ -30,6 +30,10 @@ type TO1Options struct {
 // on the client.
 func TO1(ctx context.Context, transport Transport, cred DeviceCredential, key crypto.Signer, opts *TO1Options) (*cose.Sign1[protocol.To1d, []byte], error) {
 	ctx = contextWithErrMsg(ctx)
+	ctx = protocol.ContextWithLogAttrs(ctx,
+		"protocol", protocol.TO1Protocol.String(),
+		"guid", cred.GUID.String(),
+	)
 
 	var usePSS bool
 	if opts != nil {
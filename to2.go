@@ -16,7 +16,6 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"log/slog"
 	"math"
 	"reflect"
 	"runtime"
@@ -131,6 +130,11 @@ type TO2Config struct {
 // device credential will be nil.
 func TO2(ctx context.Context, transport Transport, to1d *cose.Sign1[protocol.To1d, []byte], c TO2Config) (*DeviceCredential, error) {
 	ctx = contextWithErrMsg(ctx)
+	ctx = protocol.ContextWithLogAttrs(ctx,
+		"protocol", protocol.TO2Protocol.String(),
+		"guid", c.Cred.GUID.String(),
+		"version", protocol.Version101.String(),
+	)
 
 	// Configure defaults
 	if c.KeyExchange == "" {
@@ -202,10 +206,15 @@ func TO2(ctx context.Context, transport Transport, to1d *cose.Sign1[protocol.To1
 
 	// Loop, sending and receiving service info until done
 	if err := exchangeServiceInfo(ctx, transport, proveDeviceNonce, setupDeviceNonce, sendMTU, serviceInfoReader, sess, &c); err != nil {
+		abortDeviceModules(ctx, c.DeviceModules)
 		errorMsg(ctx, transport, err)
 		return nil, err
 	}
 
+	// Apply changes staged by device modules now that the owner service has
+	// acknowledged completion
+	commitDeviceModules(ctx, c.DeviceModules)
+
 	// If using the Credential Reuse protocol the device credential is not updated
 	if replacementOVH == nil {
 		return nil, nil
@@ -236,16 +245,17 @@ func stopOwnerPlugin(ctx context.Context, name string, module plugin.Module) {
 	defer cancel()
 
 	if err := module.GracefulStop(ctx); err != nil && !errors.Is(err, context.Canceled) {
-		slog.Warn("plugin graceful stop failed", "module", name, "error", err)
+		protocol.LoggerFromContext(ctx).Warn("plugin graceful stop failed", "module", name, "error", err)
 	}
 
 	if err := module.Stop(); err != nil {
-		slog.Warn("plugin forceful stop failed", "module", name, "error", err)
+		protocol.LoggerFromContext(ctx).Warn("plugin forceful stop failed", "module", name, "error", err)
 	}
 }
 
 // Stop any plugin device modules
-func stopDevicePlugins(modules *deviceModuleMap) {
+func stopDevicePlugins(ctx context.Context, modules *deviceModuleMap) {
+	logger := protocol.LoggerFromContext(ctx)
 	pluginStopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	var pluginStopWg sync.WaitGroup
@@ -261,7 +271,7 @@ func stopDevicePlugins(modules *deviceModuleMap) {
 			go func(p plugin.Module) {
 				defer done()
 				if err := p.GracefulStop(pluginGracefulStopCtx); err != nil && !errors.Is(err, context.Canceled) { //nolint:revive,staticcheck
-					slog.Warn("graceful stop failed", "module", name, "error", err)
+					logger.Warn("graceful stop failed", "module", name, "error", err)
 				}
 			}(p)
 
@@ -285,7 +295,7 @@ func verifyOwner(ctx context.Context, transport Transport, to1d *cose.Sign1[prot
 	if err != nil {
 		return protocol.Nonce{}, nil, nil, nil, nil, err
 	}
-	if !c.KeyExchange.Valid(c.Key.Public(), info.PublicKeyToValidate) {
+	if !c.KeyExchange.ValidContext(ctx, c.Key.Public(), info.PublicKeyToValidate) {
 		sess.Destroy()
 		return protocol.Nonce{}, nil, nil, nil, nil, fmt.Errorf(
 			"key exchange %s is invalid for the device and owner attestation types",
@@ -654,7 +664,7 @@ func (s *TO2Server) proveOVHdr(ctx context.Context, msg io.Reader) (*cose.Sign1T
 	}
 
 	// Begin key exchange
-	if !hello.KexSuiteName.Valid(hello.SigInfoA.Type, expectedCUPHOwnerKey) {
+	if !hello.KexSuiteName.ValidContext(ctx, hello.SigInfoA.Type, expectedCUPHOwnerKey) {
 		return nil, fmt.Errorf(
 			"key exchange %s is invalid for the device and owner attestation types",
 			hello.KexSuiteName,
@@ -1068,6 +1078,8 @@ func (s *TO2Server) setupDevice(ctx context.Context, msg io.Reader) (*cose.Sign1
 	if err := s1.Sign(ownerKey, nil, nil, opts); err != nil {
 		return nil, fmt.Errorf("error signing TO2.SetupDevice payload: %w", err)
 	}
+	s.markProved(ctx)
+	s.emit(ctx, DeviceProvedEvent{GUID: guid, Version: protocol.Version101})
 	return s1.Tag(), nil
 }
 
@@ -1263,7 +1275,7 @@ func exchangeServiceInfo(ctx context.Context,
 
 	// Track active modules
 	modules := deviceModuleMap{modules: c.DeviceModules, active: make(map[string]bool)}
-	defer stopDevicePlugins(&modules)
+	defer stopDevicePlugins(ctx, &modules)
 
 	var prevModuleName string
 	for {
@@ -1308,7 +1320,7 @@ func exchangeServiceInfo(ctx context.Context,
 		if done {
 			// Process final service info from message with IsDone
 			deviceInfo, discard := serviceinfo.NewChunkOutPipe(1000)
-			go discardDeviceInfo(deviceInfo)
+			go discardDeviceInfo(ctx, deviceInfo)
 			ctxWithMTU := context.WithValue(ctx, serviceinfo.MTUKey{}, mtu)
 			_ = handleOwnerModuleMessages(ctxWithMTU, prevModuleName, modules, nextOwnerInfo, discard)
 
@@ -1333,11 +1345,12 @@ func exchangeServiceInfo(ctx context.Context,
 	}
 }
 
-func discardDeviceInfo(deviceInfo *serviceinfo.ChunkReader) {
+func discardDeviceInfo(ctx context.Context, deviceInfo *serviceinfo.ChunkReader) {
+	logger := protocol.LoggerFromContext(ctx)
 	for {
 		kv, err := deviceInfo.ReadChunk(math.MaxUint16)
 		if err != nil && !errors.Is(err, io.EOF) {
-			slog.Warn("reading device service info for discard", "error", err)
+			logger.Warn("reading device service info for discard", "error", err)
 		}
 		if err != nil {
 			return
@@ -1346,7 +1359,7 @@ func discardDeviceInfo(deviceInfo *serviceinfo.ChunkReader) {
 		if err != nil {
 			prettyValue = "h'" + hex.EncodeToString(kv.Val) + "'"
 		}
-		slog.Warn("discarding device service info message because owner sent IsDone",
+		logger.Warn("discarding device service info message because owner sent IsDone",
 			"name", kv.Key, "value", prettyValue,
 		)
 	}
@@ -1516,6 +1529,7 @@ func (s *TO2Server) ownerServiceInfo(ctx context.Context, msg io.Reader) (*owner
 		moduleName, module = "devmod", &devmodOwnerModule{
 			Devmod:  devmod,
 			Modules: modules,
+			Schema:  s.DevmodSchema,
 		}
 	} else if err != nil {
 		return nil, fmt.Errorf("error getting devmod state: %w", err)
@@ -1525,24 +1539,9 @@ func (s *TO2Server) ownerServiceInfo(ctx context.Context, msg io.Reader) (*owner
 		if err != nil {
 			return nil, fmt.Errorf("error getting current service info module: %w", err)
 		}
-
-		// Set the context values that an FSIM expects
-		guid, err := s.Session.GUID(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("error retrieving associated device GUID of proof session: %w", err)
-		}
-		ov, err := s.Vouchers.Voucher(ctx, guid)
-		if err != nil {
-			return nil, fmt.Errorf("error retrieving voucher for device %x: %w", guid, err)
-		}
-		var deviceCertChain []*x509.Certificate
-		if ov.CertChain != nil {
-			deviceCertChain = make([]*x509.Certificate, len(*ov.CertChain))
-			for i, cert := range *ov.CertChain {
-				deviceCertChain[i] = (*x509.Certificate)(cert)
-			}
+		if ctx, err = s.moduleContext(ctx, devmod, modules); err != nil {
+			return nil, err
 		}
-		ctx = serviceinfo.Context(ctx, &devmod, deviceCertChain)
 	}
 
 	// Handle data with owner module
@@ -1616,26 +1615,55 @@ func (s *TO2Server) produceOwnerServiceInfo(ctx context.Context, moduleName stri
 		return nil, fmt.Errorf("error getting max device service info size: %w", err)
 	}
 
-	// Get service info produced by the module
-	producer := serviceinfo.NewProducer(moduleName, mtu)
-	explicitBlock, complete, err := module.ProduceInfo(ctx, producer)
-	if err != nil {
-		return nil, fmt.Errorf("error producing owner service info from module: %w", err)
-	}
-	if explicitBlock && complete {
-		slog.Warn("service info module completed but indicated that it had more service info to send", "module", moduleName)
-		explicitBlock = false
+	// Get service info produced by the module, unless service info which did
+	// not fit in the previous message remains to be sent
+	var producer *serviceinfo.Producer
+	var explicitBlock, complete bool
+	if pending, err := s.loadPendingInfo(ctx); err != nil {
+		return nil, fmt.Errorf("error loading pending owner service info: %w", err)
+	} else if pending != nil {
+		producer, explicitBlock, complete = pending.producer, pending.blockPeer, pending.complete
+	} else {
+		producer = serviceinfo.NewProducer(moduleName, mtu)
+		explicitBlock, complete, err = module.ProduceInfo(ctx, producer)
+		if err != nil {
+			return nil, fmt.Errorf("error producing owner service info from module: %w", err)
+		}
+		if explicitBlock && complete {
+			protocol.LoggerFromContext(ctx).Warn("service info module completed but indicated that it had more service info to send", "module", moduleName)
+			explicitBlock = false
+		}
 	}
 	serviceInfo := producer.ServiceInfo()
 	if size := serviceinfo.ArraySizeCBOR(serviceInfo); size > int64(mtu) {
 		return nil, fmt.Errorf("owner service info module produced service info exceeding the MTU=%d - 3 (message overhead), size=%d", mtu, size)
 	}
 
+	// Hold service info which did not fit and keep the device from sending
+	// until all of it has been sent
+	if remaining := producer.Remaining(); remaining != nil {
+		if err := s.storePendingInfo(ctx, &pendingServiceInfo{
+			producer:  remaining,
+			blockPeer: explicitBlock,
+			complete:  complete,
+		}); err != nil {
+			return nil, fmt.Errorf("error storing pending owner service info: %w", err)
+		}
+		explicitBlock, complete = true, false
+	}
+
 	// Store the current module state
 	if devmod, ok := module.(*devmodOwnerModule); ok {
 		if err := s.Session.SetDevmod(ctx, devmod.Devmod, devmod.Modules, complete); err != nil {
 			return nil, fmt.Errorf("error storing devmod state: %w", err)
 		}
+		if complete && s.OnEvent != nil {
+			s.emit(ctx, ServiceInfoStartedEvent{
+				GUID:    s.sessionGUID(ctx),
+				Devmod:  devmod.Devmod,
+				Modules: devmod.Modules,
+			})
+		}
 	}
 	if modules, ok := s.Modules.(serviceinfo.ModulePersister); ok {
 		if err := modules.PersistModule(ctx, moduleName, module); err != nil {
@@ -1658,6 +1686,9 @@ func (s *TO2Server) produceOwnerServiceInfo(ctx context.Context, moduleName stri
 		}
 		allModulesDone = !moreModules
 	}
+	if allModulesDone && s.OnEvent != nil {
+		s.emit(ctx, ServiceInfoCompletedEvent{GUID: s.sessionGUID(ctx), Duration: s.sinceProved(ctx, false)})
+	}
 
 	// Return chunked data
 	return &ownerServiceInfo{
@@ -1667,6 +1698,227 @@ func (s *TO2Server) produceOwnerServiceInfo(ctx context.Context, moduleName stri
 	}, nil
 }
 
+// moduleContext sets the context values that an FSIM expects.
+func (s *TO2Server) moduleContext(ctx context.Context, devmod serviceinfo.Devmod, modules []string) (context.Context, error) {
+	guid, err := s.Session.GUID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving associated device GUID of proof session: %w", err)
+	}
+	ov, err := s.Vouchers.Voucher(ctx, guid)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving voucher for device %x: %w", guid, err)
+	}
+	var deviceCertChain []*x509.Certificate
+	if ov.CertChain != nil {
+		deviceCertChain = make([]*x509.Certificate, len(*ov.CertChain))
+		for i, cert := range *ov.CertChain {
+			deviceCertChain[i] = (*x509.Certificate)(cert)
+		}
+	}
+	ctx = serviceinfo.ContextWithGUID(serviceinfo.Context(ctx, &devmod, deviceCertChain), guid)
+	return serviceinfo.ContextWithModules(ctx, modules), nil
+}
+
+// abortModule notifies the current service info module, if it implements
+// serviceinfo.AbortableOwnerModule, that the device failed TO2.
+func (s *TO2Server) abortModule(ctx context.Context, errMsg protocol.ErrorMessage) {
+	devmod, modules, complete, err := s.Session.Devmod(ctx)
+	if err != nil || !complete {
+		return
+	}
+	_, module, err := s.Modules.Module(ctx)
+	if err != nil {
+		return
+	}
+	abortable, ok := module.(serviceinfo.AbortableOwnerModule)
+	if !ok {
+		return
+	}
+	if ctx, err = s.moduleContext(ctx, devmod, modules); err != nil {
+		protocol.LoggerFromContext(ctx).Warn("error aborting service info module", "error", err)
+		return
+	}
+	abortable.Abort(ctx, errMsg)
+}
+
+// sessionKey identifies a TO2 session for state held in memory. The
+// ProveDevice nonce is generated for each session, so state of an abandoned
+// or concurrent session for the same device is never used.
+type sessionKey struct {
+	guid  protocol.GUID
+	nonce protocol.Nonce
+}
+
+// sessionKey returns the key of the current session, if the device has been
+// identified.
+func (s *TO2Server) sessionKey(ctx context.Context) (sessionKey, bool) {
+	guid, err := s.Session.GUID(ctx)
+	if err != nil {
+		return sessionKey{}, false
+	}
+	nonce, err := s.Session.ProveDeviceNonce(ctx)
+	if err != nil {
+		return sessionKey{}, false
+	}
+	return sessionKey{guid: guid, nonce: nonce}, true
+}
+
+// defaultSessionTimeout is the time after which state held in memory for an
+// abandoned TO2 session is discarded, if TO2Server.SessionTimeout is not set.
+const defaultSessionTimeout = time.Hour
+
+func (s *TO2Server) sessionTimeout() time.Duration {
+	if s.SessionTimeout > 0 {
+		return s.SessionTimeout
+	}
+	return defaultSessionTimeout
+}
+
+// sessionMap holds state of TO2 sessions in memory. Entries expire once they
+// have not been stored for the timeout given, so that state of sessions which
+// are abandoned without an error is eventually discarded.
+type sessionMap[T any] struct {
+	mu        sync.Mutex
+	entries   map[sessionKey]sessionEntry[T]
+	lastSweep time.Time
+}
+
+type sessionEntry[T any] struct {
+	val     T
+	expires time.Time
+}
+
+// sessionSweepInterval is the minimum time between removals of expired
+// session state.
+const sessionSweepInterval = time.Minute
+
+func (m *sessionMap[T]) store(key sessionKey, val T, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.entries == nil {
+		m.entries = make(map[sessionKey]sessionEntry[T])
+		m.lastSweep = now
+	}
+	if now.Sub(m.lastSweep) > sessionSweepInterval {
+		for k, entry := range m.entries {
+			if now.After(entry.expires) {
+				delete(m.entries, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.entries[key] = sessionEntry[T]{val: val, expires: now.Add(timeout)}
+}
+
+func (m *sessionMap[T]) load(key sessionKey) (T, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		var zero T
+		return zero, false
+	}
+	return entry.val, true
+}
+
+func (m *sessionMap[T]) loadAndDelete(key sessionKey) (T, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	delete(m.entries, key)
+	if !ok || time.Now().After(entry.expires) {
+		var zero T
+		return zero, false
+	}
+	return entry.val, true
+}
+
+func (m *sessionMap[T]) delete(key sessionKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
+
+// pendingServiceInfo is owner service info which did not fit in the MTU and
+// the result of the ProduceInfo call which produced it.
+type pendingServiceInfo struct {
+	producer  *serviceinfo.Producer
+	blockPeer bool
+	complete  bool
+}
+
+type pendingServiceInfoState struct {
+	Producer  []byte
+	BlockPeer bool
+	Complete  bool
+}
+
+// loadPendingInfo removes and returns the pending owner service info of the
+// session, if any.
+func (s *TO2Server) loadPendingInfo(ctx context.Context) (*pendingServiceInfo, error) {
+	state, ok := s.Session.(TO2ServiceInfoState)
+	if !ok {
+		key, ok := s.sessionKey(ctx)
+		if !ok {
+			return nil, nil
+		}
+		pending, _ := s.pendingInfo.loadAndDelete(key)
+		return pending, nil
+	}
+
+	data, err := state.PendingServiceInfo(ctx)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := state.SetPendingServiceInfo(ctx, nil); err != nil {
+		return nil, err
+	}
+	var saved pendingServiceInfoState
+	if err := cbor.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	var producer serviceinfo.Producer
+	if err := producer.UnmarshalBinary(saved.Producer); err != nil {
+		return nil, err
+	}
+	return &pendingServiceInfo{
+		producer:  &producer,
+		blockPeer: saved.BlockPeer,
+		complete:  saved.Complete,
+	}, nil
+}
+
+// storePendingInfo holds owner service info to send in following messages.
+func (s *TO2Server) storePendingInfo(ctx context.Context, pending *pendingServiceInfo) error {
+	state, ok := s.Session.(TO2ServiceInfoState)
+	if !ok {
+		key, ok := s.sessionKey(ctx)
+		if !ok {
+			return errors.New("session not identified")
+		}
+		s.pendingInfo.store(key, pending, s.sessionTimeout())
+		return nil
+	}
+
+	producer, err := pending.producer.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	data, err := cbor.Marshal(pendingServiceInfoState{
+		Producer:  producer,
+		BlockPeer: pending.blockPeer,
+		Complete:  pending.complete,
+	})
+	if err != nil {
+		return err
+	}
+	return state.SetPendingServiceInfo(ctx, data)
+}
+
 // Done(70) -> Done2(71)
 func (s *TO2Server) to2Done2(ctx context.Context, msg io.Reader) (*done2Msg, error) {
 	// Parse request
@@ -1694,6 +1946,7 @@ func (s *TO2Server) to2Done2(ctx context.Context, msg io.Reader) (*done2Msg, err
 	// found), then immediately complete TO2 without replacing the voucher.
 	replacementHmac, err := s.Session.ReplacementHmac(ctx)
 	if errors.Is(err, ErrNotFound) {
+		s.forgetProved(ctx)
 		return &done2Msg{NonceTO2SetupDv: setupDeviceNonce}, nil
 	} else if err != nil {
 		return nil, fmt.Errorf("error retrieving replacement Hmac for device: %w", err)
@@ -1743,6 +1996,11 @@ func (s *TO2Server) to2Done2(ctx context.Context, msg io.Reader) (*done2Msg, err
 	if err := s.Vouchers.ReplaceVoucher(ctx, currentGUID, ov); err != nil {
 		return nil, fmt.Errorf("error replacing persisted voucher: %w", err)
 	}
+	s.emit(ctx, VoucherReplacedEvent{
+		OldGUID:  currentGUID,
+		NewGUID:  replacementGUID,
+		Duration: s.sinceProved(ctx, true),
+	})
 
 	// Respond with nonce
 	return &done2Msg{NonceTO2SetupDv: setupDeviceNonce}, nil
@@ -30,6 +30,11 @@ import (
 // uses the 2.0 message flow where the device proves itself first.
 func TO2v200(ctx context.Context, transport Transport, to1d *cose.Sign1[protocol.To1d, []byte], c TO2Config) (*DeviceCredential, error) {
 	ctx = contextWithErrMsg(ctx)
+	ctx = protocol.ContextWithLogAttrs(ctx,
+		"protocol", protocol.TO2Protocol.String(),
+		"guid", c.Cred.GUID.String(),
+		"version", protocol.Version200.String(),
+	)
 
 	// Configure defaults (same as 1.01)
 	if c.KeyExchange == "" {
@@ -123,10 +128,15 @@ func TO2v200(ctx context.Context, transport Transport, to1d *cose.Sign1[protocol
 	go c.Devmod.Write(ctx, c.DeviceModules, sendMTU, serviceInfoWriter)
 
 	if err := exchangeServiceInfo20(ctx, transport, proveOVNonce, setupDeviceNonce, sendMTU, serviceInfoReader, replacementHMAC, sess, &c); err != nil {
+		abortDeviceModules(ctx, c.DeviceModules)
 		errorMsg(ctx, transport, err)
 		return nil, err
 	}
 
+	// Apply changes staged by device modules now that the owner service has
+	// acknowledged completion
+	commitDeviceModules(ctx, c.DeviceModules)
+
 	// If using Credential Reuse, return the original credential
 	if replacementOVH == nil {
 		return &c.Cred, nil
@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fdo
+
+import (
+	"context"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// TO2Event is an onboarding lifecycle event emitted by [TO2Server]. It is one
+// of:
+//
+//   - [DeviceProvedEvent]
+//   - [ServiceInfoStartedEvent]
+//   - [ServiceInfoCompletedEvent]
+//   - [VoucherReplacedEvent]
+//   - [DeviceErrorEvent]
+//
+// Events which include a Duration measure the time since the device proved
+// itself in the same TO2 session. Start times are tracked in the memory of
+// the TO2Server, so if the session began on another server instance or lasted
+// longer than [TO2Server.SessionTimeout], the Duration will be zero.
+type TO2Event interface {
+	to2Event()
+}
+
+// DeviceProvedEvent is emitted when the device has proven possession of its
+// credential: once TO2.ProveDevice (64) for FDO 1.01 or TO2.ProveDevice20 (82)
+// for FDO 2.0 has been fully verified and the response is ready to send.
+type DeviceProvedEvent struct {
+	GUID    protocol.GUID
+	Version protocol.Version
+}
+
+// ServiceInfoStartedEvent is emitted when the device has sent all devmod
+// service info, before any other owner service info module is started.
+type ServiceInfoStartedEvent struct {
+	GUID    protocol.GUID
+	Devmod  serviceinfo.Devmod
+	Modules []string
+}
+
+// ServiceInfoCompletedEvent is emitted when the last owner service info
+// module completes.
+type ServiceInfoCompletedEvent struct {
+	GUID     protocol.GUID
+	Duration time.Duration
+}
+
+// VoucherReplacedEvent is emitted after the voucher is replaced at the end of
+// TO2. It is not emitted when the Credential Reuse Protocol is used.
+type VoucherReplacedEvent struct {
+	OldGUID  protocol.GUID
+	NewGUID  protocol.GUID
+	Duration time.Duration
+}
+
+// DeviceErrorEvent is emitted when the device sends an error message. The
+// GUID will be the zero value if the error occurred before the device
+// identified itself.
+type DeviceErrorEvent struct {
+	GUID     protocol.GUID
+	Error    protocol.ErrorMessage
+	Duration time.Duration
+}
+
+func (DeviceProvedEvent) to2Event()         {}
+func (ServiceInfoStartedEvent) to2Event()   {}
+func (ServiceInfoCompletedEvent) to2Event() {}
+func (VoucherReplacedEvent) to2Event()      {}
+func (DeviceErrorEvent) to2Event()          {}
+
+// emit calls the event callback, if set.
+func (s *TO2Server) emit(ctx context.Context, event TO2Event) {
+	if s.OnEvent == nil {
+		return
+	}
+	s.OnEvent(ctx, event)
+}
+
+// markProved records the time that the device of the current session proved
+// itself for use in calculating event durations.
+func (s *TO2Server) markProved(ctx context.Context) {
+	if s.OnEvent == nil {
+		return
+	}
+	if key, ok := s.sessionKey(ctx); ok {
+		s.provedAt.store(key, time.Now(), s.sessionTimeout())
+	}
+}
+
+// sinceProved returns the time elapsed since the device of the current session
+// proved itself or zero if it is not known. If done is true, then the start
+// time is forgotten.
+func (s *TO2Server) sinceProved(ctx context.Context, done bool) time.Duration {
+	key, ok := s.sessionKey(ctx)
+	if !ok {
+		return 0
+	}
+	var start time.Time
+	if done {
+		start, ok = s.provedAt.loadAndDelete(key)
+	} else {
+		start, ok = s.provedAt.load(key)
+	}
+	if !ok {
+		return 0
+	}
+	return time.Since(start)
+}
+
+// forgetProved discards the start time of the current session when it ends
+// without emitting an event.
+func (s *TO2Server) forgetProved(ctx context.Context) {
+	if s.OnEvent == nil {
+		return
+	}
+	if key, ok := s.sessionKey(ctx); ok {
+		s.provedAt.delete(key)
+	}
+}
+
+// sessionGUID returns the GUID of the current session or the zero value if
+// not yet known.
+func (s *TO2Server) sessionGUID(ctx context.Context) protocol.GUID {
+	guid, _ := s.Session.GUID(ctx)
+	return guid
+}
@@ -7,9 +7,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
+	"slices"
 	"strings"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
 
@@ -169,3 +172,29 @@ func (fm deviceModuleMap) Lookup(moduleName string) (mod serviceinfo.DeviceModul
 	}
 	return module, fm.active[moduleName]
 }
+
+// commitDeviceModules applies the staged changes of all transactional device
+// modules. Errors are logged rather than returned, because the owner service
+// has already acknowledged the completion of TO2 and failing would leave the
+// device with a credential the owner no longer accepts.
+func commitDeviceModules(ctx context.Context, modules map[string]serviceinfo.DeviceModule) {
+	for _, name := range slices.Sorted(maps.Keys(modules)) {
+		if mod, ok := modules[name].(serviceinfo.TransactionalModule); ok {
+			if err := mod.Commit(ctx); err != nil {
+				protocol.LoggerFromContext(ctx).Error("error committing device module changes", "module", name, "error", err)
+			}
+		}
+	}
+}
+
+// abortDeviceModules discards the staged changes of all transactional device
+// modules.
+func abortDeviceModules(ctx context.Context, modules map[string]serviceinfo.DeviceModule) {
+	for _, name := range slices.Sorted(maps.Keys(modules)) {
+		if mod, ok := modules[name].(serviceinfo.TransactionalModule); ok {
+			if err := mod.Abort(ctx); err != nil {
+				protocol.LoggerFromContext(ctx).Warn("error aborting device module changes", "module", name, "error", err)
+			}
+		}
+	}
+}
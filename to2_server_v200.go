@@ -241,6 +241,8 @@ func (s *TO2Server) proveOVHdr20(ctx context.Context, msg io.Reader) (*cose.Sign
 	if err := s1.Sign(ownerKey, nil, nil, opts); err != nil {
 		return nil, fmt.Errorf("error signing ProveOVHdr20: %w", err)
 	}
+	s.markProved(ctx)
+	s.emit(ctx, DeviceProvedEvent{GUID: guid, Version: protocol.Version200})
 
 	return s1, nil
 }
@@ -423,6 +425,7 @@ func (s *TO2Server) doneAck20(ctx context.Context, msg io.Reader) (*DoneAck20Msg
 	// If the Credential Reuse Protocol is being used (no replacement HMAC in Done20),
 	// then immediately complete TO2 without replacing the voucher.
 	if req.ReplacementHMAC == nil {
+		s.forgetProved(ctx)
 		return &DoneAck20Msg{NonceTO2ProveOV: proveOVNonce}, nil
 	}
 	replacementHmac := *req.ReplacementHMAC
@@ -471,6 +474,11 @@ func (s *TO2Server) doneAck20(ctx context.Context, msg io.Reader) (*DoneAck20Msg
 	if err := s.Vouchers.ReplaceVoucher(ctx, currentGUID, ov); err != nil {
 		return nil, fmt.Errorf("error replacing persisted voucher: %w", err)
 	}
+	s.emit(ctx, VoucherReplacedEvent{
+		OldGUID:  currentGUID,
+		NewGUID:  replacementGUID,
+		Duration: s.sinceProved(ctx, true),
+	})
 
 	return &DoneAck20Msg{
 		NonceTO2ProveOV: proveOVNonce,
@@ -5,6 +5,7 @@ package tpm
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
 	"errors"
@@ -13,6 +14,7 @@ import (
 	"io"
 	"log/slog"
 
+	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/google/go-tpm/tpm2"
 )
 
@@ -26,12 +28,18 @@ type Hmac interface {
 // NewHmac returns an HMAC for either SHA256 or SHA384 (if supported by the TPM). To avoid a
 // resource leak, the hash must always be closed.
 func NewHmac(t TPM, h crypto.Hash) (Hmac, error) {
+	return NewHmacContext(context.Background(), t, h)
+}
+
+// NewHmacContext is like [NewHmac], but log output of the HMAC is written to
+// the logger of the context (see [protocol.LoggerFromContext]).
+func NewHmacContext(ctx context.Context, t TPM, h crypto.Hash) (Hmac, error) {
 	auth, closeSession, err := tpm2.HMACSession(t, tpm2.TPMAlgSHA256, 16)
 	if err != nil {
 		return nil, fmt.Errorf("create HMAC key authorization session: %w", err)
 	}
 	return &sessionCloser{
-		hmac:         hmac{Device: t, Auth: auth, Hash: h},
+		hmac:         hmac{Device: t, Auth: auth, Hash: h, logger: protocol.LoggerFromContext(ctx)},
 		closeSession: closeSession,
 	}, nil
 }
@@ -57,6 +65,7 @@ type hmac struct {
 	Auth   tpm2.Session
 	Hash   crypto.Hash
 
+	logger  *slog.Logger
 	bufSize uint32
 
 	inited    bool
@@ -117,7 +126,7 @@ func (h *hmac) init() {
 		h.initErr = fmt.Errorf("tpm: create hmac key: %w", err)
 		return
 	}
-	slog.Debug("tpm: generated new HMAC key",
+	h.log().Debug("tpm: generated new HMAC key",
 		"handle", fmt.Sprintf("0x%x", hmacKeyResp.ObjectHandle.HandleValue()),
 		"name_bytes", len(hmacKeyResp.Name.Buffer),
 		"handle_type", fmt.Sprintf("0x%x", hmacKeyResp.ObjectHandle.HandleValue()>>24),
@@ -156,7 +165,7 @@ func (h *hmac) start() {
 		h.err = fmt.Errorf("HmacStart: %w", err)
 		return
 	}
-	slog.Debug("tpm: started new HMAC sequence",
+	h.log().Debug("tpm: started new HMAC sequence",
 		"handle", fmt.Sprintf("0x%x", hmacStartResp.SequenceHandle.HandleValue()),
 		"handle_type", fmt.Sprintf("0x%x", h.keyHandle.HandleValue()>>24),
 	)
@@ -273,11 +282,18 @@ func (h *hmac) Size() int { return h.Hash.Size() }
 // write operations.
 func (h *hmac) BlockSize() int {
 	if h.bufSize == 0 {
-		h.bufSize = getMaxInputBuffer(h.Device)
+		h.bufSize = getMaxInputBuffer(h.Device, h.log())
 	}
 	return int(h.bufSize)
 }
 
+func (h *hmac) log() *slog.Logger {
+	if h.logger == nil {
+		return slog.Default()
+	}
+	return h.logger
+}
+
 // Err returns any errors that have occurred since the last reset.
 func (h *hmac) Err() error {
 	if h.initErr != nil {
@@ -304,16 +320,16 @@ const defaultMaxDigestBuffer = 1024
 
 // getMaxInputBuffer returns the TPM's maximum input buffer size parameter, usually a
 // TPM2B_MAX_BUFFER; see Part 2, Structures, section 6.13.
-func getMaxInputBuffer(t TPM) uint32 {
+func getMaxInputBuffer(t TPM, logger *slog.Logger) uint32 {
 	capability, err := tpm2.GetCapability{Capability: tpm2.TPMCapTPMProperties}.Execute(t)
 	if err != nil {
-		slog.Warn("tpm: get capability failed", "error", err)
+		logger.Warn("tpm: get capability failed", "error", err)
 		return defaultMaxDigestBuffer
 	}
 
 	tpmProp, err := capability.CapabilityData.Data.TPMProperties()
 	if err != nil {
-		slog.Warn("tpm: get capability properties failed", "error", err)
+		logger.Warn("tpm: get capability properties failed", "error", err)
 		return defaultMaxDigestBuffer
 	}
 
@@ -323,6 +339,6 @@ func getMaxInputBuffer(t TPM) uint32 {
 		}
 	}
 
-	slog.Info("tpm: max input buffer size undefined, using default", "size", defaultMaxDigestBuffer)
+	logger.Info("tpm: max input buffer size undefined, using default", "size", defaultMaxDigestBuffer)
 	return defaultMaxDigestBuffer
 }
@@ -0,0 +1,12 @@
+module github.com/fido-device-onboard/go-fdo/wasi
+
+go 1.25.0
+
+replace github.com/fido-device-onboard/go-fdo => ../
+
+require (
+	github.com/fido-device-onboard/go-fdo v0.0.0-00010101000000-000000000000
+	github.com/tetratelabs/wazero v1.11.0
+)
+
+require golang.org/x/sys v0.38.0 // indirect
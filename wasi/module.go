@@ -0,0 +1,250 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+// Package wasi runs service info module plugins compiled to WebAssembly in a
+// sandbox, so that third-party modules may be used without trusting them with
+// the privileges of the device or owner service.
+//
+// Plugins are WASI preview 1 (wasip1) command modules which implement the
+// same stdin/stdout protocol as executable plugins. For example, a plugin
+// written with [plugin.Plugin] is built with:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -o hello.wasm ./cmd/hello
+//
+// The plugin runs in process, without access to the host filesystem except
+// for preopened directories and without network access.
+package wasi
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+
+	"github.com/fido-device-onboard/go-fdo/plugin"
+)
+
+// Dir is a host directory which is made available to a plugin.
+type Dir struct {
+	// Host is the path of the directory on the host.
+	Host string
+
+	// Guest is the path of the directory seen by the plugin, i.e. "/data".
+	Guest string
+
+	// ReadOnly prevents the plugin from modifying the directory.
+	ReadOnly bool
+}
+
+// Module is a plugin.Module which runs a WASI command module. Each call to
+// Start runs the module with fresh memory.
+//
+// Only the following are made available to the plugin:
+//
+//   - stdin and stdout, which are connected to the module adapter
+//   - stderr, if set
+//   - args and environment variables, if set
+//   - directories, if set
+//   - the system clocks and a secure random source
+//
+// No sockets are provided, so the plugin has no network access.
+type Module struct {
+	// Wasm is the contents of the WebAssembly binary. It is compiled on the
+	// first start.
+	Wasm []byte
+
+	// Args are passed to the plugin after the program name.
+	Args []string
+
+	// Env contains the environment variables of the plugin.
+	Env map[string]string
+
+	// Dirs are the host directories which the plugin may access.
+	Dirs []Dir
+
+	// Stderr, if set, receives the stderr of the plugin. Otherwise, it is
+	// discarded.
+	Stderr io.Writer
+
+	// MemoryLimitPages, if set, limits the memory of the plugin to the given
+	// number of 64KiB pages.
+	MemoryLimitPages uint32
+
+	compileOnce sync.Once
+	runtime     wazero.Runtime
+	compiled    wazero.CompiledModule
+	compileErr  error
+
+	mu  sync.Mutex
+	run *run
+}
+
+var _ plugin.Module = (*Module)(nil)
+
+// run is a single run of the plugin.
+type run struct {
+	cancel context.CancelFunc
+	stdinR *io.PipeReader
+	stdinW *io.PipeWriter
+	stdout *io.PipeReader
+	done   chan struct{} // closed when the module has exited
+	err    error         // valid after done is closed
+}
+
+func (m *Module) compile() {
+	ctx := context.Background()
+
+	config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if m.MemoryLimitPages > 0 {
+		config = config.WithMemoryLimitPages(m.MemoryLimitPages)
+	}
+	m.runtime = wazero.NewRuntimeWithConfig(ctx, config)
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, m.runtime); err != nil {
+		m.compileErr = fmt.Errorf("error instantiating WASI: %w", err)
+		return
+	}
+	if m.compiled, m.compileErr = m.runtime.CompileModule(ctx, m.Wasm); m.compileErr != nil {
+		m.compileErr = fmt.Errorf("error compiling plugin: %w", m.compileErr)
+	}
+}
+
+// Start implements plugin.Module.
+func (m *Module) Start() (io.Writer, io.Reader, error) {
+	m.compileOnce.Do(m.compile)
+	if m.compileErr != nil {
+		return nil, nil, m.compileErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.run != nil {
+		_ = m.stopRun()
+	}
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	stderr := m.Stderr
+	if stderr == nil {
+		stderr = io.Discard
+	}
+
+	fsConfig := wazero.NewFSConfig()
+	for _, dir := range m.Dirs {
+		if dir.ReadOnly {
+			fsConfig = fsConfig.WithReadOnlyDirMount(dir.Host, dir.Guest)
+		} else {
+			fsConfig = fsConfig.WithDirMount(dir.Host, dir.Guest)
+		}
+	}
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(append([]string{"plugin"}, m.Args...)...).
+		WithStdin(stdinR).
+		WithStdout(stdoutW).
+		WithStderr(stderr).
+		WithFSConfig(fsConfig).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader)
+	keys := make([]string, 0, len(m.Env))
+	for key := range m.Env {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		config = config.WithEnv(key, m.Env[key])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &run{cancel: cancel, stdinR: stdinR, stdinW: stdinW, stdout: stdoutR, done: make(chan struct{})}
+	go func() {
+		// Instantiating a command module runs it to completion
+		mod, err := m.runtime.InstantiateModule(ctx, m.compiled, config)
+		if mod != nil {
+			_ = mod.Close(context.Background())
+		}
+		r.err = err
+		_ = stdoutW.Close()
+		_ = stdinR.Close()
+		close(r.done)
+	}()
+	m.run = r
+
+	return stdinW, stdoutR, nil
+}
+
+// Stop implements plugin.Module. An error is returned if the plugin exited
+// with an error before being stopped.
+func (m *Module) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopRun()
+}
+
+func (m *Module) stopRun() error {
+	r := m.run
+	if r == nil {
+		return nil
+	}
+	m.run = nil
+
+	var err error
+	select {
+	case <-r.done:
+		err = r.err
+	default:
+	}
+
+	// Unblock any reads or writes of the plugin and stop it if it is running
+	// WebAssembly code
+	r.cancel()
+	_ = r.stdinR.CloseWithError(io.ErrClosedPipe)
+	_ = r.stdout.CloseWithError(io.ErrClosedPipe)
+	<-r.done
+
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("plugin exited with code %d", exitErr.ExitCode())
+	}
+	return err
+}
+
+// GracefulStop implements plugin.Module by closing the plugin's stdin and
+// waiting for it to exit.
+func (m *Module) GracefulStop(ctx context.Context) error {
+	m.mu.Lock()
+	r := m.run
+	m.mu.Unlock()
+	if r == nil {
+		return nil
+	}
+
+	if err := r.stdinW.Close(); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return nil
+	}
+}
+
+// Close stops the plugin and releases the compiled module. The module must
+// not be started again.
+func (m *Module) Close(ctx context.Context) error {
+	err := m.Stop()
+	if m.runtime != nil {
+		err = errors.Join(err, m.runtime.Close(ctx))
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package wasi_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/fdotest"
+	"github.com/fido-device-onboard/go-fdo/plugin"
+	"github.com/fido-device-onboard/go-fdo/plugin/plugintest"
+	"github.com/fido-device-onboard/go-fdo/wasi"
+)
+
+// buildPlugin compiles testdata/plugin to WebAssembly.
+func buildPlugin(t *testing.T) []byte {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain is required to build test plugin")
+	}
+	out := filepath.Join(t.TempDir(), "plugin.wasm")
+	cmd := exec.Command(goBin, "build", "-o", out, "./testdata/plugin")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("error building test plugin: %v\n%s", err, output)
+	}
+	wasm, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wasm
+}
+
+func expectError(t testing.TB, produced []plugintest.KV) {
+	t.Helper()
+	if len(produced) != 1 || produced[0].Name != "error" {
+		t.Errorf("expected operation to fail, got %v", produced)
+	}
+}
+
+func TestModule(t *testing.T) {
+	wasm := buildPlugin(t)
+
+	readOnly, scratch := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(readOnly, "hello.txt"), []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	module := &wasi.Module{
+		Wasm: wasm,
+		Env:  map[string]string{"GREETING": "hi"},
+		Dirs: []wasi.Dir{
+			{Host: readOnly, Guest: "/data", ReadOnly: true},
+			{Host: scratch, Guest: "/scratch"},
+		},
+		Stderr: fdotest.TestingLog(t),
+	}
+	defer func() { _ = module.Close(context.Background()) }()
+
+	plugintest.Run(t, func() plugin.Module { return module }, plugintest.Suite{
+		Name:    "com.example.sandbox",
+		Version: "1.0.0",
+		Rounds: []plugintest.Round{
+			{
+				Send:   []plugintest.KV{{Name: "read", Value: "/data/hello.txt"}},
+				Expect: []plugintest.KV{{Name: "contents", Value: []byte("hello")}},
+			},
+			{
+				Send:   []plugintest.KV{{Name: "env", Value: "GREETING"}},
+				Expect: []plugintest.KV{{Name: "value", Value: "hi"}},
+			},
+			{
+				Send:   []plugintest.KV{{Name: "write", Value: "/scratch/out.txt"}},
+				Expect: []plugintest.KV{{Name: "written", Value: "/scratch/out.txt"}},
+			},
+			{
+				Send:  []plugintest.KV{{Name: "write", Value: "/data/out.txt"}},
+				Check: expectError,
+			},
+			{
+				Send:  []plugintest.KV{{Name: "read", Value: "/etc/hostname"}},
+				Check: expectError,
+			},
+			{
+				Send:  []plugintest.KV{{Name: "read", Value: "/data/../../../etc/hostname"}},
+				Check: expectError,
+			},
+			{
+				Send:  []plugintest.KV{{Name: "dial", Value: "127.0.0.1:80"}},
+				Check: expectError,
+			},
+		},
+	})
+
+	if data, err := os.ReadFile(filepath.Join(scratch, "out.txt")); err != nil || string(data) != "written" {
+		t.Errorf("expected plugin to write to scratch directory, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(readOnly, "out.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected plugin not to write to read-only directory, got %v", err)
+	}
+}
+
+func TestModuleStop(t *testing.T) {
+	wasm := buildPlugin(t)
+
+	t.Run("Graceful", func(t *testing.T) {
+		module := &wasi.Module{Wasm: wasm}
+		defer func() { _ = module.Close(context.Background()) }()
+
+		if _, err := plugin.ModuleName(module); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := module.Start(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if err := module.GracefulStop(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := module.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Memory limit", func(t *testing.T) {
+		module := &wasi.Module{Wasm: wasm, MemoryLimitPages: 1}
+		defer func() { _ = module.Close(context.Background()) }()
+
+		if _, err := plugin.ModuleName(module); err == nil || !strings.Contains(err.Error(), "memory") {
+			t.Fatalf("expected plugin to fail to start with memory limit, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+// Command plugin is a device plugin for testing the WASI sandbox. Each
+// message attempts an operation and the plugin responds with the result or
+// the error.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/fido-device-onboard/go-fdo/plugin"
+)
+
+func main() {
+	(&plugin.Plugin{
+		Name:    "com.example.sandbox",
+		Version: "1.0.0",
+		Device:  device{},
+	}).Run()
+}
+
+type device struct{}
+
+func (device) Receive(ctx context.Context, msg plugin.Message, send *plugin.Sender) error {
+	var arg string
+	if err := msg.Decode(&arg); err != nil {
+		return err
+	}
+
+	switch msg.Name {
+	case "read":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return send.Send("error", err.Error())
+		}
+		return send.Send("contents", data)
+
+	case "write":
+		if err := os.WriteFile(arg, []byte("written"), 0o600); err != nil {
+			return send.Send("error", err.Error())
+		}
+		return send.Send("written", arg)
+
+	case "dial":
+		conn, err := net.Dial("tcp", arg)
+		if err != nil {
+			return send.Send("error", err.Error())
+		}
+		_ = conn.Close()
+		return send.Send("connected", arg)
+
+	case "env":
+		return send.Send("value", os.Getenv(arg))
+
+	default:
+		return fmt.Errorf("unknown message %q", msg.Name)
+	}
+}
+
+func (device) Yield(ctx context.Context, send *plugin.Sender) error { return nil }